@@ -0,0 +1,93 @@
+package dns
+
+import (
+	"net"
+	"net/netip"
+	"sync/atomic"
+
+	"github.com/jmanero/go-logging"
+	"go.uber.org/zap"
+)
+
+// ACLPolicy is the action that an ACL takes for clients that do not match any of its rules
+type ACLPolicy int
+
+// ACL policies
+const (
+	ACLAllow ACLPolicy = iota
+	ACLDeny
+)
+
+// ACLRule allows or denies clients in a network
+type ACLRule struct {
+	Network *net.IPNet
+	Deny    bool
+}
+
+// Contains checks if the IP address of a UDP or TCP address is within the rule's network
+func (rule ACLRule) Contains(addr net.Addr) bool {
+	ip, _ := addrParts(addr)
+	return ip != nil && rule.Network != nil && rule.Network.Contains(ip)
+}
+
+// ACL restricts queries by the client's IP address. Rules are checked in order, and the first rule
+// whose network contains the client's address decides if the query is allowed. Clients that do not
+// match a rule are allowed or denied by the Default policy. Denied queries are rejected with the
+// Refusal policy of the request's Context, which responds with REFUSED by default
+type ACL struct {
+	Rules   []ACLRule
+	Default ACLPolicy
+
+	// Denied counts rejected queries
+	Denied atomic.Uint64
+}
+
+// ParseACLRules creates rules for CIDR prefixes, such as "192.0.2.0/24" or "2001:db8::/32", that all
+// allow or all deny clients. Addresses without a prefix length match a single host
+func ParseACLRules(deny bool, cidrs ...string) ([]ACLRule, error) {
+	set, err := ParsePrefixes(cidrs...)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make([]ACLRule, len(set))
+	for i, prefix := range set {
+		rules[i] = ACLRule{Network: prefixNet(prefix), Deny: deny}
+	}
+
+	return rules, nil
+}
+
+// prefixNet converts a netip.Prefix to a net.IPNet
+func prefixNet(prefix netip.Prefix) *net.IPNet {
+	return &net.IPNet{
+		IP:   prefix.Addr().AsSlice(),
+		Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()),
+	}
+}
+
+// Allowed checks if a client's address is allowed by the ACL
+func (acl *ACL) Allowed(addr net.Addr) bool {
+	for _, rule := range acl.Rules {
+		if rule.Contains(addr) {
+			return !rule.Deny
+		}
+	}
+
+	return acl.Default != ACLDeny
+}
+
+// Middleware wraps a Handler with the ACL. Denied queries are counted, and logged at debug level
+func (acl *ACL) Middleware(next Handler) Handler {
+	return HandlerFunc(func(wr ResponseWriter, req *Request) {
+		if acl.Allowed(req.RemoteAddr) {
+			next.ServeDNS(wr, req)
+			return
+		}
+
+		acl.Denied.Add(1)
+		logging.FromContext(req.Context()).Debug("acl.denied", zap.Stringer("remote", req.RemoteAddr), zap.String("transport", req.Transport()))
+
+		Refuse(wr, req)
+	})
+}
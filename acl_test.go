@@ -0,0 +1,61 @@
+package dns_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestACL(t *testing.T) {
+	deny, err := dns.ParseACLRules(true, "192.0.2.128/25")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allow, err := dns.ParseACLRules(false, "192.0.2.0/24", "2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acl := dns.ACL{Rules: append(deny, allow...), Default: dns.ACLDeny}
+
+	// The first matching rule decides, for both UDP and TCP clients
+	assert.True(t, acl.Allowed(&net.UDPAddr{IP: net.ParseIP("192.0.2.1")}))
+	assert.True(t, acl.Allowed(&net.TCPAddr{IP: net.ParseIP("2001:db8::1")}))
+	assert.False(t, acl.Allowed(&net.TCPAddr{IP: net.ParseIP("192.0.2.129")}))
+	assert.False(t, acl.Allowed(&net.UDPAddr{IP: net.ParseIP("198.51.100.1")}))
+
+	acl.Default = dns.ACLAllow
+	assert.True(t, acl.Allowed(&net.UDPAddr{IP: net.ParseIP("198.51.100.1")}))
+	assert.False(t, acl.Allowed(&net.UDPAddr{IP: net.ParseIP("192.0.2.200")}))
+
+	var handled int
+	handler := acl.Middleware(dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+		handled++
+		dns.ServerFailure(wr, req)
+	}))
+
+	for _, remote := range []string{"192.0.2.1", "192.0.2.200"} {
+		req, err := dns.ParseRequest(context.Background(), GenerateQuery(1, testQuestion))
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		req.RemoteAddr = &net.UDPAddr{IP: net.ParseIP(remote), Port: 53}
+
+		var wr dns.RecordingWriter
+		handler.ServeDNS(&wr, req)
+
+		res, err := wr.Response()
+		if assert.NoError(t, err) && remote == "192.0.2.200" {
+			assert.Equal(t, dnsmessage.RCodeRefused, res.RCode)
+		}
+	}
+
+	assert.Equal(t, 1, handled)
+	assert.Equal(t, uint64(1), acl.Denied.Load())
+}
@@ -0,0 +1,163 @@
+package dns
+
+import (
+	"errors"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ErrQuestionMismatch is returned by WriteAnswer when an Answer's questions do not echo the request's
+var ErrQuestionMismatch = errors.New("dns: answer questions do not match the request")
+
+// ErrExtendedRCode is returned when a response's RCODE does not fit in the message header, and the
+// response does not have an OPT record to carry its upper bits
+var ErrExtendedRCode = errors.New("dns: extended RCODEs require an OPT record")
+
+// Answer declares the contents of a response. Handlers can populate an Answer and pass it to
+// WriteAnswer instead of making ordered calls to a dnsmessage.Builder
+type Answer struct {
+	// Header holds the response's flags and RCode. The ID, Response, OpCode, RecursionDesired and
+	// CheckingDisabled fields are always derived from the request
+	Header dnsmessage.Header
+
+	// Questions must echo the request's question section. A nil value copies the request's questions
+	Questions []dnsmessage.Question
+
+	Answers     []dnsmessage.Resource
+	Authorities []dnsmessage.Resource
+	Additionals []dnsmessage.Resource
+
+	// EDNS adds an OPT record to the end of the additional section, usually from Request.ResponseEDNS.
+	// RCODEs above 15 are split between the header and the OPT record's extended RCODE
+	EDNS *EDNS0
+}
+
+// Validate checks that an Answer can be written as a response to a request
+func (answer *Answer) Validate(req *Request) error {
+	if answer.Header.RCode > 0xf && answer.EDNS == nil {
+		return ErrExtendedRCode
+	}
+
+	for _, section := range [][]dnsmessage.Resource{answer.Answers, answer.Authorities, answer.Additionals} {
+		if len(section) > MaxSectionCount {
+			return ErrSectionOverflow
+		}
+	}
+
+	if answer.Questions == nil {
+		return nil
+	}
+
+	questions, err := req.Questions()
+	if err != nil {
+		return err
+	}
+
+	if len(questions) != len(answer.Questions) {
+		return ErrQuestionMismatch
+	}
+
+	for i, question := range questions {
+		echo := answer.Questions[i]
+
+		// Names are echoed exactly, including case, for clients that randomize it (0x20 encoding)
+		if echo.Name.String() != question.Name.String() || echo.Type != question.Type || echo.Class != question.Class {
+			return ErrQuestionMismatch
+		}
+	}
+
+	return nil
+}
+
+// WriteAnswer validates an Answer and sends it as a response to a request
+func WriteAnswer(wr ResponseWriter, req *Request, answer *Answer) error {
+	err := answer.Validate(req)
+	if err != nil {
+		return err
+	}
+
+	questions := answer.Questions
+	if questions == nil {
+		questions, err = req.Questions()
+		if err != nil {
+			return err
+		}
+	}
+
+	header := answer.Header
+	header.ID = req.ID
+	header.Response = true
+	header.OpCode = req.OpCode
+	header.RecursionDesired = req.RecursionDesired
+	header.CheckingDisabled = req.CheckingDisabled
+
+	var edns EDNS0
+	if answer.EDNS != nil {
+		edns = *answer.EDNS
+		header.RCode, edns.ExtendedRCode = SplitRCode(header.RCode)
+	}
+
+	// The writer's Builder compresses names when its Compression setting is enabled, so that large
+	// RRsets with shared suffixes fit in UDP responses
+	res := wr.Builder(header)
+
+	err = buildAnswer(&res, questions, answer, &edns)
+	if err != nil {
+		releaseBuilder(wr, &res)
+		return err
+	}
+
+	wr.SendBuilder(&res)
+	return nil
+}
+
+// buildAnswer appends an Answer's sections to a response Builder
+func buildAnswer(res *dnsmessage.Builder, questions []dnsmessage.Question, answer *Answer, edns *EDNS0) error {
+	err := res.StartQuestions()
+	if err != nil {
+		return err
+	}
+
+	for _, question := range questions {
+		err = res.Question(question)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = res.StartAnswers()
+	if err != nil {
+		return err
+	}
+
+	err = AppendResources(res, answer.Answers...)
+	if err != nil {
+		return err
+	}
+
+	err = res.StartAuthorities()
+	if err != nil {
+		return err
+	}
+
+	err = AppendResources(res, answer.Authorities...)
+	if err != nil {
+		return err
+	}
+
+	err = res.StartAdditionals()
+	if err != nil {
+		return err
+	}
+
+	err = AppendResources(res, answer.Additionals...)
+	if err != nil {
+		return err
+	}
+
+	if answer.EDNS != nil {
+		return edns.AppendOPT(res)
+	}
+
+	return nil
+}
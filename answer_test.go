@@ -0,0 +1,146 @@
+package dns_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var (
+	testQuestion = dnsmessage.Question{Name: dnsmessage.MustNewName("www.example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+
+	testSOA = dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 3600},
+		Body: &dnsmessage.SOAResource{
+			NS: dnsmessage.MustNewName("ns1.example.com."), MBox: dnsmessage.MustNewName("hostmaster.example.com."),
+			Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, MinTTL: 300,
+		},
+	}
+)
+
+// Exchange calls a Handler with a query and parses its response
+func Exchange(t *testing.T, handler dns.Handler, query []byte) (res dnsmessage.Message) {
+	req, err := dns.ParseRequest(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wr := dns.NewMessageWriter(nil)
+	handler.ServeDNS(wr, req)
+
+	err = res.Unpack(wr.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
+
+func TestWriteAnswer(t *testing.T) {
+	res := Exchange(t, dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+		assert.NoError(t, dns.WriteAnswer(wr, req, &dns.Answer{
+			Header: dnsmessage.Header{Authoritative: true},
+			Answers: []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: testQuestion.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &dnsmessage.AResource{A: [4]byte{10, 0, 1, 1}},
+			}},
+		}))
+	}), GenerateQuery(42, testQuestion))
+
+	assert.Equal(t, uint16(42), res.ID)
+	assert.True(t, res.Response)
+	assert.True(t, res.Authoritative)
+	assert.Equal(t, []dnsmessage.Question{testQuestion}, res.Questions)
+	assert.Len(t, res.Answers, 1)
+
+	// Questions that do not echo the request are rejected
+	req, err := dns.ParseRequest(context.Background(), GenerateQuery(42, testQuestion))
+	assert.NoError(t, err)
+
+	other := testQuestion
+	other.Type = dnsmessage.TypeAAAA
+
+	err = dns.WriteAnswer(dns.NewMessageWriter(nil), req, &dns.Answer{Questions: []dnsmessage.Question{other}})
+	assert.ErrorIs(t, err, dns.ErrQuestionMismatch)
+}
+
+func TestWriteAnswerRelease(t *testing.T) {
+	req, err := dns.ParseRequest(context.Background(), GenerateQuery(42, testQuestion))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Names without a trailing dot can not be packed
+	answer := &dns.Answer{Answers: []dnsmessage.Resource{{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("www.example.com"), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+		Body:   &dnsmessage.AResource{A: [4]byte{10, 0, 1, 1}},
+	}}}
+
+	// The Builder's buffer is returned to the writer's Allocator when the response can not be built
+	var alloc CountingAllocator
+
+	wr := &dns.PacketWriter{Allocator: &alloc}
+	assert.Error(t, dns.WriteAnswer(wr, req, answer))
+	assert.Equal(t, int64(1), alloc.Gets.Load())
+	assert.Equal(t, int64(1), alloc.Puts.Load())
+
+	// Including Builders from writers that wrap it
+	assert.Error(t, dns.WriteAnswer(&dns.SigningWriter{ResponseWriter: wr}, req, answer))
+	assert.Equal(t, int64(2), alloc.Gets.Load())
+	assert.Equal(t, int64(2), alloc.Puts.Load())
+}
+
+func TestNegative(t *testing.T) {
+	res := Exchange(t, dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+		assert.NoError(t, dns.NoData(wr, req, testSOA))
+	}), GenerateQuery(42, testQuestion))
+
+	assert.Equal(t, dnsmessage.RCodeSuccess, res.RCode)
+	assert.Empty(t, res.Answers)
+
+	if assert.Len(t, res.Authorities, 1) {
+		// The negative TTL is the SOA's MINIMUM field
+		assert.Equal(t, dnsmessage.TypeSOA, res.Authorities[0].Header.Type)
+		assert.Equal(t, uint32(300), res.Authorities[0].Header.TTL)
+	}
+
+	res = Exchange(t, dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+		assert.NoError(t, dns.NXDomain(wr, req, testSOA))
+	}), GenerateQuery(42, testQuestion))
+
+	assert.Equal(t, dnsmessage.RCodeNameError, res.RCode)
+	assert.True(t, res.Authoritative)
+	assert.Len(t, res.Authorities, 1)
+}
+
+func TestQuestionCaseEcho(t *testing.T) {
+	question := dnsmessage.Question{Name: dnsmessage.MustNewName("wWw.ExAmPlE.cOm."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	query := GenerateQuery(42, question)
+
+	for name, handler := range map[string]dns.HandlerFunc{
+		"WriteAnswer":   func(wr dns.ResponseWriter, req *dns.Request) { dns.WriteAnswer(wr, req, &dns.Answer{}) },
+		"NXDomain":      func(wr dns.ResponseWriter, req *dns.Request) { dns.NXDomain(wr, req, testSOA) },
+		"ServerFailure": func(wr dns.ResponseWriter, req *dns.Request) { dns.ServerFailure(wr, req) },
+		"Refuse":        func(wr dns.ResponseWriter, req *dns.Request) { dns.Refuse(wr, req) },
+	} {
+		res := Exchange(t, handler, query)
+
+		if assert.Len(t, res.Questions, 1, name) {
+			assert.Equal(t, "wWw.ExAmPlE.cOm.", res.Questions[0].Name.String(), name)
+		}
+	}
+
+	// The question's wire format is echoed byte-for-byte
+	req, err := dns.ParseRequest(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wr := dns.NewMessageWriter(nil)
+	dns.ServerFailure(wr, req)
+
+	assert.Equal(t, query[12:], wr.Bytes()[12:])
+}
@@ -0,0 +1,104 @@
+package dns
+
+import (
+	"errors"
+
+	"github.com/jmanero/go-logging"
+	"go.uber.org/zap"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// RCodeNotAuth is returned to clients whose requests fail authentication (RFC 8945)
+const RCodeNotAuth dnsmessage.RCode = 9
+
+// ErrUnsignedSend is the panic value of SigningWriter.Send, which can not sign data that may carry
+// transport framing
+var ErrUnsignedSend = errors.New("dns: SigningWriter can not sign data passed to Send")
+
+// MessageAuthenticator verifies authentication data in requests and signs responses. Implementations
+// provide transaction authentication schemes like TSIG or SIG(0).
+//
+// Authenticators operate on complete wire-format messages without any transport framing. Verify is
+// called with the request's message before the Handler is called. Sign is called with each finalized
+// response message, and returns a new message with authentication data appended to its additional
+// section. The message passed to Sign belongs to the caller and must not be retained
+type MessageAuthenticator interface {
+	Verify(msg []byte, req *Request) error
+	Sign(msg []byte) ([]byte, error)
+}
+
+// ResponseSigner is implemented by MessageAuthenticators whose response signatures also cover the
+// request, like SIG(0) and TSIG. SigningWriter calls SignResponse instead of Sign when it is available
+type ResponseSigner interface {
+	SignResponse(msg []byte, req *Request) ([]byte, error)
+}
+
+// Authenticate creates a Middleware that verifies requests with a MessageAuthenticator and signs
+// the responses that the wrapped Handler sends. Requests that fail verification are answered with
+// an unsigned NOTAUTH response
+func Authenticate(auth MessageAuthenticator) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(wr ResponseWriter, req *Request) {
+			err := auth.Verify(req.Message(), req)
+			if err != nil {
+				logging.FromContext(req.Context()).Warn("auth.verify", zap.Error(err))
+
+				res := wr.Builder(req.ResponseHeader(RCodeNotAuth))
+				wr.SendBuilder(&res)
+				return
+			}
+
+			next.ServeDNS(&SigningWriter{ResponseWriter: wr, Authenticator: auth, Request: req}, req)
+		})
+	}
+}
+
+// SigningWriter wraps a ResponseWriter to sign responses with a MessageAuthenticator before they are sent
+type SigningWriter struct {
+	ResponseWriter
+	Authenticator MessageAuthenticator
+
+	// Request is passed to ResponseSigner implementations
+	Request *Request
+}
+
+// Builder creates a dnsmessage.Builder without any transport framing, so that the finalized
+// message can be passed directly to the MessageAuthenticator. The Builder uses the underlying
+// ResponseWriter's compression and Allocator settings
+func (wr *SigningWriter) Builder(header dnsmessage.Header) dnsmessage.Builder {
+	return wrappedWriter{wr.ResponseWriter}.Builder(header)
+}
+
+// SendBuilder finalizes a Builder, signs the resulting message, and sends it with the underlying
+// ResponseWriter. Builders MUST be created by SigningWriter.Builder
+func (wr *SigningWriter) SendBuilder(builder *dnsmessage.Builder) {
+	wrappedWriter{wr.ResponseWriter}.sendBuilder(wr.SendMessage, builder)
+}
+
+func (wr *SigningWriter) builderSettings() (Allocator, bool) {
+	return wrappedWriter{wr.ResponseWriter}.builderSettings()
+}
+
+// Send panics with ErrUnsignedSend, instead of sending an unsigned response. Data passed to Send may
+// carry transport framing, so it can not be signed. Send complete messages with SendMessage
+func (wr *SigningWriter) Send([]byte) {
+	panic(ErrUnsignedSend)
+}
+
+// SendMessage signs a complete message and sends it with the underlying ResponseWriter
+func (wr *SigningWriter) SendMessage(msg []byte) {
+	var signed []byte
+	var err error
+
+	if signer, is := wr.Authenticator.(ResponseSigner); is && wr.Request != nil {
+		signed, err = signer.SignResponse(msg, wr.Request)
+	} else {
+		signed, err = wr.Authenticator.Sign(msg)
+	}
+
+	if err != nil {
+		panic(err)
+	}
+
+	wr.ResponseWriter.SendMessage(signed)
+}
@@ -0,0 +1,193 @@
+package dns_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// MACAuthenticator is a TSIG-like MessageAuthenticator for tests. It appends a record with the
+// signing time and an HMAC-SHA256 of the message and time to the additional section
+type MACAuthenticator struct {
+	Secret []byte
+	Fudge  time.Duration
+	Now    func() time.Time
+}
+
+// macRecordSize is the length of the record appended by MACAuthenticator: a root owner name, the
+// fixed resource header fields, the signing time and the MAC
+const macRecordSize = 1 + 10 + 8 + sha256.Size
+
+var (
+	ErrTestMissingMAC = errors.New("test: message does not contain a MAC")
+	ErrTestBadMAC     = errors.New("test: MAC is invalid")
+	ErrTestTimeSkew   = errors.New("test: signing time is outside of the allowed skew")
+)
+
+func (auth *MACAuthenticator) mac(msg []byte, signed uint64) []byte {
+	hash := hmac.New(sha256.New, auth.Secret)
+	hash.Write(msg)
+	binary.Write(hash, binary.BigEndian, signed)
+
+	return hash.Sum(nil)
+}
+
+func (auth *MACAuthenticator) Sign(msg []byte) ([]byte, error) {
+	signed := uint64(auth.Now().Unix())
+
+	// Sign the message as it would be without the record, then append the record and count it
+	rdata := binary.BigEndian.AppendUint64(nil, signed)
+	rdata = append(rdata, auth.mac(msg, signed)...)
+
+	res := append([]byte(nil), msg...)
+	res = append(res, 0, 0xff, 0, 0, 0xff, 0, 0, 0, 0, 0, byte(len(rdata)))
+	res = append(res, rdata...)
+	binary.BigEndian.PutUint16(res[10:], binary.BigEndian.Uint16(res[10:])+1)
+
+	return res, nil
+}
+
+func (auth *MACAuthenticator) Verify(msg []byte, _ *dns.Request) error {
+	if len(msg) < 12+macRecordSize || binary.BigEndian.Uint16(msg[10:]) == 0 {
+		return ErrTestMissingMAC
+	}
+
+	record := msg[len(msg)-macRecordSize:]
+	if binary.BigEndian.Uint16(record[1:]) != 0xff00 {
+		return ErrTestMissingMAC
+	}
+
+	unsigned := append([]byte(nil), msg[:len(msg)-macRecordSize]...)
+	binary.BigEndian.PutUint16(unsigned[10:], binary.BigEndian.Uint16(unsigned[10:])-1)
+
+	signed := binary.BigEndian.Uint64(record[11:])
+	if !hmac.Equal(record[19:], auth.mac(unsigned, signed)) {
+		return ErrTestBadMAC
+	}
+
+	if skew := auth.Now().Sub(time.Unix(int64(signed), 0)); skew > auth.Fudge || -skew > auth.Fudge {
+		return ErrTestTimeSkew
+	}
+
+	return nil
+}
+
+func TestAuthenticate(t *testing.T) {
+	now := time.Unix(1760000000, 0)
+	client := &MACAuthenticator{Secret: []byte("secret"), Fudge: 5 * time.Minute, Now: func() time.Time { return now }}
+
+	var called int
+	handler := dns.Authenticate(client)(dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+		called++
+		dns.WriteAnswer(wr, req, &dns.Answer{})
+	}))
+
+	exchange := func(query []byte) (msg []byte, res dnsmessage.Message) {
+		req, err := dns.ParseRequest(context.Background(), query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wr := dns.NewMessageWriter(nil)
+		handler.ServeDNS(wr, req)
+
+		msg = wr.Bytes()
+		if assert.NoError(t, res.Unpack(msg)) {
+			assert.Equal(t, uint16(42), res.ID)
+		}
+
+		return
+	}
+
+	// Signed queries are passed to the Handler, and its responses are signed
+	query, err := client.Sign(GenerateQuery(42, testQuestion))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, res := exchange(query)
+	assert.Equal(t, 1, called)
+	assert.Equal(t, dnsmessage.RCodeSuccess, res.RCode)
+	assert.NoError(t, client.Verify(msg, nil))
+
+	// A modified MAC fails verification, and is answered with an unsigned NOTAUTH response
+	tampered := append([]byte(nil), query...)
+	tampered[len(tampered)-1] ^= 0xff
+
+	msg, res = exchange(tampered)
+	assert.Equal(t, 1, called)
+	assert.Equal(t, dns.RCodeNotAuth, res.RCode)
+	assert.ErrorIs(t, client.Verify(msg, nil), ErrTestMissingMAC)
+
+	// Unsigned queries are rejected
+	_, res = exchange(GenerateQuery(42, testQuestion))
+	assert.Equal(t, 1, called)
+	assert.Equal(t, dns.RCodeNotAuth, res.RCode)
+
+	// Queries signed outside of the allowed clock skew are rejected
+	now = now.Add(-time.Hour)
+
+	query, err = client.Sign(GenerateQuery(42, testQuestion))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(time.Hour)
+
+	assert.ErrorIs(t, client.Verify(query, nil), ErrTestTimeSkew)
+
+	_, res = exchange(query)
+	assert.Equal(t, 1, called)
+	assert.Equal(t, dns.RCodeNotAuth, res.RCode)
+}
+
+// RequestSigner records the request passed to SignResponse
+type RequestSigner struct {
+	MACAuthenticator
+	request *dns.Request
+}
+
+func (auth *RequestSigner) SignResponse(msg []byte, req *dns.Request) ([]byte, error) {
+	auth.request = req
+	return auth.Sign(msg)
+}
+
+func TestSigningWriter(t *testing.T) {
+	auth := &RequestSigner{MACAuthenticator: MACAuthenticator{Secret: []byte("secret"), Fudge: time.Minute, Now: time.Now}}
+
+	req, err := dns.ParseRequest(context.Background(), GenerateQuery(42, testQuestion))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := dns.NewMessageWriter(nil)
+	wr := &dns.SigningWriter{ResponseWriter: buf, Authenticator: auth, Request: req}
+
+	// Responses from Builders and complete messages are both signed
+	assert.NoError(t, dns.WriteAnswer(wr, req, &dns.Answer{}))
+	assert.Same(t, req, auth.request)
+	assert.NoError(t, auth.Verify(buf.Bytes(), nil))
+
+	unsigned := dns.NewMessageWriter(nil)
+	assert.NoError(t, dns.WriteAnswer(unsigned, req, &dns.Answer{}))
+
+	buf.Reset()
+	wr.SendMessage(unsigned.Bytes())
+
+	assert.NoError(t, auth.Verify(buf.Bytes(), nil))
+	assert.Len(t, buf.Bytes(), len(unsigned.Bytes())+macRecordSize)
+
+	// Data passed to Send is refused, rather than sent unsigned
+	buf.Reset()
+
+	assert.PanicsWithError(t, dns.ErrUnsignedSend.Error(), func() { wr.Send(unsigned.Bytes()) })
+	assert.Empty(t, buf.Bytes())
+}
@@ -0,0 +1,187 @@
+package dns
+
+import (
+	"errors"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// MaxStreamMessageSize is the largest message that can be sent in a length-prefixed stream frame
+const MaxStreamMessageSize = 65535
+
+// ErrTransferUDP is returned when a zone transfer is requested over UDP, which can not carry the
+// sequence of messages that a transfer is sent in (RFC 5936, section 4.2)
+var ErrTransferUDP = errors.New("dns: zone transfers require a stream transport")
+
+// AXFRWriter streams a zone transfer (RFC 5936) as a sequence of messages on a stream connection.
+// Records are packed into each message until the next record would exceed the frame size limit,
+// then the message is sent and a new one is started. The zone's SOA record is sent as the first
+// and last record of the transfer
+type AXFRWriter struct {
+	// MaxSize bounds the size of each message. A zero value uses MaxStreamMessageSize
+	MaxSize int
+
+	// DisableCompression packs names without compression pointers, for secondaries that do not
+	// tolerate them. Names are compressed within each message by default, as the owner and target
+	// names in a zone share long suffixes. Compression never refers across messages
+	DisableCompression bool
+
+	wr  ResponseWriter
+	req *Request
+	soa dnsmessage.Resource
+
+	builder  dnsmessage.Builder
+	opened   bool
+	started  bool
+	size     int
+	messages int
+
+	// scratch is reused to measure the packed size of each record
+	scratch []byte
+}
+
+// NewAXFRWriter creates an AXFRWriter for a request. The zone's SOA record begins the transfer with
+// the first call to Write or Close. Requests received over UDP return ErrTransferUDP
+func NewAXFRWriter(wr ResponseWriter, req *Request, soa dnsmessage.Resource) (*AXFRWriter, error) {
+	if req.Transport() == TransportUDP {
+		return nil, ErrTransferUDP
+	}
+
+	if _, is := soa.Body.(*dnsmessage.SOAResource); !is {
+		return nil, ErrNotSOA
+	}
+
+	soa.Header.Type = dnsmessage.TypeSOA
+	return &AXFRWriter{wr: wr, req: req, soa: soa}, nil
+}
+
+// Write adds records to the transfer, sending buffered messages as they fill
+func (axfr *AXFRWriter) Write(records ...dnsmessage.Resource) error {
+	if !axfr.opened {
+		axfr.opened = true
+
+		err := axfr.Write(axfr.soa)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, record := range records {
+		size, err := axfr.measure(record)
+		if err != nil {
+			return err
+		}
+
+		if axfr.started && axfr.size+size > axfr.limit() {
+			axfr.flush()
+		}
+
+		if !axfr.started {
+			err = axfr.start()
+			if err != nil {
+				return err
+			}
+		}
+
+		err = AppendResource(&axfr.builder, record)
+		if err != nil {
+			return err
+		}
+
+		axfr.size += size
+	}
+
+	return nil
+}
+
+// WriteZone adds all of a Zone's records to the transfer, except its SOA record
+func (axfr *AXFRWriter) WriteZone(zone *Zone) error {
+	records := zone.Records()
+	return axfr.Write(records[1:]...)
+}
+
+// Close adds the SOA record that ends the transfer and sends the last message
+func (axfr *AXFRWriter) Close() error {
+	err := axfr.Write(axfr.soa)
+	if err != nil {
+		return err
+	}
+
+	axfr.flush()
+	return nil
+}
+
+func (axfr *AXFRWriter) limit() int {
+	if axfr.MaxSize > 0 {
+		return min(axfr.MaxSize, MaxStreamMessageSize)
+	}
+
+	return MaxStreamMessageSize
+}
+
+// start begins a new message. The first message of a transfer echoes the request's question
+func (axfr *AXFRWriter) start() error {
+	header := axfr.req.ResponseHeader(dnsmessage.RCodeSuccess)
+	header.Authoritative = true
+
+	axfr.builder = axfr.wr.Builder(header)
+	axfr.size = 12
+
+	if !axfr.DisableCompression {
+		axfr.builder.EnableCompression()
+	}
+
+	if axfr.messages == 0 {
+		questions, err := axfr.req.Questions()
+		if err != nil {
+			return err
+		}
+
+		err = axfr.builder.StartQuestions()
+		if err != nil {
+			return err
+		}
+
+		for _, question := range questions {
+			err = axfr.builder.Question(question)
+			if err != nil {
+				return err
+			}
+
+			axfr.size += int(question.Name.Length) + 5
+		}
+	}
+
+	axfr.started = true
+	return axfr.builder.StartAnswers()
+}
+
+func (axfr *AXFRWriter) flush() {
+	axfr.wr.SendBuilder(&axfr.builder)
+	axfr.started = false
+	axfr.messages++
+}
+
+// measure returns the uncompressed size of a record, which bounds its size in a message. Compressed
+// messages are smaller than the sum of their records' sizes, so they may be sent before they are full
+func (axfr *AXFRWriter) measure(record dnsmessage.Resource) (int, error) {
+	builder := dnsmessage.NewBuilder(axfr.scratch[:0], dnsmessage.Header{})
+
+	err := builder.StartAnswers()
+	if err != nil {
+		return 0, err
+	}
+
+	err = AppendResource(&builder, record)
+	if err != nil {
+		return 0, err
+	}
+
+	msg, err := builder.Finish()
+	if err != nil {
+		return 0, err
+	}
+
+	axfr.scratch = msg
+	return len(msg) - 12, nil
+}
@@ -0,0 +1,218 @@
+package dns_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ReadFrames splits a buffer of length-framed messages
+func ReadFrames(t *testing.T, buf []byte) (messages []dnsmessage.Message) {
+	for len(buf) > 0 {
+		size := int(dns.DecodeLength(buf))
+
+		var msg dnsmessage.Message
+		if err := msg.Unpack(buf[2 : 2+size]); err != nil {
+			t.Fatal(err)
+		}
+
+		messages = append(messages, msg)
+		buf = buf[2+size:]
+	}
+
+	return
+}
+
+// StreamBuffer implements ResponseWriter by appending length-framed messages to a buffer
+type StreamBuffer struct {
+	dns.StreamWriter
+	buf []byte
+}
+
+func (sb *StreamBuffer) Send(frame []byte) {
+	sb.buf = append(sb.buf, frame...)
+}
+
+func (sb *StreamBuffer) SendBuilder(builder *dnsmessage.Builder) {
+	msg, err := builder.Finish()
+	if err != nil {
+		panic(err)
+	}
+
+	dns.EncodeLength(msg, uint16(len(msg)-2))
+	sb.Send(msg)
+}
+
+func TestAXFRWriter(t *testing.T) {
+	zone, err := dns.NewZone(testSOA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 4000 {
+		assert.NoError(t, zone.Add(dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(fmt.Sprintf("host-%d.example.com.", i)), Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   &dnsmessage.TXTResource{TXT: []string{"lorem ipsum dolor sit amet"}},
+		}))
+	}
+
+	req, err := dns.ParseRequest(context.Background(), GenerateQuery(42, dnsmessage.Question{Name: zone.Origin(), Type: dnsmessage.TypeAXFR, Class: dnsmessage.ClassINET}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wr StreamBuffer
+
+	axfr, err := dns.NewAXFRWriter(&wr, req, zone.SOA())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(t, axfr.WriteZone(zone))
+	assert.NoError(t, axfr.Close())
+
+	messages := ReadFrames(t, wr.buf)
+	assert.Greater(t, len(messages), 1)
+
+	var records []dnsmessage.Resource
+	for i, msg := range messages {
+		assert.Equal(t, uint16(42), msg.ID)
+		assert.True(t, msg.Authoritative)
+
+		// Only the first message echoes the question
+		assert.Equal(t, i == 0, len(msg.Questions) == 1)
+
+		records = append(records, msg.Answers...)
+	}
+
+	// The transfer includes the SOA record twice, and the zone's derived apex NS record
+	if assert.Len(t, records, 4003) {
+		assert.Equal(t, dnsmessage.TypeSOA, records[0].Header.Type)
+		assert.Equal(t, dnsmessage.TypeSOA, records[len(records)-1].Header.Type)
+	}
+}
+
+func TestZoneHandlerTransfer(t *testing.T) {
+	zone, err := dns.NewZone(testSOA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(t, zone.Add(dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: testQuestion.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+		Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+	}))
+
+	handler := &dns.ZoneHandler{Zone: zone, Transfers: true}
+	query := GenerateQuery(7, dnsmessage.Question{Name: zone.Origin(), Type: dnsmessage.TypeAXFR, Class: dnsmessage.ClassINET})
+
+	req, err := dns.ParseRequest(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wr StreamBuffer
+	handler.ServeDNS(&wr, req)
+
+	messages := ReadFrames(t, wr.buf)
+	if assert.Len(t, messages, 1) && assert.Len(t, messages[0].Answers, 4) {
+		assert.Equal(t, dnsmessage.TypeSOA, messages[0].Answers[0].Header.Type)
+		assert.Equal(t, dnsmessage.TypeSOA, messages[0].Answers[3].Header.Type)
+	}
+
+	// Transfers are refused over UDP
+	server := dns.Server{Handler: handler}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go server.Serve(conn)
+	defer server.CloseAll()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(time.Second))
+	client.Write(query)
+
+	buf := make([]byte, 512)
+	size, err := client.Read(buf)
+
+	var res dnsmessage.Message
+	if assert.NoError(t, err) && assert.NoError(t, res.Unpack(buf[:size])) {
+		assert.Equal(t, dnsmessage.RCodeRefused, res.RCode)
+		assert.Empty(t, res.Answers)
+	}
+
+	_, err = dns.NewAXFRWriter(&wr, req, dnsmessage.Resource{})
+	assert.ErrorIs(t, err, dns.ErrNotSOA)
+
+	// Transfers are refused unless they are enabled
+	wr.buf = nil
+	(&dns.ZoneHandler{Zone: zone}).ServeDNS(&wr, req)
+
+	if messages = ReadFrames(t, wr.buf); assert.Len(t, messages, 1) {
+		assert.Equal(t, dnsmessage.RCodeRefused, messages[0].RCode)
+	}
+}
+
+func BenchmarkAXFRCompression(b *testing.B) {
+	zone, err := dns.NewZone(testSOA)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for i := range 2000 {
+		name := dnsmessage.MustNewName(fmt.Sprintf("host-%d.servers.example.com.", i))
+
+		zone.Add(dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, byte(i)}},
+		}, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeMX, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   &dnsmessage.MXResource{Pref: 10, MX: dnsmessage.MustNewName("mail.servers.example.com.")},
+		})
+	}
+
+	req, err := dns.ParseRequest(context.Background(), GenerateQuery(42, dnsmessage.Question{Name: zone.Origin(), Type: dnsmessage.TypeAXFR, Class: dnsmessage.ClassINET}))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, disable := range []bool{false, true} {
+		name := "compressed"
+		if disable {
+			name = "uncompressed"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			var wr StreamBuffer
+
+			for b.Loop() {
+				wr.buf = wr.buf[:0]
+
+				axfr, err := dns.NewAXFRWriter(&wr, req, zone.SOA())
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				axfr.DisableCompression = disable
+				axfr.WriteZone(zone)
+				axfr.Close()
+			}
+
+			b.ReportMetric(float64(len(wr.buf)), "bytes/transfer")
+		})
+	}
+}
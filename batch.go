@@ -0,0 +1,81 @@
+package dns
+
+import "context"
+
+// BatchHandler is an optional interface for Handlers that resolve many queries together, such as
+// with one backend round-trip for many names. When a stream connection's read delivers more than
+// one complete frame, and its queries are handled serially, HandleStream passes the queries to
+// ServeDNSBatch together. Each request is answered with the ResponseWriter at the same index.
+// Queries that arrive alone are passed to ServeDNS.
+//
+// Batches are formed from whatever the client has pipelined, and are intended for trusted internal
+// clients that send bulk queries
+type BatchHandler interface {
+	Handler
+	ServeDNSBatch([]*Request, []ResponseWriter)
+}
+
+// HandleBatch parses and applies the Server's policies to a batch of messages, then passes those that
+// are accepted to the Handler's ServeDNSBatch method. Handlers that do not implement BatchHandler are
+// called for each message
+func (server *Server) HandleBatch(ctx context.Context, bufs [][]byte, wrs []ResponseWriter, reqs []*Request) {
+	batcher, is := server.Handler.(BatchHandler)
+	if !is {
+		for i, buf := range bufs {
+			server.Handle(ctx, buf, wrs[i], reqs[i])
+		}
+
+		return
+	}
+
+	// The frames of a batch are read from one connection
+	if len(reqs) > 0 {
+		defer server.logPanic(ctx, reqs[0].Transport())
+	}
+
+	accepted := reqs[:0:0]
+	writers := wrs[:0:0]
+
+	for i, buf := range bufs {
+		wr, end, ok := server.begin(ctx, buf, wrs[i], reqs[i])
+		if ok {
+			accepted = append(accepted, reqs[i])
+			writers = append(writers, wr)
+
+			defer end()
+		}
+	}
+
+	switch len(accepted) {
+	case 0:
+	case 1:
+		batcher.ServeDNS(writers[0], accepted[0])
+	default:
+		batcher.ServeDNSBatch(accepted, writers)
+	}
+}
+
+// streamBatch collects the frames that are read from a stream connection together
+type streamBatch struct {
+	bufs [][]byte
+	wrs  []ResponseWriter
+	reqs []*Request
+}
+
+func (batch *streamBatch) add(buf []byte, wr ResponseWriter, req *Request) {
+	batch.bufs = append(batch.bufs, buf)
+	batch.wrs = append(batch.wrs, wr)
+	batch.reqs = append(batch.reqs, req)
+}
+
+// reset empties the batch, keeping its capacity. Entries are cleared so that the batch does not
+// retain requests and frames from the reassembly buffer
+func (batch *streamBatch) reset() {
+	clear(batch.bufs)
+	clear(batch.wrs)
+	clear(batch.reqs)
+
+	batch.bufs = batch.bufs[:0]
+	batch.wrs = batch.wrs[:0]
+	batch.reqs = batch.reqs[:0]
+}
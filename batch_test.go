@@ -0,0 +1,43 @@
+package dns_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// BatchRecorder records the IDs of the requests that it receives in each call
+type BatchRecorder struct {
+	batches [][]uint16
+}
+
+func (br *BatchRecorder) ServeDNS(_ dns.ResponseWriter, req *dns.Request) {
+	br.batches = append(br.batches, []uint16{req.ID})
+}
+
+func (br *BatchRecorder) ServeDNSBatch(reqs []*dns.Request, wrs []dns.ResponseWriter) {
+	var ids []uint16
+	for _, req := range reqs {
+		ids = append(ids, req.ID)
+	}
+
+	br.batches = append(br.batches, ids)
+}
+
+func TestBatchHandler(t *testing.T) {
+	var recorder BatchRecorder
+	var tester StreamTester
+
+	// Three frames are read together, then a frame and the start of another
+	pipelined := bytes.Join([][]byte{GenerateFrame(1, testQuestion), GenerateFrame(2, testQuestion), GenerateFrame(3, testQuestion)}, nil)
+	trailing := GenerateFrame(5, testQuestion)
+
+	tester.chunks = append(tester.chunks, pipelined, append(GenerateFrame(4, testQuestion), trailing[:4]...), trailing[4:])
+
+	server := dns.Server{Handler: &recorder}
+	server.HandleStream(server.Context(), &tester)
+
+	assert.Equal(t, [][]uint16{{1, 2, 3}, {4}, {5}}, recorder.batches)
+}
@@ -0,0 +1,53 @@
+package dns_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/jmanero/go-dns"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DiscardConn accepts and discards writes
+type DiscardConn struct{ net.Conn }
+
+func (DiscardConn) Write(buf []byte) (int, error) { return len(buf), nil }
+
+// DiscardPacketConn accepts and discards datagrams
+type DiscardPacketConn struct{ net.PacketConn }
+
+func (DiscardPacketConn) WriteTo(buf []byte, _ net.Addr) (int, error) { return len(buf), nil }
+
+func benchmarkWriter(b *testing.B, wr dns.ResponseWriter) {
+	req, err := dns.ParseRequest(context.Background(), GenerateQuery(42, testQuestion))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	answer := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: testQuestion.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+		Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+	}
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			res := wr.Builder(dnsmessage.Header{ID: req.ID, Response: true})
+			res.StartQuestions()
+			res.Question(testQuestion)
+			res.StartAnswers()
+			dns.AppendResource(&res, answer)
+
+			wr.SendBuilder(&res)
+		}
+	})
+}
+
+func BenchmarkPacketWriter(b *testing.B) {
+	benchmarkWriter(b, &dns.PacketWriter{PacketConn: DiscardPacketConn{}})
+}
+
+func BenchmarkStreamWriter(b *testing.B) {
+	benchmarkWriter(b, &dns.StreamWriter{Conn: DiscardConn{}})
+}
@@ -0,0 +1,91 @@
+package dns
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultFlushDelay is the time that buffered stream writes are held before they are flushed
+const DefaultFlushDelay = time.Millisecond
+
+// bufferedConn coalesces writes to a stream connection, so that responses to a batch of pipelined
+// queries are sent with fewer system calls. Buffered writes are flushed by a timer, so that a
+// response is not held indefinitely when no further responses follow it
+type bufferedConn struct {
+	net.Conn
+
+	delay  time.Duration
+	writer *bufio.Writer
+	timer  *time.Timer
+	armed  bool
+	err    error
+
+	sync.Mutex
+}
+
+func newBufferedConn(conn net.Conn, size int, delay time.Duration) *bufferedConn {
+	bc := &bufferedConn{Conn: conn, delay: delay, writer: bufio.NewWriterSize(conn, size)}
+	bc.timer = time.AfterFunc(time.Hour, bc.timeout)
+	bc.timer.Stop()
+
+	return bc
+}
+
+// Write buffers a frame and arms the flush timer. An error from a previous flush is returned
+func (bc *bufferedConn) Write(buf []byte) (int, error) {
+	bc.Lock()
+	defer bc.Unlock()
+
+	if bc.err != nil {
+		return 0, bc.err
+	}
+
+	n, err := bc.writer.Write(buf)
+	if err != nil {
+		bc.err = err
+		return n, err
+	}
+
+	if bc.writer.Buffered() > 0 && !bc.armed {
+		bc.armed = true
+		bc.timer.Reset(bc.delay)
+	}
+
+	return n, nil
+}
+
+// Flush writes buffered frames to the connection
+func (bc *bufferedConn) Flush() error {
+	bc.Lock()
+	defer bc.Unlock()
+
+	return bc.flush()
+}
+
+func (bc *bufferedConn) flush() error {
+	bc.armed = false
+	bc.timer.Stop()
+
+	if bc.err == nil {
+		bc.err = bc.writer.Flush()
+	}
+
+	return bc.err
+}
+
+func (bc *bufferedConn) timeout() {
+	bc.Lock()
+	defer bc.Unlock()
+
+	if bc.armed {
+		bc.flush()
+	}
+}
+
+// Close flushes buffered frames and closes the connection
+func (bc *bufferedConn) Close() error {
+	bc.Flush()
+	return bc.Conn.Close()
+}
@@ -2,23 +2,87 @@ package dns
 
 import (
 	"sync"
+
+	"golang.org/x/net/dns/dnsmessage"
 )
 
-var buffers = sync.Pool{
-	New: func() any { return make([]byte, 4096) },
+// Allocator provides the byte buffers that a Server reads messages into, and that its writers build
+// responses in. Put may be called with buffers that were not returned by Get, such as a Builder's
+// buffer that grew, and may drop them. An Allocator must be safe for concurrent use
+type Allocator interface {
+	Get(capacity, length int) []byte
+	Put([]byte)
+}
+
+// poolAllocator allocates buffers from the package's size class pools
+type poolAllocator struct{}
+
+func (poolAllocator) Get(capacity, length int) []byte {
+	return GetBuffer(capacity, length)
+}
+
+func (poolAllocator) Put(buf []byte) {
+	FreeBuffer(buf)
+}
+
+// DefaultAllocator allocates buffers with GetBuffer, and returns them with FreeBuffer
+var DefaultAllocator Allocator = poolAllocator{}
+
+// allocator returns an Allocator, or DefaultAllocator if it is nil
+func allocator(alloc Allocator) Allocator {
+	if alloc == nil {
+		return DefaultAllocator
+	}
+
+	return alloc
+}
+
+// bufferClasses are the capacities of pooled buffers: a datagram without EDNS0, a datagram read
+// buffer, and the largest stream frame with its length prefix
+var bufferClasses = [...]int{512, 4096, MaxStreamMessageSize + 2}
+
+// buffers pools buffers by the index of their size class
+var buffers [len(bufferClasses)]sync.Pool
+
+// bufferClass returns the index of the smallest size class that holds a capacity, or -1 if the
+// capacity exceeds every class
+func bufferClass(capacity int) int {
+	for class, size := range bufferClasses {
+		if capacity <= size {
+			return class
+		}
+	}
+
+	return -1
 }
 
-// GetBuffer gets a byte buffer from an underlying pool
+// GetBuffer gets a byte buffer from the pool for the smallest size class with the requested
+// capacity. Buffers larger than every class are allocated, and are not pooled
 func GetBuffer(capacity, length int) []byte {
-	buf := buffers.Get().([]byte)
+	class := bufferClass(capacity)
+	if class < 0 {
+		return GrowBuffer(nil, capacity, length)
+	}
+
+	buf, is := buffers[class].Get().([]byte)
+	if !is {
+		buf = make([]byte, 0, bufferClasses[class])
+	}
 
 	// Ensure that the buffer has the requested capacity and length
 	return GrowBuffer(buf, capacity, length)
 }
 
-// FreeBuffer returns a byte buffer to a pool for reuse
+// FreeBuffer returns a byte buffer to the pool for its size class for reuse. Buffers whose capacity
+// is not exactly that of a class, such as those that grew beyond their class, are dropped. The caller
+// must not retain any slice of the buffer, as it may be returned by a subsequent GetBuffer call
 func FreeBuffer(buf []byte) {
-	buffers.Put(buf)
+	for class, size := range bufferClasses {
+		if cap(buf) == size {
+			buffers[class].Put(buf[:0])
+			return
+		}
+	}
 }
 
 // GrowBuffer expands a buffer slice to the requested capacity and length
@@ -36,3 +100,122 @@ func GrowBuffer(buf []byte, capacity, length int) []byte {
 	// Return a subslice at the requested length
 	return buf[:length]
 }
+
+// builderPool recycles the buffers of response builders for a transport. Buffers are stored with
+// pointers from a second pool, so that returning a buffer to the pool does not allocate a slice header
+type builderPool struct {
+	buffers sync.Pool
+	boxes   sync.Pool
+}
+
+// Transport builder pools. Stream buffers are pooled separately, as large responses grow them
+// beyond the size of a datagram
+var (
+	packetBuilders builderPool
+	streamBuilders builderPool
+)
+
+// Builder creates a dnsmessage.Builder with a pooled buffer, after a prefix of zeroed bytes
+func (pool *builderPool) Builder(prefix int, header dnsmessage.Header) dnsmessage.Builder {
+	var buf []byte
+
+	if box, is := pool.buffers.Get().(*[]byte); is {
+		buf, *box = *box, nil
+		pool.boxes.Put(box)
+	}
+
+	buf = GrowBuffer(buf, 4096, prefix)
+	clear(buf)
+
+	return dnsmessage.NewBuilder(buf, header)
+}
+
+// allocBuilder creates a dnsmessage.Builder with a buffer from an Allocator, or from a builder pool
+// if the Allocator is nil
+func allocBuilder(alloc Allocator, pool *builderPool, prefix int, header dnsmessage.Header) dnsmessage.Builder {
+	if alloc == nil {
+		return pool.Builder(prefix, header)
+	}
+
+	buf := alloc.Get(4096, prefix)
+	clear(buf)
+
+	return dnsmessage.NewBuilder(buf, header)
+}
+
+// freeBuilder returns the buffer of a message from allocBuilder
+func freeBuilder(alloc Allocator, pool *builderPool, msg []byte) {
+	if alloc == nil {
+		pool.Free(msg)
+		return
+	}
+
+	alloc.Put(msg)
+}
+
+// Free returns a finished message's buffer to the pool
+func (pool *builderPool) Free(msg []byte) {
+	if cap(msg) == 0 {
+		return
+	}
+
+	box, is := pool.boxes.Get().(*[]byte)
+	if !is {
+		box = new([]byte)
+	}
+
+	*box = msg[:0]
+	pool.buffers.Put(box)
+}
+
+// builderReleaser is implemented by writers that can reclaim the buffer of a Builder that they
+// created, when the Builder's message is abandoned instead of being sent
+type builderReleaser interface {
+	releaseBuilder(msg []byte)
+}
+
+func (wr *PacketWriter) releaseBuilder(msg []byte) {
+	freeBuilder(wr.Allocator, &packetBuilders, msg)
+}
+
+func (wr *StreamWriter) releaseBuilder(msg []byte) {
+	freeBuilder(wr.Allocator, &streamBuilders, msg)
+}
+
+func (wr *QUICWriter) releaseBuilder(msg []byte) {
+	freeBuilder(wr.Allocator, &streamBuilders, msg)
+}
+
+func (wr *BufferWriter) releaseBuilder(msg []byte) {
+	packetBuilders.Free(msg)
+}
+
+func (wr *RecordingWriter) releaseBuilder(msg []byte) {
+	packetBuilders.Free(msg)
+}
+
+func (wr wrappedWriter) releaseBuilder(msg []byte) {
+	alloc, _ := wr.builderSettings()
+	freeBuilder(alloc, &packetBuilders, msg)
+}
+
+func (wr *SigningWriter) releaseBuilder(msg []byte) {
+	wrappedWriter{wr.ResponseWriter}.releaseBuilder(msg)
+}
+
+// releaseBuilder returns the buffer of a Builder from a writer's Builder method, when an error
+// prevents its message from being sent. Buffers of writers that do not implement builderReleaser are
+// left to the garbage collector
+func releaseBuilder(wr ResponseWriter, builder *dnsmessage.Builder) {
+	releaser, is := wr.(builderReleaser)
+	if !is {
+		return
+	}
+
+	msg, err := builder.Finish()
+	if err != nil {
+		return
+	}
+
+	releaser.releaseBuilder(msg)
+}
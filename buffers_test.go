@@ -0,0 +1,91 @@
+package dns_test
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBufferClasses(t *testing.T) {
+	// Buffers come from the smallest class that holds the requested capacity
+	assert.Equal(t, 512, cap(dns.GetBuffer(100, 12)))
+	assert.Equal(t, 4096, cap(dns.GetBuffer(1232, 1232)))
+	assert.Equal(t, 65537, cap(dns.GetBuffer(4097, 0)))
+	assert.Len(t, dns.GetBuffer(100, 12), 12)
+
+	// Larger buffers are allocated to size
+	assert.GreaterOrEqual(t, cap(dns.GetBuffer(70000, 0)), 70000)
+
+	// Buffers that grew beyond their class are dropped, rather than returned to a smaller class
+	grown := dns.GrowBuffer(dns.GetBuffer(512, 512), 1024, 1024)
+	dns.FreeBuffer(grown)
+
+	for range 16 {
+		assert.Equal(t, 512, cap(dns.GetBuffer(512, 0)))
+	}
+}
+
+// CountingAllocator counts the buffers that it allocates and is returned
+type CountingAllocator struct {
+	Gets atomic.Int64
+	Puts atomic.Int64
+}
+
+func (alloc *CountingAllocator) Get(capacity, length int) []byte {
+	alloc.Gets.Add(1)
+	return make([]byte, length, capacity)
+}
+
+func (alloc *CountingAllocator) Put([]byte) {
+	alloc.Puts.Add(1)
+}
+
+func TestServerAllocator(t *testing.T) {
+	var alloc CountingAllocator
+
+	server := &dns.Server{Allocator: &alloc, Handler: dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) { dns.ServerFailure(wr, req) })}
+
+	packets, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go server.Serve(packets)
+	go server.ServeStream(listener)
+
+	for network, addr := range map[string]net.Addr{"udp": packets.LocalAddr(), "tcp": listener.Addr()} {
+		conn, err := net.Dial(network, addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn.SetDeadline(time.Now().Add(time.Second))
+
+		if network == "udp" {
+			conn.Write(GenerateQuery(1, testQuestion))
+			_, err = conn.Read(make([]byte, 512))
+		} else {
+			conn.Write(GenerateFrame(1, testQuestion))
+			_, err = dns.ReadFrame(conn)
+		}
+
+		assert.NoError(t, err, network)
+		conn.Close()
+	}
+
+	assert.NoError(t, server.Shutdown(context.Background()))
+
+	// Read buffers and response builders for each transport are returned
+	assert.GreaterOrEqual(t, alloc.Gets.Load(), int64(4))
+	assert.Equal(t, alloc.Gets.Load(), alloc.Puts.Load())
+}
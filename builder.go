@@ -0,0 +1,168 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// MaxSectionCount is the largest number of entries that a section's 16-bit header count can represent
+const MaxSectionCount = 1<<16 - 1
+
+// Resource-writing errors
+var (
+	// ErrSectionOverflow is returned by resource-writing helpers when a section would exceed MaxSectionCount entries
+	ErrSectionOverflow = errors.New("dns: section would exceed 65535 entries")
+	// ErrRDataTooLong is returned by RawResource when RDATA does not fit in a record's 16-bit length field
+	ErrRDataTooLong = errors.New("dns: RDATA exceeds 65535 bytes")
+	// ErrNoType is returned by RawResource when the resource header does not have a type
+	ErrNoType = errors.New("dns: resource header does not have a type")
+)
+
+// AppendResource writes a Resource of any supported type to the current section of a dnsmessage.Builder.
+// ErrSectionOverflow is returned, and the resource is not written, if the section is already full
+func AppendResource(builder *dnsmessage.Builder, resource dnsmessage.Resource) error {
+	return overflow(appendResource(builder, resource))
+}
+
+func appendResource(builder *dnsmessage.Builder, resource dnsmessage.Resource) error {
+	switch body := resource.Body.(type) {
+	case *dnsmessage.AResource:
+		return builder.AResource(resource.Header, *body)
+	case *dnsmessage.AAAAResource:
+		return builder.AAAAResource(resource.Header, *body)
+	case *dnsmessage.CNAMEResource:
+		return builder.CNAMEResource(resource.Header, *body)
+	case *dnsmessage.MXResource:
+		return builder.MXResource(resource.Header, *body)
+	case *dnsmessage.NSResource:
+		return builder.NSResource(resource.Header, *body)
+	case *dnsmessage.PTRResource:
+		return builder.PTRResource(resource.Header, *body)
+	case *dnsmessage.SOAResource:
+		return builder.SOAResource(resource.Header, *body)
+	case *dnsmessage.SRVResource:
+		return builder.SRVResource(resource.Header, *body)
+	case *dnsmessage.TXTResource:
+		return builder.TXTResource(resource.Header, *body)
+	case *dnsmessage.OPTResource:
+		return builder.OPTResource(resource.Header, *body)
+	case *dnsmessage.UnknownResource:
+		return builder.UnknownResource(resource.Header, *body)
+	default:
+		return fmt.Errorf("dns: unsupported resource body %T", resource.Body)
+	}
+}
+
+// RawResource writes a resource with pre-serialized wire-format RDATA to the current section of a
+// dnsmessage.Builder, without parsing it into a typed resource body. It allows proxies to relay records
+// of any type verbatim. RDATA is written as-is, and must not contain compression pointers, as they
+// would refer to offsets in the message that the RDATA was copied from
+func RawResource(builder *dnsmessage.Builder, header dnsmessage.ResourceHeader, rdata []byte) error {
+	if header.Type == 0 {
+		return ErrNoType
+	}
+
+	if len(rdata) > 0xffff {
+		return ErrRDataTooLong
+	}
+
+	return overflow(builder.UnknownResource(header, dnsmessage.UnknownResource{Type: header.Type, Data: rdata}))
+}
+
+// AppendResources writes a list of Resources to the current section of a dnsmessage.Builder. Lists longer
+// than MaxSectionCount are rejected with ErrSectionOverflow before any resource is written.
+//
+// The records of an RRset must have the same TTL (RFC 2181, section 5.2). Records in the list that
+// share an owner name, type, and class are written with the least TTL among them, so that data with
+// inconsistent TTLs does not leave caches with inconsistent RRsets. The resources are not modified
+func AppendResources(builder *dnsmessage.Builder, resources ...dnsmessage.Resource) error {
+	if len(resources) > MaxSectionCount {
+		return ErrSectionOverflow
+	}
+
+	ttls := rrsetTTLs(resources)
+
+	for _, resource := range resources {
+		if ttl, has := ttls[newRRsetKey(resource.Header)]; has {
+			resource.Header.TTL = ttl
+		}
+
+		err := AppendResource(builder, resource)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type rrsetKey struct {
+	name   string
+	rtype  dnsmessage.Type
+	rclass dnsmessage.Class
+}
+
+func newRRsetKey(header dnsmessage.ResourceHeader) rrsetKey {
+	return rrsetKey{name: CanonicalName(header.Name), rtype: header.Type, rclass: header.Class}
+}
+
+// rrsetTTLs returns the least TTL of each RRset whose records have different TTLs, or nil if the
+// TTLs are consistent. OPT records are excluded, as their TTL field holds EDNS flags, as are RRSIG
+// records, which take the TTL of the RRset that they cover
+func rrsetTTLs(resources []dnsmessage.Resource) map[rrsetKey]uint32 {
+	excluded := func(resource dnsmessage.Resource) bool {
+		return resource.Header.Type == dnsmessage.TypeOPT || resource.Header.Type == TypeRRSIG
+	}
+
+	// Most lists have a single TTL, and are written without indexing their RRsets
+	index := slices.IndexFunc(resources, func(resource dnsmessage.Resource) bool { return !excluded(resource) })
+	if index < 0 || !slices.ContainsFunc(resources[index:], func(resource dnsmessage.Resource) bool {
+		return !excluded(resource) && resource.Header.TTL != resources[index].Header.TTL
+	}) {
+		return nil
+	}
+
+	least := map[rrsetKey]uint32{}
+	mixed := map[rrsetKey]uint32{}
+
+	for _, resource := range resources[index:] {
+		if excluded(resource) {
+			continue
+		}
+
+		key := newRRsetKey(resource.Header)
+
+		ttl, has := least[key]
+		if !has {
+			least[key] = resource.Header.TTL
+			continue
+		}
+
+		if ttl != resource.Header.TTL {
+			least[key] = min(ttl, resource.Header.TTL)
+			mixed[key] = least[key]
+		}
+	}
+
+	return mixed
+}
+
+// overflow translates the dnsmessage.Builder's unexported section count errors into ErrSectionOverflow
+func overflow(err error) error {
+	if err != nil && slices.Contains(sectionOverflows, err.Error()) {
+		return ErrSectionOverflow
+	}
+
+	return err
+}
+
+// sectionOverflows are the messages of the errors that a dnsmessage.Builder returns when each of its
+// resource sections is full. The errors are not exported, so they are matched by their text
+var sectionOverflows = []string{
+	"too many Answers to pack (>65535)",
+	"too many Authorities to pack (>65535)",
+	"too many Additionals to pack (>65535)",
+}
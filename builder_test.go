@@ -0,0 +1,122 @@
+package dns_test
+
+import (
+	"testing"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestSectionOverflow(t *testing.T) {
+	record := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("foo.bar.baz."), Class: dnsmessage.ClassINET, TTL: 42},
+		Body:   &dnsmessage.AResource{A: [4]byte{10, 0, 1, 1}},
+	}
+
+	records := make([]dnsmessage.Resource, dns.MaxSectionCount+1)
+	for i := range records {
+		records[i] = record
+	}
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true})
+	assert.NoError(t, builder.StartAnswers())
+
+	// Lists that can never fit in a section are rejected up front
+	assert.ErrorIs(t, dns.AppendResources(&builder, records...), dns.ErrSectionOverflow)
+
+	// Fill the section, then attempt to write one more record
+	assert.NoError(t, dns.AppendResources(&builder, records[1:]...))
+	assert.ErrorIs(t, dns.AppendResource(&builder, record), dns.ErrSectionOverflow)
+
+	msg, err := builder.Finish()
+	assert.NoError(t, err)
+
+	var parser dnsmessage.Parser
+
+	_, err = parser.Start(msg)
+	assert.NoError(t, err)
+	assert.NoError(t, parser.SkipAllQuestions())
+
+	answers, err := parser.AllAnswers()
+	assert.NoError(t, err)
+	assert.Len(t, answers, dns.MaxSectionCount)
+
+	// Other Builder errors are returned unchanged
+	builder = dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true})
+	assert.ErrorIs(t, dns.AppendResource(&builder, record), dnsmessage.ErrNotStarted)
+
+	// Sections after the answers overflow in the same way
+	assert.NoError(t, builder.StartAuthorities())
+	assert.NoError(t, dns.AppendResources(&builder, records[1:]...))
+	assert.ErrorIs(t, dns.AppendResource(&builder, record), dns.ErrSectionOverflow)
+
+	assert.NoError(t, builder.StartAdditionals())
+	assert.NoError(t, dns.AppendResources(&builder, records[1:]...))
+	assert.ErrorIs(t, dns.AppendResource(&builder, record), dns.ErrSectionOverflow)
+}
+
+func TestRawResource(t *testing.T) {
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true})
+	assert.NoError(t, builder.StartAnswers())
+
+	header := dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("foo.bar.baz."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 42}
+
+	assert.NoError(t, dns.RawResource(&builder, header, []byte{10, 0, 1, 1}))
+	assert.ErrorIs(t, dns.RawResource(&builder, header, make([]byte, 0x10000)), dns.ErrRDataTooLong)
+	assert.ErrorIs(t, dns.RawResource(&builder, dnsmessage.ResourceHeader{Name: header.Name}, nil), dns.ErrNoType)
+
+	msg, err := builder.Finish()
+	assert.NoError(t, err)
+
+	var res dnsmessage.Message
+	if assert.NoError(t, res.Unpack(msg)) && assert.Len(t, res.Answers, 1) {
+		// Raw RDATA for a known type is parsed into its typed body
+		assert.Equal(t, &dnsmessage.AResource{A: [4]byte{10, 0, 1, 1}}, res.Answers[0].Body)
+	}
+}
+
+func TestRRsetTTL(t *testing.T) {
+	record := func(name string, rtype dnsmessage.Type, ttl uint32) dnsmessage.Resource {
+		return dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: rtype, Class: dnsmessage.ClassINET, TTL: ttl},
+			Body:   &dnsmessage.AResource{A: [4]byte{10, 0, 1, 1}},
+		}
+	}
+
+	var opt dnsmessage.ResourceHeader
+	opt.SetEDNS0(1232, dnsmessage.RCodeSuccess, true)
+
+	records := []dnsmessage.Resource{
+		record("www.example.com.", dnsmessage.TypeA, 300),
+		record("mail.example.com.", dnsmessage.TypeA, 600),
+		record("WWW.example.com.", dnsmessage.TypeA, 60),
+		record("www.example.com.", dnsmessage.TypeA, 3600),
+		{Header: opt, Body: &dnsmessage.OPTResource{}},
+	}
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true})
+	assert.NoError(t, builder.StartAdditionals())
+	assert.NoError(t, dns.AppendResources(&builder, records...))
+
+	msg, err := builder.Finish()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var res dnsmessage.Message
+	if assert.NoError(t, res.Unpack(msg)) && assert.Len(t, res.Additionals, 5) {
+		// The records of the www.example.com RRset take its least TTL. Other RRsets, and the OPT
+		// record's flags, are not changed
+		var ttls []uint32
+		for _, record := range res.Additionals[:4] {
+			ttls = append(ttls, record.Header.TTL)
+		}
+
+		assert.Equal(t, []uint32{60, 600, 60, 60}, ttls)
+		assert.Equal(t, opt.TTL, res.Additionals[4].Header.TTL)
+	}
+
+	// The caller's records are not modified
+	assert.Equal(t, uint32(3600), records[3].Header.TTL)
+}
@@ -0,0 +1,463 @@
+package dns
+
+import (
+	"bytes"
+	"cmp"
+	"container/list"
+	"encoding/binary"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DefaultCacheSize bounds the number of responses in a Cache with a zero MaxEntries
+const DefaultCacheSize = 4096
+
+// DefaultStaleTTL is the TTL of records in stale responses, as recommended by RFC 8767
+const DefaultStaleTTL = 30 * time.Second
+
+// CacheOptions configures a response Cache
+type CacheOptions struct {
+	// MaxEntries bounds the number of cached responses. The least recently used response is evicted
+	// to store a new one. A zero value uses DefaultCacheSize
+	MaxEntries int
+
+	// MaxTTL caps the time that a response is cached. A zero value does not cap TTLs
+	MaxTTL time.Duration
+
+	// StaleWhileRevalidate serves an expired response for up to this long after it expires, while it
+	// is refreshed in the background. A zero value refreshes expired responses before answering
+	StaleWhileRevalidate time.Duration
+
+	// ServeStale retains expired responses for up to this long after they expire, and serves them
+	// when a refreshed response can not be obtained because the upstreams could not be reached (RFC
+	// 8767). See ExchangeFailed. A zero value does not serve stale responses
+	ServeStale time.Duration
+
+	// StaleTTL is the TTL of records in stale responses. A zero value uses DefaultStaleTTL
+	StaleTTL time.Duration
+
+	// StaleError adds an Extended DNS Error (RFC 8914) indicating a stale answer to stale responses
+	// for clients that sent an OPT record
+	StaleError bool
+
+	// Persist is a file that the cache is loaded from when it is created, and saved to when it is
+	// closed, so that a restarted resolver does not begin with a cold cache. Responses that expired
+	// while the resolver was stopped are dropped. A missing or corrupt file is ignored. See Cache.Close
+	Persist string
+}
+
+// cacheStatus is the outcome of a cache lookup
+type cacheStatus int
+
+const (
+	cacheMiss cacheStatus = iota
+	cacheHit
+	// cacheStale responses are served while they are refreshed
+	cacheStale
+	// cacheExpired responses are served only if they can not be refreshed
+	cacheExpired
+)
+
+// Cache stores wire-format responses keyed by their question's name, type, and class, and by the
+// request's EDNS presence, DO bit, and CD bit, which change the content of a response. Responses are
+// stored without their OPT record, and an OPT record is built for each request that a response is
+// served to. Positive
+// responses are cached for the least TTL of their records, and negative responses (NXDOMAIN and
+// NODATA) for the lesser of their SOA record's TTL and MINIMUM field (RFC 2308). Responses that
+// are truncated, have another RCODE, or are negative without an SOA record are not cached. A Cache
+// is safe for concurrent use
+type Cache struct {
+	CacheOptions
+
+	// Stats counts lookups by their outcome
+	Stats CacheStats
+
+	entries map[cacheKey]*list.Element
+	lru     list.List
+	sync.Mutex
+}
+
+// NewCache creates a Cache, and loads its Persist file if one is configured
+func NewCache(opts CacheOptions) *Cache {
+	cache := &Cache{CacheOptions: opts, entries: map[cacheKey]*list.Element{}}
+
+	if cache.Persist != "" {
+		// A cache that can not be loaded starts empty
+		cache.Load(cache.Persist)
+	}
+
+	return cache
+}
+
+type cacheKey struct {
+	name   string
+	qtype  dnsmessage.Type
+	qclass dnsmessage.Class
+	flags  cacheFlags
+}
+
+// cacheFlags are the bits of a request that select a cached response
+type cacheFlags uint8
+
+const (
+	// cacheEDNS is set for requests with an OPT record
+	cacheEDNS cacheFlags = 1 << iota
+	// cacheDO is set for requests with the DNSSEC OK bit
+	cacheDO
+	// cacheCD is set for requests with the Checking Disabled bit
+	cacheCD
+)
+
+func newCacheKey(req *Request, question dnsmessage.Question) cacheKey {
+	var flags cacheFlags
+
+	if edns, found, err := req.ClientEDNS(); err == nil && found {
+		flags |= cacheEDNS
+
+		if edns.DO {
+			flags |= cacheDO
+		}
+	}
+
+	if req.CheckingDisabled {
+		flags |= cacheCD
+	}
+
+	return cacheKey{name: strings.ToLower(question.Name.String()), qtype: question.Type, qclass: question.Class, flags: flags}
+}
+
+// cacheEntry is a response along with the offsets of its records' TTL fields
+type cacheEntry struct {
+	key  cacheKey
+	msg  []byte
+	ttls []int
+
+	stored  time.Time
+	expires time.Time
+
+	// refreshing is set while an expired entry is refreshed
+	refreshing bool
+}
+
+// Len returns the number of cached responses
+func (cache *Cache) Len() int {
+	cache.Lock()
+	defer cache.Unlock()
+
+	return len(cache.entries)
+}
+
+// Store caches a response to a request. It returns false if the request is not a standard query
+// with a single question, or the response is not cacheable
+func (cache *Cache) Store(req *Request, msg []byte) bool {
+	question, cacheable := cacheQuestion(req)
+	if !cacheable {
+		return false
+	}
+
+	return cache.store(newCacheKey(req, question), msg)
+}
+
+// store caches a response without its OPT record. Responses with an OPT record that can not be
+// removed are not cacheable
+func (cache *Cache) store(key cacheKey, msg []byte) bool {
+	msg, cacheable := stripOPT(bytes.Clone(msg))
+	if !cacheable {
+		return false
+	}
+
+	ttl, offsets, cacheable := cacheTTL(msg)
+	if !cacheable {
+		return false
+	}
+
+	if cache.MaxTTL > 0 {
+		ttl = min(ttl, cache.MaxTTL)
+	}
+
+	now := time.Now()
+	entry := &cacheEntry{
+		key:     key,
+		msg:     msg,
+		ttls:    offsets,
+		stored:  now,
+		expires: now.Add(ttl),
+	}
+
+	SetMessageID(entry.msg, 0)
+
+	cache.Lock()
+	defer cache.Unlock()
+
+	if elem, has := cache.entries[entry.key]; has {
+		cache.lru.Remove(elem)
+	}
+
+	cache.entries[entry.key] = cache.lru.PushFront(entry)
+
+	for len(cache.entries) > cmp.Or(cache.MaxEntries, DefaultCacheSize) {
+		oldest := cache.lru.Back()
+
+		cache.lru.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*cacheEntry).key)
+	}
+
+	return true
+}
+
+// lookup returns a copy of the cached response to a question with its TTLs decremented by the time
+// that it has been cached. Expired responses are returned with StaleTTL, and refresh is true for the
+// first lookup of a response in the StaleWhileRevalidate window
+func (cache *Cache) lookup(key cacheKey) (msg []byte, status cacheStatus, refresh bool) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	elem, has := cache.entries[key]
+	if !has {
+		return nil, cacheMiss, false
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	now := time.Now()
+
+	status = cacheHit
+	if !now.Before(entry.expires) {
+		switch expired := now.Sub(entry.expires); {
+		case expired < cache.StaleWhileRevalidate:
+			status = cacheStale
+			refresh = !entry.refreshing
+			entry.refreshing = true
+
+		case expired < cache.ServeStale:
+			status = cacheExpired
+
+		default:
+			cache.lru.Remove(elem)
+			delete(cache.entries, key)
+
+			return nil, cacheMiss, false
+		}
+	}
+
+	cache.lru.MoveToFront(elem)
+
+	// TTLs are decremented by the response's age, and do not outlive the cached response
+	age := uint32(now.Sub(entry.stored) / time.Second)
+	remaining := uint32(max(entry.expires.Sub(now), 0) / time.Second)
+	stale := uint32(cmp.Or(cache.StaleTTL, DefaultStaleTTL) / time.Second)
+
+	msg = append([]byte(nil), entry.msg...)
+
+	for _, offset := range entry.ttls {
+		ttl := binary.BigEndian.Uint32(msg[offset:])
+
+		switch {
+		case status != cacheHit:
+			ttl = stale
+		case ttl < age:
+			ttl = 0
+		default:
+			ttl = min(ttl-age, remaining)
+		}
+
+		binary.BigEndian.PutUint32(msg[offset:], ttl)
+	}
+
+	return msg, status, refresh
+}
+
+// staleOptions returns the options of the OPT record of a stale response: a Stale Answer extended
+// error when StaleError is set
+func (cache *Cache) staleOptions() []dnsmessage.Option {
+	if !cache.StaleError {
+		return nil
+	}
+
+	return []dnsmessage.Option{{Code: OptionExtendedError, Data: []byte{0, byte(EDEStaleAnswer)}}}
+}
+
+// refreshed clears the refreshing flag of an expired response that could not be refreshed
+func (cache *Cache) refreshed(key cacheKey) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	if elem, has := cache.entries[key]; has {
+		elem.Value.(*cacheEntry).refreshing = false
+	}
+}
+
+// cacheTTL returns the time that a response may be cached, and the offsets of its records' TTL
+// fields. The boolean result is false if the response is not cacheable
+func cacheTTL(msg []byte) (time.Duration, []int, bool) {
+	if len(msg) < 12 || msg[2]&0x02 != 0 {
+		// Malformed or truncated
+		return 0, nil, false
+	}
+
+	rcode := dnsmessage.RCode(msg[3] & 0x0f)
+	if rcode != dnsmessage.RCodeSuccess && rcode != dnsmessage.RCodeNameError {
+		return 0, nil, false
+	}
+
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+	nscount := int(binary.BigEndian.Uint16(msg[8:]))
+	arcount := int(binary.BigEndian.Uint16(msg[10:]))
+
+	offset := 12
+	for range qdcount {
+		offset = skipName(msg, offset) + 4
+		if offset < 0 || offset > len(msg) {
+			return 0, nil, false
+		}
+	}
+
+	var offsets []int
+	var least, negative uint32 = ^uint32(0), ^uint32(0)
+
+	for index := range ancount + nscount + arcount {
+		offset = skipName(msg, offset)
+		if offset < 0 || offset+10 > len(msg) {
+			return 0, nil, false
+		}
+
+		rtype := dnsmessage.Type(binary.BigEndian.Uint16(msg[offset:]))
+		ttl := binary.BigEndian.Uint32(msg[offset+4:])
+		rdata := offset + 10
+		offset = rdata + int(binary.BigEndian.Uint16(msg[offset+8:]))
+
+		if offset > len(msg) {
+			return 0, nil, false
+		}
+
+		if rtype == dnsmessage.TypeOPT {
+			// The OPT record's TTL field holds EDNS flags
+			continue
+		}
+
+		offsets = append(offsets, rdata-6)
+		least = min(least, ttl)
+
+		if rtype == dnsmessage.TypeSOA && index >= ancount && index < ancount+nscount && offset-4 >= rdata {
+			// The SOA record's MINIMUM field is the last field in its RDATA
+			negative = min(ttl, binary.BigEndian.Uint32(msg[offset-4:]))
+		}
+	}
+
+	if rcode == dnsmessage.RCodeNameError || ancount == 0 {
+		if negative == ^uint32(0) {
+			return 0, nil, false
+		}
+
+		least = negative
+	}
+
+	if least == ^uint32(0) {
+		return 0, nil, false
+	}
+
+	return time.Duration(least) * time.Second, offsets, true
+}
+
+// stripOPT removes the OPT record from the end of a response, so that an OPT record can be built for
+// each request that the response is served to. The message is modified in place. The boolean result
+// is false if the response is malformed, or its OPT record can not be removed because it is followed
+// by another record, such as a signature, or carries an extended RCODE
+func stripOPT(msg []byte) ([]byte, bool) {
+	if len(msg) < 12 {
+		return nil, false
+	}
+
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+	nscount := int(binary.BigEndian.Uint16(msg[8:]))
+	arcount := int(binary.BigEndian.Uint16(msg[10:]))
+
+	offset := 12
+	for range qdcount {
+		offset = skipName(msg, offset)
+		if offset < 0 || offset+4 > len(msg) {
+			return nil, false
+		}
+
+		offset += 4
+	}
+
+	for index := range ancount + nscount + arcount {
+		start := offset
+
+		offset = skipName(msg, offset)
+		if offset < 0 || offset+10 > len(msg) {
+			return nil, false
+		}
+
+		rtype := dnsmessage.Type(binary.BigEndian.Uint16(msg[offset:]))
+		ttl := binary.BigEndian.Uint32(msg[offset+4:])
+		offset += 10 + int(binary.BigEndian.Uint16(msg[offset+8:]))
+
+		if offset > len(msg) {
+			return nil, false
+		}
+
+		if rtype != dnsmessage.TypeOPT {
+			continue
+		}
+
+		if index != ancount+nscount+arcount-1 || offset != len(msg) || ttl>>24 != 0 {
+			return nil, false
+		}
+
+		binary.BigEndian.PutUint16(msg[10:], uint16(arcount-1))
+		return msg[:start], true
+	}
+
+	return msg, true
+}
+
+// appendOPT adds an OPT record with EDNS0 parameters to the end of a wire-format message
+func appendOPT(msg []byte, edns *EDNS0) []byte {
+	header := edns.ResourceHeader()
+
+	length := 0
+	for _, option := range edns.Options {
+		length += 4 + len(option.Data)
+	}
+
+	// The OPT record is owned by the root name
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(dnsmessage.TypeOPT))
+	msg = binary.BigEndian.AppendUint16(msg, uint16(header.Class))
+	msg = binary.BigEndian.AppendUint32(msg, header.TTL)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(length))
+
+	for _, option := range edns.Options {
+		msg = binary.BigEndian.AppendUint16(msg, option.Code)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(option.Data)))
+		msg = append(msg, option.Data...)
+	}
+
+	binary.BigEndian.PutUint16(msg[10:], binary.BigEndian.Uint16(msg[10:])+1)
+	return msg
+}
+
+// skipName returns the offset following a wire-format name, or -1 if the name is malformed
+func skipName(msg []byte, offset int) int {
+	for offset >= 0 && offset < len(msg) {
+		switch length := int(msg[offset]); {
+		case length == 0:
+			return offset + 1
+		case length&0xc0 == 0xc0:
+			// A compression pointer ends the name
+			return offset + 2
+		case length&0xc0 != 0:
+			return -1
+		default:
+			offset += length + 1
+		}
+	}
+
+	return -1
+}
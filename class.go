@@ -0,0 +1,77 @@
+package dns
+
+import (
+	"errors"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ErrNoQuestion is returned by Request helpers that require a question when the message has none
+var ErrNoQuestion = errors.New("dns: message does not contain a question")
+
+// ClassANYPolicy selects how queries for ClassANY (255) are handled
+type ClassANYPolicy uint8
+
+// Handling policies for ClassANY queries
+const (
+	// ClassANYPass passes the query to the Handler unmodified
+	ClassANYPass ClassANYPolicy = iota
+	// ClassANYAsINET reports the query's class as ClassINET from Request.QuestionClass
+	ClassANYAsINET
+	// ClassANYRefuse rejects the query with the request's Refusal policy
+	ClassANYRefuse
+	// ClassANYNotImplemented responds with NOTIMP
+	ClassANYNotImplemented
+)
+
+// QuestionClass returns the class of the request's first question, after any ClassANY policy
+// has been applied. Handlers written for ClassINET should use QuestionClass rather than reading
+// the class from the question directly, so that ClassANY queries are handled consistently.
+//
+// The recommended configuration for most servers is the ClassANYAsINET policy, as ClassANY queries
+// are almost always intended for Internet class data. ErrNoQuestion is returned if the message does
+// not contain a question
+func (req *Request) QuestionClass() (dnsmessage.Class, error) {
+	if req.qclass != 0 {
+		return req.qclass, nil
+	}
+
+	questions, err := req.Questions()
+	if err != nil {
+		return 0, err
+	}
+
+	if len(questions) == 0 {
+		return 0, ErrNoQuestion
+	}
+
+	return questions[0].Class, nil
+}
+
+// ClassANY creates a Middleware that applies a ClassANYPolicy to queries for ClassANY. Other
+// queries are passed to the wrapped Handler unmodified
+func ClassANY(policy ClassANYPolicy) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(wr ResponseWriter, req *Request) {
+			class, err := req.QuestionClass()
+			if err != nil || class != dnsmessage.ClassANY {
+				next.ServeDNS(wr, req)
+				return
+			}
+
+			switch policy {
+			case ClassANYAsINET:
+				clone := *req
+				clone.qclass = dnsmessage.ClassINET
+
+				next.ServeDNS(wr, &clone)
+			case ClassANYRefuse:
+				Refuse(wr, req)
+			case ClassANYNotImplemented:
+				WriteError(wr, req, dnsmessage.RCodeNotImplemented)
+			default:
+				next.ServeDNS(wr, req)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package dns_test
+
+import (
+	"testing"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestClassANY(t *testing.T) {
+	anyQuestion := testQuestion
+	anyQuestion.Class = dnsmessage.ClassANY
+
+	for policy, expected := range map[dns.ClassANYPolicy]struct {
+		class dnsmessage.Class
+		rcode dnsmessage.RCode
+	}{
+		dns.ClassANYPass:           {class: dnsmessage.ClassANY, rcode: dnsmessage.RCodeSuccess},
+		dns.ClassANYAsINET:         {class: dnsmessage.ClassINET, rcode: dnsmessage.RCodeSuccess},
+		dns.ClassANYRefuse:         {rcode: dnsmessage.RCodeRefused},
+		dns.ClassANYNotImplemented: {rcode: dnsmessage.RCodeNotImplemented},
+	} {
+		var class dnsmessage.Class
+
+		handler := dns.ClassANY(policy)(dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+			var err error
+
+			class, err = req.QuestionClass()
+			assert.NoError(t, err)
+
+			dns.WriteAnswer(wr, req, &dns.Answer{})
+		}))
+
+		res := Exchange(t, handler, GenerateQuery(42, anyQuestion))
+		assert.Equal(t, expected.rcode, res.RCode, policy)
+		assert.Equal(t, expected.class, class, policy)
+
+		// The question is echoed with its original class
+		assert.Equal(t, []dnsmessage.Question{anyQuestion}, res.Questions, policy)
+
+		// Other classes are passed to the Handler unmodified
+		class = 0
+
+		res = Exchange(t, handler, GenerateQuery(42, testQuestion))
+		assert.Equal(t, dnsmessage.RCodeSuccess, res.RCode, policy)
+		assert.Equal(t, dnsmessage.ClassINET, class, policy)
+	}
+}
@@ -0,0 +1,313 @@
+package dns
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Client errors
+var (
+	ErrShortMessage = errors.New("dns: message is shorter than a header")
+	ErrIDMismatch   = errors.New("dns: response ID does not match query")
+)
+
+// DefaultExchangeTimeout bounds each exchange when a Client's Timeout is zero
+const DefaultExchangeTimeout = 5 * time.Second
+
+// Client exchanges DNS messages with remote servers
+type Client struct {
+	// Dialer opens connections to servers. The zero value is usable
+	Dialer net.Dialer
+	// TLSConfig is used for DNS-over-TLS exchanges. A nil value uses the default configuration
+	TLSConfig *tls.Config
+	// Timeout bounds each exchange when the context does not have an earlier deadline. A zero value
+	// uses DefaultExchangeTimeout
+	Timeout time.Duration
+
+	// Server is the address that Query sends queries to, such as "127.0.0.1:53"
+	Server string
+}
+
+// RCodeError is returned by Query when a server answers with an RCODE other than NOERROR
+type RCodeError struct {
+	RCode dnsmessage.RCode
+}
+
+func (err *RCodeError) Error() string {
+	return "dns: server responded with " + err.RCode.String()
+}
+
+// Query asks the Client's Server for the records of a type at a name, with recursion desired, and
+// returns the answer section of its response. Queries are sent over UDP with an OPT record that
+// advertises DefaultUDPSize, and are retried over TCP if the response is truncated. Responses with
+// an RCODE other than NOERROR return an *RCodeError
+func (client *Client) Query(ctx context.Context, name string, qtype dnsmessage.Type) ([]dnsmessage.Resource, error) {
+	qname, err := dnsmessage.NewName(canonicalPattern(name))
+	if err != nil {
+		return nil, err
+	}
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{RecursionDesired: true})
+
+	err = builder.StartQuestions()
+	if err != nil {
+		return nil, err
+	}
+
+	err = builder.Question(dnsmessage.Question{Name: qname, Type: qtype, Class: dnsmessage.ClassINET})
+	if err != nil {
+		return nil, err
+	}
+
+	err = builder.StartAdditionals()
+	if err != nil {
+		return nil, err
+	}
+
+	var opt dnsmessage.ResourceHeader
+
+	err = opt.SetEDNS0(DefaultUDPSize, dnsmessage.RCodeSuccess, false)
+	if err != nil {
+		return nil, err
+	}
+
+	err = builder.OPTResource(opt, dnsmessage.OPTResource{})
+	if err != nil {
+		return nil, err
+	}
+
+	query, err := builder.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := client.Exchange(ctx, query, client.Server)
+	if err != nil {
+		return nil, err
+	}
+
+	var res dnsmessage.Message
+
+	err = res.Unpack(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.RCode != dnsmessage.RCodeSuccess {
+		return nil, &RCodeError{RCode: res.RCode}
+	}
+
+	return res.Answers, nil
+}
+
+// Exchange sends a query to a server over UDP, and retries over TCP if the response is truncated
+func (client *Client) Exchange(ctx context.Context, msg []byte, addr string) ([]byte, error) {
+	ctx, cancel := client.context(ctx)
+	defer cancel()
+
+	conn, err := client.Dialer.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+	stop := Deadline(ctx, conn)
+	defer stop()
+
+	query, id, err := Rekey(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	defer FreeBuffer(query)
+
+	_, err = conn.Write(query)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := GetBuffer(4096, 4096)
+	defer FreeBuffer(buf)
+
+	for {
+		size, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		if size < 12 || MessageID(buf) != MessageID(query) {
+			// Discard datagrams that do not answer our query
+			continue
+		}
+
+		var header dnsmessage.Header
+		var parser dnsmessage.Parser
+
+		header, err = parser.Start(buf[:size])
+		if err != nil {
+			return nil, err
+		}
+
+		if header.Truncated {
+			return client.ExchangeStream(ctx, msg, addr)
+		}
+
+		res := append([]byte(nil), buf[:size]...)
+		SetMessageID(res, id)
+
+		return res, nil
+	}
+}
+
+// ExchangeStream sends a query to a server over TCP
+func (client *Client) ExchangeStream(ctx context.Context, msg []byte, addr string) ([]byte, error) {
+	ctx, cancel := client.context(ctx)
+	defer cancel()
+
+	conn, err := client.Dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+	return client.ExchangeConn(ctx, conn, msg)
+}
+
+// ExchangeTLS sends a query to a server over a DNS-over-TLS connection
+func (client *Client) ExchangeTLS(ctx context.Context, msg []byte, addr string) ([]byte, error) {
+	ctx, cancel := client.context(ctx)
+	defer cancel()
+
+	conn, err := client.DialTLS(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+	return client.ExchangeConn(ctx, conn, msg)
+}
+
+// DialTLS opens a DNS-over-TLS connection to a server
+func (client *Client) DialTLS(ctx context.Context, addr string) (net.Conn, error) {
+	dialer := tls.Dialer{NetDialer: &client.Dialer, Config: client.TLSConfig}
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+// ExchangeConn writes a length-framed query to an open stream connection and reads
+// a single length-framed response from it. The response is read with ReadFrame
+func (client *Client) ExchangeConn(ctx context.Context, conn net.Conn, msg []byte) ([]byte, error) {
+	ctx, cancel := client.context(ctx)
+	defer cancel()
+
+	stop := Deadline(ctx, conn)
+	defer stop()
+
+	query, id, err := Rekey(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	defer FreeBuffer(query)
+
+	// Prepend a length header to the query
+	frame := GetBuffer(len(query)+2, len(query)+2)
+	defer FreeBuffer(frame)
+
+	EncodeLength(frame, uint16(len(query)))
+	copy(frame[2:], query)
+
+	_, err = conn.Write(frame)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := ReadFrame(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res) < 12 {
+		FreeBuffer(res)
+		return nil, ErrShortMessage
+	}
+
+	if MessageID(res) != MessageID(query) {
+		FreeBuffer(res)
+		return nil, ErrIDMismatch
+	}
+
+	SetMessageID(res, id)
+	return res, nil
+}
+
+// context applies the Client's Timeout to a Context
+func (client *Client) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, cmp.Or(client.Timeout, DefaultExchangeTimeout))
+}
+
+// MessageID reads the ID field from the header of a wire-format message
+func MessageID(msg []byte) uint16 {
+	return binary.BigEndian.Uint16(msg)
+}
+
+// SetMessageID overwrites the ID field in the header of a wire-format message
+func SetMessageID(msg []byte, id uint16) {
+	binary.BigEndian.PutUint16(msg, id)
+}
+
+// ReadFrame reads a single length-framed message from a stream. The message is read into a buffer
+// from GetBuffer, which the caller may release with FreeBuffer when it is done with the message
+func ReadFrame(conn io.Reader) ([]byte, error) {
+	var head [2]byte
+
+	_, err := io.ReadFull(conn, head[:])
+	if err != nil {
+		return nil, err
+	}
+
+	size := int(DecodeLength(head[:]))
+	msg := GetBuffer(size, size)
+
+	_, err = io.ReadFull(conn, msg)
+	if err != nil {
+		FreeBuffer(msg)
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// Deadline applies a Context's deadline to a connection, and interrupts blocked reads and
+// writes when the Context is canceled. The returned function releases the cancellation monitor
+func Deadline(ctx context.Context, conn net.Conn) (stop func() bool) {
+	if deadline, has := ctx.Deadline(); has {
+		conn.SetDeadline(deadline)
+	}
+
+	return context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+}
+
+// Rekey copies a message into a pooled buffer with a random ID to protect the exchange from
+// spoofed responses. The message's original ID is returned to be restored in the response
+func Rekey(msg []byte) ([]byte, uint16, error) {
+	if len(msg) < 12 {
+		return nil, 0, ErrShortMessage
+	}
+
+	query := GetBuffer(len(msg), len(msg))
+	copy(query, msg)
+
+	id := MessageID(msg)
+	SetMessageID(query, uint16(rand.Uint32()))
+
+	return query, id, nil
+}
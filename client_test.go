@@ -0,0 +1,233 @@
+package dns_test
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ListenPair binds a UDP socket and a TCP listener to the same loopback port. The UDP socket's
+// ephemeral port may already be bound for TCP, so ports are tried until both can be bound
+func ListenPair(t *testing.T) (net.PacketConn, net.Listener) {
+	for range 10 {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		listener, err := net.Listen("tcp", conn.LocalAddr().String())
+		if err != nil {
+			conn.Close()
+			continue
+		}
+
+		t.Cleanup(func() { conn.Close(); listener.Close() })
+		return conn, listener
+	}
+
+	t.Fatal("dns_test: no port is available for both UDP and TCP")
+	return nil, nil
+}
+
+func TestClientQuery(t *testing.T) {
+	conn, listener := ListenPair(t)
+
+	var answers []dnsmessage.Resource
+	for i := range 100 {
+		answers = append(answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: testQuestion.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, byte(i)}},
+		})
+	}
+
+	var mux dns.ServeMux
+	mux.HandleFunc("many.example.com.", dnsmessage.TypeA, func(wr dns.ResponseWriter, req *dns.Request) {
+		dns.WriteAnswer(wr, req, &dns.Answer{Answers: answers})
+	})
+	mux.HandleFunc("*.example.com.", dnsmessage.TypeA, func(wr dns.ResponseWriter, req *dns.Request) {
+		questions, _ := req.Questions()
+		dns.WriteAnswer(wr, req, &dns.Answer{Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+		}}})
+	})
+
+	server := dns.Server{Handler: &mux}
+
+	go server.Serve(conn)
+	go server.ServeStream(listener)
+	defer server.Shutdown(context.Background())
+
+	client := dns.Client{Timeout: time.Second, Server: conn.LocalAddr().String()}
+
+	// Names are made fully qualified
+	records, err := client.Query(context.Background(), "www.example.com", dnsmessage.TypeA)
+	if assert.NoError(t, err) && assert.Len(t, records, 1) {
+		assert.Equal(t, &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}, records[0].Body)
+	}
+
+	// Truncated responses are retried over TCP
+	records, err = client.Query(context.Background(), "many.example.com.", dnsmessage.TypeA)
+	assert.NoError(t, err)
+	assert.Len(t, records, 100)
+
+	_, err = client.Query(context.Background(), "example.org.", dnsmessage.TypeA)
+
+	var rcode *dns.RCodeError
+	if assert.ErrorAs(t, err, &rcode) {
+		assert.Equal(t, dnsmessage.RCodeRefused, rcode.RCode)
+	}
+}
+
+// Echo answers a query by setting the QR bit, and any other header bits in flags, on a copy of it
+func Echo(query []byte, flags byte) []byte {
+	res := append([]byte(nil), query...)
+	res[2] |= 0x80 | flags
+
+	return res
+}
+
+// RawDatagram answers each query received on a UDP socket with the messages returned by respond
+func RawDatagram(t *testing.T, respond func(query []byte) [][]byte) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+	AnswerDatagrams(conn, respond)
+
+	return conn
+}
+
+// AnswerDatagrams answers each query received on a UDP socket with the messages returned by respond
+func AnswerDatagrams(conn net.PacketConn, respond func(query []byte) [][]byte) {
+	go func() {
+		buf := make([]byte, 512)
+
+		for {
+			size, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			for _, msg := range respond(buf[:size]) {
+				conn.WriteTo(msg, from)
+			}
+		}
+	}()
+}
+
+// RawStream answers each framed query received on a TCP listener with the message returned by respond
+func RawStream(t *testing.T, addr string, respond func(query []byte) []byte) net.Listener {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { listener.Close() })
+	AnswerStreams(listener, respond)
+
+	return listener
+}
+
+// AnswerStreams answers each framed query received on a TCP listener with the message returned by respond
+func AnswerStreams(listener net.Listener, respond func(query []byte) []byte) {
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				for {
+					query, err := dns.ReadFrame(conn)
+					if err != nil {
+						return
+					}
+
+					res := respond(query)
+					conn.Write(append([]byte{byte(len(res) >> 8), byte(len(res))}, res...))
+				}
+			}()
+		}
+	}()
+}
+
+func TestClientLostReply(t *testing.T) {
+	client := dns.Client{Timeout: 50 * time.Millisecond}
+	start := time.Now()
+
+	// The Client's Timeout bounds the exchange when the Context has no deadline
+	_, err := client.Exchange(context.Background(), GenerateQuery(42, testQuestion), BlackHole(t))
+
+	var nerr net.Error
+	if assert.ErrorAs(t, err, &nerr) {
+		assert.True(t, nerr.Timeout())
+	}
+
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestClientIDMismatch(t *testing.T) {
+	conn := RawDatagram(t, func(query []byte) [][]byte {
+		spoofed := Echo(query, 0)
+		spoofed[0]++
+
+		return [][]byte{spoofed, Echo(query, 0)}
+	})
+
+	client := dns.Client{Timeout: time.Second}
+
+	// Datagrams with the wrong ID are discarded while waiting for the response
+	res, err := client.Exchange(context.Background(), GenerateQuery(42, testQuestion), conn.LocalAddr().String())
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint16(42), dns.MessageID(res))
+	}
+
+	listener := RawStream(t, "127.0.0.1:0", func(query []byte) []byte {
+		res := Echo(query, 0)
+		res[0]++
+
+		return res
+	})
+
+	// A stream response for another query fails the exchange
+	_, err = client.ExchangeStream(context.Background(), GenerateQuery(42, testQuestion), listener.Addr().String())
+	assert.ErrorIs(t, err, dns.ErrIDMismatch)
+}
+
+func TestClientTruncatedRetry(t *testing.T) {
+	var streamed atomic.Bool
+
+	conn, listener := ListenPair(t)
+
+	AnswerDatagrams(conn, func(query []byte) [][]byte {
+		return [][]byte{Echo(query, 0x02)}
+	})
+
+	AnswerStreams(listener, func(query []byte) []byte {
+		streamed.Store(true)
+		return Echo(query, 0)
+	})
+
+	client := dns.Client{Timeout: time.Second}
+
+	res, err := client.Exchange(context.Background(), GenerateQuery(42, testQuestion), conn.LocalAddr().String())
+	if assert.NoError(t, err) {
+		assert.True(t, streamed.Load())
+		assert.Equal(t, uint16(42), dns.MessageID(res))
+
+		// The response over TCP is not truncated
+		assert.Zero(t, res[2]&0x02)
+	}
+}
@@ -0,0 +1,76 @@
+package dns
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// MaxCNAMEDepth bounds the number of CNAME records that FollowCNAME chases
+const MaxCNAMEDepth = 8
+
+// RecordStore looks up RRsets by owner name and type. The boolean result reports whether the name
+// exists with records of any type. Zone implements RecordStore
+type RecordStore interface {
+	Lookup(name dnsmessage.Name, qtype dnsmessage.Type) ([]dnsmessage.Resource, bool)
+}
+
+// zoneBounded is implemented by RecordStores that are authoritative for a subtree of names
+type zoneBounded interface {
+	Contains(name dnsmessage.Name) bool
+}
+
+var _ RecordStore = &Zone{}
+
+// FollowCNAME builds the answer section for a query, chasing CNAME records to their targets. The
+// answer contains each CNAME in the chain, followed by the target's RRset of the requested type.
+//
+// The rcode describes the last name in the chain (RFC 6604): NXDOMAIN if it does not exist, or
+// NOERROR if it exists or is outside of the store's zone. A chain that loops, or is longer than
+// MaxCNAMEDepth, returns the chain with SERVFAIL
+func FollowCNAME(store RecordStore, name dnsmessage.Name, qtype dnsmessage.Type) ([]dnsmessage.Resource, dnsmessage.RCode) {
+	var answers []dnsmessage.Resource
+
+	bounded, _ := store.(zoneBounded)
+	seen := map[string]bool{}
+
+	for range MaxCNAMEDepth + 1 {
+		seen[CanonicalName(name)] = true
+
+		records, exists := store.Lookup(name, qtype)
+		if len(records) > 0 {
+			return append(answers, records...), dnsmessage.RCodeSuccess
+		}
+
+		if !exists {
+			return answers, dnsmessage.RCodeNameError
+		}
+
+		if qtype == dnsmessage.TypeCNAME {
+			return answers, dnsmessage.RCodeSuccess
+		}
+
+		cnames, _ := store.Lookup(name, dnsmessage.TypeCNAME)
+		if len(cnames) == 0 {
+			// The name exists without records of the requested type
+			return answers, dnsmessage.RCodeSuccess
+		}
+
+		cname, is := cnames[0].Body.(*dnsmessage.CNAMEResource)
+		if !is {
+			return answers, dnsmessage.RCodeServerFailure
+		}
+
+		answers = append(answers, cnames[0])
+		name = cname.CNAME
+
+		if bounded != nil && !bounded.Contains(name) {
+			// The client resolves targets outside of the zone
+			return answers, dnsmessage.RCodeSuccess
+		}
+
+		if seen[CanonicalName(name)] {
+			return answers, dnsmessage.RCodeServerFailure
+		}
+	}
+
+	return answers, dnsmessage.RCodeServerFailure
+}
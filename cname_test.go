@@ -0,0 +1,56 @@
+package dns_test
+
+import (
+	"testing"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func cname(name, target string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET, TTL: 300},
+		Body:   &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(target)},
+	}
+}
+
+func TestFollowCNAME(t *testing.T) {
+	zone, err := dns.NewZone(testSOA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(t, zone.Add(
+		cname("www.example.com.", "web.example.com."),
+		cname("web.example.com.", "host.example.com."),
+		dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("host.example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+		},
+		cname("dangling.example.com.", "missing.example.com."),
+		cname("external.example.com.", "www.example.org."),
+		cname("loop-a.example.com.", "loop-b.example.com."),
+		cname("loop-b.example.com.", "loop-a.example.com."),
+	))
+
+	for _, test := range []struct {
+		name  string
+		qtype dnsmessage.Type
+		count int
+		rcode dnsmessage.RCode
+	}{
+		{"www.example.com.", dnsmessage.TypeA, 3, dnsmessage.RCodeSuccess},
+		{"www.example.com.", dnsmessage.TypeCNAME, 1, dnsmessage.RCodeSuccess},
+		{"www.example.com.", dnsmessage.TypeAAAA, 2, dnsmessage.RCodeSuccess},
+		{"dangling.example.com.", dnsmessage.TypeA, 1, dnsmessage.RCodeNameError},
+		{"external.example.com.", dnsmessage.TypeA, 1, dnsmessage.RCodeSuccess},
+		{"loop-a.example.com.", dnsmessage.TypeA, 2, dnsmessage.RCodeServerFailure},
+		{"nothing.example.com.", dnsmessage.TypeA, 0, dnsmessage.RCodeNameError},
+	} {
+		answers, rcode := dns.FollowCNAME(zone, dnsmessage.MustNewName(test.name), test.qtype)
+
+		assert.Len(t, answers, test.count, test.name)
+		assert.Equal(t, test.rcode, rcode, test.name)
+	}
+}
@@ -0,0 +1,226 @@
+package dns
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Cookie sizes (RFC 7873, section 4)
+const (
+	ClientCookieSize = 8
+	// ServerCookieSize is the size of the server cookies that Cookies generates: a version, three
+	// reserved octets, a timestamp, and a hash, in the layout of RFC 9018
+	ServerCookieSize = 16
+
+	minServerCookieSize = 8
+	maxServerCookieSize = 32
+)
+
+// ErrCookie is returned when a COOKIE option is malformed
+var ErrCookie = errors.New("dns: malformed COOKIE option")
+
+// RCodeBadCookie is the extended RCODE of a response to a query without a valid server cookie. It
+// does not fit in a message header, and is sent with an OPT record (RFC 7873, section 8)
+const RCodeBadCookie dnsmessage.RCode = 23
+
+// DefaultCookieLifetime bounds the age of a valid server cookie when Cookies.Lifetime is zero. Clients
+// receive a fresh cookie with each response, and RFC 9018 recommends accepting cookies for an hour
+const DefaultCookieLifetime = time.Hour
+
+// cookieSkew tolerates server cookies with timestamps in the future, from servers in an anycast set
+// whose clocks differ
+const cookieSkew = 5 * time.Minute
+
+// Cookies generates and validates DNS server cookies (RFC 7873). A server cookie is derived from
+// the client's cookie, the client's IP address, and a timestamp, with a secret that is shared by
+// the servers that a client may reach at an address
+type Cookies struct {
+	// Secret keys the server cookie hash. It should be at least 16 random octets
+	Secret []byte
+
+	// Lifetime bounds the age of a valid server cookie. A zero value uses DefaultCookieLifetime
+	Lifetime time.Duration
+
+	// Enforce answers UDP queries whose COOKIE option does not carry a valid server cookie with
+	// BADCOOKIE and a fresh server cookie, so that the client retries with it (RFC 7873, section
+	// 5.2.3). Spoofed queries do not receive a full response to amplify. Queries over stream
+	// transports, which can not be spoofed, and queries without a COOKIE option are not enforced
+	Enforce bool
+}
+
+// SplitCookie separates the data of a COOKIE option into the client and server cookies. The server
+// cookie is empty if the client has not received one. The boolean result is false if the option
+// is malformed, and the query should be answered with FORMERR
+func SplitCookie(data []byte) (client, server []byte, ok bool) {
+	switch size := len(data); {
+	case size == ClientCookieSize:
+		return data, nil, true
+	case size >= ClientCookieSize+minServerCookieSize && size <= ClientCookieSize+maxServerCookieSize:
+		return data[:ClientCookieSize], data[ClientCookieSize:], true
+	}
+
+	return nil, nil, false
+}
+
+// ServerCookie generates a server cookie for a client cookie and address at a time
+func (cookies *Cookies) ServerCookie(client []byte, addr net.Addr, now time.Time) []byte {
+	cookie := make([]byte, 8, ServerCookieSize)
+	cookie[0] = 1
+	binary.BigEndian.PutUint32(cookie[4:], uint32(now.Unix()))
+
+	return append(cookie, cookies.hash(client, cookie, addr)...)
+}
+
+// Valid checks a server cookie that the client received in an earlier response from this server, or
+// another server with the same Secret
+func (cookies *Cookies) Valid(client, server []byte, addr net.Addr, now time.Time) bool {
+	if len(client) != ClientCookieSize || len(server) != ServerCookieSize || server[0] != 1 {
+		return false
+	}
+
+	// Timestamps are compared with serial number arithmetic (RFC 1982)
+	age := time.Duration(int32(uint32(now.Unix())-binary.BigEndian.Uint32(server[4:]))) * time.Second
+	if age > cookies.lifetime() || age < -cookieSkew {
+		return false
+	}
+
+	return hmac.Equal(server[8:], cookies.hash(client, server[:8], addr))
+}
+
+func (cookies *Cookies) lifetime() time.Duration {
+	if cookies.Lifetime > 0 {
+		return cookies.Lifetime
+	}
+
+	return DefaultCookieLifetime
+}
+
+// hash authenticates a server cookie's header for a client cookie and IP address
+func (cookies *Cookies) hash(client, header []byte, addr net.Addr) []byte {
+	mac := hmac.New(sha256.New, cookies.Secret)
+	mac.Write(client)
+	mac.Write(header)
+
+	if ip, _ := addrParts(addr); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+
+		mac.Write(ip)
+	}
+
+	return mac.Sum(nil)[:ServerCookieSize-8]
+}
+
+// Option returns a COOKIE option with the client's cookie and a fresh server cookie, for a response
+// to a request. The boolean result is false if the request does not have a COOKIE option. Malformed
+// options are returned with an error
+func (cookies *Cookies) Option(req *Request) (dnsmessage.Option, bool, error) {
+	option, _, found, err := cookies.check(req)
+	return option, found, err
+}
+
+// check reads the COOKIE option of a request, and returns an option with a fresh server cookie for
+// the response, and whether the request carries a valid server cookie
+func (cookies *Cookies) check(req *Request) (option dnsmessage.Option, valid, found bool, err error) {
+	edns, found, err := req.ClientEDNS()
+	if err != nil || !found {
+		return option, false, false, err
+	}
+
+	data, found := edns.Cookie()
+	if !found {
+		return option, false, false, nil
+	}
+
+	client, server, ok := SplitCookie(data)
+	if !ok {
+		return option, false, true, ErrCookie
+	}
+
+	now := time.Now()
+
+	cookie := append(append(make([]byte, 0, ClientCookieSize+ServerCookieSize), client...), cookies.ServerCookie(client, req.RemoteAddr, now)...)
+	return dnsmessage.Option{Code: OptionCookie, Data: cookie}, cookies.Valid(client, server, req.RemoteAddr, now), true, nil
+}
+
+// Middleware answers messages without a question that carry a COOKIE option, which clients send to
+// obtain a server cookie before their first query, with NOERROR and a fresh server cookie (RFC 7873,
+// section 5.4). A malformed COOKIE option is answered with FORMERR. When Enforce is set, UDP queries
+// without a valid server cookie are answered with BADCOOKIE. Other messages are passed to the
+// Handler, and the Handler's responses to messages with a COOKIE option carry a fresh server cookie
+func (cookies *Cookies) Middleware(next Handler) Handler {
+	return HandlerFunc(func(wr ResponseWriter, req *Request) {
+		option, valid, found, err := cookies.check(req)
+		switch {
+		case err != nil:
+			WriteError(wr, req, dnsmessage.RCodeFormatError)
+			return
+		case !found:
+			next.ServeDNS(wr, req)
+			return
+		}
+
+		if questions, err := req.Questions(); err == nil && len(questions) == 0 {
+			noQuestion(wr, req, option)
+			return
+		}
+
+		if cookies.Enforce && !valid && req.Transport() == TransportUDP {
+			badCookie(wr, req, option)
+			return
+		}
+
+		edns, _, _ := req.ClientEDNS()
+		header := (&EDNS0{UDPSize: DefaultUDPSize, DO: edns.DO}).ResourceHeader()
+
+		next.ServeDNS(&cookieWriter{wrappedWriter: wrappedWriter{wr}, header: header, option: option}, req)
+	})
+}
+
+// badCookie answers a query with BADCOOKIE and a fresh server cookie, echoing its question
+func badCookie(wr ResponseWriter, req *Request, option dnsmessage.Option) error {
+	edns, found := req.ResponseEDNS(0)
+	if !found {
+		return ErrExtendedRCode
+	}
+
+	header := req.ResponseHeader(RCodeBadCookie)
+	header.RCode, edns.ExtendedRCode = SplitRCode(RCodeBadCookie)
+	edns.Options = []dnsmessage.Option{option}
+
+	return writeEmpty(wr, req, header, edns)
+}
+
+// cookieWriter adds a server cookie to the OPT record of each response, or adds an OPT record with
+// a header to responses without one
+type cookieWriter struct {
+	wrappedWriter
+
+	header dnsmessage.ResourceHeader
+	option dnsmessage.Option
+}
+
+// SendBuilder finalizes a Builder, and sends the resulting message with the server cookie
+func (wr *cookieWriter) SendBuilder(builder *dnsmessage.Builder) {
+	wr.sendBuilder(wr.SendMessage, builder)
+}
+
+// SendMessage adds the server cookie to a message, and sends it. Messages sent directly with Send
+// are not modified, as they may include transport framing. Messages that cannot be parsed are sent
+// without the server cookie
+func (wr *cookieWriter) SendMessage(msg []byte) {
+	cookied, err := appendOption(msg, wr.header, wr.option)
+	if err != nil {
+		wr.ResponseWriter.SendMessage(msg)
+		return
+	}
+
+	wr.ResponseWriter.SendMessage(cookied)
+}
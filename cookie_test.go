@@ -0,0 +1,165 @@
+package dns_test
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestServerCookie(t *testing.T) {
+	cookies := dns.Cookies{Secret: []byte("0123456789abcdef")}
+
+	client := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	addr := &net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 5353}
+	now := time.Now()
+
+	server := cookies.ServerCookie(client, addr, now)
+	assert.Len(t, server, dns.ServerCookieSize)
+	assert.True(t, cookies.Valid(client, server, addr, now.Add(time.Minute)))
+
+	// Cookies are bound to the client's cookie and address, and expire
+	assert.False(t, cookies.Valid([]byte{8, 7, 6, 5, 4, 3, 2, 1}, server, addr, now))
+	assert.False(t, cookies.Valid(client, server, &net.UDPAddr{IP: net.IP{192, 0, 2, 2}}, now))
+	assert.False(t, cookies.Valid(client, server, addr, now.Add(2*time.Hour)))
+
+	// Servers that share a secret accept each other's cookies
+	other := dns.Cookies{Secret: cookies.Secret}
+	assert.True(t, other.Valid(client, server, addr, now))
+
+	_, _, ok := dns.SplitCookie(append(client, 1, 2, 3))
+	assert.False(t, ok)
+}
+
+func TestCookieProbe(t *testing.T) {
+	cookies := dns.Cookies{Secret: []byte("0123456789abcdef")}
+
+	var handled int
+	handler := cookies.Middleware(dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+		handled++
+		dns.NoQuestion(wr, req)
+	}))
+
+	client := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	// A cookie-only probe receives a server cookie
+	res := Exchange(t, handler, GenerateProbe(1, dnsmessage.Option{Code: dns.OptionCookie, Data: client}))
+	assert.Equal(t, dnsmessage.RCodeSuccess, res.RCode)
+	assert.Zero(t, handled)
+
+	if assert.Len(t, res.Additionals, 1) {
+		options := res.Additionals[0].Body.(*dnsmessage.OPTResource).Options
+		if assert.Len(t, options, 1) {
+			assert.Equal(t, dns.OptionCookie, options[0].Code)
+
+			received, server, ok := dns.SplitCookie(options[0].Data)
+			assert.True(t, ok)
+			assert.Equal(t, client, received)
+			assert.Len(t, server, dns.ServerCookieSize)
+		}
+	}
+
+	// Malformed cookies are answered with FORMERR
+	res = Exchange(t, handler, GenerateProbe(2, dnsmessage.Option{Code: dns.OptionCookie, Data: client[:5]}))
+	assert.Equal(t, dnsmessage.RCodeFormatError, res.RCode)
+
+	// Probes without a cookie, and queries, are passed to the Handler
+	Exchange(t, handler, GenerateProbe(3))
+	Exchange(t, handler, GenerateEDNSQuery(4, 1232, dnsmessage.Option{Code: dns.OptionCookie, Data: client}))
+	assert.Equal(t, 2, handled)
+}
+
+func TestCookieUnparsable(t *testing.T) {
+	cookies := dns.Cookies{Secret: []byte("0123456789abcdef")}
+	handler := cookies.Middleware(dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+		wr.SendMessage([]byte("unparsable"))
+	}))
+
+	req, err := dns.ParseRequest(context.Background(), GenerateEDNSQuery(1, 1232, dnsmessage.Option{Code: dns.OptionCookie, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Messages that cannot be parsed are sent without the server cookie
+	wr := dns.NewMessageWriter(nil)
+	handler.ServeDNS(wr, req)
+	assert.Equal(t, []byte("unparsable"), wr.Bytes())
+}
+
+func TestCookieEnforcement(t *testing.T) {
+	cookies := dns.Cookies{Secret: []byte("0123456789abcdef"), Enforce: true}
+
+	var handled atomic.Int32
+	server := dns.Server{Handler: cookies.Middleware(dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+		handled.Add(1)
+		dns.Refused(wr, req)
+	}))}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go server.Serve(conn)
+	defer server.CloseAll()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(time.Second))
+
+	exchange := func(query []byte) (res dnsmessage.Message, cookie []byte) {
+		client.Write(query)
+
+		buf := make([]byte, 1232)
+		size, err := client.Read(buf)
+		if !assert.NoError(t, err) || !assert.NoError(t, res.Unpack(buf[:size])) {
+			t.FailNow()
+		}
+
+		for _, additional := range res.Additionals {
+			if additional.Header.Type == dnsmessage.TypeOPT {
+				cookie, _ = dns.ParseEDNS0(additional).Cookie()
+			}
+		}
+
+		return
+	}
+
+	clientCookie := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	// UDP queries without a server cookie receive BADCOOKIE and a server cookie to retry with
+	res, cookie := exchange(GenerateEDNSQuery(1, 1232, dnsmessage.Option{Code: dns.OptionCookie, Data: clientCookie}))
+	if assert.Len(t, res.Additionals, 1) {
+		assert.Equal(t, dns.RCodeBadCookie, dns.ParseEDNS0(res.Additionals[0]).RCode(res.RCode))
+		assert.Equal(t, []dnsmessage.Question{testQuestion}, res.Questions)
+	}
+
+	assert.Len(t, cookie, dns.ClientCookieSize+dns.ServerCookieSize)
+	assert.Zero(t, handled.Load())
+
+	// The retry is handled, and the response carries a fresh server cookie
+	res, cookie = exchange(GenerateEDNSQuery(2, 1232, dnsmessage.Option{Code: dns.OptionCookie, Data: cookie}))
+	assert.Equal(t, dnsmessage.RCodeRefused, res.RCode)
+	assert.Equal(t, clientCookie, cookie[:dns.ClientCookieSize])
+	assert.Equal(t, int32(1), handled.Load())
+
+	// Queries without a COOKIE option are not enforced
+	res, cookie = exchange(GenerateQuery(3, testQuestion))
+	assert.Equal(t, dnsmessage.RCodeRefused, res.RCode)
+	assert.Nil(t, cookie)
+	assert.Equal(t, int32(2), handled.Load())
+
+	// Queries over other transports are not enforced
+	res = Exchange(t, server.Handler, GenerateEDNSQuery(4, 1232, dnsmessage.Option{Code: dns.OptionCookie, Data: clientCookie}))
+	assert.Equal(t, dnsmessage.RCodeRefused, res.RCode)
+	assert.Equal(t, int32(3), handled.Load())
+}
@@ -0,0 +1,118 @@
+package dns
+
+import (
+	"container/list"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DefaultDedupWindow bounds how long a query is considered in-flight for deduplication
+const DefaultDedupWindow = 2 * time.Second
+
+// maxInflight bounds the number of queries tracked for deduplication
+const maxInflight = 1 << 16
+
+// inflight tracks UDP queries that are being handled, to absorb client retransmissions. Entries are
+// ordered by the time that they started, so that expired entries are evicted from the front of the
+// order without scanning the table
+type inflight struct {
+	entries map[string]*list.Element
+	order   list.List
+	next    uint64
+	sync.Mutex
+}
+
+// inflightEntry records when a query started, and the token of the request that is handling it
+type inflightEntry struct {
+	key     string
+	started time.Time
+	token   uint64
+}
+
+// begin records a query as in-flight, and returns a token to end it with. It returns false if an
+// identical query is already in-flight and was started less than window ago. The token is zero if
+// the query is not tracked
+func (inf *inflight) begin(key string, window time.Duration) (uint64, bool) {
+	inf.Lock()
+	defer inf.Unlock()
+
+	now := time.Now()
+
+	if elem, has := inf.entries[key]; has {
+		if now.Sub(elem.Value.(*inflightEntry).started) < window {
+			return 0, false
+		}
+
+		inf.remove(elem)
+	}
+
+	if inf.entries == nil {
+		inf.entries = map[string]*list.Element{}
+	}
+
+	// Evict expired entries, which are the oldest
+	for oldest := inf.order.Front(); oldest != nil && now.Sub(oldest.Value.(*inflightEntry).started) >= window; oldest = inf.order.Front() {
+		inf.remove(oldest)
+	}
+
+	if len(inf.entries) >= maxInflight {
+		// The table is full of fresh entries. Handle the query without tracking it
+		return 0, true
+	}
+
+	inf.next++
+	inf.entries[key] = inf.order.PushBack(&inflightEntry{key: key, started: now, token: inf.next})
+
+	return inf.next, true
+}
+
+func (inf *inflight) remove(elem *list.Element) {
+	inf.order.Remove(elem)
+	delete(inf.entries, elem.Value.(*inflightEntry).key)
+}
+
+// end removes a query from the in-flight table, unless a later request for the same query has
+// replaced its entry after the window expired
+func (inf *inflight) end(key string, token uint64) {
+	inf.Lock()
+	defer inf.Unlock()
+
+	if elem, has := inf.entries[key]; has && elem.Value.(*inflightEntry).token == token {
+		inf.remove(elem)
+	}
+}
+
+// dedupKey identifies a query by its client address, message ID, and first question. The
+// boolean result is false if the message's question could not be parsed
+func dedupKey(from net.Addr, msg []byte) (string, bool) {
+	var parser dnsmessage.Parser
+
+	header, err := parser.Start(msg)
+	if err != nil {
+		return "", false
+	}
+
+	question, err := parser.Question()
+	if err != nil {
+		return "", false
+	}
+
+	var key strings.Builder
+
+	key.WriteString(from.String())
+	key.WriteByte('|')
+	key.WriteString(strconv.FormatUint(uint64(header.ID), 16))
+	key.WriteByte('|')
+	key.WriteString(question.Name.String())
+	key.WriteByte('|')
+	key.WriteString(strconv.FormatUint(uint64(question.Type), 16))
+	key.WriteByte('|')
+	key.WriteString(strconv.FormatUint(uint64(question.Class), 16))
+
+	return key.String(), true
+}
@@ -0,0 +1,93 @@
+package dns_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedupRetries(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each call to the Handler blocks until it is released
+	calls := make(chan chan struct{}, 8)
+	returned := make(chan struct{}, 8)
+
+	server := dns.Server{
+		DedupRetries: true,
+		DedupWindow:  200 * time.Millisecond,
+		Handler: dns.HandlerFunc(func(dns.ResponseWriter, *dns.Request) {
+			release := make(chan struct{})
+			calls <- release
+
+			<-release
+			returned <- struct{}{}
+		}),
+	}
+
+	go server.Serve(conn)
+	defer server.Shutdown(context.Background())
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+
+	query := GenerateQuery(42, testQuestion)
+	send := func() {
+		_, err := client.Write(query)
+		assert.NoError(t, err)
+	}
+
+	received := func() chan struct{} {
+		select {
+		case release := <-calls:
+			return release
+		case <-time.After(time.Second):
+			t.Fatal("query was not handled")
+		}
+
+		return nil
+	}
+
+	send()
+	first := received()
+
+	// Retransmissions are dropped while the query is in-flight
+	send()
+	time.Sleep(20 * time.Millisecond)
+	assert.Empty(t, calls)
+	assert.Equal(t, uint64(1), server.Stats.Duplicates.Load())
+
+	// A retransmission after the window is handled again
+	time.Sleep(250 * time.Millisecond)
+
+	send()
+	second := received()
+
+	// The first request ending does not clear the second request's entry
+	close(first)
+	<-returned
+
+	send()
+	time.Sleep(20 * time.Millisecond)
+	assert.Empty(t, calls)
+	assert.Equal(t, uint64(2), server.Stats.Duplicates.Load())
+
+	close(second)
+	<-returned
+
+	// Queries are handled again once they are no longer in-flight
+	send()
+	close(received())
+	<-returned
+}
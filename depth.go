@@ -0,0 +1,63 @@
+package dns
+
+import (
+	"encoding/binary"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// NameDepth counts the labels of the first question's name in a wire-format message, without
+// parsing the message. The boolean result is false if the message does not have a question, or
+// its name is malformed
+func NameDepth(msg []byte) (int, bool) {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg[4:]) == 0 {
+		return 0, false
+	}
+
+	var depth int
+	for off := 12; off < len(msg); {
+		size := int(msg[off])
+		switch {
+		case size == 0:
+			return depth, true
+		case size&0xC0 != 0:
+			// A question's name is the first in the message, and has nothing to refer to
+			return depth, false
+		}
+
+		depth++
+		off += size + 1
+	}
+
+	return depth, false
+}
+
+// tooDeep responds with FORMERR to a query whose question has more labels than MaxNameDepth. The
+// response does not echo the question, so that the name is not parsed
+func (server *Server) tooDeep(wr ResponseWriter, req *Request) bool {
+	if server.MaxNameDepth <= 0 {
+		return false
+	}
+
+	depth, _ := NameDepth(req.msg)
+	if req.parser != nil {
+		depth = 0
+
+		// Messages in a non-standard encoding are measured by their parsed question
+		if questions, err := req.Questions(); err == nil && len(questions) > 0 && questions[0].Name.String() != "." {
+			depth = strings.Count(questions[0].Name.String(), ".")
+		}
+	}
+
+	if depth <= server.MaxNameDepth {
+		return false
+	}
+
+	server.Stats.DeepNames.Add(1)
+
+	res := wr.Builder(req.ResponseHeader(dnsmessage.RCodeFormatError))
+	wr.SendBuilder(&res)
+
+	return true
+}
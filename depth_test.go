@@ -0,0 +1,60 @@
+package dns_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestNameDepth(t *testing.T) {
+	depth, ok := dns.NameDepth(GenerateQuery(1, testQuestion))
+	assert.True(t, ok)
+	assert.Equal(t, 3, depth)
+
+	root := dnsmessage.Question{Name: dnsmessage.MustNewName("."), Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET}
+
+	depth, ok = dns.NameDepth(GenerateQuery(1, root))
+	assert.True(t, ok)
+	assert.Zero(t, depth)
+
+	// A message without a question, and a name that runs past the end of the message
+	_, ok = dns.NameDepth(GenerateQuery(1))
+	assert.False(t, ok)
+
+	_, ok = dns.NameDepth(GenerateQuery(1, testQuestion)[:16])
+	assert.False(t, ok)
+}
+
+func TestMaxNameDepth(t *testing.T) {
+	// The deepest name that fits in 255 octets: 127 single-character labels
+	deep := dnsmessage.Question{Name: dnsmessage.MustNewName(strings.Repeat("a.", 127)), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+
+	var handled int
+
+	server := dns.Server{
+		MaxNameDepth: 32,
+		Handler: dns.HandlerFunc(func(dns.ResponseWriter, *dns.Request) {
+			handled++
+		}),
+	}
+
+	var conn CapturePacketConn
+	for id, question := range []dnsmessage.Question{deep, testQuestion} {
+		req := &dns.Request{}
+		server.Handle(server.Context(), GenerateQuery(uint16(id), question), &dns.PacketWriter{PacketConn: &conn, Request: req}, req)
+	}
+
+	assert.Equal(t, 1, handled)
+	assert.Equal(t, uint64(1), server.Stats.DeepNames.Load())
+
+	if assert.Len(t, conn.sent, 1) {
+		var res dnsmessage.Message
+		if assert.NoError(t, res.Unpack(conn.sent[0])) {
+			assert.Equal(t, dnsmessage.RCodeFormatError, res.RCode)
+			assert.Empty(t, res.Questions)
+		}
+	}
+}
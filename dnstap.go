@@ -0,0 +1,373 @@
+package dns
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DnstapContentType identifies dnstap payloads in a frame stream
+const DnstapContentType = "protobuf:dnstap.Dnstap"
+
+// Frame stream control frame types
+const (
+	fstrmAccept uint32 = 1
+	fstrmStart  uint32 = 2
+	fstrmStop   uint32 = 3
+	fstrmReady  uint32 = 4
+	fstrmFinish uint32 = 5
+
+	fstrmContentType uint32 = 1
+)
+
+// ErrFrameStream is returned when a dnstap collector does not complete the frame stream handshake
+var ErrFrameStream = errors.New("dns: unexpected frame stream control frame")
+
+// DnstapWriter encodes tapped messages as dnstap (https://dnstap.info) protobuf payloads, and writes
+// them to a frame stream on a Unix socket or in a file. Socket connections are re-established after
+// a failure. Events are queued, and are dropped when the queue is full or the socket is disconnected
+type DnstapWriter struct {
+	// Path is the Unix socket or file that frames are written to
+	Path string
+	// File writes a unidirectional frame stream to a file at Path, instead of a Unix socket
+	File bool
+
+	// Identity and Version identify the server in each payload
+	Identity []byte
+	Version  []byte
+
+	// Authoritative logs AUTH_QUERY and AUTH_RESPONSE messages. CLIENT_QUERY and CLIENT_RESPONSE
+	// messages are logged by default
+	Authoritative bool
+
+	// Buffer is the number of events that can be queued. A zero value uses 1024
+	Buffer int
+	// RetryInterval is the time to wait before reconnecting to the socket. A zero value uses one second
+	RetryInterval time.Duration
+
+	// Dropped counts events that were not written
+	Dropped atomic.Uint64
+
+	once    sync.Once
+	closing sync.Once
+	events  chan []byte
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// Dnstap writes the Server's queries and responses to a dnstap collector's Unix socket. The writer
+// is closed by Shutdown
+func (server *Server) Dnstap(path string) *DnstapWriter {
+	writer := &DnstapWriter{Path: path}
+	server.Tap = writer.Tap
+
+	if !server.AddCloser(writer) {
+		writer.Close()
+	}
+
+	return writer
+}
+
+func (writer *DnstapWriter) start() {
+	writer.once.Do(func() {
+		writer.events = make(chan []byte, cmp.Or(writer.Buffer, 1024))
+		writer.done = make(chan struct{})
+		writer.stopped = make(chan struct{})
+
+		go writer.run()
+	})
+}
+
+// Tap encodes an event and queues it to be written
+func (writer *DnstapWriter) Tap(event TapEvent) {
+	writer.start()
+
+	select {
+	case <-writer.done:
+		writer.Dropped.Add(1)
+	case writer.events <- writer.encode(event):
+	default:
+		writer.Dropped.Add(1)
+	}
+}
+
+// Close stops the frame stream and closes the socket or file
+func (writer *DnstapWriter) Close() error {
+	writer.start()
+	writer.closing.Do(func() { close(writer.done) })
+
+	<-writer.stopped
+	return nil
+}
+
+func (writer *DnstapWriter) run() {
+	defer close(writer.stopped)
+
+	retry := writer.RetryInterval
+	if retry == 0 {
+		retry = time.Second
+	}
+
+	for {
+		conn, err := writer.open()
+		if err == nil {
+			err = writer.stream(conn)
+			conn.Close()
+
+			if err == nil {
+				return
+			}
+		}
+
+		select {
+		case <-writer.done:
+			return
+		case <-time.After(retry):
+		}
+	}
+}
+
+// open connects to the collector and completes the frame stream handshake
+func (writer *DnstapWriter) open() (io.ReadWriteCloser, error) {
+	if writer.File {
+		file, err := os.OpenFile(writer.Path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = file.Write(controlFrame(fstrmStart, true))
+		return file, err
+	}
+
+	conn, err := net.Dial("unix", writer.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Write(controlFrame(fstrmReady, true))
+	if err == nil {
+		err = expectControl(conn, fstrmAccept)
+	}
+
+	if err == nil {
+		_, err = conn.Write(controlFrame(fstrmStart, true))
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// stream writes queued payloads until the writer is closed, or a write fails
+func (writer *DnstapWriter) stream(conn io.ReadWriter) error {
+	for {
+		select {
+		case <-writer.done:
+			// Write the events that were queued before the writer was closed
+			for len(writer.events) > 0 {
+				err := writer.write(conn, <-writer.events)
+				if err != nil {
+					return nil
+				}
+			}
+
+			_, err := conn.Write(controlFrame(fstrmStop, false))
+			if err == nil && !writer.File {
+				if deadline, is := conn.(interface{ SetReadDeadline(time.Time) error }); is {
+					deadline.SetReadDeadline(time.Now().Add(time.Second))
+				}
+
+				expectControl(conn, fstrmFinish)
+			}
+
+			return nil
+
+		case payload := <-writer.events:
+			err := writer.write(conn, payload)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// write sends a payload in a data frame
+func (writer *DnstapWriter) write(conn io.Writer, payload []byte) error {
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+
+	_, err := conn.Write(append(frame, payload...))
+	if err != nil {
+		writer.Dropped.Add(1)
+	}
+
+	return err
+}
+
+// controlFrame encodes a frame stream control frame, optionally with the dnstap content type
+func controlFrame(ctype uint32, content bool) []byte {
+	body := binary.BigEndian.AppendUint32(nil, ctype)
+	if content {
+		body = binary.BigEndian.AppendUint32(body, fstrmContentType)
+		body = binary.BigEndian.AppendUint32(body, uint32(len(DnstapContentType)))
+		body = append(body, DnstapContentType...)
+	}
+
+	// Control frames are escaped with a zero length
+	frame := binary.BigEndian.AppendUint32(nil, 0)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(body)))
+
+	return append(frame, body...)
+}
+
+// expectControl reads a control frame and checks its type
+func expectControl(conn io.Reader, ctype uint32) error {
+	var head [8]byte
+
+	_, err := io.ReadFull(conn, head[:])
+	if err != nil {
+		return err
+	}
+
+	size := binary.BigEndian.Uint32(head[4:])
+	if binary.BigEndian.Uint32(head[:]) != 0 || size < 4 || size > 512 {
+		return ErrFrameStream
+	}
+
+	body := make([]byte, size)
+
+	_, err = io.ReadFull(conn, body)
+	if err != nil {
+		return err
+	}
+
+	if binary.BigEndian.Uint32(body) != ctype {
+		return ErrFrameStream
+	}
+
+	return nil
+}
+
+// dnstap message types and socket enumerations
+const (
+	dnstapAuthQuery      = 1
+	dnstapAuthResponse   = 2
+	dnstapClientQuery    = 5
+	dnstapClientResponse = 6
+
+	dnstapINET  = 1
+	dnstapINET6 = 2
+)
+
+var dnstapProtocols = map[string]uint64{
+	TransportUDP:   1,
+	TransportTCP:   2,
+	TransportTLS:   3,
+	TransportHTTPS: 4,
+	TransportQUIC:  7,
+}
+
+// encode serializes an event as a dnstap.Dnstap protobuf message
+func (writer *DnstapWriter) encode(event TapEvent) []byte {
+	var msg []byte
+
+	mtype := uint64(dnstapClientQuery)
+	if writer.Authoritative {
+		mtype = dnstapAuthQuery
+	}
+
+	if event.Kind == TapResponse {
+		mtype++
+	}
+
+	msg = appendVarintField(msg, 1, mtype)
+
+	// The client is the query address, and the server is the response address
+	query, qport := addrParts(event.RemoteAddr)
+	response, rport := addrParts(event.LocalAddr)
+
+	if ip4 := query.To4(); ip4 != nil {
+		msg = appendVarintField(msg, 2, dnstapINET)
+		query, response = ip4, response.To4()
+	} else if query != nil {
+		msg = appendVarintField(msg, 2, dnstapINET6)
+	}
+
+	if protocol, has := dnstapProtocols[event.Transport]; has {
+		msg = appendVarintField(msg, 3, protocol)
+	}
+
+	if query != nil {
+		msg = appendBytesField(msg, 4, query)
+		msg = appendVarintField(msg, 6, uint64(qport))
+	}
+
+	if response != nil {
+		msg = appendBytesField(msg, 5, response)
+		msg = appendVarintField(msg, 7, uint64(rport))
+	}
+
+	if !event.QueryTime.IsZero() {
+		msg = appendVarintField(msg, 8, uint64(event.QueryTime.Unix()))
+		msg = appendFixed32Field(msg, 9, uint32(event.QueryTime.Nanosecond()))
+	}
+
+	if event.Kind == TapQuery {
+		msg = appendBytesField(msg, 10, event.Message)
+	} else {
+		msg = appendVarintField(msg, 12, uint64(event.ResponseTime.Unix()))
+		msg = appendFixed32Field(msg, 13, uint32(event.ResponseTime.Nanosecond()))
+		msg = appendBytesField(msg, 14, event.Message)
+	}
+
+	var frame []byte
+	if writer.Identity != nil {
+		frame = appendBytesField(frame, 1, writer.Identity)
+	}
+
+	if writer.Version != nil {
+		frame = appendBytesField(frame, 2, writer.Version)
+	}
+
+	frame = appendBytesField(frame, 14, msg)
+
+	// The Dnstap frame's type is always MESSAGE
+	return appendVarintField(frame, 15, 1)
+}
+
+func addrParts(addr net.Addr) (net.IP, int) {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP, addr.Port
+	case *net.TCPAddr:
+		return addr.IP, addr.Port
+	}
+
+	return nil, 0
+}
+
+// Protobuf wire encoding
+func appendVarintField(buf []byte, field int, value uint64) []byte {
+	buf = binary.AppendUvarint(buf, uint64(field)<<3)
+	return binary.AppendUvarint(buf, value)
+}
+
+func appendBytesField(buf []byte, field int, value []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(field)<<3|2)
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+
+	return append(buf, value...)
+}
+
+func appendFixed32Field(buf []byte, field int, value uint32) []byte {
+	buf = binary.AppendUvarint(buf, uint64(field)<<3|5)
+	return binary.LittleEndian.AppendUint32(buf, value)
+}
@@ -0,0 +1,114 @@
+package dns_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// ReadFrame reads a frame stream frame, and returns its control type if it is a control frame
+func ReadFstrm(t *testing.T, conn io.Reader) (uint32, []byte) {
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	size := binary.BigEndian.Uint32(head[:])
+	control := size == 0
+
+	if control {
+		if _, err := io.ReadFull(conn, head[:]); err != nil {
+			t.Fatal(err)
+		}
+
+		size = binary.BigEndian.Uint32(head[:])
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		t.Fatal(err)
+	}
+
+	if control {
+		return binary.BigEndian.Uint32(body), body
+	}
+
+	return 0, body
+}
+
+func TestDnstap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnstap.sock")
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer listener.Close()
+
+	payloads := make(chan [][]byte)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		ctype, body := ReadFstrm(t, conn)
+		assert.Equal(t, uint32(4), ctype)
+		assert.Contains(t, string(body), dns.DnstapContentType)
+
+		// ACCEPT
+		conn.Write([]byte{0, 0, 0, 0, 0, 0, 0, 4, 0, 0, 0, 1})
+
+		ctype, _ = ReadFstrm(t, conn)
+		assert.Equal(t, uint32(2), ctype)
+
+		var received [][]byte
+		for {
+			ctype, body := ReadFstrm(t, conn)
+			if ctype == 3 {
+				break
+			}
+
+			received = append(received, body)
+		}
+
+		// FINISH
+		conn.Write([]byte{0, 0, 0, 0, 0, 0, 0, 4, 0, 0, 0, 5})
+		payloads <- received
+	}()
+
+	server := dns.Server{Handler: dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) { dns.ServerFailure(wr, req) })}
+	writer := server.Dnstap(path)
+
+	query := GenerateQuery(42, testQuestion)
+	wr := dns.NewMessageWriter(nil)
+
+	server.Handle(context.Background(), query, wr, &dns.Request{
+		LocalAddr:  &net.UDPAddr{IP: net.IPv4(192, 0, 2, 53), Port: 53},
+		RemoteAddr: &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 40000},
+	})
+
+	assert.NoError(t, server.Shutdown(context.Background()))
+
+	received := <-payloads
+	if assert.Len(t, received, 2) {
+		assert.True(t, bytes.Contains(received[0], query))
+		assert.True(t, bytes.Contains(received[1], wr.Bytes()))
+
+		// Client address
+		assert.True(t, bytes.Contains(received[0], []byte{198, 51, 100, 1}))
+	}
+
+	assert.Zero(t, writer.Dropped.Load())
+}
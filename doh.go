@@ -0,0 +1,130 @@
+package dns
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// TransportHTTPS names the DNS-over-HTTPS transport
+const TransportHTTPS = "https"
+
+// maxHTTPMessageSize bounds the size of a DNS-over-HTTPS request body
+const maxHTTPMessageSize = 65535
+
+// DoHHandler exposes a Handler over DNS-over-HTTPS with a Server's default policies. See ServeHTTP
+func DoHHandler(handler Handler) http.Handler {
+	return &Server{Handler: handler}
+}
+
+// ServeHTTP answers DNS-over-HTTPS (RFC 8484) queries with the Server's Handler. Queries are sent
+// with GET, in the base64url-encoded dns parameter, or POSTed as application/dns-message bodies.
+// Malformed and oversized queries are rejected with 400, and other methods with 405. Responses
+// that may be cached carry a Cache-Control max-age of their least TTL (RFC 8484, section 5.1).
+//
+// HTTP carries messages of any size, so responses are not truncated to the UDP payload size that
+// a client advertises in its OPT record, unless DoHRespectEDNSSize is set
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var msg []byte
+	var err error
+
+	switch r.Method {
+	case http.MethodGet:
+		msg, err = decodeDoHQuery(r.URL.Query().Get("dns"))
+
+	case http.MethodPost:
+		msg, err = io.ReadAll(io.LimitReader(r.Body, maxHTTPMessageSize+1))
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	if err != nil || len(msg) == 0 || len(msg) > maxHTTPMessageSize {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	ctx := ContextWithRecursion(ContextWithRefusal(r.Context(), server.DefaultRefusal), server.RecursionAvailable)
+	req := &Request{ctx: ctx, transport: TransportHTTPS}
+
+	req.LocalAddr, _ = r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		req.RemoteAddr = addr
+	}
+
+	wr := &httpWriter{Request: req, RespectEDNSSize: server.DoHRespectEDNSSize}
+	server.Handle(ctx, msg, wr, req)
+
+	if len(wr.buf) == 0 {
+		// The Handler dropped the query, or it could not be parsed
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", MediaType)
+	if ttl, _, cacheable := cacheTTL(wr.buf); cacheable {
+		w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(ttl.Seconds())))
+	}
+
+	w.Write(wr.buf)
+}
+
+// decodeDoHQuery decodes the dns parameter of a GET request. RFC 8484 omits padding, but padded
+// values are accepted. The parameter's size is bounded by the http.Server's MaxHeaderBytes
+func decodeDoHQuery(param string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(param, "="))
+}
+
+// httpWriter captures a DNS-over-HTTPS response, optionally truncating it to the request's
+// advertised UDP payload size
+type httpWriter struct {
+	BufferWriter
+
+	Request         *Request
+	RespectEDNSSize bool
+}
+
+// SendBuilder finalizes a Builder and captures the resulting message
+func (wr *httpWriter) SendBuilder(builder *dnsmessage.Builder) {
+	msg, err := builder.Finish()
+	if err != nil {
+		panic(err)
+	}
+
+	wr.SendMessage(msg)
+	packetBuilders.Free(msg)
+}
+
+// Send captures a message. An HTTP response carries a single message, so messages sent after the
+// first are discarded
+func (wr *httpWriter) Send(msg []byte) {
+	if len(wr.buf) > 0 {
+		return
+	}
+
+	wr.BufferWriter.Send(msg)
+}
+
+// SendMessage captures a complete message, truncating it to the payload size advertised in the
+// request's OPT record when RespectEDNSSize is set. Messages that can not be parsed are captured as
+// they are
+func (wr *httpWriter) SendMessage(msg []byte) {
+	if wr.RespectEDNSSize {
+		if _, found, _ := wr.Request.OPT(); found {
+			truncated, _, err := Truncate(msg, wr.Request.UDPSize())
+			if err == nil {
+				msg = truncated
+			}
+		}
+	}
+
+	wr.Send(msg)
+}
@@ -0,0 +1,149 @@
+package dns_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestDoHRespectEDNSSize(t *testing.T) {
+	server := dns.Server{
+		Handler: dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+			answer := dns.Answer{}
+			for i := range 100 {
+				answer.Answers = append(answer.Answers, dnsmessage.Resource{
+					Header: dnsmessage.ResourceHeader{Name: testQuestion.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+					Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, byte(i)}},
+				})
+			}
+
+			assert.Equal(t, dns.TransportHTTPS, req.Transport())
+			dns.WriteAnswer(wr, req, &answer)
+		}),
+	}
+
+	endpoint := httptest.NewServer(&server)
+	defer endpoint.Close()
+
+	exchange := func() (res dnsmessage.Message) {
+		post, err := http.Post(endpoint.URL, dns.MediaType, bytes.NewReader(GenerateEDNSQuery(42, 512)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer post.Body.Close()
+		assert.Equal(t, dns.MediaType, post.Header.Get("Content-Type"))
+
+		body, err := io.ReadAll(post.Body)
+		if assert.NoError(t, err) {
+			assert.NoError(t, res.Unpack(body))
+		}
+
+		return
+	}
+
+	// Responses are not truncated to the advertised UDP payload size by default
+	res := exchange()
+	assert.False(t, res.Truncated)
+	assert.Len(t, res.Answers, 100)
+
+	server.DoHRespectEDNSSize = true
+
+	res = exchange()
+	assert.True(t, res.Truncated)
+	assert.Less(t, len(res.Answers), 100)
+
+	put, err := http.NewRequest(http.MethodPut, endpoint.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rejected, err := http.DefaultClient.Do(put)
+	if assert.NoError(t, err) {
+		rejected.Body.Close()
+		assert.Equal(t, http.StatusMethodNotAllowed, rejected.StatusCode)
+	}
+}
+
+func TestDoHHandler(t *testing.T) {
+	endpoint := httptest.NewServer(dns.DoHHandler(dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+		dns.WriteAnswer(wr, req, &dns.Answer{Answers: []dnsmessage.Resource{
+			{
+				Header: dnsmessage.ResourceHeader{Name: testQuestion.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+				Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+			},
+			{
+				Header: dnsmessage.ResourceHeader{Name: testQuestion.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 2}},
+			},
+		}})
+	})))
+	defer endpoint.Close()
+
+	status := func(res *http.Response, err error) int {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// GET queries are base64url-encoded without padding
+	get, err := http.Get(endpoint.URL + "?dns=" + base64.RawURLEncoding.EncodeToString(GenerateQuery(42, testQuestion)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer get.Body.Close()
+	assert.Equal(t, http.StatusOK, get.StatusCode)
+	assert.Equal(t, dns.MediaType, get.Header.Get("Content-Type"))
+
+	// Responses may be cached for their least TTL
+	assert.Equal(t, "max-age=60", get.Header.Get("Cache-Control"))
+
+	body, err := io.ReadAll(get.Body)
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint16(42), dns.MessageID(body))
+	}
+
+	assert.Equal(t, http.StatusOK, status(http.Post(endpoint.URL, dns.MediaType, bytes.NewReader(GenerateQuery(43, testQuestion)))))
+
+	// Malformed and oversized queries are rejected
+	assert.Equal(t, http.StatusBadRequest, status(http.Get(endpoint.URL+"?dns=not*base64")))
+	assert.Equal(t, http.StatusBadRequest, status(http.Get(endpoint.URL)))
+	assert.Equal(t, http.StatusBadRequest, status(http.Post(endpoint.URL, dns.MediaType, bytes.NewReader(make([]byte, 70000)))))
+}
+
+func TestDoHResponseMessage(t *testing.T) {
+	server := dns.Server{
+		DoHRespectEDNSSize: true,
+		Handler: dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+			wr.SendMessage([]byte("unparsable"))
+			dns.ServerFailure(wr, req)
+		}),
+	}
+
+	endpoint := httptest.NewServer(&server)
+	defer endpoint.Close()
+
+	post, err := http.Post(endpoint.URL, dns.MediaType, bytes.NewReader(GenerateEDNSQuery(42, 512)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer post.Body.Close()
+
+	// Messages that can not be truncated are sent as they are, and only the first message is sent
+	body, err := io.ReadAll(post.Body)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []byte("unparsable"), body)
+	}
+}
@@ -0,0 +1,212 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// EDNS0 option codes
+const (
+	OptionCookie    uint16 = 10
+	OptionKeepalive uint16 = 11
+	// OptionExtendedError carries an Extended DNS Error (RFC 8914)
+	OptionExtendedError uint16 = 15
+)
+
+// Extended DNS Error info codes (RFC 8914)
+const (
+	EDEStaleAnswer uint16 = 3
+)
+
+// rootName owns OPT records
+var rootName = dnsmessage.MustNewName(".")
+
+// ErrMultipleOPT is returned by Request.EDNS for a message with more than one OPT record, which must
+// be answered with FORMERR (RFC 6891, section 6.1.1)
+var ErrMultipleOPT = errors.New("dns: message has more than one OPT record")
+
+// EDNS0 holds the parameters of an OPT pseudo-record (RFC 6891)
+type EDNS0 struct {
+	// UDPSize is the requestor's UDP payload size, from the OPT record's class
+	UDPSize uint16
+	// ExtendedRCode is the upper eight bits of a 12-bit RCODE
+	ExtendedRCode uint8
+	Version       uint8
+	// DO is the DNSSEC OK flag
+	DO bool
+
+	Options []dnsmessage.Option
+}
+
+// ParseEDNS0 reads the parameters of an OPT pseudo-record
+func ParseEDNS0(opt dnsmessage.Resource) *EDNS0 {
+	edns := &EDNS0{
+		UDPSize:       uint16(opt.Header.Class),
+		ExtendedRCode: uint8(opt.Header.TTL >> 24),
+		Version:       uint8(opt.Header.TTL >> 16),
+		DO:            opt.Header.TTL&0x8000 != 0,
+	}
+
+	if body, is := opt.Body.(*dnsmessage.OPTResource); is {
+		edns.Options = body.Options
+	}
+
+	return edns
+}
+
+// SplitRCode splits a 12-bit RCODE into its lower four bits, which are carried in the message header,
+// and its upper eight bits, which are carried in an OPT record (RFC 6891, section 6.1.3)
+func SplitRCode(rcode dnsmessage.RCode) (dnsmessage.RCode, uint8) {
+	return rcode & 0xf, uint8(rcode >> 4)
+}
+
+// RCode joins the lower four bits of an RCODE from a message header with the extended RCODE
+func (edns *EDNS0) RCode(header dnsmessage.RCode) dnsmessage.RCode {
+	return dnsmessage.RCode(edns.ExtendedRCode)<<4 | header&0xf
+}
+
+// ResourceHeader packs the EDNS0 parameters into the header of an OPT record
+func (edns *EDNS0) ResourceHeader() dnsmessage.ResourceHeader {
+	ttl := uint32(edns.ExtendedRCode)<<24 | uint32(edns.Version)<<16
+	if edns.DO {
+		ttl |= 0x8000
+	}
+
+	return dnsmessage.ResourceHeader{Name: rootName, Type: dnsmessage.TypeOPT, Class: dnsmessage.Class(edns.UDPSize), TTL: ttl}
+}
+
+// AppendOPT adds an OPT record with the EDNS0 parameters to a Builder's additional section. It
+// should be the last record in the section, before any signature
+func (edns *EDNS0) AppendOPT(builder *dnsmessage.Builder) error {
+	return builder.OPTResource(edns.ResourceHeader(), dnsmessage.OPTResource{Options: edns.Options})
+}
+
+// ResponseEDNS returns the EDNS0 parameters for a response to a request with an OPT record. The
+// response advertises a UDP payload size, and echoes the request's DO bit. A zero size uses
+// DefaultUDPSize. The boolean result is false if the request does not have an OPT record, and the
+// response must not have one either (RFC 6891, section 7).
+//
+// The advertised size is also the negotiated payload size of the request: UDPSize returns the lesser
+// of it and the client's size, so that UDP responses are truncated to fit both
+func (req *Request) ResponseEDNS(size uint16) (*EDNS0, bool) {
+	client, found, err := req.ClientEDNS()
+	if err != nil || !found {
+		return nil, false
+	}
+
+	if size == 0 {
+		size = DefaultUDPSize
+	}
+
+	req.payload = size
+	return &EDNS0{UDPSize: size, DO: client.DO}, true
+}
+
+// Option returns the data of the first option with a code
+func (edns *EDNS0) Option(code uint16) ([]byte, bool) {
+	for _, option := range edns.Options {
+		if option.Code == code {
+			return option.Data, true
+		}
+	}
+
+	return nil, false
+}
+
+// Cookie returns the COOKIE option's data (RFC 7873)
+func (edns *EDNS0) Cookie() ([]byte, bool) {
+	return edns.Option(OptionCookie)
+}
+
+// Keepalive returns the idle timeout from the edns-tcp-keepalive option (RFC 7828). Clients send
+// the option without a timeout, in which case the returned duration is zero
+func (edns *EDNS0) Keepalive() (time.Duration, bool) {
+	data, found := edns.Option(OptionKeepalive)
+	if !found || len(data) < 2 {
+		return 0, found
+	}
+
+	// The timeout is encoded in units of 100 milliseconds
+	return time.Duration(binary.BigEndian.Uint16(data)) * 100 * time.Millisecond, true
+}
+
+// ednsCache holds the EDNS0 parameters of the last query received on a connection, along with
+// the raw OPT record that they were parsed from
+type ednsCache struct {
+	raw  []byte
+	edns *EDNS0
+	sync.Mutex
+}
+
+type ednsCacheKey struct{}
+
+// withEDNSCache adds an empty EDNS0 cache to a connection's Context
+func withEDNSCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ednsCacheKey{}, &ednsCache{})
+}
+
+// ClientEDNS returns the EDNS0 parameters of the request's OPT record. The boolean result is false
+// if the request does not have an OPT record.
+//
+// When the Server's CacheEDNS option is set, the parameters of a stream connection's last query are
+// cached in the connection's Context, and are reused without parsing the message when a subsequent
+// query carries an identical OPT record as its last record. A query with different parameters
+// replaces the cached value. The returned value is shared, and must not be modified
+func (req *Request) ClientEDNS() (*EDNS0, bool, error) {
+	cache, _ := req.Context().Value(ednsCacheKey{}).(*ednsCache)
+	if cache == nil {
+		return req.parseEDNS()
+	}
+
+	cache.Lock()
+	defer cache.Unlock()
+
+	if cache.raw != nil && len(req.msg) >= 12 && binary.BigEndian.Uint16(req.msg[10:]) > 0 &&
+		len(req.msg)-len(cache.raw) >= 12 && bytes.HasSuffix(req.msg, cache.raw) {
+		return cache.edns, true, nil
+	}
+
+	opt, found, err := req.OPT()
+	if err != nil || !found {
+		return nil, found, err
+	}
+
+	cache.edns = ParseEDNS0(opt)
+	cache.raw = nil
+
+	// OPT records are owned by the root name, and are usually the last record in a message
+	if start := len(req.msg) - 11 - int(opt.Header.Length); start >= 12 &&
+		bytes.HasPrefix(req.msg[start:], []byte{0, 0, byte(dnsmessage.TypeOPT)}) {
+		cache.raw = bytes.Clone(req.msg[start:])
+	}
+
+	return cache.edns, true, nil
+}
+
+// EDNS parses the EDNS0 parameters of the request's OPT record. The boolean result is false if the
+// request does not have an OPT record. Unlike ClientEDNS, the message is always parsed, and the
+// returned value is not shared. EDNS may be called at any point in the request's handling, as it
+// does not use the request's Parser
+func (req *Request) EDNS() (*EDNS0, bool, error) {
+	opt, found, err := req.findOPT(true)
+	if err != nil || !found {
+		return nil, found, err
+	}
+
+	return ParseEDNS0(opt), true, nil
+}
+
+func (req *Request) parseEDNS() (*EDNS0, bool, error) {
+	opt, found, err := req.OPT()
+	if err != nil || !found {
+		return nil, found, err
+	}
+
+	return ParseEDNS0(opt), true, nil
+}
@@ -0,0 +1,181 @@
+package dns_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// GenerateEDNSQuery builds a query with an OPT record advertising a UDP payload size and options
+func GenerateEDNSQuery(id, size uint16, options ...dnsmessage.Option) []byte {
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id})
+	builder.StartQuestions()
+	builder.Question(testQuestion)
+	builder.StartAdditionals()
+
+	var header dnsmessage.ResourceHeader
+	header.SetEDNS0(int(size), dnsmessage.RCodeSuccess, true)
+	builder.OPTResource(header, dnsmessage.OPTResource{Options: options})
+
+	buf, err := builder.Finish()
+	if err != nil {
+		panic(err)
+	}
+
+	return buf
+}
+
+func frame(msg []byte) []byte {
+	return append([]byte{byte(len(msg) >> 8), byte(len(msg))}, msg...)
+}
+
+func TestEDNSCache(t *testing.T) {
+	cookie := dnsmessage.Option{Code: dns.OptionCookie, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}}
+	keepalive := dnsmessage.Option{Code: dns.OptionKeepalive, Data: []byte{0, 50}}
+
+	var tester StreamTester
+	tester.chunks = append(tester.chunks,
+		frame(GenerateEDNSQuery(1, 1232, cookie, keepalive)),
+		frame(GenerateEDNSQuery(2, 1232, cookie, keepalive)),
+		frame(GenerateEDNSQuery(3, 4096, cookie)),
+		frame(GenerateQuery(4, testQuestion)),
+	)
+
+	var seen []*dns.EDNS0
+
+	server := dns.Server{
+		CacheEDNS: true,
+		Handler: dns.HandlerFunc(func(_ dns.ResponseWriter, req *dns.Request) {
+			edns, found, err := req.ClientEDNS()
+			assert.NoError(t, err)
+			assert.Equal(t, req.ID != 4, found)
+
+			seen = append(seen, edns)
+		}),
+	}
+
+	server.HandleStream(server.Context(), &tester)
+
+	if !assert.Len(t, seen, 4) {
+		return
+	}
+
+	assert.Equal(t, uint16(1232), seen[0].UDPSize)
+	assert.True(t, seen[0].DO)
+
+	data, found := seen[0].Cookie()
+	assert.True(t, found)
+	assert.Equal(t, cookie.Data, data)
+
+	timeout, found := seen[0].Keepalive()
+	assert.True(t, found)
+	assert.Equal(t, "5s", timeout.String())
+
+	// An identical OPT record reuses the cached parameters
+	assert.Same(t, seen[0], seen[1])
+
+	// Changed parameters replace the cache
+	assert.NotSame(t, seen[1], seen[2])
+	assert.Equal(t, uint16(4096), seen[2].UDPSize)
+
+	_, found = seen[2].Keepalive()
+	assert.False(t, found)
+
+	assert.Nil(t, seen[3])
+}
+
+func TestRequestEDNS(t *testing.T) {
+	cookie := dnsmessage.Option{Code: dns.OptionCookie, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}}
+
+	req, err := dns.ParseRequest(context.Background(), GenerateEDNSQuery(1, 1232, cookie))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The OPT record is found after the question section has been read
+	questions, err := req.AllQuestions()
+	assert.NoError(t, err)
+	assert.Len(t, questions, 1)
+
+	edns, found, err := req.EDNS()
+	if assert.NoError(t, err) && assert.True(t, found) {
+		assert.Equal(t, &dns.EDNS0{UDPSize: 1232, DO: true, Options: []dnsmessage.Option{cookie}}, edns)
+	}
+
+	req, _ = dns.ParseRequest(context.Background(), GenerateQuery(2, testQuestion))
+	_, found, err = req.EDNS()
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	// Messages with more than one OPT record are malformed
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 3})
+	builder.StartAdditionals()
+
+	var header dnsmessage.ResourceHeader
+	header.SetEDNS0(1232, dnsmessage.RCodeSuccess, false)
+	builder.OPTResource(header, dnsmessage.OPTResource{})
+	builder.OPTResource(header, dnsmessage.OPTResource{})
+
+	msg, err := builder.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ = dns.ParseRequest(context.Background(), msg)
+	_, _, err = req.EDNS()
+	assert.ErrorIs(t, err, dns.ErrMultipleOPT)
+}
+
+func TestResponseEDNS(t *testing.T) {
+	req, err := dns.ParseRequest(context.Background(), GenerateEDNSQuery(1, 4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 4096, req.UDPSize())
+
+	edns, found := req.ResponseEDNS(1400)
+	if !assert.True(t, found) {
+		return
+	}
+
+	// The response's size bounds truncation along with the client's
+	assert.Equal(t, 1400, req.UDPSize())
+
+	var wr dns.RecordingWriter
+	assert.NoError(t, dns.WriteAnswer(&wr, req, &dns.Answer{Header: dnsmessage.Header{RCode: dnsmessage.RCodeNameError}, EDNS: edns}))
+
+	res, err := wr.Response()
+	if assert.NoError(t, err) && assert.Len(t, res.Additionals, 1) {
+		assert.Equal(t, dnsmessage.RCodeNameError, res.RCode)
+		assert.Equal(t, dnsmessage.TypeOPT, res.Additionals[0].Header.Type)
+		assert.Equal(t, uint16(1400), dns.ParseEDNS0(res.Additionals[0]).UDPSize)
+	}
+
+	// Extended RCODEs are split between the header and the OPT record
+	const badCookie = dnsmessage.RCode(23)
+
+	wr.Reset()
+	assert.NoError(t, dns.WriteError(&wr, req, badCookie))
+
+	res, err = wr.Response()
+	if assert.NoError(t, err) && assert.Len(t, res.Additionals, 1) {
+		assert.Equal(t, dnsmessage.RCode(7), res.RCode)
+		assert.Equal(t, badCookie, dns.ParseEDNS0(res.Additionals[0]).RCode(res.RCode))
+		assert.True(t, res.Response)
+	}
+
+	// A request without an OPT record can not receive an extended RCODE
+	req, err = dns.ParseRequest(context.Background(), GenerateQuery(2, testQuestion))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, found = req.ResponseEDNS(0)
+	assert.False(t, found)
+	assert.ErrorIs(t, dns.WriteError(&wr, req, badCookie), dns.ErrExtendedRCode)
+	assert.ErrorIs(t, dns.WriteAnswer(&wr, req, &dns.Answer{Header: dnsmessage.Header{RCode: badCookie}}), dns.ErrExtendedRCode)
+}
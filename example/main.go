@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"net"
 	"os"
 	"os/signal"
@@ -11,37 +10,20 @@ import (
 	"golang.org/x/net/dns/dnsmessage"
 )
 
-// ServeTXT implements a dns.HandlerFunc that responds to TXT queries with a Hello World message
+// ServeTXT implements a dns.HandlerFunc that responds to TXT queries with a Hello World message.
+// It is registered with a dns.TypeMux, which only dispatches TXT queries with a single question
 func ServeTXT(wr dns.ResponseWriter, req *dns.Request) {
 	queries, err := req.AllQuestions()
 	if err != nil {
 		panic(err)
 	}
 
-	if len(queries) != 1 {
-		panic(fmt.Errorf("UNexpected number of queries: %d != 1", len(queries)))
-	}
-
 	query := queries[0]
-	if query.Type != dnsmessage.TypeTXT {
-		res := wr.Builder(dnsmessage.Header{
-			ID:            req.ID,
-			Response:      true,
-			OpCode:        req.OpCode,
-			Authoritative: true,
-			RCode:         dnsmessage.RCodeRefused,
-		})
-
-		wr.SendBuilder(&res)
-		return
-	}
 
-	res := wr.Builder(dnsmessage.Header{
-		ID:            req.ID,
-		Response:      true,
-		OpCode:        req.OpCode,
-		Authoritative: true,
-	})
+	header := req.ResponseHeader(dnsmessage.RCodeSuccess)
+	header.Authoritative = true
+
+	res := wr.Builder(header)
 
 	err = res.StartQuestions()
 	if err != nil {
@@ -81,8 +63,12 @@ func main() {
 		panic(err)
 	}
 
+	// Queries for other types are refused
+	var mux dns.TypeMux
+	mux.HandleFunc(dnsmessage.TypeTXT, ServeTXT)
+
 	server := dns.Server{
-		Handler: dns.HandlerFunc(ServeTXT),
+		Handler: &mux,
 	}
 
 	go server.Serve(conn)
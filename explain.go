@@ -0,0 +1,178 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/jmanero/go-logging"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// maxExplainSize limits the RDATA of the TXT record that returns an explanation
+const maxExplainSize = 2048
+
+// ExplainName is the owner of the TXT record that returns a request's explanation to the client
+var ExplainName = dnsmessage.MustNewName("explain.")
+
+// Explanation accumulates the decisions that middlewares and Handlers make for a request, such as a
+// cache hit or miss, the route that a mux matched, or the upstream that answered. It is safe for
+// concurrent use
+type Explanation struct {
+	steps []string
+	sync.Mutex
+}
+
+// Add records a step
+func (explanation *Explanation) Add(format string, args ...any) {
+	explanation.Lock()
+	defer explanation.Unlock()
+
+	explanation.steps = append(explanation.steps, fmt.Sprintf(format, args...))
+}
+
+// Steps returns a copy of the recorded steps, in order
+func (explanation *Explanation) Steps() []string {
+	explanation.Lock()
+	defer explanation.Unlock()
+
+	return slices.Clone(explanation.steps)
+}
+
+type explanationKeyType struct{}
+
+var explanationKey explanationKeyType
+
+// ContextWithExplanation adds a new Explanation to a Context
+func ContextWithExplanation(ctx context.Context) (context.Context, *Explanation) {
+	explanation := &Explanation{}
+	return context.WithValue(ctx, explanationKey, explanation), explanation
+}
+
+// ExplanationFromContext returns the Explanation in a Context, if explain mode is enabled for its request
+func ExplanationFromContext(ctx context.Context) (*Explanation, bool) {
+	explanation, has := ctx.Value(explanationKey).(*Explanation)
+	return explanation, has
+}
+
+// Explain records a step in the Explanation of a Context. It does nothing if explain mode is not
+// enabled for the Context's request
+func Explain(ctx context.Context, format string, args ...any) {
+	if explanation, has := ExplanationFromContext(ctx); has {
+		explanation.Add(format, args...)
+	}
+}
+
+// Explain records a step in the request's Explanation, if explain mode is enabled for the request
+func (req *Request) Explain(format string, args ...any) {
+	Explain(req.Context(), format, args...)
+}
+
+// explain enables explain mode for a request when the Server's Explain flag is set, or the query
+// carries the Server's ExplainOption. Queries with the option receive the explanation in a TXT record
+// if the client is allowed by ExplainACL
+func (server *Server) explain(wr ResponseWriter, req *Request) ResponseWriter {
+	var requested bool
+	if server.ExplainOption != 0 && server.explainAllowed(req) {
+		edns, found, err := req.ClientEDNS()
+		if err == nil && found {
+			_, requested = edns.Option(server.ExplainOption)
+		}
+	}
+
+	if !server.Explain && !requested {
+		return wr
+	}
+
+	var explanation *Explanation
+	req.ctx, explanation = ContextWithExplanation(req.ctx)
+
+	if !requested {
+		return wr
+	}
+
+	return &explainWriter{wrappedWriter: wrappedWriter{wr}, explanation: explanation}
+}
+
+// explainAllowed checks if a client may request an explanation with ExplainOption
+func (server *Server) explainAllowed(req *Request) bool {
+	if server.ExplainACL != nil {
+		return server.ExplainACL.Allowed(req.RemoteAddr)
+	}
+
+	ip, _ := addrParts(req.RemoteAddr)
+	return ip != nil && ip.IsLoopback()
+}
+
+// explained logs a request's Explanation, once its Handler has returned
+func (server *Server) explained(req *Request) {
+	if explanation, has := ExplanationFromContext(req.Context()); has {
+		server.log(logging.FromContext(req.Context()), zapcore.DebugLevel, "handler.explain", zap.Strings("steps", explanation.Steps()))
+	}
+}
+
+// explainWriter adds a TXT record with the steps that were recorded before a response was sent to
+// the additional section of each response
+type explainWriter struct {
+	wrappedWriter
+
+	explanation *Explanation
+}
+
+// SendBuilder finalizes a Builder, and sends the resulting message with the explanation
+func (wr *explainWriter) SendBuilder(builder *dnsmessage.Builder) {
+	wr.sendBuilder(wr.SendMessage, builder)
+}
+
+// SendMessage adds the explanation to a message, and sends it. Messages sent directly with Send are
+// not modified, as they may include transport framing. Messages that cannot be parsed, or that would
+// not fit in a DNS message with the explanation, are sent without it
+func (wr *explainWriter) SendMessage(msg []byte) {
+	steps := wr.explanation.Steps()
+	if len(steps) == 0 {
+		wr.ResponseWriter.SendMessage(msg)
+		return
+	}
+
+	var res dnsmessage.Message
+
+	err := res.Unpack(msg)
+	if err != nil {
+		wr.ResponseWriter.SendMessage(msg)
+		return
+	}
+
+	// Character strings are limited to 255 octets, and the record to maxExplainSize octets of
+	// RDATA. Steps that do not fit are dropped
+	size := 0
+	for i, step := range steps {
+		if len(step) > 255 {
+			step = step[:255]
+		}
+
+		size += 1 + len(step)
+		if size > maxExplainSize {
+			steps = steps[:i]
+			break
+		}
+
+		steps[i] = step
+	}
+
+	// The record is added before the OPT record and any signature, which must be last
+	res.Additionals = slices.Insert(res.Additionals, 0, dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: ExplainName, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassCHAOS},
+		Body:   &dnsmessage.TXTResource{TXT: steps},
+	})
+
+	explained, err := res.Pack()
+	if err != nil || len(explained) > 65535 {
+		wr.ResponseWriter.SendMessage(msg)
+		return
+	}
+
+	wr.ResponseWriter.SendMessage(explained)
+}
@@ -0,0 +1,144 @@
+package dns_test
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestExplain(t *testing.T) {
+	// Steps are not recorded without an Explanation
+	dns.Explain(context.Background(), "ignored")
+
+	ctx, explanation := dns.ContextWithExplanation(context.Background())
+	dns.Explain(ctx, "cache: %s", "miss")
+
+	found, has := dns.ExplanationFromContext(ctx)
+	assert.True(t, has)
+	assert.Same(t, explanation, found)
+	assert.Equal(t, []string{"cache: miss"}, explanation.Steps())
+}
+
+// explainQuery generates a query for testQuestion's name with the given type, that requests an
+// explanation with OptionLocalMin
+func explainQuery(id uint16, qtype dnsmessage.Type) []byte {
+	question := testQuestion
+	question.Type = qtype
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id})
+	builder.StartQuestions()
+	builder.Question(question)
+	builder.StartAdditionals()
+
+	var header dnsmessage.ResourceHeader
+	header.SetEDNS0(4096, dnsmessage.RCodeSuccess, true)
+	builder.OPTResource(header, dnsmessage.OPTResource{Options: []dnsmessage.Option{{Code: dns.OptionLocalMin}}})
+
+	buf, err := builder.Finish()
+	if err != nil {
+		panic(err)
+	}
+
+	return buf
+}
+
+func TestExplainOption(t *testing.T) {
+	mux := &dns.TypeMux{}
+	mux.HandleFunc(dnsmessage.TypeA, func(wr dns.ResponseWriter, req *dns.Request) {
+		req.Explain("answer: %d records", 0)
+		dns.ServerFailure(wr, req)
+	})
+
+	mux.HandleFunc(dnsmessage.TypeTXT, func(wr dns.ResponseWriter, req *dns.Request) {
+		for i := range 100 {
+			req.Explain("step %d: %s", i, strings.Repeat("x", 300))
+		}
+
+		dns.ServerFailure(wr, req)
+	})
+
+	mux.HandleFunc(dnsmessage.TypeAAAA, func(wr dns.ResponseWriter, req *dns.Request) {
+		wr.SendMessage([]byte("unparsable"))
+	})
+
+	// serve starts a Server, and returns a function that exchanges queries with it
+	serve := func(server *dns.Server) func([]byte) []byte {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go server.Serve(conn)
+		t.Cleanup(func() { server.CloseAll() })
+
+		client, err := net.Dial("udp", conn.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Cleanup(func() { client.Close() })
+		client.SetDeadline(time.Now().Add(time.Second))
+
+		return func(query []byte) []byte {
+			client.Write(query)
+
+			buf := make([]byte, 8192)
+			size, err := client.Read(buf)
+			assert.NoError(t, err)
+
+			return buf[:size]
+		}
+	}
+
+	unpack := func(msg []byte) (res dnsmessage.Message) {
+		assert.NoError(t, res.Unpack(msg))
+		return
+	}
+
+	exchange := serve(&dns.Server{ExplainOption: dns.OptionLocalMin, Handler: mux})
+
+	// The steps are returned in a TXT record
+	res := unpack(exchange(GenerateEDNSQuery(1, 1232, dnsmessage.Option{Code: dns.OptionLocalMin})))
+	assert.Equal(t, dnsmessage.RCodeServerFailure, res.RCode)
+
+	if assert.Len(t, res.Additionals, 1) {
+		txt := res.Additionals[0]
+		assert.Equal(t, dns.ExplainName, txt.Header.Name)
+		assert.Equal(t, dnsmessage.ClassCHAOS, txt.Header.Class)
+		assert.Equal(t, []string{"mux: type TypeA", "answer: 0 records"}, txt.Body.(*dnsmessage.TXTResource).TXT)
+	}
+
+	// Responses to queries without the option are not modified
+	res = unpack(exchange(GenerateEDNSQuery(2, 1232)))
+	assert.Empty(t, res.Additionals)
+
+	// Long explanations are limited to 2048 octets of RDATA
+	res = unpack(exchange(explainQuery(3, dnsmessage.TypeTXT)))
+
+	if assert.Len(t, res.Additionals, 1) {
+		steps := res.Additionals[0].Body.(*dnsmessage.TXTResource).TXT
+		if assert.Len(t, steps, 8) {
+			assert.Equal(t, "mux: type TypeTXT", steps[0])
+
+			for _, step := range steps[1:] {
+				assert.Len(t, step, 255)
+			}
+		}
+	}
+
+	// Messages that cannot be parsed are sent without the explanation
+	assert.Equal(t, []byte("unparsable"), exchange(explainQuery(4, dnsmessage.TypeAAAA)))
+
+	// The option is ignored in queries from clients that the ACL denies
+	exchange = serve(&dns.Server{ExplainOption: dns.OptionLocalMin, ExplainACL: &dns.ACL{Default: dns.ACLDeny}, Handler: mux})
+
+	res = unpack(exchange(GenerateEDNSQuery(5, 1232, dnsmessage.Option{Code: dns.OptionLocalMin})))
+	assert.Equal(t, dnsmessage.RCodeServerFailure, res.RCode)
+	assert.Empty(t, res.Additionals)
+}
@@ -0,0 +1,151 @@
+package dns
+
+import (
+	"container/list"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultFallbackWindow bounds how long after a truncated UDP response a TCP query for the same
+// question is counted as the client's retry
+const DefaultFallbackWindow = 5 * time.Second
+
+// truncations records truncated UDP responses, so that the TCP queries that clients retry them with
+// can be correlated. Entries are ordered by the time that they were sent, so that expired entries are
+// evicted from the front of the order without scanning the table
+type truncations struct {
+	entries map[string]*list.Element
+	order   list.List
+	sync.Mutex
+}
+
+// truncation records when a truncated response was sent
+type truncation struct {
+	key  string
+	sent time.Time
+}
+
+// record notes a truncated response
+func (tr *truncations) record(key string, window time.Duration) {
+	tr.Lock()
+	defer tr.Unlock()
+
+	now := time.Now()
+
+	if tr.entries == nil {
+		tr.entries = map[string]*list.Element{}
+	}
+
+	if elem, has := tr.entries[key]; has {
+		tr.remove(elem)
+	}
+
+	// Evict expired entries, which are the oldest
+	for oldest := tr.order.Front(); oldest != nil && now.Sub(oldest.Value.(*truncation).sent) >= window; oldest = tr.order.Front() {
+		tr.remove(oldest)
+	}
+
+	if len(tr.entries) >= maxInflight {
+		return
+	}
+
+	tr.entries[key] = tr.order.PushBack(&truncation{key: key, sent: now})
+}
+
+// take removes a truncated response, and returns the time since it was sent if it is within the window
+func (tr *truncations) take(key string, window time.Duration) (time.Duration, bool) {
+	tr.Lock()
+	defer tr.Unlock()
+
+	elem, has := tr.entries[key]
+	if !has {
+		return 0, false
+	}
+
+	tr.remove(elem)
+
+	delay := time.Since(elem.Value.(*truncation).sent)
+	return delay, delay < window
+}
+
+func (tr *truncations) remove(elem *list.Element) {
+	tr.order.Remove(elem)
+	delete(tr.entries, elem.Value.(*truncation).key)
+}
+
+// fallbackKey identifies a query by its client's IP address and its first question. Ports are
+// excluded, as clients retry over TCP from a different port
+func fallbackKey(req *Request) (string, bool) {
+	if req.RemoteAddr == nil {
+		return "", false
+	}
+
+	questions, err := req.Questions()
+	if err != nil || len(questions) == 0 {
+		return "", false
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr.String())
+	if err != nil {
+		host = req.RemoteAddr.String()
+	}
+
+	question := questions[0]
+
+	var key strings.Builder
+
+	key.WriteString(host)
+	key.WriteByte('|')
+	key.WriteString(strings.ToLower(question.Name.String()))
+	key.WriteByte('|')
+	key.WriteString(strconv.FormatUint(uint64(question.Type), 16))
+	key.WriteByte('|')
+	key.WriteString(strconv.FormatUint(uint64(question.Class), 16))
+
+	return key.String(), true
+}
+
+// recordTruncation notes a truncated UDP response when fallback correlation is enabled
+func (server *Server) recordTruncation(req *Request) {
+	if !server.CorrelateFallback {
+		return
+	}
+
+	if key, has := fallbackKey(req); has {
+		server.fallbacks.record(key, server.fallbackWindow())
+	}
+}
+
+// correlateFallback checks if a stream query retries a truncated UDP response
+func (server *Server) correlateFallback(req *Request) {
+	if !server.CorrelateFallback || req.transport == TransportUDP {
+		return
+	}
+
+	key, has := fallbackKey(req)
+	if !has {
+		return
+	}
+
+	delay, retried := server.fallbacks.take(key, server.fallbackWindow())
+	if !retried {
+		return
+	}
+
+	server.Stats.Fallbacks.Add(1)
+
+	if server.OnFallback != nil {
+		server.OnFallback(req, delay)
+	}
+}
+
+func (server *Server) fallbackWindow() time.Duration {
+	if server.FallbackWindow > 0 {
+		return server.FallbackWindow
+	}
+
+	return DefaultFallbackWindow
+}
@@ -0,0 +1,456 @@
+package dns
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jmanero/go-logging"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Forwarding errors classify the reason that an exchange with an upstream failed. Errors returned
+// to OnForwardError wrap one of these errors along with the underlying error, unless the request
+// was canceled or the failure could not be classified
+var (
+	ErrUpstreamTimeout     = errors.New("dns: upstream did not respond in time")
+	ErrUpstreamUnreachable = errors.New("dns: upstream is unreachable")
+	ErrUpstreamMalformed   = errors.New("dns: upstream response is malformed")
+	ErrUpstreamFailure     = errors.New("dns: upstream responded SERVFAIL")
+)
+
+// Upstream exchanges wire-format DNS messages with a remote resolver
+type Upstream interface {
+	Exchange(context.Context, []byte) ([]byte, error)
+}
+
+// DatagramUpstream forwards queries to a resolver over UDP, falling back to TCP for truncated responses
+type DatagramUpstream struct {
+	// Client sends queries to the upstream. A nil value uses a zero Client
+	Client *Client
+	Addr   string
+}
+
+var defaultClient = &Client{}
+
+// Exchange sends a query to the upstream resolver
+func (up *DatagramUpstream) Exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	return orDefault(up.Client, defaultClient).Exchange(ctx, msg, up.Addr)
+}
+
+func (up *DatagramUpstream) String() string {
+	return "udp://" + up.Addr
+}
+
+// TLSUpstream forwards queries to a resolver over DNS-over-TLS, and reuses idle connections
+// for subsequent queries
+type TLSUpstream struct {
+	// Client sends queries to the upstream. A nil value uses a zero Client
+	Client *Client
+	Addr   string
+
+	// MaxIdle bounds the number of idle connections retained for reuse
+	MaxIdle int
+
+	idle []net.Conn
+	sync.Mutex
+}
+
+// Exchange sends a query to the upstream resolver on an idle or new connection
+func (up *TLSUpstream) Exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	client := orDefault(up.Client, defaultClient)
+
+	conn, reused := up.get()
+	if !reused {
+		var err error
+
+		conn, err = client.DialTLS(ctx, up.Addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res, err := client.ExchangeConn(ctx, conn, msg)
+	if err != nil {
+		conn.Close()
+
+		if reused && ctx.Err() == nil {
+			// The upstream may have closed an idle connection. Retry once on a new connection
+			return up.Exchange(ctx, msg)
+		}
+
+		return nil, err
+	}
+
+	// Clear deadlines set for the exchange and return the connection to the pool
+	conn.SetDeadline(time.Time{})
+	up.put(conn)
+
+	return res, nil
+}
+
+func (up *TLSUpstream) get() (net.Conn, bool) {
+	up.Lock()
+	defer up.Unlock()
+
+	if len(up.idle) == 0 {
+		return nil, false
+	}
+
+	conn := up.idle[len(up.idle)-1]
+	up.idle = up.idle[:len(up.idle)-1]
+
+	return conn, true
+}
+
+func (up *TLSUpstream) put(conn net.Conn) {
+	up.Lock()
+	defer up.Unlock()
+
+	if len(up.idle) >= max(up.MaxIdle, 1) {
+		conn.Close()
+		return
+	}
+
+	up.idle = append(up.idle, conn)
+}
+
+// Close closes all idle connections
+func (up *TLSUpstream) Close() (err error) {
+	up.Lock()
+	defer up.Unlock()
+
+	for _, conn := range up.idle {
+		err = multierr.Append(err, conn.Close())
+	}
+
+	up.idle = nil
+	return
+}
+
+func (up *TLSUpstream) String() string {
+	return "tls://" + up.Addr
+}
+
+// MediaType is the HTTP content type of wire-format DNS messages
+const MediaType = "application/dns-message"
+
+// HTTPSUpstream forwards queries to a DNS-over-HTTPS resolver
+type HTTPSUpstream struct {
+	// Client sends requests to the upstream. A nil value uses a client that attempts HTTP/2
+	Client *http.Client
+	URL    string
+}
+
+var defaultHTTPSClient = &http.Client{Transport: &http.Transport{ForceAttemptHTTP2: true, Proxy: http.ProxyFromEnvironment}}
+
+// Exchange POSTs a query to the upstream resolver. Responses that are not application/dns-message
+// bodies are rejected
+func (up *HTTPSUpstream) Exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, up.URL, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", MediaType)
+	req.Header.Set("Accept", MediaType)
+
+	res, err := orDefault(up.Client, defaultHTTPSClient).Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("dns: upstream %s responded %s", up.URL, res.Status)
+	}
+
+	if mediatype, _, err := mime.ParseMediaType(res.Header.Get("Content-Type")); err != nil || mediatype != MediaType {
+		return nil, fmt.Errorf("%w: content type %q", ErrUpstreamMalformed, res.Header.Get("Content-Type"))
+	}
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 65535))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(body) < 12 {
+		return nil, ErrShortMessage
+	}
+
+	return body, nil
+}
+
+func (up *HTTPSUpstream) String() string {
+	return up.URL
+}
+
+// ForwardHandler forwards queries to a list of upstream resolvers, trying each in order until one responds
+type ForwardHandler struct {
+	Upstreams []Upstream
+
+	// Timeout bounds each attempt to exchange a query with an upstream. A zero value uses
+	// DefaultExchangeTimeout
+	Timeout time.Duration
+
+	// RetryServerFailure tries the next upstream when an upstream responds SERVFAIL. The last SERVFAIL
+	// response is relayed if no upstream answers. Other responses, including NXDOMAIN and NODATA
+	// answers, are always relayed
+	RetryServerFailure bool
+
+	// Retries is the number of additional passes over Upstreams after every upstream has failed.
+	// Each pass waits for Backoff, doubling with each pass, before it starts. Retries stop when the
+	// request's deadline expires
+	Retries int
+
+	// Backoff moves an upstream that has failed to the end of the order in which upstreams are tried,
+	// until it has responded or the backoff has elapsed. The backoff doubles with each consecutive
+	// failure, up to 32 times its initial value. A zero value tries upstreams in their listed order
+	Backoff time.Duration
+
+	// DropOnCancel suppresses the SERVFAIL response when the request's Context is canceled or its
+	// deadline expires, as the client has most likely given up on the query
+	DropOnCancel bool
+
+	// OnForwardError is called when an exchange with an upstream fails
+	OnForwardError func(req *Request, upstream Upstream, err error)
+
+	// Stats counts upstream failures by their classification
+	Stats ForwardStats
+
+	backoffs []backoff
+	sync.Mutex
+}
+
+// backoff tracks consecutive failures of an upstream
+type backoff struct {
+	failures int
+	until    time.Time
+}
+
+var _ Handler = &ForwardHandler{}
+
+// ServeDNS forwards a request to upstream resolvers and relays the first response to the client.
+// A SERVFAIL response that echoes the question and sets RA is sent if no upstream responds.
+//
+// Upstream exchanges are bound to the request's Context, so that an exchange is aborted when the
+// request's deadline expires or it is canceled, and no further upstreams are attempted
+func (fw *ForwardHandler) ServeDNS(wr ResponseWriter, req *Request) {
+	ctx := req.Context()
+
+	// The last SERVFAIL response from an upstream, when RetryServerFailure is set
+	var failure []byte
+
+	for pass := 0; pass <= fw.Retries && fw.wait(ctx, pass); pass++ {
+		for _, index := range fw.order() {
+			upstream := fw.Upstreams[index]
+
+			res, err := fw.exchange(ctx, upstream, req.Message())
+			if err != nil {
+				logging.FromContext(ctx).Warn("forward.error", zap.Any("upstream", upstream), zap.Error(err))
+				fw.Stats.count(err)
+
+				// A canceled request is not the upstream's fault
+				if !errors.Is(ctx.Err(), context.Canceled) {
+					fw.failed(index)
+				}
+
+				req.Explain("forward: upstream %d failed: %s", index, err)
+
+				if fw.OnForwardError != nil {
+					fw.OnForwardError(req, upstream, err)
+				}
+
+				if errors.Is(err, ErrUpstreamFailure) {
+					failure = res
+				}
+
+				if ctx.Err() != nil {
+					break
+				}
+
+				continue
+			}
+
+			fw.responded(index)
+			req.Explain("forward: upstream %d responded", index)
+			fw.relay(wr, req, res)
+
+			return
+		}
+	}
+
+	if fw.DropOnCancel && ctx.Err() != nil {
+		return
+	}
+
+	if failure != nil {
+		fw.relay(wr, req, failure)
+		return
+	}
+
+	ExchangeFailed(req)
+
+	// Forwarders provide recursion on behalf of their upstreams
+	ServerFailure(wr, req.WithContext(ContextWithRecursion(ctx, true)))
+}
+
+// wait delays a retry pass by the pass's backoff. It returns false if the request's Context is
+// done before the pass can start
+func (fw *ForwardHandler) wait(ctx context.Context, pass int) bool {
+	if pass == 0 || fw.Backoff <= 0 {
+		return ctx.Err() == nil
+	}
+
+	timer := time.NewTimer(fw.Backoff << min(pass-1, 5))
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// relay sends an upstream's response to the client
+func (fw *ForwardHandler) relay(wr ResponseWriter, req *Request, res []byte) {
+	// Restore the client's ID in the upstream's response
+	SetMessageID(res, req.ID)
+	ClearReserved(res)
+	wr.SendMessage(res)
+}
+
+// order returns the indexes of Upstreams in the order that they should be tried. Upstreams that are
+// backing off are tried last
+func (fw *ForwardHandler) order() []int {
+	order := make([]int, 0, len(fw.Upstreams))
+	if fw.Backoff <= 0 {
+		for index := range fw.Upstreams {
+			order = append(order, index)
+		}
+
+		return order
+	}
+
+	fw.Lock()
+	defer fw.Unlock()
+
+	now := time.Now()
+
+	var waiting []int
+	for index := range fw.Upstreams {
+		if index < len(fw.backoffs) && now.Before(fw.backoffs[index].until) {
+			waiting = append(waiting, index)
+			continue
+		}
+
+		order = append(order, index)
+	}
+
+	return append(order, waiting...)
+}
+
+// failed starts or extends an upstream's backoff
+func (fw *ForwardHandler) failed(index int) {
+	if fw.Backoff <= 0 {
+		return
+	}
+
+	fw.Lock()
+	defer fw.Unlock()
+
+	if len(fw.backoffs) < len(fw.Upstreams) {
+		fw.backoffs = append(fw.backoffs, make([]backoff, len(fw.Upstreams)-len(fw.backoffs))...)
+	}
+
+	state := &fw.backoffs[index]
+	state.until = time.Now().Add(fw.Backoff << min(state.failures, 5))
+	state.failures++
+}
+
+// responded clears an upstream's backoff
+func (fw *ForwardHandler) responded(index int) {
+	if fw.Backoff <= 0 {
+		return
+	}
+
+	fw.Lock()
+	defer fw.Unlock()
+
+	if index < len(fw.backoffs) {
+		fw.backoffs[index] = backoff{}
+	}
+}
+
+func (fw *ForwardHandler) exchange(ctx context.Context, upstream Upstream, msg []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, cmp.Or(fw.Timeout, DefaultExchangeTimeout))
+	defer cancel()
+
+	res, err := upstream.Exchange(ctx, msg)
+	if err != nil {
+		return nil, classify(ctx, err)
+	}
+
+	var parser dnsmessage.Parser
+
+	header, err := parser.Start(res)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUpstreamMalformed, err)
+	}
+
+	if !header.Response {
+		return nil, fmt.Errorf("%w: QR bit is not set", ErrUpstreamMalformed)
+	}
+
+	if fw.RetryServerFailure && header.RCode == dnsmessage.RCodeServerFailure {
+		return res, ErrUpstreamFailure
+	}
+
+	return res, nil
+}
+
+// classify wraps an upstream exchange error with its forwarding error
+func classify(ctx context.Context, err error) error {
+	var nerr net.Error
+	var operr *net.OpError
+
+	switch {
+	case errors.Is(ctx.Err(), context.Canceled):
+		// The request was canceled, not the upstream's fault
+		return err
+
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &nerr) && nerr.Timeout():
+		return fmt.Errorf("%w: %w", ErrUpstreamTimeout, err)
+
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH),
+		errors.As(err, &operr) && operr.Op == "dial":
+		return fmt.Errorf("%w: %w", ErrUpstreamUnreachable, err)
+
+	case errors.Is(err, ErrShortMessage), errors.Is(err, ErrIDMismatch):
+		return fmt.Errorf("%w: %w", ErrUpstreamMalformed, err)
+	}
+
+	return err
+}
+
+func orDefault[T any](value, def *T) *T {
+	if value == nil {
+		return def
+	}
+
+	return value
+}
@@ -0,0 +1,388 @@
+package dns_test
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// BlackHole opens a UDP socket that never responds
+func BlackHole(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+	return conn.LocalAddr().String()
+}
+
+func TestForwardCancel(t *testing.T) {
+	forwarder := dns.ForwardHandler{
+		Upstreams: []dns.Upstream{&dns.DatagramUpstream{Addr: BlackHole(t)}, &dns.DatagramUpstream{Addr: BlackHole(t)}},
+		Timeout:   10 * time.Second,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	req, err := dns.ParseRequest(ctx, GenerateQuery(42, dnsmessage.Question{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}))
+	assert.NoError(t, err)
+
+	wr := dns.NewMessageWriter(nil)
+	start := time.Now()
+
+	forwarder.ServeDNS(wr, req)
+
+	// The upstream exchange is aborted at the request's deadline rather than the forwarder's timeout
+	assert.Less(t, time.Since(start), time.Second)
+
+	var res dnsmessage.Message
+	if assert.NoError(t, res.Unpack(wr.Bytes())) {
+		assert.Equal(t, uint16(42), res.ID)
+		assert.Equal(t, dnsmessage.RCodeServerFailure, res.RCode)
+	}
+
+	// Canceled requests are dropped without a response
+	forwarder.DropOnCancel = true
+	wr.Reset()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	forwarder.ServeDNS(wr, req.WithContext(ctx))
+	assert.Empty(t, wr.Bytes())
+}
+
+// StaticUpstream responds to every query with a fixed message
+type StaticUpstream []byte
+
+func (up StaticUpstream) Exchange(context.Context, []byte) ([]byte, error) {
+	return up, nil
+}
+
+// ClosedPort returns the address of a UDP port that nothing is listening on
+func ClosedPort(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := conn.LocalAddr().String()
+	conn.Close()
+
+	return addr
+}
+
+func TestForwardErrors(t *testing.T) {
+	var errs []error
+
+	forwarder := dns.ForwardHandler{
+		Upstreams: []dns.Upstream{
+			&dns.DatagramUpstream{Addr: BlackHole(t)},
+			&dns.DatagramUpstream{Addr: ClosedPort(t)},
+			StaticUpstream{1, 2, 3},
+			StaticUpstream(GenerateQuery(42)),
+		},
+		Timeout:        50 * time.Millisecond,
+		OnForwardError: func(_ *dns.Request, _ dns.Upstream, err error) { errs = append(errs, err) },
+	}
+
+	req, err := dns.ParseRequest(context.Background(), GenerateQuery(42, dnsmessage.Question{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}))
+	assert.NoError(t, err)
+
+	wr := dns.NewMessageWriter(nil)
+	forwarder.ServeDNS(wr, req)
+
+	if assert.Len(t, errs, 4) {
+		assert.ErrorIs(t, errs[0], dns.ErrUpstreamTimeout)
+		assert.ErrorIs(t, errs[1], dns.ErrUpstreamUnreachable)
+		assert.ErrorIs(t, errs[2], dns.ErrUpstreamMalformed)
+		assert.ErrorIs(t, errs[3], dns.ErrUpstreamMalformed)
+	}
+
+	assert.Equal(t, uint64(1), forwarder.Stats.Timeouts.Load())
+	assert.Equal(t, uint64(1), forwarder.Stats.Unreachable.Load())
+	assert.Equal(t, uint64(2), forwarder.Stats.Malformed.Load())
+
+	var res dnsmessage.Message
+	if assert.NoError(t, res.Unpack(wr.Bytes())) {
+		assert.Equal(t, dnsmessage.RCodeServerFailure, res.RCode)
+		assert.True(t, res.RecursionAvailable)
+		assert.Len(t, res.Questions, 1)
+		assert.Empty(t, res.Answers)
+	}
+}
+
+// RCodeUpstream responds to every query with an empty response and a fixed RCODE
+type RCodeUpstream struct {
+	RCode dnsmessage.RCode
+	Calls int
+}
+
+func (up *RCodeUpstream) Exchange(_ context.Context, msg []byte) ([]byte, error) {
+	up.Calls++
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: dns.MessageID(msg), Response: true, RCode: up.RCode})
+
+	res, err := builder.Finish()
+	if err != nil {
+		panic(err)
+	}
+
+	return res, nil
+}
+
+func TestForwardRetry(t *testing.T) {
+	failing := &RCodeUpstream{RCode: dnsmessage.RCodeServerFailure}
+	answering := &RCodeUpstream{RCode: dnsmessage.RCodeNameError}
+
+	forwarder := dns.ForwardHandler{
+		Upstreams:          []dns.Upstream{failing, answering},
+		RetryServerFailure: true,
+		Backoff:            time.Minute,
+	}
+
+	req, err := dns.ParseRequest(context.Background(), GenerateQuery(42, testQuestion))
+	assert.NoError(t, err)
+
+	rcode := func() dnsmessage.RCode {
+		wr := dns.NewMessageWriter(nil)
+		forwarder.ServeDNS(wr, req)
+
+		var res dnsmessage.Message
+		assert.NoError(t, res.Unpack(wr.Bytes()))
+
+		return res.RCode
+	}
+
+	// SERVFAIL is retried against the next upstream, and NXDOMAIN is relayed
+	assert.Equal(t, dnsmessage.RCodeNameError, rcode())
+	assert.Equal(t, 1, failing.Calls)
+	assert.Equal(t, 1, answering.Calls)
+	assert.Equal(t, uint64(1), forwarder.Stats.ServerFailures.Load())
+
+	// The failing upstream is tried last while it backs off
+	assert.Equal(t, dnsmessage.RCodeNameError, rcode())
+	assert.Equal(t, 1, failing.Calls)
+	assert.Equal(t, 2, answering.Calls)
+
+	// NXDOMAIN is an answer, and is not retried
+	forwarder = dns.ForwardHandler{Upstreams: []dns.Upstream{answering, failing}, RetryServerFailure: true}
+
+	assert.Equal(t, dnsmessage.RCodeNameError, rcode())
+	assert.Equal(t, 1, failing.Calls)
+	assert.Equal(t, 3, answering.Calls)
+
+	// The upstream's SERVFAIL is relayed after every pass has failed
+	forwarder = dns.ForwardHandler{Upstreams: []dns.Upstream{failing}, RetryServerFailure: true, Retries: 2}
+
+	assert.Equal(t, dnsmessage.RCodeServerFailure, rcode())
+	assert.Equal(t, 4, failing.Calls)
+}
+
+// CancelUpstream cancels the request that it is forwarding
+type CancelUpstream struct {
+	Cancel context.CancelFunc
+	Calls  int
+}
+
+func (up *CancelUpstream) Exchange(ctx context.Context, _ []byte) ([]byte, error) {
+	up.Calls++
+	up.Cancel()
+
+	return nil, ctx.Err()
+}
+
+func TestForwardBackoff(t *testing.T) {
+	failing := &RCodeUpstream{RCode: dnsmessage.RCodeServerFailure}
+	forwarder := dns.ForwardHandler{
+		Upstreams:          []dns.Upstream{failing},
+		RetryServerFailure: true,
+		Retries:            2,
+		Backoff:            20 * time.Millisecond,
+	}
+
+	req, err := dns.ParseRequest(context.Background(), GenerateQuery(42, testQuestion))
+	assert.NoError(t, err)
+
+	// Retry passes wait for the doubling backoff
+	start := time.Now()
+	forwarder.ServeDNS(dns.NewMessageWriter(nil), req)
+
+	assert.Equal(t, 3, failing.Calls)
+	assert.GreaterOrEqual(t, time.Since(start), 60*time.Millisecond)
+
+	// An upstream does not back off when the request is canceled during its exchange
+	canceling := &CancelUpstream{}
+	answering := &RCodeUpstream{RCode: dnsmessage.RCodeSuccess}
+	forwarder = dns.ForwardHandler{Upstreams: []dns.Upstream{canceling, answering}, Backoff: time.Minute}
+
+	for range 2 {
+		ctx, cancel := context.WithCancel(context.Background())
+		canceling.Cancel = cancel
+
+		forwarder.ServeDNS(dns.NewMessageWriter(nil), req.WithContext(ctx))
+	}
+
+	assert.Equal(t, 2, canceling.Calls)
+	assert.Zero(t, answering.Calls)
+}
+
+// TLSResponder serves DNS-over-TLS connections that answer each query by echoing it as a response,
+// and records the connections that it accepts
+type TLSResponder struct {
+	net.Listener
+
+	conns []net.Conn
+	sync.Mutex
+}
+
+func NewTLSResponder(t *testing.T, cert tls.Certificate) *TLSResponder {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	responder := &TLSResponder{Listener: listener}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			responder.Lock()
+			responder.conns = append(responder.conns, conn)
+			responder.Unlock()
+
+			go func() {
+				defer conn.Close()
+
+				for {
+					msg, err := dns.ReadFrame(conn)
+					if err != nil {
+						return
+					}
+
+					msg[2] |= 0x80
+					conn.Write(append([]byte{byte(len(msg) >> 8), byte(len(msg))}, msg...))
+				}
+			}()
+		}
+	}()
+
+	return responder
+}
+
+// Accepted returns the number of connections that have been accepted
+func (responder *TLSResponder) Accepted() int {
+	responder.Lock()
+	defer responder.Unlock()
+
+	return len(responder.conns)
+}
+
+// CloseConns closes the accepted connections from the responder's side
+func (responder *TLSResponder) CloseConns() {
+	responder.Lock()
+	defer responder.Unlock()
+
+	for _, conn := range responder.conns {
+		conn.Close()
+	}
+}
+
+func TestTLSUpstream(t *testing.T) {
+	cert, pool := SelfSigned(t)
+	responder := NewTLSResponder(t, cert)
+
+	upstream := &dns.TLSUpstream{
+		Client: &dns.Client{Timeout: time.Second, TLSConfig: &tls.Config{RootCAs: pool}},
+		Addr:   responder.Addr().String(),
+	}
+
+	defer upstream.Close()
+	assert.Equal(t, "tls://"+responder.Addr().String(), upstream.String())
+
+	// Idle connections are reused for subsequent queries
+	for id := range uint16(3) {
+		res, err := upstream.Exchange(context.Background(), GenerateQuery(id, testQuestion))
+		if assert.NoError(t, err) {
+			assert.Equal(t, id, dns.MessageID(res))
+		}
+	}
+
+	assert.Equal(t, 1, responder.Accepted())
+
+	// A pooled connection that the upstream closed is replaced
+	responder.CloseConns()
+
+	res, err := upstream.Exchange(context.Background(), GenerateQuery(4, testQuestion))
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint16(4), dns.MessageID(res))
+	}
+
+	assert.Equal(t, 2, responder.Accepted())
+
+	// Closing the upstream closes its idle connections, and new queries dial a new connection
+	assert.NoError(t, upstream.Close())
+
+	_, err = upstream.Exchange(context.Background(), GenerateQuery(5, testQuestion))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, responder.Accepted())
+}
+
+func TestHTTPSUpstream(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, dns.MediaType, r.Header.Get("Content-Type"))
+
+		msg, _ := io.ReadAll(r.Body)
+		msg[2] |= 0x80
+
+		switch r.URL.Path {
+		case "/unavailable":
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		case "/text":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write(msg)
+		default:
+			w.Header().Set("Content-Type", dns.MediaType)
+			w.Write(msg)
+		}
+	}))
+
+	defer server.Close()
+
+	upstream := &dns.HTTPSUpstream{Client: server.Client(), URL: server.URL + "/dns-query"}
+	assert.Equal(t, server.URL+"/dns-query", upstream.String())
+
+	res, err := upstream.Exchange(context.Background(), GenerateQuery(42, testQuestion))
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint16(42), dns.MessageID(res))
+	}
+
+	// Responses with another status or content type are rejected
+	upstream.URL = server.URL + "/unavailable"
+
+	_, err = upstream.Exchange(context.Background(), GenerateQuery(43, testQuestion))
+	assert.ErrorContains(t, err, "503")
+
+	upstream.URL = server.URL + "/text"
+
+	_, err = upstream.Exchange(context.Background(), GenerateQuery(44, testQuestion))
+	assert.ErrorIs(t, err, dns.ErrUpstreamMalformed)
+}
@@ -0,0 +1,67 @@
+package dns
+
+import (
+	"context"
+	"sync"
+
+	"go.uber.org/multierr"
+)
+
+// ServerGroup manages the lifecycle of several independent Servers, such as separate servers for
+// internal and external zones with different policies
+type ServerGroup struct {
+	servers []*Server
+	sync.Mutex
+}
+
+// Add registers Servers with the group
+func (group *ServerGroup) Add(servers ...*Server) {
+	group.Lock()
+	defer group.Unlock()
+
+	group.servers = append(group.servers, servers...)
+}
+
+// Servers returns the group's Servers
+func (group *ServerGroup) Servers() []*Server {
+	group.Lock()
+	defer group.Unlock()
+
+	return append([]*Server(nil), group.servers...)
+}
+
+// Shutdown shuts down all of the group's Servers in parallel, sharing the Context's deadline, and
+// returns their aggregated errors
+func (group *ServerGroup) Shutdown(ctx context.Context) (err error) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+
+	for _, server := range group.Servers() {
+		wg.Go(func() {
+			serr := server.Shutdown(ctx)
+
+			mu.Lock()
+			err = multierr.Append(err, serr)
+			mu.Unlock()
+		})
+	}
+
+	wg.Wait()
+	return
+}
+
+// Wait blocks until all of the group's Serve routines and handlers have returned
+func (group *ServerGroup) Wait() {
+	for _, server := range group.Servers() {
+		server.Wait()
+	}
+}
+
+// Stats returns the sum of the group's Server counters
+func (group *ServerGroup) Stats() (total Counters) {
+	for _, server := range group.Servers() {
+		total = total.Add(server.Stats.Load())
+	}
+
+	return
+}
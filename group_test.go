@@ -0,0 +1,47 @@
+package dns_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerGroup(t *testing.T) {
+	var group dns.ServerGroup
+	var internal, external dns.Server
+
+	group.Add(&internal, &external)
+
+	internal.Stats.Truncated.Add(2)
+	external.Stats.Truncated.Add(3)
+	external.Stats.Duplicates.Add(1)
+
+	assert.Equal(t, dns.Counters{Truncated: 5, Duplicates: 1}, group.Stats())
+
+	errs := make(chan error, 2)
+
+	for _, server := range group.Servers() {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go func() { errs <- server.Serve(conn) }()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// Give Serve routines a moment to register their connections
+	time.Sleep(50 * time.Millisecond)
+
+	assert.NoError(t, group.Shutdown(ctx))
+	assert.Error(t, <-errs)
+	assert.Error(t, <-errs)
+
+	group.Wait()
+}
@@ -2,11 +2,14 @@ package dns
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"net"
 	"time"
 
 	"github.com/jmanero/go-listen"
 	"github.com/jmanero/go-logging"
+	"go.uber.org/multierr"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
 )
@@ -20,48 +23,117 @@ type Options struct {
 
 // ListenOptions configures a listener
 type ListenOptions struct {
+	// Name identifies the listener in the Context of its requests. See ListenerFromContext. An
+	// empty Name identifies each of the listener's sockets by its bound address
+	Name string `json:"name,omitempty"`
+
 	Network string         `json:"network"`
 	Listen  string         `json:"listen"`
 	Socket  listen.Options `json:"options"`
+
+	// TLS serves DNS-over-TLS on a stream listener. See ListenAndServeTLS
+	TLS *tls.Config `json:"-"`
+}
+
+// PartialBindError is returned by the ListenAndServe helpers when some, but not all, of the
+// addresses that a ListenOptions expands to could be bound. The listeners that were bound are
+// serving, and callers may treat the error as a warning. Use errors.As to detect it
+type PartialBindError struct {
+	Listen string
+	Err    error
+}
+
+func (err *PartialBindError) Error() string {
+	return "dns: partial bind of " + err.Listen + ": " + err.Err.Error()
+}
+
+func (err *PartialBindError) Unwrap() error {
+	return err.Err
+}
+
+// bindResult classifies the error from opening a set of listeners. Any error is logged. If no
+// listener could be opened, the error is fatal and is returned as is. Otherwise it is wrapped
+// in a PartialBindError
+func bindResult(logger *zap.Logger, opts ListenOptions, count int, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if count == 0 {
+		logger.Error("listen.error", zap.Error(err))
+		return err
+	}
+
+	logger.Warn("listen.partial", zap.Error(err))
+	return &PartialBindError{Listen: opts.Listen, Err: err}
 }
 
-// ListenAndServeStream opens net.Listeners and starts accepting connections from them
+// ListenAndServeStream opens net.Listeners and starts accepting connections from them. If only some
+// of the listeners could be opened, the others are served and a *PartialBindError is returned
 func ListenAndServeStream(ctx context.Context, opts ListenOptions, group *errgroup.Group, server *Server) (err error) {
+	return listenAndServeStream(ctx, opts, group, server, server.ServeStream)
+}
+
+// ListenAndServeTLS opens net.Listeners and starts accepting DNS-over-TLS connections from them with
+// the options' TLS configuration. If only some of the listeners could be opened, the others are
+// served and a *PartialBindError is returned
+func ListenAndServeTLS(ctx context.Context, opts ListenOptions, group *errgroup.Group, server *Server) (err error) {
+	if opts.TLS == nil {
+		return ErrNoTLSConfig
+	}
+
+	return listenAndServeStream(ctx, opts, group, server, func(listener net.Listener) error {
+		return server.ServeTLS(listener, opts.TLS)
+	})
+}
+
+func listenAndServeStream(ctx context.Context, opts ListenOptions, group *errgroup.Group, server *Server, serve func(net.Listener) error) (err error) {
 	_, logger := logging.With(ctx, zap.String("bind", opts.Listen))
 
 	listeners, err := listen.Listen(ctx, opts.Network, opts.Listen, opts.Socket)
-	if err != nil && len(listeners) == 0 {
-		logger.Error("listen.error", zap.Error(err))
+	if err = bindResult(logger, opts, len(listeners), err); err != nil && len(listeners) == 0 {
 		return
 	}
 
 	for _, listener := range listeners {
 		logger.Info("listening", zap.Stringer("addr", listener.Addr()))
-		group.Go(func() error { return server.ServeStream(listener) })
+		if opts.Name != "" {
+			server.NameListener(listener.Addr(), opts.Name)
+		}
+
+		group.Go(func() error { return serve(listener) })
 	}
 
 	return
 }
 
-// ListenAndServeDatagram opens and binds net.PacketConns and starts reading message datagrams from them
+// ListenAndServeDatagram opens and binds net.PacketConns and starts reading message datagrams from them. If
+// only some of the connections could be opened, the others are served and a *PartialBindError is returned
 func ListenAndServeDatagram(ctx context.Context, opts ListenOptions, group *errgroup.Group, server *Server) (err error) {
 	_, logger := logging.With(ctx, zap.String("bind", opts.Listen))
 
 	conns, err := listen.Packet(ctx, opts.Network, opts.Listen, opts.Socket)
-	if err != nil && len(conns) == 0 {
+	if err = bindResult(logger, opts, len(conns), err); err != nil && len(conns) == 0 {
 		// Fail if no connections could be opened for the given address and options
 		return
 	}
 
 	for _, conn := range conns {
 		logger.Info("listening", zap.Stringer("addr", conn.LocalAddr()))
+		if opts.Name != "" {
+			server.NameListener(conn.LocalAddr(), opts.Name)
+		}
+
 		group.Go(func() error { return server.Serve(conn) })
 	}
 
 	return
 }
 
-// Serve creates a Server, starts configured listeners, and creates a shutdown monitor
+// Serve creates a Server, starts configured listeners, and creates a shutdown monitor. Serve stops at
+// the first listener that fails to bind entirely. Partial bind failures do not stop it from starting
+// the remaining listeners, and are returned together as *PartialBindError values once all of the
+// listeners have been started
 func Serve(ctx context.Context, opts Options, group *errgroup.Group, handler Handler) (err error) {
 	ctx, logger := logging.Named(ctx, "dns")
 
@@ -80,21 +152,71 @@ func Serve(ctx context.Context, opts Options, group *errgroup.Group, handler Han
 	// server routines and their listeners if subsequent ListenAndServeXXX calls fail
 	group.Go(func() error { return Shutdown(ctx, opts.Shutdown, service.Shutdown) })
 
+	return service.listen(ctx, opts, group)
+}
+
+// ListenAndServe starts the listeners in Options, and serves them until the Context is done or a
+// listener fails, then shuts the Server down within the Options' Shutdown timeout. It returns the
+// errors of the listeners and the shutdown, joined. Partial bind failures are included as
+// *PartialBindError values, but do not stop the Server. Use Serve and the ListenAndServeXXX helpers
+// to manage listeners with an errgroup.Group directly
+func (server *Server) ListenAndServe(ctx context.Context, opts Options) error {
+	group, ctx := errgroup.WithContext(ctx)
+
+	// A fatal bind error stops the listeners that were started
+	partial := server.listen(ctx, opts, group)
+	if partial != nil && !isPartial(partial) {
+		fatal := partial
+		partial = nil
+
+		group.Go(func() error { return fatal })
+	}
+
+	shutdown := Shutdown(ctx, opts.Shutdown, server.Shutdown)
+
+	// Listeners that were closed by the shutdown return net.ErrClosed
+	err := group.Wait()
+	if errors.Is(err, net.ErrClosed) || errors.Is(err, ErrServerClosed) {
+		err = nil
+	}
+
+	return multierr.Combine(partial, err, shutdown)
+}
+
+// listen starts the listeners in Options. It stops at the first listener that fails to bind
+// entirely, and returns partial bind failures together once all of the listeners have been started
+func (server *Server) listen(ctx context.Context, opts Options, group *errgroup.Group) (err error) {
+	var partial error
+
 	for _, opts := range opts.Streams {
-		err = ListenAndServeStream(ctx, opts, group, &service)
-		if err != nil {
+		if opts.TLS != nil {
+			err = ListenAndServeTLS(ctx, opts, group, server)
+		} else {
+			err = ListenAndServeStream(ctx, opts, group, server)
+		}
+
+		if err != nil && !isPartial(err) {
 			return
 		}
+
+		partial = multierr.Append(partial, err)
 	}
 
 	for _, opts := range opts.Datagrams {
-		err = ListenAndServeDatagram(ctx, opts, group, &service)
-		if err != nil {
+		err = ListenAndServeDatagram(ctx, opts, group, server)
+		if err != nil && !isPartial(err) {
 			return
 		}
+
+		partial = multierr.Append(partial, err)
 	}
 
-	return
+	return partial
+}
+
+func isPartial(err error) bool {
+	var partial *PartialBindError
+	return errors.As(err, &partial)
 }
 
 // Shutdown gracefully stops a server instance
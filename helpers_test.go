@@ -0,0 +1,150 @@
+package dns_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jmanero/go-dns"
+	"github.com/jmanero/go-listen/addrs"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sync/errgroup"
+)
+
+func init() {
+	// Expand to a loopback address that can be bound, and a TEST-NET-1 address that can not
+	addrs.AddHandler("partial", func([]string) ([]net.Addr, error) {
+		return []net.Addr{&net.IPAddr{IP: net.IP{127, 0, 0, 1}}, &net.IPAddr{IP: net.IP{192, 0, 2, 1}}}, nil
+	})
+}
+
+func TestPartialBind(t *testing.T) {
+	var group errgroup.Group
+
+	// BaseContext is called once a listener has been registered to be closed by Shutdown
+	serving := make(chan net.Addr, 2)
+	server := dns.Server{BaseContext: func(ctx context.Context, addr net.Addr) context.Context {
+		serving <- addr
+		return ctx
+	}}
+
+	opts := dns.ListenOptions{Network: "udp", Listen: "partial(test):0"}
+
+	err := dns.ListenAndServeDatagram(context.Background(), opts, &group, &server)
+
+	var partial *dns.PartialBindError
+	if assert.ErrorAs(t, err, &partial) {
+		assert.Equal(t, opts.Listen, partial.Listen)
+	}
+
+	opts.Network = "tcp"
+
+	err = dns.ListenAndServeStream(context.Background(), opts, &group, &server)
+	assert.ErrorAs(t, err, &partial)
+
+	// A complete failure to bind is not partial
+	opts.Listen = "192.0.2.1:0"
+
+	err = dns.ListenAndServeStream(context.Background(), opts, &group, &server)
+	assert.Error(t, err)
+	assert.NotErrorAs(t, err, &partial)
+
+	// Stop the listeners that were bound
+	<-serving
+	<-serving
+
+	assert.NoError(t, server.Shutdown(context.Background()))
+	assert.Error(t, group.Wait())
+}
+
+func TestListenerFromContext(t *testing.T) {
+	var group errgroup.Group
+	listeners := make(chan string)
+
+	server := dns.Server{
+		Handler: dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+			name, _ := dns.ListenerFromContext(req.Context())
+			listeners <- name
+
+			dns.ServerFailure(wr, req)
+		}),
+	}
+
+	// A TCP listener on the named UDP listener's port does not share its name
+	named, stream := ListenPair(t)
+
+	server.NameListener(named.LocalAddr(), "internal")
+	group.Go(func() error { return server.Serve(named) })
+	group.Go(func() error { return server.ServeStream(stream) })
+
+	unnamed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	group.Go(func() error { return server.Serve(unnamed) })
+
+	query := func(conn net.PacketConn) string {
+		client, err := net.Dial("udp", conn.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer client.Close()
+		client.Write(GenerateQuery(1, testQuestion))
+
+		return <-listeners
+	}
+
+	assert.Equal(t, "internal", query(named))
+	assert.Equal(t, unnamed.LocalAddr().String(), query(unnamed))
+
+	client, err := net.Dial("tcp", stream.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+	client.Write(GenerateFrame(1, testQuestion))
+
+	assert.Equal(t, stream.Addr().String(), <-listeners)
+
+	assert.NoError(t, server.Shutdown(context.Background()))
+	assert.Error(t, group.Wait())
+}
+
+func TestServerListenAndServe(t *testing.T) {
+	opts := dns.Options{
+		Streams:   []dns.ListenOptions{{Network: "tcp", Listen: "127.0.0.1:0"}},
+		Datagrams: []dns.ListenOptions{{Network: "udp", Listen: "partial(test):0"}},
+		Shutdown:  time.Second,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+
+	var server dns.Server
+	go func() { done <- server.ListenAndServe(ctx, opts) }()
+
+	// The server runs until the Context is done, and returns the partial bind failure
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	var partial *dns.PartialBindError
+	select {
+	case err := <-done:
+		assert.ErrorAs(t, err, &partial)
+		assert.NotErrorIs(t, err, net.ErrClosed)
+	case <-time.After(time.Second):
+		t.Fatal("ListenAndServe did not return")
+	}
+
+	// A listener that can not be bound stops the others
+	opts.Streams = append(opts.Streams, dns.ListenOptions{Network: "tcp", Listen: "192.0.2.1:0"})
+
+	var failed dns.Server
+	err := failed.ListenAndServe(context.Background(), opts)
+	assert.Error(t, err)
+	assert.NotErrorAs(t, err, &partial)
+}
@@ -0,0 +1,92 @@
+package dns
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyStats summarizes the time that a Server's Handler took to serve queries
+type LatencyStats struct {
+	Count uint64
+
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+}
+
+// Latency summarizes the handling time of the queries that the Server has served. Percentiles are
+// accurate to within 12.5%, and are reported as the upper bound of their histogram bucket
+func (server *Server) Latency() LatencyStats {
+	return server.latency.stats()
+}
+
+// Latency histogram buckets are log-linear: each power of two microseconds is divided into eight
+// buckets, covering up to 2^40 microseconds (about 12 days) in a fixed number of counters
+const (
+	latencySubBits = 3
+	latencySubs    = 1 << latencySubBits
+	latencyBuckets = (40-latencySubBits)*latencySubs + latencySubs
+)
+
+// latency is a bounded, lock-free histogram of handling times
+type latency struct {
+	buckets [latencyBuckets]atomic.Uint64
+}
+
+func (lat *latency) record(elapsed time.Duration) {
+	lat.buckets[latencyBucket(uint64(elapsed/time.Microsecond))].Add(1)
+}
+
+// latencyBucket returns the index of the bucket for a number of microseconds
+func latencyBucket(micros uint64) int {
+	exp := bits.Len64(micros)
+	if exp <= latencySubBits+1 {
+		return int(micros)
+	}
+
+	index := (exp-latencySubBits)*latencySubs + int(micros>>(exp-latencySubBits-1)) - latencySubs
+	return min(index, latencyBuckets-1)
+}
+
+// latencyBound returns the largest number of microseconds in a bucket
+func latencyBound(index int) uint64 {
+	if index < 2*latencySubs {
+		return uint64(index)
+	}
+
+	exp := index/latencySubs + latencySubBits
+	mantissa := uint64(index%latencySubs + latencySubs)
+
+	return (mantissa+1)<<(exp-latencySubBits-1) - 1
+}
+
+func (lat *latency) stats() (stats LatencyStats) {
+	var counts [latencyBuckets]uint64
+	for index := range lat.buckets {
+		counts[index] = lat.buckets[index].Load()
+		stats.Count += counts[index]
+	}
+
+	if stats.Count == 0 {
+		return
+	}
+
+	percentile := func(p uint64) time.Duration {
+		// The rank of the percentile, rounded up
+		rank := (stats.Count*p + 99) / 100
+
+		var seen uint64
+		for index, count := range counts {
+			seen += count
+			if seen >= rank {
+				return time.Duration(latencyBound(index)) * time.Microsecond
+			}
+		}
+
+		return time.Duration(latencyBound(latencyBuckets-1)) * time.Microsecond
+	}
+
+	stats.P50, stats.P90, stats.P99 = percentile(50), percentile(90), percentile(99)
+	return
+}
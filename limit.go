@@ -0,0 +1,45 @@
+package dns
+
+import (
+	"github.com/jmanero/go-logging"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// limitSize wraps a ResponseWriter to replace responses larger than MaxResponseSize with SERVFAIL
+func (server *Server) limitSize(wr ResponseWriter, req *Request) ResponseWriter {
+	if server.MaxResponseSize <= 0 {
+		return wr
+	}
+
+	return &sizeWriter{wrappedWriter: wrappedWriter{wr}, server: server, req: req}
+}
+
+// sizeWriter checks the size of each response before sending it
+type sizeWriter struct {
+	wrappedWriter
+
+	server *Server
+	req    *Request
+}
+
+// SendBuilder finalizes a Builder, and sends the resulting message if it is within the size limit
+func (wr *sizeWriter) SendBuilder(builder *dnsmessage.Builder) {
+	wr.sendBuilder(wr.SendMessage, builder)
+}
+
+// SendMessage sends a message if it is within the size limit, or sends SERVFAIL instead. Messages
+// sent directly with Send are not checked, as they may include transport framing
+func (wr *sizeWriter) SendMessage(msg []byte) {
+	if len(msg) <= wr.server.MaxResponseSize {
+		wr.ResponseWriter.SendMessage(msg)
+		return
+	}
+
+	wr.server.Stats.Oversized.Add(1)
+	wr.server.log(logging.FromContext(wr.req.Context()), zapcore.WarnLevel, "handler.oversized",
+		zap.Int("size", len(msg)), zap.Int("limit", wr.server.MaxResponseSize))
+
+	ServerFailure(wr.ResponseWriter, wr.req)
+}
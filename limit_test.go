@@ -0,0 +1,58 @@
+package dns_test
+
+import (
+	"testing"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestMaxResponseSize(t *testing.T) {
+	server := dns.Server{
+		MaxResponseSize: 1024,
+		Handler: dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+			var answer dns.Answer
+
+			// A bug that answers with far more records than intended
+			for i := range 4096 {
+				answer.Answers = append(answer.Answers, dnsmessage.Resource{
+					Header: dnsmessage.ResourceHeader{Name: testQuestion.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+					Body:   &dnsmessage.AResource{A: [4]byte{10, 0, byte(i >> 8), byte(i)}},
+				})
+			}
+
+			if req.ID == 2 {
+				answer.Answers = answer.Answers[:1]
+			}
+
+			dns.WriteAnswer(wr, req, &answer)
+		}),
+	}
+
+	var conn CapturePacketConn
+	for _, id := range []uint16{1, 2} {
+		req, err := dns.ParseRequest(server.Context(), GenerateQuery(id, testQuestion))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		server.Handle(server.Context(), req.Message(), &dns.PacketWriter{PacketConn: &conn, Request: req}, req)
+	}
+
+	assert.Equal(t, uint64(1), server.Stats.Oversized.Load())
+
+	if assert.Len(t, conn.sent, 2) {
+		var res dnsmessage.Message
+		if assert.NoError(t, res.Unpack(conn.sent[0])) {
+			assert.Equal(t, dnsmessage.RCodeServerFailure, res.RCode)
+			assert.Empty(t, res.Answers)
+		}
+
+		// Responses within the limit are sent
+		if assert.NoError(t, res.Unpack(conn.sent[1])) {
+			assert.Equal(t, dnsmessage.RCodeSuccess, res.RCode)
+			assert.Len(t, res.Answers, 1)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package dns
+
+import (
+	"context"
+	"net"
+)
+
+type listenerKeyType struct{}
+
+var listenerKey listenerKeyType
+
+// ContextWithListener sets the identity of the listener that requests handled with a Context were
+// received from
+func ContextWithListener(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, listenerKey, name)
+}
+
+// ListenerFromContext returns the identity of the listener that a request was received from, so
+// that handlers on a multi-homed server can apply policies by ingress point. Listeners are
+// identified by the Name in their ListenOptions, or by their bound address. The boolean result is
+// false if the Context was not derived from a Server's listener
+func ListenerFromContext(ctx context.Context) (string, bool) {
+	name, found := ctx.Value(listenerKey).(string)
+	return name, found
+}
+
+// NameListener sets the identity of the listener or PacketConn bound to an address, for
+// ListenerFromContext. Addresses are qualified by their network, so that UDP and TCP listeners on
+// the same port may have different names. It must be called before the listener is served
+func (server *Server) NameListener(addr net.Addr, name string) {
+	server.names.Store(addr.Network()+"/"+addr.String(), name)
+}
+
+// listenerName returns the identity of a listener by its bound address
+func (server *Server) listenerName(addr net.Addr) string {
+	if name, found := server.names.Load(addr.Network() + "/" + addr.String()); found {
+		return name.(string)
+	}
+
+	return addr.String()
+}
@@ -0,0 +1,82 @@
+package dns
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ErrHandlerPanic is passed to Metrics.Error when a Handler panics
+var ErrHandlerPanic = errors.New("dns: handler panicked")
+
+// Metrics receives the outcome of each message that a Server handles, so that query counts, latency
+// and error rates can be exported to a monitoring system without a dependency in this package.
+// Methods are called concurrently, and must not block
+type Metrics interface {
+	// QueryReceived is called when a message's header has been parsed and it is accepted. The type
+	// is that of the first question, or zero for a message without a question
+	QueryReceived(transport string, qtype dnsmessage.Type)
+
+	// ResponseSent is called when the Handler returns or panics, if it sent a response. The RCODE is
+	// that of the first response, and the duration covers the whole ServeDNS call
+	ResponseSent(transport string, rcode dnsmessage.RCode, elapsed time.Duration)
+
+	// Error is called when a message can not be parsed, or with ErrHandlerPanic when the Handler
+	// panics. A Handler that panics after it sends a response is reported to both ResponseSent and Error
+	Error(transport string, err error)
+}
+
+// received reports an accepted query to the Server's Metrics
+func (server *Server) received(req *Request) {
+	if server.Metrics == nil {
+		return
+	}
+
+	var qtype dnsmessage.Type
+	if questions, err := req.Questions(); err == nil && len(questions) > 0 {
+		qtype = questions[0].Type
+	}
+
+	server.Metrics.QueryReceived(req.Transport(), qtype)
+}
+
+// measure wraps a ResponseWriter to capture the RCODE of the Handler's first response
+func (server *Server) measure(wr ResponseWriter) ResponseWriter {
+	if server.Metrics == nil {
+		return wr
+	}
+
+	return &metricsWriter{wrappedWriter: wrappedWriter{wr}}
+}
+
+// measured reports the outcome of a Handler to the Server's Metrics, when the Handler returns. It is
+// also called while a panicking Handler unwinds, before the panic is recovered and reported
+func (server *Server) measured(wr ResponseWriter, req *Request, start time.Time) {
+	if metrics, is := wr.(*metricsWriter); is && metrics.sent {
+		server.Metrics.ResponseSent(req.Transport(), metrics.rcode, time.Since(start))
+	}
+}
+
+// metricsWriter records the RCODE of the first message sent by a Handler
+type metricsWriter struct {
+	wrappedWriter
+
+	rcode dnsmessage.RCode
+	sent  bool
+}
+
+// SendBuilder finalizes a Builder, and sends the resulting message
+func (wr *metricsWriter) SendBuilder(builder *dnsmessage.Builder) {
+	wr.sendBuilder(wr.SendMessage, builder)
+}
+
+// SendMessage records the RCODE of the first message, and sends it
+func (wr *metricsWriter) SendMessage(msg []byte) {
+	if !wr.sent && len(msg) >= 12 {
+		wr.rcode = dnsmessage.RCode(msg[3] & 0x0f)
+		wr.sent = true
+	}
+
+	wr.ResponseWriter.SendMessage(msg)
+}
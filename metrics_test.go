@@ -0,0 +1,115 @@
+package dns_test
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// MetricsRecorder records the calls to its Metrics methods
+type MetricsRecorder struct {
+	received []dnsmessage.Type
+	rcodes   []dnsmessage.RCode
+	elapsed  []time.Duration
+	errors   []error
+	sync.Mutex
+}
+
+func (mr *MetricsRecorder) QueryReceived(transport string, qtype dnsmessage.Type) {
+	mr.Lock()
+	defer mr.Unlock()
+
+	mr.received = append(mr.received, qtype)
+}
+
+func (mr *MetricsRecorder) ResponseSent(transport string, rcode dnsmessage.RCode, elapsed time.Duration) {
+	mr.Lock()
+	defer mr.Unlock()
+
+	mr.rcodes = append(mr.rcodes, rcode)
+	mr.elapsed = append(mr.elapsed, elapsed)
+}
+
+func (mr *MetricsRecorder) Error(transport string, err error) {
+	mr.Lock()
+	defer mr.Unlock()
+
+	mr.errors = append(mr.errors, err)
+}
+
+func TestMetrics(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var metrics MetricsRecorder
+
+	server := dns.Server{
+		Metrics: &metrics,
+		Handler: dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+			switch req.ID {
+			case 2:
+				panic("handler failed")
+			case 3:
+				dns.Refuse(wr, req)
+				panic("handler failed after responding")
+			}
+
+			dns.ServerFailure(wr, req)
+
+			// The duration covers the Handler's work after its response is sent
+			time.Sleep(20 * time.Millisecond)
+		}),
+	}
+
+	go server.Serve(conn)
+	defer server.CloseAll()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+
+	client.Write(GenerateQuery(1, testQuestion))
+	client.Write(GenerateQuery(2, testQuestion))
+	client.Write(GenerateQuery(3, testQuestion))
+	client.Write([]byte{0, 3, 1})
+
+	assert.Eventually(t, func() bool {
+		metrics.Lock()
+		defer metrics.Unlock()
+
+		return len(metrics.rcodes) == 2 && len(metrics.errors) == 3
+	}, time.Second, time.Millisecond)
+
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	assert.Equal(t, []dnsmessage.Type{testQuestion.Type, testQuestion.Type, testQuestion.Type}, metrics.received)
+
+	// A Handler that panics after it responds is reported with both its response and the panic
+	assert.ElementsMatch(t, []dnsmessage.RCode{dnsmessage.RCodeServerFailure, dnsmessage.RCodeRefused}, metrics.rcodes)
+
+	var panics int
+	for _, err := range metrics.errors {
+		if err == dns.ErrHandlerPanic {
+			panics++
+		}
+	}
+
+	assert.Equal(t, 2, panics)
+
+	for i, rcode := range metrics.rcodes {
+		if rcode == dnsmessage.RCodeServerFailure {
+			assert.GreaterOrEqual(t, metrics.elapsed[i], 20*time.Millisecond)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package dns
+
+import (
+	"runtime/debug"
+
+	"github.com/jmanero/go-logging"
+	"go.uber.org/zap"
+)
+
+// Middleware wraps a Handler to add behavior before or after it serves a request
+type Middleware func(Handler) Handler
+
+// Chain wraps a Handler with Middlewares. The first Middleware is the outermost, and sees each
+// request first
+func Chain(handler Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+
+	return handler
+}
+
+// RecoverMiddleware recovers a panic from the wrapped Handler and logs it as "handler.panic" with
+// the request's logger, so that a layer's failure is contained where it is composed. The Server
+// recovers panics that reach it in the same way
+func RecoverMiddleware(next Handler) Handler {
+	return HandlerFunc(func(wr ResponseWriter, req *Request) {
+		defer func() {
+			if value := recover(); value != nil {
+				logging.FromContext(req.Context()).Error("handler.panic", panicFields(value)...)
+			}
+		}()
+
+		next.ServeDNS(wr, req)
+	})
+}
+
+// panicFields describes a recovered panic, with the stack of the goroutine that recovered it
+func panicFields(value any) []zap.Field {
+	return []zap.Field{zap.Any("panic", value), zap.String("stack", string(debug.Stack()))}
+}
@@ -0,0 +1,52 @@
+package dns_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChain(t *testing.T) {
+	var order []string
+
+	layer := func(name string) dns.Middleware {
+		return func(next dns.Handler) dns.Handler {
+			return dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+				order = append(order, name)
+				next.ServeDNS(wr, req)
+			})
+		}
+	}
+
+	handler := dns.Chain(dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+		order = append(order, "handler")
+		dns.ServerFailure(wr, req)
+	}), layer("outer"), layer("inner"))
+
+	Exchange(t, handler, GenerateQuery(42, testQuestion))
+	assert.Equal(t, []string{"outer", "inner", "handler"}, order)
+}
+
+func TestRecoverMiddleware(t *testing.T) {
+	var after bool
+
+	handler := dns.Chain(dns.HandlerFunc(func(dns.ResponseWriter, *dns.Request) {
+		panic("handler failed")
+	}), func(next dns.Handler) dns.Handler {
+		return dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+			next.ServeDNS(wr, req)
+			after = true
+		})
+	}, dns.RecoverMiddleware)
+
+	req, err := dns.ParseRequest(context.Background(), GenerateQuery(42, testQuestion))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Outer layers continue after the panic is recovered
+	assert.NotPanics(t, func() { handler.ServeDNS(dns.NewMessageWriter(nil), req) })
+	assert.True(t, after)
+}
@@ -0,0 +1,143 @@
+package dns
+
+import (
+	"cmp"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ServeMux dispatches queries to Handlers by the name and type of their first question. Patterns
+// are exact names, such as "www.example.com.", or wildcards that match the names below a suffix,
+// such as "*.example.com.". Names are compared without regard to case. A ServeMux is safe for
+// concurrent use.
+//
+// The most specific pattern is chosen: an exact name, then the wildcard with the longest suffix. For
+// each pattern, a Handler registered for the question's type is preferred to one registered for
+// any type
+type ServeMux struct {
+	// Default serves queries that do not match a pattern. A nil Default rejects them according to the
+	// request's Refusal policy
+	Default Handler
+
+	routes map[muxKey]Handler
+	sync.RWMutex
+}
+
+var _ Handler = &ServeMux{}
+
+type muxKey struct {
+	name     string
+	wildcard bool
+	qtype    dnsmessage.Type
+}
+
+// Handle registers the Handler for a pattern and question type, replacing any existing Handler. A
+// zero qtype matches any type. Handle panics if the pattern is empty or has a wildcard label other
+// than its first
+func (mux *ServeMux) Handle(pattern string, qtype dnsmessage.Type, handler Handler) {
+	key := muxKey{name: canonicalPattern(pattern), qtype: qtype}
+	if rest, found := strings.CutPrefix(key.name, "*."); found {
+		key.name, key.wildcard = cmp.Or(rest, "."), true
+	}
+
+	if pattern == "" || strings.Contains(key.name, "*") {
+		panic("dns: invalid ServeMux pattern " + pattern)
+	}
+
+	mux.Lock()
+	defer mux.Unlock()
+
+	if mux.routes == nil {
+		mux.routes = map[muxKey]Handler{}
+	}
+
+	mux.routes[key] = handler
+}
+
+// HandleFunc registers a handler function for a pattern and question type
+func (mux *ServeMux) HandleFunc(pattern string, qtype dnsmessage.Type, handler HandlerFunc) {
+	mux.Handle(pattern, qtype, handler)
+}
+
+// Handler returns the Handler for a question, and the pattern that it matched. The Handler is nil
+// if no pattern matches
+func (mux *ServeMux) Handler(question dnsmessage.Question) (Handler, string) {
+	name := canonicalPattern(question.Name.String())
+
+	mux.RLock()
+	defer mux.RUnlock()
+
+	if handler := mux.route(name, false, question.Type); handler != nil {
+		return handler, name
+	}
+
+	// Wildcards match names strictly below their suffix
+	for suffix := name; suffix != "."; {
+		_, suffix, _ = strings.Cut(suffix, ".")
+		if suffix == "" {
+			suffix = "."
+		}
+
+		if handler := mux.route(suffix, true, question.Type); handler != nil {
+			if suffix == "." {
+				return handler, "*."
+			}
+
+			return handler, "*." + suffix
+		}
+	}
+
+	return nil, ""
+}
+
+// route finds the Handler for a pattern, preferring one that is registered for a type
+func (mux *ServeMux) route(name string, wildcard bool, qtype dnsmessage.Type) Handler {
+	if handler, has := mux.routes[muxKey{name, wildcard, qtype}]; has {
+		return handler
+	}
+
+	return mux.routes[muxKey{name, wildcard, 0}]
+}
+
+// ServeDNS dispatches a request to the Handler for its first question. Messages without a question
+// are answered with NoQuestion
+func (mux *ServeMux) ServeDNS(wr ResponseWriter, req *Request) {
+	questions, err := req.Questions()
+
+	switch {
+	case err != nil:
+		WriteError(wr, req, dnsmessage.RCodeFormatError)
+		return
+
+	case len(questions) == 0:
+		NoQuestion(wr, req)
+		return
+	}
+
+	if handler, pattern := mux.Handler(questions[0]); handler != nil {
+		req.Explain("mux: pattern %s", pattern)
+		handler.ServeDNS(wr, req)
+		return
+	}
+
+	if mux.Default != nil {
+		req.Explain("mux: default")
+		mux.Default.ServeDNS(wr, req)
+		return
+	}
+
+	req.Explain("mux: no route")
+	Refuse(wr, req)
+}
+
+// canonicalPattern lowercases a name, and makes it fully qualified
+func canonicalPattern(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+
+	return name
+}
@@ -0,0 +1,69 @@
+package dns_test
+
+import (
+	"testing"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestServeMux(t *testing.T) {
+	var mux dns.ServeMux
+
+	var routed string
+	route := func(name string) dns.HandlerFunc {
+		return func(wr dns.ResponseWriter, req *dns.Request) {
+			routed = name
+			dns.ServerFailure(wr, req)
+		}
+	}
+
+	mux.HandleFunc("www.example.com.", dnsmessage.TypeA, route("www A"))
+	mux.HandleFunc("www.example.com", 0, route("www"))
+	mux.HandleFunc("*.example.com.", 0, route("*.example.com"))
+	mux.HandleFunc("*.sub.example.com.", dnsmessage.TypeTXT, route("*.sub.example.com TXT"))
+	mux.HandleFunc("*.", dnsmessage.TypeSOA, route("* SOA"))
+
+	query := func(name string, qtype dnsmessage.Type) (string, dnsmessage.RCode) {
+		routed = ""
+		res := Exchange(t, &mux, GenerateQuery(1, dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}))
+
+		return routed, res.RCode
+	}
+
+	for _, test := range []struct {
+		name   string
+		qtype  dnsmessage.Type
+		routed string
+	}{
+		// Exact names are preferred to wildcards, and types to any type
+		{"www.example.com.", dnsmessage.TypeA, "www A"},
+		{"WWW.Example.COM.", dnsmessage.TypeAAAA, "www"},
+
+		// The longest wildcard suffix is preferred
+		{"a.sub.example.com.", dnsmessage.TypeTXT, "*.sub.example.com TXT"},
+		{"a.sub.example.com.", dnsmessage.TypeA, "*.example.com"},
+		{"a.b.example.com.", dnsmessage.TypeA, "*.example.com"},
+		{"example.org.", dnsmessage.TypeSOA, "* SOA"},
+	} {
+		routed, rcode := query(test.name, test.qtype)
+		assert.Equal(t, test.routed, routed, test.name)
+		assert.Equal(t, dnsmessage.RCodeServerFailure, rcode)
+	}
+
+	// Wildcards do not match their suffix, and unmatched queries are refused
+	routed, rcode := query("example.com.", dnsmessage.TypeA)
+	assert.Empty(t, routed)
+	assert.Equal(t, dnsmessage.RCodeRefused, rcode)
+
+	mux.Default = route("default")
+
+	routed, _ = query("example.org.", dnsmessage.TypeA)
+	assert.Equal(t, "default", routed)
+
+	_, pattern := mux.Handler(dnsmessage.Question{Name: dnsmessage.MustNewName("x.sub.example.com."), Type: dnsmessage.TypeTXT})
+	assert.Equal(t, "*.sub.example.com.", pattern)
+
+	assert.Panics(t, func() { mux.HandleFunc("www.*.example.com.", 0, route("invalid")) })
+}
@@ -0,0 +1,84 @@
+//go:build unix
+
+package dns_test
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// DelayListener disables TCP_NODELAY on the connections that it accepts
+type DelayListener struct {
+	net.Listener
+}
+
+func (listener *DelayListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err == nil {
+		conn.(*net.TCPConn).SetNoDelay(false)
+	}
+
+	return conn, err
+}
+
+// NoDelay reads the TCP_NODELAY option of a TCP connection's socket
+func NoDelay(t *testing.T, conn net.Conn) bool {
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var value int
+	var serr error
+
+	err = raw.Control(func(fd uintptr) {
+		value, serr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+	})
+
+	if err != nil || serr != nil {
+		t.Fatal(err, serr)
+	}
+
+	return value != 0
+}
+
+func TestTCPNoDelay(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		nodelay := make(chan bool, 1)
+		server := dns.Server{
+			TCPNoDelay: enabled,
+			ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+				nodelay <- NoDelay(t, conn)
+				return ctx
+			},
+		}
+
+		go server.ServeStream(&DelayListener{Listener: listener})
+
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case value := <-nodelay:
+			assert.Equal(t, enabled, value)
+		case <-time.After(time.Second):
+			t.Error("connection was not accepted")
+		}
+
+		conn.Close()
+		server.Shutdown(context.Background())
+	}
+}
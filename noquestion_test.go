@@ -0,0 +1,97 @@
+package dns_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// GenerateProbe builds an EDNS0 probe without a question, with optional EDNS0 options
+func GenerateProbe(id uint16, options ...dnsmessage.Option) []byte {
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id})
+	builder.StartAdditionals()
+
+	var header dnsmessage.ResourceHeader
+	header.SetEDNS0(1232, dnsmessage.RCodeSuccess, false)
+	builder.OPTResource(header, dnsmessage.OPTResource{Options: options})
+
+	buf, err := builder.Finish()
+	if err != nil {
+		panic(err)
+	}
+
+	return buf
+}
+
+func TestNoQuestionTransports(t *testing.T) {
+	handler := dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+		questions, err := req.AllQuestions()
+		assert.NoError(t, err)
+		assert.Empty(t, questions)
+
+		// Repeated reads of the empty section are consistent
+		questions, err = req.Questions()
+		assert.NoError(t, err)
+		assert.Empty(t, questions)
+
+		_, err = req.QuestionClass()
+		assert.ErrorIs(t, err, dns.ErrNoQuestion)
+
+		edns, found, err := req.ClientEDNS()
+		if assert.NoError(t, err) && assert.True(t, found) {
+			assert.Equal(t, uint16(1232), edns.UDPSize)
+		}
+
+		assert.NoError(t, dns.NoQuestion(wr, req))
+	})
+
+	server := dns.Server{
+		Handler:      dns.ClassANY(dns.ClassANYAsINET)(dns.RestrictTypes(dnsmessage.TypeA)(handler)),
+		DedupRetries: true,
+		CacheEDNS:    true,
+		Tap:          func(dns.TapEvent) {},
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go server.Serve(conn)
+	go server.ServeStream(listener)
+	defer server.Shutdown(context.Background())
+
+	client := dns.Client{Timeout: time.Second}
+
+	for transport, exchange := range map[string]func() ([]byte, error){
+		"udp": func() ([]byte, error) {
+			return client.Exchange(context.Background(), GenerateProbe(42), conn.LocalAddr().String())
+		},
+		"tcp": func() ([]byte, error) {
+			return client.ExchangeStream(context.Background(), GenerateProbe(42), listener.Addr().String())
+		},
+	} {
+		res, err := exchange()
+		if !assert.NoError(t, err, transport) {
+			continue
+		}
+
+		var msg dnsmessage.Message
+		if assert.NoError(t, msg.Unpack(res), transport) {
+			assert.Equal(t, uint16(42), msg.ID, transport)
+			assert.Equal(t, dnsmessage.RCodeSuccess, msg.RCode, transport)
+			assert.Empty(t, msg.Questions, transport)
+			assert.Len(t, msg.Additionals, 1, transport)
+		}
+	}
+}
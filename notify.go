@@ -0,0 +1,158 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/multierr"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// OpCodeNotify identifies NOTIFY messages (RFC 1996)
+const OpCodeNotify dnsmessage.OpCode = 4
+
+// ErrNotAcknowledged is returned when a secondary does not acknowledge a NOTIFY before retries are exhausted
+var ErrNotAcknowledged = errors.New("dns: NOTIFY was not acknowledged")
+
+// Notifier sends NOTIFY messages from a primary server to its secondaries when a zone changes
+type Notifier struct {
+	// Client sends NOTIFY messages. A nil value uses a zero Client
+	Client *Client
+
+	// Interval is the time to wait for an acknowledgement before retransmitting. A zero value uses two seconds
+	Interval time.Duration
+	// Retries is the number of retransmissions after the first attempt. A zero value uses five, and a
+	// negative value sends each NOTIFY once
+	Retries int
+}
+
+// Notify sends a NOTIFY for a zone to each secondary in parallel over UDP, retransmitting until each
+// secondary acknowledges it. The returned error aggregates the failures for each secondary
+func (notifier *Notifier) Notify(ctx context.Context, zone dnsmessage.Name, secondaries []net.Addr) error {
+	return notifier.notify(ctx, zone, nil, secondaries)
+}
+
+// NotifyZone sends a NOTIFY for a Zone to each secondary, and includes the zone's current SOA
+// record in the answer section as a hint to the secondaries (RFC 1996, section 3.7)
+func (notifier *Notifier) NotifyZone(ctx context.Context, zone *Zone, secondaries []net.Addr) error {
+	soa := zone.SOA()
+	return notifier.notify(ctx, zone.Origin(), &soa, secondaries)
+}
+
+func (notifier *Notifier) notify(ctx context.Context, zone dnsmessage.Name, soa *dnsmessage.Resource, secondaries []net.Addr) (err error) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+
+	for _, secondary := range secondaries {
+		wg.Go(func() {
+			msg, nerr := NotifyMessage(uint16(rand.Uint32()), zone, soa)
+			if nerr == nil {
+				nerr = notifier.send(ctx, msg, secondary.String())
+			}
+
+			if nerr != nil {
+				mu.Lock()
+				err = multierr.Append(err, fmt.Errorf("%s: %w", secondary, nerr))
+				mu.Unlock()
+			}
+		})
+	}
+
+	wg.Wait()
+	return
+}
+
+func (notifier *Notifier) send(ctx context.Context, msg []byte, addr string) (err error) {
+	client := orDefault(notifier.Client, defaultClient)
+
+	interval := notifier.Interval
+	if interval == 0 {
+		interval = 2 * time.Second
+	}
+
+	retries := notifier.Retries
+	switch {
+	case retries == 0:
+		retries = 5
+	case retries < 0:
+		retries = 0
+	}
+
+	for range retries + 1 {
+		attempt, cancel := context.WithTimeout(ctx, interval)
+
+		var res []byte
+		res, err = client.Exchange(attempt, msg, addr)
+		if err == nil {
+			cancel()
+			return checkNotifyResponse(res)
+		}
+
+		// Wait for the rest of the interval before retransmitting
+		<-attempt.Done()
+		cancel()
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+
+	return multierr.Append(ErrNotAcknowledged, err)
+}
+
+// NotifyMessage builds a NOTIFY message for a zone, with an optional SOA answer
+func NotifyMessage(id uint16, zone dnsmessage.Name, soa *dnsmessage.Resource) ([]byte, error) {
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:            id,
+		OpCode:        OpCodeNotify,
+		Authoritative: true,
+	})
+
+	err := builder.StartQuestions()
+	if err != nil {
+		return nil, err
+	}
+
+	err = builder.Question(dnsmessage.Question{Name: zone, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET})
+	if err != nil {
+		return nil, err
+	}
+
+	if soa != nil {
+		err = builder.StartAnswers()
+		if err != nil {
+			return nil, err
+		}
+
+		err = AppendResource(&builder, *soa)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return builder.Finish()
+}
+
+func checkNotifyResponse(res []byte) error {
+	var parser dnsmessage.Parser
+
+	header, err := parser.Start(res)
+	if err != nil {
+		return err
+	}
+
+	if !header.Response || header.OpCode != OpCodeNotify {
+		return fmt.Errorf("dns: unexpected response to NOTIFY: %s", header.GoString())
+	}
+
+	if header.RCode != dnsmessage.RCodeSuccess {
+		return fmt.Errorf("dns: NOTIFY rejected with %s", header.RCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,70 @@
+package dns_test
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestNotify(t *testing.T) {
+	var received atomic.Int32
+
+	// Acknowledge the third NOTIFY
+	conn := RawDatagram(t, func(query []byte) [][]byte {
+		var parser dnsmessage.Parser
+
+		header, err := parser.Start(query)
+		if assert.NoError(t, err) {
+			assert.Equal(t, dns.OpCodeNotify, header.OpCode)
+		}
+
+		if received.Add(1) < 3 {
+			return nil
+		}
+
+		return [][]byte{Echo(query, 0)}
+	})
+
+	secondaries := []net.Addr{conn.LocalAddr()}
+	zone := dnsmessage.MustNewName("example.com.")
+
+	notifier := dns.Notifier{Interval: 20 * time.Millisecond}
+	assert.NoError(t, notifier.Notify(context.Background(), zone, secondaries))
+	assert.Equal(t, int32(3), received.Load())
+
+	// Retransmissions stop after Retries
+	received.Store(-10)
+
+	notifier.Retries = 2
+	assert.ErrorIs(t, notifier.Notify(context.Background(), zone, secondaries), dns.ErrNotAcknowledged)
+	assert.Equal(t, int32(-7), received.Load())
+
+	// A negative value sends a single NOTIFY
+	received.Store(-10)
+
+	notifier.Retries = -1
+	assert.ErrorIs(t, notifier.Notify(context.Background(), zone, secondaries), dns.ErrNotAcknowledged)
+	assert.Equal(t, int32(-9), received.Load())
+}
+
+func TestNotifyRejected(t *testing.T) {
+	conn := RawDatagram(t, func(query []byte) [][]byte {
+		res := Echo(query, 0)
+		res[3] = byte(dnsmessage.RCodeNotImplemented)
+
+		return [][]byte{res}
+	})
+
+	notifier := dns.Notifier{Interval: 20 * time.Millisecond}
+
+	err := notifier.Notify(context.Background(), dnsmessage.MustNewName("example.com."), []net.Addr{conn.LocalAddr()})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "NOTIFY rejected")
+	}
+}
@@ -0,0 +1,467 @@
+package dns
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNSSEC record types (RFC 4034, RFC 5155). The dnsmessage package does not parse them, and they
+// are carried as UnknownResource bodies
+const (
+	TypeRRSIG dnsmessage.Type = 46
+	TypeNSEC  dnsmessage.Type = 47
+	TypeNSEC3 dnsmessage.Type = 50
+)
+
+// NSEC3HashSHA1 is the only NSEC3 hash algorithm (RFC 5155, section 11)
+const NSEC3HashSHA1 uint8 = 1
+
+// NSEC errors
+var (
+	ErrNSECRecord  = errors.New("dns: malformed NSEC or NSEC3 record")
+	ErrNSEC3Params = errors.New("dns: NSEC3 records have different parameters")
+	ErrNSEC3Hash   = errors.New("dns: unsupported NSEC3 hash algorithm")
+	ErrNameTooLong = errors.New("dns: name exceeds 255 octets")
+)
+
+// nsec3Encoding encodes hashed owner names as lower-case base32hex without padding. The encoding
+// preserves the order of the hashes
+var nsec3Encoding = base32.NewEncoding("0123456789abcdefghijklmnopqrstuv").WithPadding(base32.NoPadding)
+
+// CanonicalCompare compares two names in the canonical DNS name order (RFC 4034, section 6.1):
+// labels are compared from the root, as case-folded octet strings. It returns -1, 0, or 1
+func CanonicalCompare(a, b dnsmessage.Name) int {
+	left, right := canonicalLabels(a), canonicalLabels(b)
+
+	for i := 1; i <= min(len(left), len(right)); i++ {
+		if c := strings.Compare(left[len(left)-i], right[len(right)-i]); c != 0 {
+			return c
+		}
+	}
+
+	return cmp.Compare(len(left), len(right))
+}
+
+// canonicalLabels returns the lower-cased labels of a name, without the root label
+func canonicalLabels(name dnsmessage.Name) []string {
+	key := strings.TrimSuffix(CanonicalName(name), ".")
+	if key == "" {
+		return nil
+	}
+
+	return strings.Split(key, ".")
+}
+
+// canonicalWire encodes a name in the canonical wire format: uncompressed, with lower-cased labels
+func canonicalWire(name dnsmessage.Name) ([]byte, error) {
+	var wire []byte
+	for _, label := range canonicalLabels(name) {
+		wire = append(wire, byte(len(label)))
+		wire = append(wire, label...)
+	}
+
+	wire = append(wire, 0)
+	if len(wire) > 255 {
+		return nil, ErrNameTooLong
+	}
+
+	return wire, nil
+}
+
+// NSEC3Hash computes the hashed owner name of a name (RFC 5155, section 5)
+func NSEC3Hash(name dnsmessage.Name, algorithm uint8, iterations uint16, salt []byte) ([]byte, error) {
+	if algorithm != NSEC3HashSHA1 {
+		return nil, ErrNSEC3Hash
+	}
+
+	wire, err := canonicalWire(name)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha1.Sum(append(wire, salt...))
+	for range iterations {
+		digest = sha1.Sum(append(digest[:], salt...))
+	}
+
+	return digest[:], nil
+}
+
+// NSEC3Owner returns the owner name of the NSEC3 record for a hash in a zone
+func NSEC3Owner(hash []byte, zone dnsmessage.Name) (dnsmessage.Name, error) {
+	return dnsmessage.NewName(nsec3Encoding.EncodeToString(hash) + "." + strings.TrimPrefix(zone.String(), "."))
+}
+
+// TypeBitmap encodes a set of types as the type bit maps field of an NSEC or NSEC3 record (RFC 4034,
+// section 4.1.2)
+func TypeBitmap(types ...dnsmessage.Type) []byte {
+	types = slices.Clone(types)
+	slices.Sort(types)
+
+	var bitmap []byte
+	window, block := -1, []byte(nil)
+
+	flush := func() {
+		if window >= 0 {
+			bitmap = append(bitmap, byte(window), byte(len(block)))
+			bitmap = append(bitmap, block...)
+		}
+	}
+
+	for _, rtype := range slices.Compact(types) {
+		if int(rtype>>8) != window {
+			flush()
+			window, block = int(rtype>>8), nil
+		}
+
+		octet := int(rtype&0xff) / 8
+		for len(block) <= octet {
+			block = append(block, 0)
+		}
+
+		block[octet] |= 0x80 >> (rtype & 7)
+	}
+
+	flush()
+	return bitmap
+}
+
+// NSECResource creates the body of an NSEC record with the next owner name in the zone's chain, and
+// the types that exist at the record's owner name
+func NSECResource(next dnsmessage.Name, types ...dnsmessage.Type) (*dnsmessage.UnknownResource, error) {
+	wire, err := canonicalWire(next)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dnsmessage.UnknownResource{Type: TypeNSEC, Data: append(wire, TypeBitmap(types...)...)}, nil
+}
+
+// NSEC3Params holds the hash parameters of a zone's NSEC3 chain
+type NSEC3Params struct {
+	Algorithm  uint8
+	Flags      uint8
+	Iterations uint16
+	Salt       []byte
+}
+
+// Hash computes the hashed owner name of a name with the parameters
+func (params NSEC3Params) Hash(name dnsmessage.Name) ([]byte, error) {
+	return NSEC3Hash(name, params.Algorithm, params.Iterations, params.Salt)
+}
+
+// NSEC3Resource creates the body of an NSEC3 record with the next hashed owner name in the zone's
+// chain, and the types that exist at the record's original owner name
+func NSEC3Resource(params NSEC3Params, next []byte, types ...dnsmessage.Type) *dnsmessage.UnknownResource {
+	data := []byte{params.Algorithm, params.Flags}
+	data = binary.BigEndian.AppendUint16(data, params.Iterations)
+	data = append(data, byte(len(params.Salt)))
+	data = append(data, params.Salt...)
+	data = append(data, byte(len(next)))
+	data = append(data, next...)
+
+	return &dnsmessage.UnknownResource{Type: TypeNSEC3, Data: append(data, TypeBitmap(types...)...)}
+}
+
+// parseNSEC3 reads the parameters and next hashed owner of an NSEC3 record's RDATA
+func parseNSEC3(data []byte) (params NSEC3Params, next []byte, err error) {
+	if len(data) < 5 || len(data) < 6+int(data[4]) {
+		return params, nil, ErrNSECRecord
+	}
+
+	params = NSEC3Params{Algorithm: data[0], Flags: data[1], Iterations: binary.BigEndian.Uint16(data[2:])}
+	params.Salt = data[5 : 5+int(data[4])]
+
+	offset := 5 + len(params.Salt)
+	if len(data) < offset+1+int(data[offset]) {
+		return params, nil, ErrNSECRecord
+	}
+
+	return params, data[offset+1 : offset+1+int(data[offset])], nil
+}
+
+// unknownData returns the RDATA of a record that is carried as an UnknownResource
+func unknownData(record dnsmessage.Resource) ([]byte, error) {
+	body, is := record.Body.(*dnsmessage.UnknownResource)
+	if !is {
+		return nil, ErrNSECRecord
+	}
+
+	return body.Data, nil
+}
+
+// nsec3Entry is an NSEC3 record indexed by the hash in its owner name
+type nsec3Entry struct {
+	hash   []byte
+	record dnsmessage.Resource
+}
+
+type signatureKey struct {
+	owner   string
+	covered dnsmessage.Type
+}
+
+// SortedZone holds a zone's NSEC or NSEC3 chain in canonical order, along with the RRSIG records
+// that cover it, to prove the non-existence of names and types in negative responses to clients
+// that request DNSSEC records (RFC 4035, section 3.1.3, and RFC 5155, section 7.2). A SortedZone is
+// a snapshot of a signed zone's records, and is not modified after it is created. It is safe for
+// concurrent use
+type SortedZone struct {
+	origin dnsmessage.Name
+
+	nsec   []dnsmessage.Resource
+	nsec3  []nsec3Entry
+	params NSEC3Params
+
+	signatures map[signatureKey][]dnsmessage.Resource
+}
+
+// NewSortedZone indexes the NSEC, NSEC3, and RRSIG records of a signed zone. Other records are
+// ignored. The NSEC3 records of a zone must share their hash parameters
+func NewSortedZone(origin dnsmessage.Name, records []dnsmessage.Resource) (*SortedZone, error) {
+	sz := &SortedZone{origin: origin, signatures: map[signatureKey][]dnsmessage.Resource{}}
+
+	for _, record := range records {
+		switch record.Header.Type {
+		case TypeNSEC:
+			sz.nsec = append(sz.nsec, record)
+
+		case TypeNSEC3:
+			data, err := unknownData(record)
+			if err != nil {
+				return nil, err
+			}
+
+			params, _, err := parseNSEC3(data)
+			if err != nil {
+				return nil, err
+			}
+
+			if len(sz.nsec3) == 0 {
+				sz.params = params
+			} else if params.Algorithm != sz.params.Algorithm || params.Iterations != sz.params.Iterations || !bytes.Equal(params.Salt, sz.params.Salt) {
+				return nil, ErrNSEC3Params
+			}
+
+			label, _, _ := strings.Cut(record.Header.Name.String(), ".")
+
+			hash, err := nsec3Encoding.DecodeString(strings.ToLower(label))
+			if err != nil {
+				return nil, ErrNSECRecord
+			}
+
+			sz.nsec3 = append(sz.nsec3, nsec3Entry{hash: hash, record: record})
+
+		case TypeRRSIG:
+			data, err := unknownData(record)
+			if err != nil || len(data) < 2 {
+				return nil, ErrNSECRecord
+			}
+
+			key := signatureKey{owner: CanonicalName(record.Header.Name), covered: dnsmessage.Type(binary.BigEndian.Uint16(data))}
+			sz.signatures[key] = append(sz.signatures[key], record)
+		}
+	}
+
+	slices.SortFunc(sz.nsec, func(a, b dnsmessage.Resource) int {
+		return CanonicalCompare(a.Header.Name, b.Header.Name)
+	})
+
+	slices.SortFunc(sz.nsec3, func(a, b nsec3Entry) int {
+		return bytes.Compare(a.hash, b.hash)
+	})
+
+	return sz, nil
+}
+
+// NSEC3 reports whether the zone is signed with an NSEC3 chain
+func (sz *SortedZone) NSEC3() bool {
+	return len(sz.nsec3) > 0
+}
+
+// MatchingNSEC returns the NSEC record owned by a name
+func (sz *SortedZone) MatchingNSEC(name dnsmessage.Name) (dnsmessage.Resource, bool) {
+	index, found := slices.BinarySearchFunc(sz.nsec, name, func(record dnsmessage.Resource, name dnsmessage.Name) int {
+		return CanonicalCompare(record.Header.Name, name)
+	})
+
+	if !found {
+		return dnsmessage.Resource{}, false
+	}
+
+	return sz.nsec[index], true
+}
+
+// CoveringNSEC returns the NSEC record whose owner name precedes a name in canonical order, and
+// whose next name follows it, proving that the name does not exist. The last record of the chain
+// covers names that follow it, and names that precede the zone's first name
+func (sz *SortedZone) CoveringNSEC(name dnsmessage.Name) (dnsmessage.Resource, bool) {
+	index, found := slices.BinarySearchFunc(sz.nsec, name, func(record dnsmessage.Resource, name dnsmessage.Name) int {
+		return CanonicalCompare(record.Header.Name, name)
+	})
+
+	if found || len(sz.nsec) == 0 {
+		return dnsmessage.Resource{}, false
+	}
+
+	return sz.nsec[(index+len(sz.nsec)-1)%len(sz.nsec)], true
+}
+
+// MatchingNSEC3 returns the NSEC3 record for the hash of a name
+func (sz *SortedZone) MatchingNSEC3(name dnsmessage.Name) (dnsmessage.Resource, bool) {
+	index, found, err := sz.searchNSEC3(name)
+	if err != nil || !found {
+		return dnsmessage.Resource{}, false
+	}
+
+	return sz.nsec3[index].record, true
+}
+
+// CoveringNSEC3 returns the NSEC3 record whose hashed owner precedes the hash of a name, and whose
+// next hashed owner follows it
+func (sz *SortedZone) CoveringNSEC3(name dnsmessage.Name) (dnsmessage.Resource, bool) {
+	index, found, err := sz.searchNSEC3(name)
+	if err != nil || found || len(sz.nsec3) == 0 {
+		return dnsmessage.Resource{}, false
+	}
+
+	return sz.nsec3[(index+len(sz.nsec3)-1)%len(sz.nsec3)].record, true
+}
+
+func (sz *SortedZone) searchNSEC3(name dnsmessage.Name) (int, bool, error) {
+	hash, err := sz.params.Hash(name)
+	if err != nil {
+		return 0, false, err
+	}
+
+	index, found := slices.BinarySearchFunc(sz.nsec3, hash, func(entry nsec3Entry, hash []byte) int {
+		return bytes.Compare(entry.hash, hash)
+	})
+
+	return index, found, nil
+}
+
+// exists checks if a name is the owner of an NSEC record, or is an empty non-terminal whose
+// descendants follow it in canonical order
+func (sz *SortedZone) exists(name dnsmessage.Name) bool {
+	index, found := slices.BinarySearchFunc(sz.nsec, name, func(record dnsmessage.Resource, name dnsmessage.Name) int {
+		return CanonicalCompare(record.Header.Name, name)
+	})
+
+	return found || index < len(sz.nsec) && IsSubdomain(sz.nsec[index].Header.Name, name)
+}
+
+// ancestors returns a name's ancestors within the zone, from the name's parent to the zone's origin
+func (sz *SortedZone) ancestors(name dnsmessage.Name) []dnsmessage.Name {
+	var names []dnsmessage.Name
+
+	labels := canonicalLabels(name)
+	for i := 1; i <= len(labels); i++ {
+		ancestor, err := dnsmessage.NewName(strings.Join(labels[i:], ".") + ".")
+		if err != nil || !IsSubdomain(ancestor, sz.origin) {
+			break
+		}
+
+		names = append(names, ancestor)
+	}
+
+	return names
+}
+
+// Denial returns the NSEC or NSEC3 records, and the RRSIG records that cover them, that prove the
+// non-existence of a name for an NXDOMAIN response, or of a type at a name for a NODATA response.
+// The records belong in the authority section of the response, along with the zone's SOA record
+func (sz *SortedZone) Denial(name dnsmessage.Name, rcode dnsmessage.RCode) []dnsmessage.Resource {
+	var proof []dnsmessage.Resource
+
+	add := func(record dnsmessage.Resource, found bool) {
+		if !found {
+			return
+		}
+
+		for _, existing := range proof {
+			if CanonicalName(existing.Header.Name) == CanonicalName(record.Header.Name) && existing.Header.Type == record.Header.Type {
+				return
+			}
+		}
+
+		proof = append(proof, record)
+		proof = append(proof, sz.signatures[signatureKey{owner: CanonicalName(record.Header.Name), covered: record.Header.Type}]...)
+	}
+
+	if sz.NSEC3() {
+		if rcode != dnsmessage.RCodeNameError {
+			if record, found := sz.MatchingNSEC3(name); found {
+				add(record, found)
+				return proof
+			}
+		}
+
+		// The closest encloser proof: the closest ancestor that exists, the next closer name below
+		// it that does not, and the wildcard at the closest encloser
+		next := name
+		for _, encloser := range sz.ancestors(name) {
+			if record, found := sz.MatchingNSEC3(encloser); found {
+				add(record, found)
+				add(sz.CoveringNSEC3(next))
+				if star, ok := wildcard(encloser); ok {
+					add(sz.CoveringNSEC3(star))
+				}
+
+				break
+			}
+
+			next = encloser
+		}
+
+		return proof
+	}
+
+	if record, found := sz.MatchingNSEC(name); found {
+		add(record, found)
+		return proof
+	}
+
+	add(sz.CoveringNSEC(name))
+
+	if rcode == dnsmessage.RCodeNameError {
+		// Prove that a wildcard at the closest encloser does not exist
+		for _, encloser := range sz.ancestors(name) {
+			if sz.exists(encloser) {
+				if star, ok := wildcard(encloser); ok {
+					add(sz.CoveringNSEC(star))
+				}
+
+				break
+			}
+		}
+	}
+
+	return proof
+}
+
+// Deny adds the records that prove the non-existence of the answer's question to the authority
+// section of a negative answer, when the request's OPT record sets the DO bit
+func (sz *SortedZone) Deny(req *Request, answer *Answer, name dnsmessage.Name) {
+	edns, found, err := req.ClientEDNS()
+	if err != nil || !found || !edns.DO {
+		return
+	}
+
+	answer.Authorities = append(answer.Authorities, sz.Denial(name, answer.Header.RCode)...)
+}
+
+// wildcard returns the wildcard name below a name. The boolean result is false if the name is too
+// long to have a child
+func wildcard(name dnsmessage.Name) (dnsmessage.Name, bool) {
+	star, err := dnsmessage.NewName(strings.TrimSuffix("*."+name.String(), ".") + ".")
+	return star, err == nil
+}
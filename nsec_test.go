@@ -0,0 +1,249 @@
+package dns_test
+
+import (
+	"encoding/hex"
+	"slices"
+	"testing"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestCanonicalCompare(t *testing.T) {
+	// RFC 4034, section 6.1
+	ordered := []string{"example.", "a.example.", "yljkjljk.a.example.", "Z.a.example.", "zABC.a.EXAMPLE.", "z.example.", "*.z.example."}
+
+	names := make([]dnsmessage.Name, len(ordered))
+	for i, name := range ordered {
+		names[i] = dnsmessage.MustNewName(name)
+	}
+
+	shuffled := slices.Clone(names)
+	slices.Reverse(shuffled)
+	slices.SortFunc(shuffled, dns.CanonicalCompare)
+
+	assert.Equal(t, names, shuffled)
+	assert.Zero(t, dns.CanonicalCompare(dnsmessage.MustNewName("A.Example."), dnsmessage.MustNewName("a.example.")))
+}
+
+func TestNSEC3Hash(t *testing.T) {
+	// RFC 5155, appendix A
+	salt, _ := hex.DecodeString("aabbccdd")
+
+	hash, err := dns.NSEC3Hash(dnsmessage.MustNewName("example."), dns.NSEC3HashSHA1, 12, salt)
+	if assert.NoError(t, err) {
+		owner, err := dns.NSEC3Owner(hash, dnsmessage.MustNewName("example."))
+		assert.NoError(t, err)
+		assert.Equal(t, "0p9mhaveqvm6t7vbl5lop2u3t2rp3tom.example.", owner.String())
+	}
+
+	_, err = dns.NSEC3Hash(dnsmessage.MustNewName("example."), 2, 0, nil)
+	assert.ErrorIs(t, err, dns.ErrNSEC3Hash)
+}
+
+func TestTypeBitmap(t *testing.T) {
+	// RFC 4034, section 4.3
+	bitmap := dns.TypeBitmap(dnsmessage.TypeA, dnsmessage.TypeMX, dns.TypeRRSIG, dns.TypeNSEC, 1234)
+	assert.Equal(t, []byte{
+		0x00, 0x06, 0x40, 0x01, 0x00, 0x00, 0x00, 0x03,
+		0x04, 0x1b, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x20,
+	}, bitmap)
+}
+
+// nsecChain creates a closed NSEC chain for names in canonical order
+func nsecChain(t *testing.T, names ...string) (records []dnsmessage.Resource) {
+	for i, name := range names {
+		body, err := dns.NSECResource(dnsmessage.MustNewName(names[(i+1)%len(names)]), dnsmessage.TypeA, dns.TypeNSEC)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		records = append(records, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dns.TypeNSEC, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   body,
+		})
+	}
+
+	return
+}
+
+func owners(records []dnsmessage.Resource) (names []string) {
+	for _, record := range records {
+		names = append(names, record.Header.Name.String())
+	}
+
+	return
+}
+
+func TestNSECDenial(t *testing.T) {
+	records := nsecChain(t, "example.com.", "a.example.com.", "x.y.example.com.", "z.example.com.")
+
+	// Signatures are returned with the records that they cover
+	records = append(records, dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("a.example.com."), Type: dns.TypeRRSIG, Class: dnsmessage.ClassINET, TTL: 300},
+		Body:   &dnsmessage.UnknownResource{Type: dns.TypeRRSIG, Data: []byte{0, byte(dns.TypeNSEC), 13, 3}},
+	})
+
+	slices.Reverse(records)
+
+	sz, err := dns.NewSortedZone(dnsmessage.MustNewName("example.com."), records)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	covering, found := sz.CoveringNSEC(dnsmessage.MustNewName("b.example.com."))
+	assert.True(t, found)
+	assert.Equal(t, "a.example.com.", covering.Header.Name.String())
+
+	// The last record covers names past the end of the chain
+	covering, _ = sz.CoveringNSEC(dnsmessage.MustNewName("zz.example.com."))
+	assert.Equal(t, "z.example.com.", covering.Header.Name.String())
+
+	// NXDOMAIN proves that the name and the wildcard at its closest encloser do not exist
+	proof := sz.Denial(dnsmessage.MustNewName("b.example.com."), dnsmessage.RCodeNameError)
+	assert.Equal(t, []string{"a.example.com.", "a.example.com.", "example.com."}, owners(proof))
+	assert.Equal(t, dns.TypeRRSIG, proof[1].Header.Type)
+
+	// The empty non-terminal y.example.com is the closest encloser of a name below it. One record
+	// covers both the name and the wildcard, and is not repeated
+	proof = sz.Denial(dnsmessage.MustNewName("w.y.example.com."), dnsmessage.RCodeNameError)
+	assert.Equal(t, []string{"a.example.com.", "a.example.com."}, owners(proof))
+
+	proof = sz.Denial(dnsmessage.MustNewName("zz.y.example.com."), dnsmessage.RCodeNameError)
+	assert.Equal(t, []string{"x.y.example.com.", "a.example.com.", "a.example.com."}, owners(proof))
+
+	// NODATA returns the name's NSEC record, which lists the types that exist
+	proof = sz.Denial(dnsmessage.MustNewName("z.example.com."), dnsmessage.RCodeSuccess)
+	assert.Equal(t, []string{"z.example.com."}, owners(proof))
+}
+
+func TestNSEC3Denial(t *testing.T) {
+	origin := dnsmessage.MustNewName("example.com.")
+	params := dns.NSEC3Params{Algorithm: dns.NSEC3HashSHA1, Iterations: 0, Salt: []byte{0xab}}
+
+	var hashes [][]byte
+	for _, name := range []string{"example.com.", "a.example.com.", "c.example.com."} {
+		hash, err := params.Hash(dnsmessage.MustNewName(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hashes = append(hashes, hash)
+	}
+
+	slices.SortFunc(hashes, func(a, b []byte) int { return slices.Compare(a, b) })
+
+	var records []dnsmessage.Resource
+	for i, hash := range hashes {
+		owner, err := dns.NSEC3Owner(hash, origin)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		records = append(records, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: owner, Type: dns.TypeNSEC3, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   dns.NSEC3Resource(params, hashes[(i+1)%len(hashes)], dnsmessage.TypeA),
+		})
+	}
+
+	sz, err := dns.NewSortedZone(origin, records)
+	if !assert.NoError(t, err) || !assert.True(t, sz.NSEC3()) {
+		return
+	}
+
+	matching, found := sz.MatchingNSEC3(dnsmessage.MustNewName("A.example.com."))
+	assert.True(t, found)
+
+	_, found = sz.CoveringNSEC3(dnsmessage.MustNewName("a.example.com."))
+	assert.False(t, found)
+
+	// NODATA returns the matching record
+	assert.Equal(t, []dnsmessage.Resource{matching}, sz.Denial(dnsmessage.MustNewName("a.example.com."), dnsmessage.RCodeSuccess))
+
+	// NXDOMAIN returns the closest encloser proof: the closest encloser's matching record, and the
+	// records covering the next closer name and the wildcard. Records are not repeated
+	proof := sz.Denial(dnsmessage.MustNewName("b.example.com."), dnsmessage.RCodeNameError)
+	if assert.NotEmpty(t, proof) {
+		apex, _ := sz.MatchingNSEC3(origin)
+		assert.Equal(t, apex, proof[0])
+
+		next, _ := sz.CoveringNSEC3(dnsmessage.MustNewName("b.example.com."))
+		assert.Contains(t, proof, next)
+
+		star, _ := sz.CoveringNSEC3(dnsmessage.MustNewName("*.example.com."))
+		assert.Contains(t, proof, star)
+
+		assert.Equal(t, len(proof), len(slices.CompactFunc(slices.Clone(proof), func(a, b dnsmessage.Resource) bool { return a.Header.Name == b.Header.Name })))
+	}
+
+	// Chains must share their parameters
+	params.Iterations = 1
+	records = append(records, dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("00000000000000000000000000000000.example.com."), Type: dns.TypeNSEC3},
+		Body:   dns.NSEC3Resource(params, hashes[0]),
+	})
+
+	_, err = dns.NewSortedZone(origin, records)
+	assert.ErrorIs(t, err, dns.ErrNSEC3Params)
+}
+
+func TestZoneHandlerDenial(t *testing.T) {
+	zone, err := dns.NewZone(testSOA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := nsecChain(t, "example.com.", "a.example.com.", "www.example.com.")
+	assert.NoError(t, zone.Add(records...))
+	assert.NoError(t, zone.Add(dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: testQuestion.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+		Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+	}))
+
+	sz, err := dns.NewSortedZone(zone.Origin(), zone.Records())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	handler := &dns.ZoneHandler{Zone: zone, Denial: sz}
+
+	question := testQuestion
+	question.Name = dnsmessage.MustNewName("b.example.com.")
+
+	// Clients that set the DO bit receive the proof after the SOA record
+	res := Exchange(t, handler, GenerateEDNSQueryFor(1, question))
+	assert.Equal(t, dnsmessage.RCodeNameError, res.RCode)
+	assert.Equal(t, []string{"example.com.", "a.example.com.", "example.com."}, owners(res.Authorities))
+
+	res = Exchange(t, handler, GenerateQuery(2, question))
+	assert.Len(t, res.Authorities, 1)
+
+	// NODATA
+	question.Name = testQuestion.Name
+	question.Type = dnsmessage.TypeAAAA
+
+	res = Exchange(t, handler, GenerateEDNSQueryFor(3, question))
+	assert.Equal(t, dnsmessage.RCodeSuccess, res.RCode)
+	assert.Equal(t, []string{"example.com.", "www.example.com."}, owners(res.Authorities))
+}
+
+// GenerateEDNSQueryFor builds a query for a question with an OPT record that sets the DO bit
+func GenerateEDNSQueryFor(id uint16, question dnsmessage.Question) []byte {
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id})
+	builder.StartQuestions()
+	builder.Question(question)
+	builder.StartAdditionals()
+
+	var header dnsmessage.ResourceHeader
+	header.SetEDNS0(1232, dnsmessage.RCodeSuccess, true)
+	builder.OPTResource(header, dnsmessage.OPTResource{})
+
+	buf, err := builder.Finish()
+	if err != nil {
+		panic(err)
+	}
+
+	return buf
+}
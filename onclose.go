@@ -0,0 +1,58 @@
+package dns
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// closeHooks holds the functions that are called when a stream connection is closed
+type closeHooks struct {
+	hooks  []func()
+	closed bool
+	sync.Mutex
+}
+
+type closeHooksKeyType struct{}
+
+var closeHooksKey closeHooksKeyType
+
+// OnClose registers a function to be called when the stream connection that a request was received
+// on is closed, for any reason, so that handlers can release connection-scoped state such as a
+// per-connection cache or authentication. Functions are called in the reverse order of their
+// registration, once the connection's handlers have returned, and their panics are logged like a
+// Handler's. OnClose returns false, and does not register the function, if the Context does not
+// belong to a stream connection, or the connection has already been closed
+func OnClose(ctx context.Context, fn func()) bool {
+	hooks, _ := ctx.Value(closeHooksKey).(*closeHooks)
+	if hooks == nil {
+		return false
+	}
+
+	hooks.Lock()
+	defer hooks.Unlock()
+
+	if hooks.closed {
+		return false
+	}
+
+	hooks.hooks = append(hooks.hooks, fn)
+	return true
+}
+
+// run calls the registered functions. A panic in a function is recovered and logged by the Server,
+// and does not prevent the remaining functions from being called
+func (hooks *closeHooks) run(ctx context.Context, server *Server, transport string) {
+	hooks.Lock()
+	hooks.closed = true
+	registered := hooks.hooks
+	hooks.hooks = nil
+	hooks.Unlock()
+
+	for _, fn := range slices.Backward(registered) {
+		func() {
+			defer server.logPanic(ctx, transport)
+			fn()
+		}()
+	}
+}
@@ -0,0 +1,65 @@
+package dns
+
+import (
+	"cmp"
+	"net"
+	"time"
+
+	"github.com/jmanero/go-logging"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// OverflowPolicy selects what Serve does with a datagram that arrives while the Server is handling
+// MaxConcurrent UDP queries
+type OverflowPolicy int
+
+const (
+	// OverflowBlock stops reading datagrams until a handler returns, for up to OverflowWait. The
+	// datagram is dropped if no handler returns in time
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDrop drops the datagram immediately
+	OverflowDrop
+)
+
+// DefaultOverflowWait bounds how long OverflowBlock waits for a handler to return when
+// Server.OverflowWait is zero
+const DefaultOverflowWait = 10 * time.Millisecond
+
+// acquire reserves a slot for a UDP handler. It returns false if the datagram should be dropped
+func (server *Server) acquire(from net.Addr) bool {
+	if server.MaxConcurrent <= 0 {
+		return true
+	}
+
+	server.slotsOnce.Do(func() { server.slots = make(chan struct{}, server.MaxConcurrent) })
+
+	select {
+	case server.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if server.OverflowPolicy == OverflowBlock {
+		timer := time.NewTimer(cmp.Or(server.OverflowWait, DefaultOverflowWait))
+		defer timer.Stop()
+
+		select {
+		case server.slots <- struct{}{}:
+			return true
+		case <-timer.C:
+		}
+	}
+
+	server.Stats.Overflows.Add(1)
+	server.log(logging.FromContext(server.Context()), zapcore.DebugLevel, "handler.overflow", zap.Stringer("remote", from))
+
+	return false
+}
+
+// release frees a slot that was reserved by acquire
+func (server *Server) release() {
+	if server.MaxConcurrent > 0 {
+		<-server.slots
+	}
+}
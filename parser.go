@@ -0,0 +1,44 @@
+package dns
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Parser reads the header and question section of a received message, before the message is
+// passed to a Handler. A Server uses WireParser unless its Parser is set, which allows messages with
+// non-standard encodings to be served for research, testing, or bridging legacy protocols.
+//
+// ParseHeader is called once for each message that a Server receives, and its result becomes the
+// Request's Header. An error drops the message. ParseQuestions is called by Request.Questions, and
+// may be called any number of times, concurrently. Both methods must not retain the message, as its
+// buffer is reused once the Handler returns.
+//
+// When a custom Parser is used, the Request's embedded dnsmessage.Parser is not started, and the
+// methods that read other sections of the message, such as OPT, parse it in the standard encoding
+type Parser interface {
+	ParseHeader(msg []byte) (dnsmessage.Header, error)
+	ParseQuestions(msg []byte) ([]dnsmessage.Question, error)
+}
+
+// WireParser parses messages in the standard wire format (RFC 1035) with dnsmessage.Parser
+type WireParser struct{}
+
+var _ Parser = WireParser{}
+
+// ParseHeader parses a message's header
+func (WireParser) ParseHeader(msg []byte) (dnsmessage.Header, error) {
+	var parser dnsmessage.Parser
+	return parser.Start(msg)
+}
+
+// ParseQuestions parses a message's question section
+func (WireParser) ParseQuestions(msg []byte) ([]dnsmessage.Question, error) {
+	var parser dnsmessage.Parser
+
+	_, err := parser.Start(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return parser.AllQuestions()
+}
@@ -0,0 +1,73 @@
+package dns_test
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// TextParser parses messages in a text encoding of "<id> <name>", as A queries
+type TextParser struct{}
+
+func (TextParser) ParseHeader(msg []byte) (dnsmessage.Header, error) {
+	id, _, found := strings.Cut(string(msg), " ")
+	if !found {
+		return dnsmessage.Header{}, errors.New("malformed")
+	}
+
+	parsed, err := strconv.ParseUint(id, 10, 16)
+	return dnsmessage.Header{ID: uint16(parsed), RecursionDesired: true}, err
+}
+
+func (TextParser) ParseQuestions(msg []byte) ([]dnsmessage.Question, error) {
+	_, name, _ := strings.Cut(string(msg), " ")
+
+	parsed, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return []dnsmessage.Question{{Name: parsed, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}}, nil
+}
+
+func TestParser(t *testing.T) {
+	var questions []dnsmessage.Question
+
+	server := dns.Server{
+		Parser: TextParser{},
+		Handler: dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+			parsed, err := req.Questions()
+			assert.NoError(t, err)
+
+			questions = append(questions, parsed...)
+			dns.ServerFailure(wr, req)
+		}),
+	}
+
+	wr := dns.NewMessageWriter(nil)
+	server.Handle(server.Context(), []byte("4242 www.example.com."), wr, &dns.Request{})
+
+	var res dnsmessage.Message
+	if assert.NoError(t, res.Unpack(wr.Bytes())) {
+		assert.Equal(t, uint16(4242), res.ID)
+		assert.True(t, res.RecursionDesired)
+		assert.Equal(t, []dnsmessage.Question{testQuestion}, res.Questions)
+	}
+
+	assert.Equal(t, []dnsmessage.Question{testQuestion}, questions)
+
+	// Messages that the Parser rejects are dropped
+	server.Handle(server.Context(), []byte("malformed"), wr, &dns.Request{})
+	assert.Len(t, questions, 1)
+
+	// The default parser reads the standard wire format
+	header, err := dns.WireParser{}.ParseHeader(GenerateQuery(7, testQuestion))
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint16(7), header.ID)
+	}
+}
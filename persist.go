@@ -0,0 +1,201 @@
+package dns
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ErrCacheFile is returned when a persisted cache file was not written by a compatible version of
+// the package, or is corrupt. Entries that were read before a corrupt entry are loaded
+var ErrCacheFile = errors.New("dns: invalid cache file")
+
+// cacheFileMagic begins a persisted cache file, followed by its format version
+const (
+	cacheFileMagic   = "dnscache"
+	cacheFileVersion = 2
+)
+
+// Close saves the Cache to its Persist file, if one is configured. A Cache may be registered with
+// Server.AddCloser to save it when the server shuts down. The Cache may still be used after Close
+func (cache *Cache) Close() error {
+	if cache.Persist == "" {
+		return nil
+	}
+
+	return cache.Save(cache.Persist)
+}
+
+// Save writes the cached responses to a file, along with the times that they were stored and expire.
+// The file is replaced atomically
+func (cache *Cache) Save(path string) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	writer.WriteString(cacheFileMagic)
+	writer.WriteByte(cacheFileVersion)
+
+	cache.Lock()
+	for elem := cache.lru.Front(); elem != nil; elem = elem.Next() {
+		writer.Write(elem.Value.(*cacheEntry).marshal())
+	}
+	cache.Unlock()
+
+	err = writer.Flush()
+	if err == nil {
+		err = file.Close()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// Load adds the responses in a file written by Save to the Cache. Responses that have expired, and
+// can not be served stale, are dropped. A missing file is not an error. Responses that are already
+// cached are not replaced
+func (cache *Cache) Load(path string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+	reader := bufio.NewReader(file)
+
+	header := make([]byte, len(cacheFileMagic)+1)
+
+	_, err = io.ReadFull(reader, header)
+	if err != nil || string(header[:len(cacheFileMagic)]) != cacheFileMagic || header[len(cacheFileMagic)] != cacheFileVersion {
+		return ErrCacheFile
+	}
+
+	retain := max(cache.StaleWhileRevalidate, cache.ServeStale)
+	now := time.Now()
+
+	cache.Lock()
+	defer cache.Unlock()
+
+	for {
+		entry, err := readCacheEntry(reader)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			return ErrCacheFile
+		}
+
+		if !now.Before(entry.expires.Add(retain)) {
+			continue
+		}
+
+		if _, has := cache.entries[entry.key]; has {
+			continue
+		}
+
+		// Entries are saved from most to least recently used
+		if len(cache.entries) < cmp.Or(cache.MaxEntries, DefaultCacheSize) {
+			cache.entries[entry.key] = cache.lru.PushBack(entry)
+		}
+	}
+}
+
+// marshal encodes an entry as its times, question, request flags, and response, followed by a checksum
+func (entry *cacheEntry) marshal() []byte {
+	buf := binary.BigEndian.AppendUint64(nil, uint64(entry.stored.UnixNano()))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(entry.expires.UnixNano()))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(entry.key.qtype))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(entry.key.qclass))
+	buf = append(buf, byte(entry.key.flags))
+
+	buf = append(buf, byte(len(entry.key.name)))
+	buf = append(buf, entry.key.name...)
+
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(entry.msg)))
+	buf = append(buf, entry.msg...)
+
+	return binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+// readCacheEntry decodes an entry. It returns io.EOF at the end of the file, and another error if
+// the entry is truncated, its checksum does not match, or its response is not cacheable
+func readCacheEntry(reader *bufio.Reader) (*cacheEntry, error) {
+	fixed := make([]byte, 22)
+
+	_, err := io.ReadFull(reader, fixed)
+	if err != nil {
+		return nil, err
+	}
+
+	name := make([]byte, fixed[21])
+
+	_, err = io.ReadFull(reader, name)
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	var size [2]byte
+
+	_, err = io.ReadFull(reader, size[:])
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	rest := make([]byte, int(binary.BigEndian.Uint16(size[:]))+4)
+
+	_, err = io.ReadFull(reader, rest)
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	msg := rest[:len(rest)-4]
+
+	checksum := crc32.NewIEEE()
+	checksum.Write(fixed)
+	checksum.Write(name)
+	checksum.Write(size[:])
+	checksum.Write(msg)
+
+	if checksum.Sum32() != binary.BigEndian.Uint32(rest[len(msg):]) {
+		return nil, ErrCacheFile
+	}
+
+	_, offsets, cacheable := cacheTTL(msg)
+	if !cacheable {
+		return nil, ErrCacheFile
+	}
+
+	return &cacheEntry{
+		key: cacheKey{
+			name:   string(name),
+			qtype:  dnsmessage.Type(binary.BigEndian.Uint16(fixed[16:])),
+			qclass: dnsmessage.Class(binary.BigEndian.Uint16(fixed[18:])),
+			flags:  cacheFlags(fixed[20]),
+		},
+		msg:     msg,
+		ttls:    offsets,
+		stored:  time.Unix(0, int64(binary.BigEndian.Uint64(fixed))),
+		expires: time.Unix(0, int64(binary.BigEndian.Uint64(fixed[8:]))),
+	}, nil
+}
@@ -0,0 +1,95 @@
+package dns
+
+import (
+	"net"
+	"net/netip"
+	"sync/atomic"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// PrefixSet matches client addresses against a list of CIDR prefixes
+type PrefixSet []netip.Prefix
+
+// ParsePrefixes parses CIDR prefixes, such as "192.0.2.0/24" or "2001:db8::/32". Addresses without
+// a prefix length match a single host
+func ParsePrefixes(cidrs ...string) (PrefixSet, error) {
+	set := make(PrefixSet, 0, len(cidrs))
+
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(cidr)
+			if aerr != nil {
+				return nil, err
+			}
+
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+
+		set = append(set, prefix.Masked())
+	}
+
+	return set, nil
+}
+
+// Contains checks if an address is within any of the set's prefixes. IPv4-mapped IPv6 addresses
+// are matched as IPv4 addresses
+func (set PrefixSet) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	for _, prefix := range set {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ContainsAddr checks if the IP address of a UDP or TCP address is within any of the set's prefixes
+func (set PrefixSet) ContainsAddr(addr net.Addr) bool {
+	ip, _ := addrParts(addr)
+	if ip == nil {
+		return false
+	}
+
+	parsed, ok := netip.AddrFromSlice(ip)
+	return ok && set.Contains(parsed)
+}
+
+// TCPRequirement makes clients in a set of prefixes use TCP. UDP queries from the clients are
+// answered with an empty truncated response, regardless of the size of the response that they
+// would have received, so that they retry over TCP (RFC 7766). It is a policy for clients with
+// unreliable UDP paths, such as resolvers behind NATs that drop fragments, and is independent of
+// any policy based on the question
+type TCPRequirement struct {
+	Clients PrefixSet
+
+	// Forced counts UDP queries that were answered with TC
+	Forced atomic.Uint64
+}
+
+// Middleware wraps a Handler with the requirement. Queries from other clients, and queries over
+// other transports, are passed to the Handler
+func (requirement *TCPRequirement) Middleware(next Handler) Handler {
+	return HandlerFunc(func(wr ResponseWriter, req *Request) {
+		if req.Transport() != TransportUDP || !requirement.Clients.ContainsAddr(req.RemoteAddr) {
+			next.ServeDNS(wr, req)
+			return
+		}
+
+		requirement.Forced.Add(1)
+
+		header := req.ResponseHeader(dnsmessage.RCodeSuccess)
+		header.Truncated = true
+
+		writeEmpty(wr, req, header, nil)
+	})
+}
+
+// ForceTCPClients creates a Middleware that answers UDP queries from clients in a set of prefixes
+// with TC, so that they retry over TCP. Use a TCPRequirement to count the forced queries
+func ForceTCPClients(clients PrefixSet) Middleware {
+	return (&TCPRequirement{Clients: clients}).Middleware
+}
@@ -0,0 +1,81 @@
+package dns_test
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestPrefixSet(t *testing.T) {
+	set, err := dns.ParsePrefixes("192.0.2.0/24", "2001:db8::/32", "198.51.100.7")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.True(t, set.Contains(netip.MustParseAddr("192.0.2.200")))
+	assert.True(t, set.Contains(netip.MustParseAddr("::ffff:192.0.2.1")))
+	assert.True(t, set.Contains(netip.MustParseAddr("2001:db8::1")))
+	assert.True(t, set.Contains(netip.MustParseAddr("198.51.100.7")))
+	assert.False(t, set.Contains(netip.MustParseAddr("198.51.100.8")))
+
+	assert.True(t, set.ContainsAddr(&net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 53}))
+	assert.False(t, set.ContainsAddr(&net.UnixAddr{Name: "/tmp/sock"}))
+
+	_, err = dns.ParsePrefixes("192.0.2.0/33")
+	assert.Error(t, err)
+}
+
+func TestForceTCPClients(t *testing.T) {
+	clients, _ := dns.ParsePrefixes("127.0.0.0/8", "1.2.3.4")
+	requirement := dns.TCPRequirement{Clients: clients}
+
+	var handled int
+	server := dns.Server{
+		Handler: requirement.Middleware(dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+			handled++
+			dns.ServerFailure(wr, req)
+		})),
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go server.Serve(conn)
+	defer server.CloseAll()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(time.Second))
+	client.Write(GenerateQuery(1, testQuestion))
+
+	buf := make([]byte, 512)
+	size, err := client.Read(buf)
+
+	var res dnsmessage.Message
+	if assert.NoError(t, err) && assert.NoError(t, res.Unpack(buf[:size])) {
+		assert.True(t, res.Truncated)
+		assert.Equal(t, []dnsmessage.Question{testQuestion}, res.Questions)
+		assert.Empty(t, res.Answers)
+	}
+
+	assert.Zero(t, handled)
+	assert.Equal(t, uint64(1), requirement.Forced.Load())
+
+	// TCP queries from the clients are handled
+	tester := StreamTester{chunks: [][]byte{GenerateFrame(2, testQuestion)}}
+	stream := dns.Server{Handler: requirement.Middleware(dns.HandlerFunc(func(dns.ResponseWriter, *dns.Request) { handled++ }))}
+	stream.HandleStream(stream.Context(), &tester)
+
+	assert.Equal(t, 1, handled)
+}
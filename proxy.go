@@ -0,0 +1,184 @@
+package dns
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmanero/go-logging"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// ErrProxyHeader is returned when a stream connection does not begin with a valid PROXY protocol header
+var ErrProxyHeader = errors.New("dns: malformed PROXY protocol header")
+
+// DefaultProxyHeaderTimeout bounds the time to receive a PROXY protocol header when
+// Server.ReadTimeout is zero
+const DefaultProxyHeaderTimeout = 5 * time.Second
+
+// PROXY protocol signatures
+var (
+	proxyV1Signature = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// maxProxyV1Size is the longest v1 header, including its CRLF
+const maxProxyV1Size = 107
+
+// ReadProxyHeader reads a PROXY protocol (version 1 or 2) header from the start of a connection,
+// and returns the client's address. The address is nil if the header does not carry one, such as a
+// v2 LOCAL command from a load balancer's health check. No data after the header is read
+func ReadProxyHeader(r io.Reader) (net.Addr, error) {
+	// The shortest v1 header, "PROXY UNKNOWN\r\n", is longer than the v2 signature
+	header := make([]byte, len(proxyV2Signature), maxProxyV1Size)
+
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case bytes.Equal(header, proxyV2Signature):
+		return readProxyV2(r)
+	case bytes.HasPrefix(header, proxyV1Signature):
+		return readProxyV1(r, header)
+	}
+
+	return nil, ErrProxyHeader
+}
+
+// readProxyV1 reads the rest of a text header, one octet at a time so that no data after it is read
+func readProxyV1(r io.Reader, line []byte) (net.Addr, error) {
+	var next [1]byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == maxProxyV1Size {
+			return nil, ErrProxyHeader
+		}
+
+		_, err := io.ReadFull(r, next[:])
+		if err != nil {
+			return nil, err
+		}
+
+		line = append(line, next[0])
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) < 2 {
+		return nil, ErrProxyHeader
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, ErrProxyHeader
+	}
+
+	if len(fields) != 6 {
+		return nil, ErrProxyHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, ErrProxyHeader
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads the rest of a binary header. TLVs following the addresses are discarded
+func readProxyV2(r io.Reader) (net.Addr, error) {
+	var header [4]byte
+
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return nil, err
+	}
+
+	if header[0]>>4 != 2 {
+		return nil, ErrProxyHeader
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(header[2:]))
+
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, err
+	}
+
+	switch header[0] & 0x0f {
+	case 0:
+		// LOCAL connections are made by the proxy itself
+		return nil, nil
+	case 1:
+	default:
+		return nil, ErrProxyHeader
+	}
+
+	// Source and destination addresses, then source and destination ports
+	var size int
+	switch header[1] >> 4 {
+	case 1:
+		size = net.IPv4len
+	case 2:
+		size = net.IPv6len
+	default:
+		// Unspecified and unix socket addresses are not IP addresses
+		return nil, nil
+	}
+
+	if len(body) < 2*size+4 {
+		return nil, ErrProxyHeader
+	}
+
+	return &net.TCPAddr{IP: net.IP(body[:size]), Port: int(binary.BigEndian.Uint16(body[2*size:]))}, nil
+}
+
+// proxyConn replaces the remote address of a connection with the client's address from a PROXY
+// protocol header
+type proxyConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (conn *proxyConn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+// proxy reads the PROXY protocol header of a connection when the Server's ProxyProtocol flag is
+// set, and returns a connection with the client's address. Connections with a malformed header are
+// closed, and the failure is logged as "connection.proxy"
+func (server *Server) proxy(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	if !server.ProxyProtocol {
+		return conn, nil
+	}
+
+	conn.SetReadDeadline(time.Now().Add(cmp.Or(server.ReadTimeout, DefaultProxyHeaderTimeout)))
+
+	remote, err := ReadProxyHeader(conn)
+	if err != nil {
+		server.log(logging.FromContext(ctx), zapcore.WarnLevel, "connection.proxy", zap.Stringer("remote", conn.RemoteAddr()), zap.Error(err))
+		conn.Close()
+
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Time{})
+
+	if remote == nil {
+		return conn, nil
+	}
+
+	return &proxyConn{Conn: conn, remote: remote}, nil
+}
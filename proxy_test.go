@@ -0,0 +1,118 @@
+package dns_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// ProxyV2Header builds a PROXY protocol v2 header for a TCP client
+func ProxyV2Header(client *net.TCPAddr) []byte {
+	header := []byte("\r\n\r\n\x00\r\nQUIT\n\x21")
+
+	ip, family := client.IP.To4(), byte(0x11)
+	if ip == nil {
+		ip, family = client.IP.To16(), 0x21
+	}
+
+	header = append(header, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(2*len(ip)+4))
+	header = append(header, ip...)
+	header = append(header, make([]byte, len(ip))...)
+	header = binary.BigEndian.AppendUint16(header, uint16(client.Port))
+
+	return binary.BigEndian.AppendUint16(header, 53)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		client string
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 40000 53\r\n", "192.0.2.1:40000"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::53 40000 53\r\n", "[2001:db8::1]:40000"},
+		{"PROXY UNKNOWN\r\n", ""},
+		{string(ProxyV2Header(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000})), "192.0.2.1:40000"},
+		{string(ProxyV2Header(&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000})), "[2001:db8::1]:40000"},
+		{"\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00", ""},
+	} {
+		// Data after the header is not read
+		r := bytes.NewReader(append([]byte(tc.header), 0, 42))
+
+		client, err := dns.ReadProxyHeader(r)
+		if assert.NoError(t, err, tc.header) {
+			if tc.client == "" {
+				assert.Nil(t, client)
+			} else if assert.NotNil(t, client) {
+				assert.Equal(t, tc.client, client.String())
+			}
+
+			assert.Equal(t, 2, r.Len())
+		}
+	}
+
+	for _, header := range []string{
+		"GET / HTTP/1.1\r\n",
+		"PROXY TCP4 192.0.2.1\r\n",
+		"PROXY TCP4 not-an-address 198.51.100.1 40000 53\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 40000 53" + string(bytes.Repeat([]byte{' '}, 100)),
+		"\r\n\r\n\x00\r\nQUIT\n\x11\x11\x00\x0c",
+	} {
+		_, err := dns.ReadProxyHeader(bytes.NewReader([]byte(header)))
+		assert.Error(t, err, header)
+	}
+}
+
+func TestServerProxyProtocol(t *testing.T) {
+	clients := make(chan net.Addr, 1)
+
+	server := &dns.Server{ProxyProtocol: true, Handler: dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+		clients <- req.RemoteAddr
+		dns.ServerFailure(wr, req)
+	})}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go server.ServeStream(listener)
+	defer server.Shutdown(context.Background())
+
+	dial := func(header []byte) net.Conn {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(time.Second))
+		conn.Write(header)
+
+		return conn
+	}
+
+	// Requests carry the client's address from the header
+	conn := dial(append([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 40000 53\r\n"), GenerateFrame(1, testQuestion)...))
+
+	_, err = dns.ReadFrame(conn)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "192.0.2.1:40000", (<-clients).String())
+	}
+
+	// Connections with a malformed header are closed. The client may see a reset, as the rest of
+	// the frame is not read
+	conn = dial(GenerateFrame(2, testQuestion))
+
+	size, err := conn.Read(make([]byte, 1))
+	assert.Zero(t, size)
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, os.ErrDeadlineExceeded)
+}
@@ -0,0 +1,125 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ErrStreamDone is raised by QUICWriter when a second message is sent on a stream that only permits one
+var ErrStreamDone = errors.New("dns: DoQ stream has already been answered")
+
+// QUICStream is a bidirectional QUIC stream. Close must close only the send direction of the
+// stream, as the Close method of quic-go's Stream does
+type QUICStream interface {
+	io.Reader
+	io.Writer
+	Close() error
+}
+
+// QUICWriter implements ResponseWriter for DNS-over-QUIC (RFC 9250). Messages are length-prefixed as
+// they are on TCP, but each stream carries a single query and its response: the send side of the
+// stream is closed (FIN) after the response is written, and further messages are rejected. Zone
+// transfers, which send several response messages on one stream, must set Multiple and call Close
+// after the last message
+type QUICWriter struct {
+	Stream QUICStream
+
+	// Multiple permits several messages to be sent before the stream is closed
+	Multiple bool
+
+	// Compression enables name compression in the Builders that the writer creates
+	Compression bool
+
+	// Allocator provides the buffers of the Builders and frames that the writer creates. A nil
+	// Allocator uses the package's pools
+	Allocator Allocator
+
+	done bool
+}
+
+var _ ResponseWriter = &QUICWriter{}
+
+// Builder creates a new builder with a 2 byte length header
+func (wr *QUICWriter) Builder(header dnsmessage.Header) dnsmessage.Builder {
+	builder := allocBuilder(wr.Allocator, &streamBuilders, 2, header)
+	if wr.Compression {
+		builder.EnableCompression()
+	}
+
+	return builder
+}
+
+// SendBuilder finalizes a Builder and sends the resulting message. Builders MUST be created with a 2 byte header
+func (wr *QUICWriter) SendBuilder(builder *dnsmessage.Builder) {
+	msg, err := builder.Finish()
+	if err != nil {
+		panic(err)
+	}
+
+	EncodeLength(msg, uint16(len(msg)-2))
+
+	wr.Send(msg)
+	freeBuilder(wr.Allocator, &streamBuilders, msg)
+}
+
+// SendMessage prepends a length header to a complete message and sends the resulting frame
+func (wr *QUICWriter) SendMessage(msg []byte) {
+	alloc := allocator(wr.Allocator)
+
+	frame := alloc.Get(len(msg)+2, len(msg)+2)
+	defer alloc.Put(frame)
+
+	EncodeLength(frame, uint16(len(msg)))
+	copy(frame[2:], msg)
+
+	wr.Send(frame)
+}
+
+// Send writes a length-prefixed frame to the stream, and closes the stream unless Multiple is set
+func (wr *QUICWriter) Send(frame []byte) {
+	if wr.done {
+		panic(ErrStreamDone)
+	}
+
+	_, err := wr.Stream.Write(frame)
+	if err != nil {
+		panic(err)
+	}
+
+	if !wr.Multiple {
+		wr.Close()
+	}
+}
+
+// Close closes the send side of the stream
+func (wr *QUICWriter) Close() error {
+	if wr.done {
+		return nil
+	}
+
+	wr.done = true
+	return wr.Stream.Close()
+}
+
+// HandleQUICStream reads a single query from a DNS-over-QUIC stream and passes it to the message
+// handler. The stream's send side is closed after the handler returns, if the handler did not
+// respond. QUIC listeners are not provided by this package, and must accept streams from their
+// connections and call HandleQUICStream for each of them
+func (server *Server) HandleQUICStream(ctx context.Context, stream QUICStream, local, remote net.Addr) {
+	msg, err := ReadFrame(stream)
+	if err != nil {
+		stream.Close()
+		return
+	}
+
+	defer FreeBuffer(msg)
+
+	wr := &QUICWriter{Stream: stream, Compression: server.Compression, Allocator: server.Allocator}
+	defer wr.Close()
+
+	server.Handle(ctx, msg, wr, &Request{ctx: ctx, LocalAddr: local, RemoteAddr: remote, transport: TransportQUIC})
+}
@@ -0,0 +1,104 @@
+package dns_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// QUICStreamTester is a QUIC stream that reads from its Buffer and records writes
+type QUICStreamTester struct {
+	bytes.Buffer
+	sent   bytes.Buffer
+	closed int
+}
+
+func (st *QUICStreamTester) Write(buf []byte) (int, error) {
+	return st.sent.Write(buf)
+}
+
+func (st *QUICStreamTester) Close() error {
+	st.closed++
+	return nil
+}
+
+func TestQUICWriter(t *testing.T) {
+	var stream QUICStreamTester
+	stream.Buffer.Write(GenerateFrame(0, testQuestion))
+
+	var transport string
+
+	server := dns.Server{Handler: dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+		transport = req.Transport()
+		dns.ServerFailure(wr, req)
+
+		// A second response on the stream is rejected
+		assert.PanicsWithValue(t, dns.ErrStreamDone, func() { dns.ServerFailure(wr, req) })
+	})}
+
+	server.HandleQUICStream(context.Background(), &stream, nil, nil)
+
+	assert.Equal(t, dns.TransportQUIC, transport)
+	assert.Equal(t, 1, stream.closed)
+
+	res, err := dns.ReadFrame(&stream.sent)
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint16(0), dns.MessageID(res))
+	}
+
+	assert.Zero(t, stream.sent.Len())
+}
+
+func TestQUICWriterSendMessage(t *testing.T) {
+	var stream QUICStreamTester
+	var alloc CountingAllocator
+
+	wr := &dns.QUICWriter{Stream: &stream, Allocator: &alloc}
+	msg := GenerateQuery(42, testQuestion)
+
+	// Messages are sent with a length prefix, and the stream is closed after the first
+	wr.SendMessage(msg)
+	assert.Equal(t, frame(msg), stream.sent.Bytes())
+	assert.Equal(t, 1, stream.closed)
+
+	// Frames are allocated by the writer's Allocator
+	assert.Equal(t, int64(1), alloc.Gets.Load())
+	assert.Equal(t, int64(1), alloc.Puts.Load())
+
+	assert.PanicsWithValue(t, dns.ErrStreamDone, func() { wr.SendMessage(msg) })
+	assert.Equal(t, 1, stream.closed)
+}
+
+func TestQUICWriterCompression(t *testing.T) {
+	answer := &dns.Answer{}
+	for i := range 10 {
+		answer.Answers = append(answer.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: testQuestion.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, byte(i)}},
+		})
+	}
+
+	// exchange sends an answer through a Server's QUIC stream handler, and returns the response's size
+	exchange := func(server *dns.Server) int {
+		var stream QUICStreamTester
+		stream.Buffer.Write(GenerateFrame(0, testQuestion))
+
+		server.Handler = dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+			assert.NoError(t, dns.WriteAnswer(wr, req, answer))
+		})
+
+		server.HandleQUICStream(context.Background(), &stream, nil, nil)
+
+		res, err := dns.ReadFrame(&stream.sent)
+		assert.NoError(t, err)
+
+		return len(res)
+	}
+
+	// The stream's Builders use the Server's compression setting
+	assert.Less(t, exchange(&dns.Server{Compression: true}), exchange(&dns.Server{}))
+}
@@ -0,0 +1,256 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jmanero/go-logging"
+	"go.uber.org/zap"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ReadThroughHandler answers queries from a Cache, and forwards queries that miss the cache to a
+// forwarding Handler, such as a ForwardHandler. Cacheable responses are stored before they are
+// relayed. Concurrent queries for the same question share one forwarded query
+type ReadThroughHandler struct {
+	Forwarder Handler
+	Cache     *Cache
+
+	flights map[cacheKey]*flight
+	sync.Mutex
+}
+
+var _ Handler = &ReadThroughHandler{}
+
+// flight is a forwarded query that identical queries wait for
+type flight struct {
+	done chan struct{}
+	// res is the response without its OPT record, or nil if the Forwarder did not respond
+	res    []byte
+	failed bool
+	// private is set when the response's OPT record can not be removed. Waiting queries are
+	// forwarded on their own instead of sharing the response
+	private bool
+}
+
+// ReadThrough creates a caching resolver from a forwarding Handler
+func ReadThrough(forwarder Handler, opts CacheOptions) Handler {
+	return &ReadThroughHandler{Forwarder: forwarder, Cache: NewCache(opts)}
+}
+
+// ServeDNS answers a request from the cache, or forwards it. Messages that are not standard queries
+// with a single question are forwarded without caching their responses
+func (rt *ReadThroughHandler) ServeDNS(wr ResponseWriter, req *Request) {
+	question, cacheable := cacheQuestion(req)
+	if !cacheable {
+		rt.Forwarder.ServeDNS(wr, req)
+		return
+	}
+
+	key := newCacheKey(req, question)
+	msg, status, refresh := rt.Cache.lookup(key)
+
+	switch status {
+	case cacheHit:
+		rt.Cache.Stats.Hits.Add(1)
+		req.Explain("cache: hit")
+		respond(wr, req, msg)
+
+		return
+
+	case cacheStale:
+		rt.Cache.Stats.Stale.Add(1)
+		req.Explain("cache: stale, refresh=%t", refresh)
+
+		if refresh {
+			rt.refresh(req, key)
+		}
+
+		respond(wr, req, msg, rt.Cache.staleOptions()...)
+		return
+	}
+
+	rt.Cache.Stats.Misses.Add(1)
+	req.Explain("cache: miss")
+
+	res, shared, failed := rt.forward(req, key)
+	if status == cacheExpired && failed {
+		// The upstreams could not be reached. Serve the expired response instead (RFC 8767)
+		rt.Cache.Stats.Stale.Add(1)
+		req.Explain("cache: upstreams failed, serving expired response")
+		respond(wr, req, msg, rt.Cache.staleOptions()...)
+
+		return
+	}
+
+	switch {
+	case res == nil:
+	case shared:
+		respond(wr, req, res)
+	default:
+		// The Forwarder's response to this request is relayed as it was sent
+		wr.SendMessage(res)
+	}
+}
+
+// Middleware answers queries from the Cache, and passes queries that miss it to the wrapped Handler.
+// Cacheable responses from the Handler are stored, so that the Cache can be placed in a Chain in
+// front of a forwarder or any other Handler. See ReadThroughHandler
+func (cache *Cache) Middleware(next Handler) Handler {
+	return &ReadThroughHandler{Forwarder: next, Cache: cache}
+}
+
+// CacheResponses creates a Cache, and a Middleware that caches the responses of the wrapped Handler.
+// The Cache may be registered with Server.AddCloser to save it to its Persist file, or used to read
+// its Stats
+func CacheResponses(opts CacheOptions) (*Cache, Middleware) {
+	cache := NewCache(opts)
+	return cache, cache.Middleware
+}
+
+type exchangeFailureKeyType struct{}
+
+var exchangeFailureKey exchangeFailureKeyType
+
+// ExchangeFailed records that a forwarding Handler could not exchange a request with any upstream,
+// before it sends its own SERVFAIL response. A ReadThroughHandler serves an expired response instead
+// of the Handler's response when the exchange failed (RFC 8767). SERVFAIL responses that are relayed
+// from an upstream are answers, and are not replaced
+func ExchangeFailed(req *Request) {
+	if failure, has := req.Context().Value(exchangeFailureKey).(*atomic.Bool); has {
+		failure.Store(true)
+	}
+}
+
+// forward sends a query to the Forwarder, or waits for an identical query that is in flight. It
+// returns the Forwarder's response, or nil if the Forwarder did not respond, and whether the Forwarder
+// failed to exchange the query with its upstreams. A response shared from another query does not have
+// an OPT record, which is indicated by the shared result
+func (rt *ReadThroughHandler) forward(req *Request, key cacheKey) (res []byte, shared bool, failed bool) {
+	rt.Lock()
+	if call, has := rt.flights[key]; has {
+		rt.Unlock()
+
+		select {
+		case <-call.done:
+			if call.private {
+				res, failed = rt.exchange(req)
+				return res, false, failed
+			}
+
+			return bytes.Clone(call.res), true, call.failed || call.res == nil
+		case <-req.Context().Done():
+			return nil, false, true
+		}
+	}
+
+	if rt.flights == nil {
+		rt.flights = map[cacheKey]*flight{}
+	}
+
+	call := &flight{done: make(chan struct{})}
+	rt.flights[key] = call
+	rt.Unlock()
+
+	// Release waiting queries, even if the Forwarder panics
+	defer func() {
+		rt.Lock()
+		delete(rt.flights, key)
+		rt.Unlock()
+
+		close(call.done)
+	}()
+
+	res, call.failed = rt.exchange(req)
+	if res == nil {
+		return nil, false, true
+	}
+
+	// The OPT record is built for each query that the response is shared with
+	stripped, removed := stripOPT(bytes.Clone(res))
+	if !removed {
+		call.private = true
+		return res, false, call.failed
+	}
+
+	call.res = stripped
+	rt.Cache.store(key, stripped)
+	return res, false, call.failed
+}
+
+// exchange sends a query to the Forwarder. It returns the Forwarder's response, or nil if the
+// Forwarder did not respond, and whether the Forwarder failed to exchange the query
+func (rt *ReadThroughHandler) exchange(req *Request) ([]byte, bool) {
+	var failure atomic.Bool
+	capture := NewMessageWriter(nil)
+	rt.Forwarder.ServeDNS(capture, req.WithContext(context.WithValue(req.Context(), exchangeFailureKey, &failure)))
+
+	res := capture.Bytes()
+	if len(res) == 0 {
+		return nil, true
+	}
+
+	return res, failure.Load()
+}
+
+// refresh forwards a copy of a request in the background to replace an expired response
+func (rt *ReadThroughHandler) refresh(req *Request, key cacheKey) {
+	ctx := context.WithoutCancel(req.Context())
+
+	clone, err := ParseRequest(ctx, bytes.Clone(req.Message()))
+	if err != nil {
+		rt.Cache.refreshed(key)
+		return
+	}
+
+	clone.LocalAddr, clone.RemoteAddr, clone.transport = req.LocalAddr, req.RemoteAddr, req.transport
+
+	go func() {
+		defer rt.Cache.refreshed(key)
+		defer func() {
+			if value := recover(); value != nil {
+				logging.FromContext(ctx).Error("cache.refresh", zap.Any("panic", value))
+			}
+		}()
+
+		rt.forward(clone, key)
+	}()
+}
+
+// cacheQuestion returns the question of a standard query with a single question
+func cacheQuestion(req *Request) (dnsmessage.Question, bool) {
+	if req.OpCode != 0 {
+		return dnsmessage.Question{}, false
+	}
+
+	questions, err := req.Questions()
+	if err != nil || len(questions) != 1 {
+		return dnsmessage.Question{}, false
+	}
+
+	return questions[0], true
+}
+
+// respond sends a cached or shared response, which does not have an OPT record, to a request. The
+// response's ID and RD flag are set from the request, and its question is replaced with the
+// request's, which may differ in case. An OPT record with the options is added for requests that have
+// one (RFC 6891, section 7)
+func respond(wr ResponseWriter, req *Request, msg []byte, options ...dnsmessage.Option) {
+	SetMessageID(msg, req.ID)
+
+	query := req.Message()
+	msg[2] = msg[2]&^0x01 | query[2]&0x01
+
+	if end := skipName(query, 12) + 4; end > 12 && end <= len(query) && end <= len(msg) && skipName(msg, 12)+4 == end {
+		copy(msg[12:end], query[12:end])
+	}
+
+	if edns, found := req.ResponseEDNS(0); found {
+		edns.Options = options
+		msg = appendOPT(msg, edns)
+	}
+
+	wr.SendMessage(msg)
+}
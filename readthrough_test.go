@@ -0,0 +1,474 @@
+package dns_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// AnsweringForwarder answers A queries with a record, and other queries with NXDOMAIN. Fail fails
+// the exchange with its upstreams, and ServerFailure relays an upstream's SERVFAIL response
+type AnsweringForwarder struct {
+	TTL           uint32
+	Calls         atomic.Int32
+	Release       chan struct{}
+	Fail          atomic.Bool
+	ServerFailure atomic.Bool
+}
+
+func (fw *AnsweringForwarder) ServeDNS(wr dns.ResponseWriter, req *dns.Request) {
+	fw.Calls.Add(1)
+
+	if fw.Release != nil {
+		<-fw.Release
+	}
+
+	if fw.Fail.Load() {
+		dns.ExchangeFailed(req)
+		dns.ServerFailure(wr, req)
+		return
+	}
+
+	if fw.ServerFailure.Load() {
+		dns.ServerFailure(wr, req)
+		return
+	}
+
+	questions, _ := req.Questions()
+	if questions[0].Type != dnsmessage.TypeA {
+		dns.NXDomain(wr, req, testSOA)
+		return
+	}
+
+	dns.WriteAnswer(wr, req, &dns.Answer{
+		Header: dnsmessage.Header{RecursionAvailable: true},
+		Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: fw.TTL},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+		}},
+	})
+}
+
+func TestReadThrough(t *testing.T) {
+	forwarder := &AnsweringForwarder{TTL: 60}
+	handler := dns.ReadThrough(forwarder, dns.CacheOptions{})
+
+	res := Exchange(t, handler, GenerateQuery(1, testQuestion))
+	assert.Equal(t, uint16(1), res.ID)
+	assert.Len(t, res.Answers, 1)
+
+	// The response is served from the cache with the client's ID and question
+	question := testQuestion
+	question.Name = dnsmessage.MustNewName("WwW.ExAmPlE.cOm.")
+
+	res = Exchange(t, handler, GenerateQuery(2, question))
+	assert.Equal(t, uint16(2), res.ID)
+	assert.Equal(t, []dnsmessage.Question{question}, res.Questions)
+
+	if assert.Len(t, res.Answers, 1) {
+		assert.LessOrEqual(t, res.Answers[0].Header.TTL, uint32(60))
+	}
+
+	assert.Equal(t, int32(1), forwarder.Calls.Load())
+
+	// Negative responses are cached for the SOA record's MINIMUM
+	question.Type = dnsmessage.TypeAAAA
+
+	res = Exchange(t, handler, GenerateQuery(3, question))
+	assert.Equal(t, dnsmessage.RCodeNameError, res.RCode)
+
+	res = Exchange(t, handler, GenerateQuery(4, question))
+	assert.Equal(t, dnsmessage.RCodeNameError, res.RCode)
+
+	if assert.Len(t, res.Authorities, 1) {
+		assert.LessOrEqual(t, res.Authorities[0].Header.TTL, uint32(300))
+	}
+
+	assert.Equal(t, int32(2), forwarder.Calls.Load())
+
+	cache := handler.(*dns.ReadThroughHandler).Cache
+	assert.Equal(t, 2, cache.Len())
+	assert.Equal(t, uint64(2), cache.Stats.Hits.Load())
+	assert.Equal(t, uint64(2), cache.Stats.Misses.Load())
+}
+
+func TestReadThroughSingleFlight(t *testing.T) {
+	forwarder := &AnsweringForwarder{TTL: 60, Release: make(chan struct{})}
+	handler := dns.ReadThrough(forwarder, dns.CacheOptions{})
+
+	var wg sync.WaitGroup
+	for id := range uint16(8) {
+		wg.Go(func() {
+			res := Exchange(t, handler, GenerateQuery(id, testQuestion))
+			assert.Equal(t, id, res.ID)
+			assert.Len(t, res.Answers, 1)
+		})
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(forwarder.Release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), forwarder.Calls.Load())
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	forwarder := &AnsweringForwarder{TTL: 1}
+	handler := dns.ReadThrough(forwarder, dns.CacheOptions{StaleWhileRevalidate: time.Minute})
+
+	Exchange(t, handler, GenerateQuery(1, testQuestion))
+	time.Sleep(1100 * time.Millisecond)
+
+	// The expired response is served with the stale TTL while it is refreshed
+	res := Exchange(t, handler, GenerateQuery(2, testQuestion))
+	if assert.Len(t, res.Answers, 1) {
+		assert.Equal(t, uint32(30), res.Answers[0].Header.TTL)
+	}
+
+	assert.Eventually(t, func() bool { return forwarder.Calls.Load() == 2 }, time.Second, 10*time.Millisecond)
+
+	cache := handler.(*dns.ReadThroughHandler).Cache
+	assert.Equal(t, uint64(1), cache.Stats.Stale.Load())
+}
+
+func TestServeStale(t *testing.T) {
+	forwarder := &AnsweringForwarder{TTL: 1}
+	handler := dns.ReadThrough(forwarder, dns.CacheOptions{ServeStale: time.Minute, StaleTTL: 10 * time.Second, StaleError: true})
+
+	Exchange(t, handler, GenerateEDNSQuery(1, 1232))
+	time.Sleep(1100 * time.Millisecond)
+
+	// The expired response is served when the upstreams fail, with an extended error
+	forwarder.Fail.Store(true)
+
+	res := Exchange(t, handler, GenerateEDNSQuery(2, 1232))
+	assert.Equal(t, dnsmessage.RCodeSuccess, res.RCode)
+
+	if assert.Len(t, res.Answers, 1) {
+		assert.Equal(t, uint32(10), res.Answers[0].Header.TTL)
+	}
+
+	if assert.Len(t, res.Additionals, 1) {
+		options := res.Additionals[0].Body.(*dnsmessage.OPTResource).Options
+		assert.Equal(t, []dnsmessage.Option{{Code: dns.OptionExtendedError, Data: []byte{0, 3}}}, options)
+	}
+
+	// An upstream's SERVFAIL response is relayed
+	forwarder.Fail.Store(false)
+	forwarder.ServerFailure.Store(true)
+
+	res = Exchange(t, handler, GenerateEDNSQuery(3, 1232))
+	assert.Equal(t, dnsmessage.RCodeServerFailure, res.RCode)
+	assert.Empty(t, res.Answers)
+
+	// A refreshed response replaces the expired response
+	forwarder.ServerFailure.Store(false)
+
+	res = Exchange(t, handler, GenerateEDNSQuery(3, 1232))
+	if assert.Len(t, res.Answers, 1) {
+		assert.Equal(t, uint32(1), res.Answers[0].Header.TTL)
+	}
+
+	assert.Empty(t, res.Additionals)
+	assert.Equal(t, int32(4), forwarder.Calls.Load())
+}
+
+func TestCachePersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+	forwarder := &AnsweringForwarder{TTL: 60}
+
+	// A missing file starts an empty cache
+	handler := &dns.ReadThroughHandler{Forwarder: forwarder, Cache: dns.NewCache(dns.CacheOptions{Persist: path})}
+	assert.Zero(t, handler.Cache.Len())
+
+	Exchange(t, handler, GenerateQuery(1, testQuestion))
+	assert.Equal(t, 1, handler.Cache.Len())
+	assert.NoError(t, handler.Cache.Close())
+
+	// The restarted cache answers without forwarding
+	handler = &dns.ReadThroughHandler{Forwarder: forwarder, Cache: dns.NewCache(dns.CacheOptions{Persist: path})}
+	assert.Equal(t, 1, handler.Cache.Len())
+
+	res := Exchange(t, handler, GenerateQuery(2, testQuestion))
+	assert.Equal(t, uint16(2), res.ID)
+	assert.Len(t, res.Answers, 1)
+	assert.Equal(t, int32(1), forwarder.Calls.Load())
+
+	// Expired responses are dropped
+	forwarder.TTL = 0
+	expiring := dns.NewCache(dns.CacheOptions{})
+
+	question := testQuestion
+	question.Name = dnsmessage.MustNewName("expired.example.com.")
+	query := GenerateQuery(3, question)
+	msg := Exchange(t, forwarder, query)
+
+	req, err := dns.ParseRequest(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packed, err := msg.Pack()
+	if assert.NoError(t, err) {
+		assert.True(t, expiring.Store(req, packed))
+	}
+
+	assert.NoError(t, expiring.Save(path))
+
+	loaded := dns.NewCache(dns.CacheOptions{})
+	assert.NoError(t, loaded.Load(path))
+	assert.Zero(t, loaded.Len())
+
+	// Corrupt files are rejected, keeping the entries that precede the corruption
+	assert.NoError(t, handler.Cache.Save(path))
+
+	data, err := os.ReadFile(path)
+	if assert.NoError(t, err) {
+		assert.NoError(t, os.WriteFile(path, append(data, data[9:20]...), 0o644))
+		assert.ErrorIs(t, loaded.Load(path), dns.ErrCacheFile)
+		assert.Equal(t, 1, loaded.Len())
+
+		assert.NoError(t, os.WriteFile(path, []byte("something else"), 0o644))
+		assert.ErrorIs(t, dns.NewCache(dns.CacheOptions{}).Load(path), dns.ErrCacheFile)
+		assert.Zero(t, dns.NewCache(dns.CacheOptions{Persist: path}).Len())
+	}
+}
+
+func TestCacheMiddleware(t *testing.T) {
+	forwarder := &AnsweringForwarder{TTL: 60}
+	cache := dns.NewCache(dns.CacheOptions{MaxEntries: 1})
+
+	handler := dns.Chain(forwarder, cache.Middleware)
+
+	// Positive and negative responses are cached by question
+	nxdomain := testQuestion
+	nxdomain.Type = dnsmessage.TypeAAAA
+
+	for id, question := range []dnsmessage.Question{testQuestion, testQuestion, nxdomain, nxdomain} {
+		res := Exchange(t, handler, GenerateQuery(uint16(id), question))
+		assert.Equal(t, uint16(id), res.ID)
+	}
+
+	assert.Equal(t, int32(2), forwarder.Calls.Load())
+	assert.Equal(t, uint64(2), cache.Stats.Hits.Load())
+
+	// The least recently used response is evicted
+	assert.Equal(t, 1, cache.Len())
+	Exchange(t, handler, GenerateQuery(5, testQuestion))
+	assert.Equal(t, int32(3), forwarder.Calls.Load())
+}
+
+// EDNSForwarder answers A queries like an upstream that echoes the client's EDNS options, and adds
+// an RRSIG record for clients that set the DO bit
+type EDNSForwarder struct {
+	Calls   atomic.Int32
+	Release chan struct{}
+}
+
+func (fw *EDNSForwarder) ServeDNS(wr dns.ResponseWriter, req *dns.Request) {
+	fw.Calls.Add(1)
+
+	if fw.Release != nil {
+		<-fw.Release
+	}
+
+	questions, _ := req.Questions()
+	answer := &dns.Answer{Answers: []dnsmessage.Resource{{
+		Header: dnsmessage.ResourceHeader{Name: questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+		Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+	}}}
+
+	client, found, _ := req.ClientEDNS()
+	if found {
+		answer.EDNS, _ = req.ResponseEDNS(0)
+		answer.EDNS.Options = client.Options
+	}
+
+	if found && client.DO {
+		answer.Answers = append(answer.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: questions[0].Name, Type: dns.TypeRRSIG, Class: dnsmessage.ClassINET, TTL: 60},
+			Body:   &dnsmessage.UnknownResource{Type: dns.TypeRRSIG, Data: []byte{0, byte(dnsmessage.TypeA), 13, 3}},
+		})
+	}
+
+	dns.WriteAnswer(wr, req, answer)
+}
+
+// GenerateOPTQuery builds a query for testQuestion with an OPT record, optionally setting the DO bit
+func GenerateOPTQuery(id uint16, do bool, options ...dnsmessage.Option) []byte {
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id})
+	builder.StartQuestions()
+	builder.Question(testQuestion)
+	builder.StartAdditionals()
+
+	var header dnsmessage.ResourceHeader
+	header.SetEDNS0(1232, dnsmessage.RCodeSuccess, do)
+	builder.OPTResource(header, dnsmessage.OPTResource{Options: options})
+
+	buf, err := builder.Finish()
+	if err != nil {
+		panic(err)
+	}
+
+	return buf
+}
+
+// AssertOPT checks that a response has an OPT record with the DO bit and options, or no OPT record
+// if edns is false
+func AssertOPT(t *testing.T, res dnsmessage.Message, edns, do bool, options ...dnsmessage.Option) {
+	t.Helper()
+
+	var opts []dnsmessage.Resource
+	for _, resource := range res.Additionals {
+		if resource.Header.Type == dnsmessage.TypeOPT {
+			opts = append(opts, resource)
+		}
+	}
+
+	if !edns {
+		assert.Empty(t, opts)
+		return
+	}
+
+	if assert.Len(t, opts, 1) {
+		assert.Equal(t, do, opts[0].Header.DNSSECAllowed())
+		assert.Equal(t, options, opts[0].Body.(*dnsmessage.OPTResource).Options)
+	}
+}
+
+func TestReadThroughEDNS(t *testing.T) {
+	forwarder := &EDNSForwarder{}
+	handler := dns.ReadThrough(forwarder, dns.CacheOptions{})
+
+	first := dnsmessage.Option{Code: dns.OptionCookie, Data: []byte{1, 1, 1, 1, 1, 1, 1, 1}}
+	second := dnsmessage.Option{Code: dns.OptionCookie, Data: []byte{2, 2, 2, 2, 2, 2, 2, 2}}
+
+	// Each client's response is cached without its OPT record
+	res := Exchange(t, handler, GenerateOPTQuery(1, true, first))
+	AssertOPT(t, res, true, true, first)
+	assert.Len(t, res.Answers, 2)
+
+	res = Exchange(t, handler, GenerateQuery(2, testQuestion))
+	AssertOPT(t, res, false, false)
+	assert.Len(t, res.Answers, 1)
+
+	res = Exchange(t, handler, GenerateOPTQuery(3, false))
+	AssertOPT(t, res, true, false)
+	assert.Len(t, res.Answers, 1)
+
+	// Cached responses are served with an OPT record built for each client, and do not carry
+	// another client's options
+	res = Exchange(t, handler, GenerateOPTQuery(4, true, second))
+	AssertOPT(t, res, true, true)
+	assert.Len(t, res.Answers, 2)
+
+	res = Exchange(t, handler, GenerateQuery(5, testQuestion))
+	AssertOPT(t, res, false, false)
+	assert.Len(t, res.Answers, 1)
+
+	res = Exchange(t, handler, GenerateOPTQuery(6, false, second))
+	AssertOPT(t, res, true, false)
+	assert.Len(t, res.Answers, 1)
+
+	assert.Equal(t, int32(3), forwarder.Calls.Load())
+
+	// Queries with the CD bit are cached separately
+	query := GenerateOPTQuery(7, true)
+	query[3] |= 0x10
+
+	res = Exchange(t, handler, query)
+	assert.True(t, res.CheckingDisabled)
+	assert.Equal(t, int32(4), forwarder.Calls.Load())
+
+	cache := handler.(*dns.ReadThroughHandler).Cache
+	assert.Equal(t, 4, cache.Len())
+}
+
+func TestReadThroughSingleFlightEDNS(t *testing.T) {
+	forwarder := &EDNSForwarder{Release: make(chan struct{})}
+	handler := dns.ReadThrough(forwarder, dns.CacheOptions{})
+
+	cookie := func(id uint16) dnsmessage.Option {
+		return dnsmessage.Option{Code: dns.OptionCookie, Data: []byte{byte(id), 0, 0, 0, 0, 0, 0, 0}}
+	}
+
+	// The leading query's response echoes its own cookie, and shared responses have no options
+	assertOPT := func(res dnsmessage.Message, do bool) {
+		if !assert.NotEmpty(t, res.Additionals) {
+			return
+		}
+
+		opt := res.Additionals[len(res.Additionals)-1]
+		if assert.Equal(t, dnsmessage.TypeOPT, opt.Header.Type) {
+			assert.Equal(t, do, opt.Header.DNSSECAllowed())
+
+			for _, option := range opt.Body.(*dnsmessage.OPTResource).Options {
+				assert.Equal(t, cookie(res.ID), option)
+			}
+		}
+	}
+
+	// Queries share a forwarded query only with queries that have the same EDNS and DO bits, and do
+	// not receive the leading query's options
+	var wg sync.WaitGroup
+	for id := range uint16(12) {
+		wg.Go(func() {
+			switch id % 3 {
+			case 0:
+				res := Exchange(t, handler, GenerateQuery(id, testQuestion))
+				assert.Equal(t, id, res.ID)
+				AssertOPT(t, res, false, false)
+				assert.Len(t, res.Answers, 1)
+
+			case 1:
+				res := Exchange(t, handler, GenerateOPTQuery(id, false, cookie(id)))
+				assert.Equal(t, id, res.ID)
+				assert.Len(t, res.Answers, 1)
+				assertOPT(res, false)
+
+			case 2:
+				res := Exchange(t, handler, GenerateOPTQuery(id, true, cookie(id)))
+				assert.Equal(t, id, res.ID)
+				assert.Len(t, res.Answers, 2)
+				assertOPT(res, true)
+			}
+		})
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(forwarder.Release)
+	wg.Wait()
+
+	assert.Equal(t, int32(3), forwarder.Calls.Load())
+}
+
+func TestCacheResponses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+	forwarder := &AnsweringForwarder{TTL: 60}
+
+	cache, middleware := dns.CacheResponses(dns.CacheOptions{Persist: path})
+	handler := dns.Chain(forwarder, middleware)
+
+	for id := range uint16(2) {
+		res := Exchange(t, handler, GenerateQuery(id, testQuestion))
+		assert.Equal(t, id, res.ID)
+		assert.Len(t, res.Answers, 1)
+	}
+
+	assert.Equal(t, int32(1), forwarder.Calls.Load())
+	assert.Equal(t, uint64(1), cache.Stats.Hits.Load())
+
+	// The returned Cache saves the Middleware's responses
+	assert.NoError(t, cache.Close())
+
+	restored, _ := dns.CacheResponses(dns.CacheOptions{Persist: path})
+	assert.Equal(t, 1, restored.Len())
+}
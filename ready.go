@@ -0,0 +1,31 @@
+package dns
+
+// SetReady marks the server as ready to answer queries with its Handler, when AwaitReady is set.
+// Call SetReady once the data that the Handler depends on, such as a zone, is loaded
+func (server *Server) SetReady() {
+	server.ready.Store(true)
+}
+
+// Ready reports whether the server is answering queries with its Handler, for use in readiness
+// probes. A server is not ready before SetReady is called when AwaitReady is set, or once it has
+// begun to drain
+func (server *Server) Ready() bool {
+	return (!server.AwaitReady || server.ready.Load()) && !server.draining.Load()
+}
+
+// warmingUp answers a query that was received before SetReady was called
+func (server *Server) warmingUp(wr ResponseWriter, req *Request) bool {
+	if !server.AwaitReady || server.ready.Load() {
+		return false
+	}
+
+	server.Stats.NotReady.Add(1)
+
+	if server.NotReady != nil {
+		server.NotReady.ServeDNS(wr, req)
+		return true
+	}
+
+	ServerFailure(wr, req)
+	return true
+}
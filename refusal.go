@@ -0,0 +1,61 @@
+package dns
+
+import (
+	"context"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Refusal is the policy that built-in middlewares (ACLs, rate limits, class and type restrictions)
+// apply when they reject a query. The zero value responds with REFUSED
+type Refusal struct {
+	// RCode is sent in the rejection response. A zero value uses RCodeRefused
+	RCode dnsmessage.RCode
+	// Drop rejects queries silently, without sending a response
+	Drop bool
+}
+
+type refusalKeyType struct{}
+
+var refusalKey refusalKeyType
+
+// ContextWithRefusal sets the Refusal policy for requests handled with a Context
+func ContextWithRefusal(ctx context.Context, policy Refusal) context.Context {
+	return context.WithValue(ctx, refusalKey, policy)
+}
+
+// RefusalFromContext returns the Refusal policy for a Context, or the zero Refusal if none is set
+func RefusalFromContext(ctx context.Context) Refusal {
+	policy, _ := ctx.Value(refusalKey).(Refusal)
+	return policy
+}
+
+// Refuse rejects a request according to a Refusal policy
+func (policy Refusal) Refuse(wr ResponseWriter, req *Request) error {
+	if policy.Drop {
+		return nil
+	}
+
+	rcode := policy.RCode
+	if rcode == dnsmessage.RCodeSuccess {
+		rcode = dnsmessage.RCodeRefused
+	}
+
+	return WriteError(wr, req, rcode)
+}
+
+// Refuse rejects a request according to the Refusal policy in the request's Context. Built-in
+// middlewares use Refuse so that operators can configure a consistent posture with
+// Server.DefaultRefusal, or override it for part of a handler chain with WithRefusal
+func Refuse(wr ResponseWriter, req *Request) error {
+	return RefusalFromContext(req.Context()).Refuse(wr, req)
+}
+
+// WithRefusal creates a Middleware that overrides the Refusal policy for the wrapped Handler
+func WithRefusal(policy Refusal) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(wr ResponseWriter, req *Request) {
+			next.ServeDNS(wr, req.WithContext(ContextWithRefusal(req.Context(), policy)))
+		})
+	}
+}
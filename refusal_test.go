@@ -0,0 +1,53 @@
+package dns_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestRefusal(t *testing.T) {
+	refuse := dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+		assert.NoError(t, dns.Refuse(wr, req))
+	})
+
+	serve := func(ctx context.Context, handler dns.Handler) []byte {
+		req, err := dns.ParseRequest(ctx, GenerateQuery(42, testQuestion))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wr := dns.NewMessageWriter(nil)
+		handler.ServeDNS(wr, req)
+
+		return wr.Bytes()
+	}
+
+	// The zero policy responds with REFUSED
+	res := Exchange(t, refuse, GenerateQuery(42, testQuestion))
+	assert.Equal(t, dnsmessage.RCodeRefused, res.RCode)
+	assert.Equal(t, []dnsmessage.Question{testQuestion}, res.Questions)
+
+	// The policy in the request's Context selects the RCODE
+	var parsed dnsmessage.Message
+
+	msg := serve(dns.ContextWithRefusal(context.Background(), dns.Refusal{RCode: dns.RCodeNotAuth}), refuse)
+	if assert.NoError(t, parsed.Unpack(msg)) {
+		assert.Equal(t, dns.RCodeNotAuth, parsed.RCode)
+	}
+
+	// WithRefusal overrides the Context's policy for the wrapped Handler
+	msg = serve(dns.ContextWithRefusal(context.Background(), dns.Refusal{RCode: dns.RCodeNotAuth}), dns.WithRefusal(dns.Refusal{Drop: true})(refuse))
+	assert.Empty(t, msg)
+
+	assert.Equal(t, dns.Refusal{}, dns.RefusalFromContext(context.Background()))
+
+	// Requests without a Context use the zero policy
+	msg = serve(nil, refuse)
+	if assert.NoError(t, parsed.Unpack(msg)) {
+		assert.Equal(t, dnsmessage.RCodeRefused, parsed.RCode)
+	}
+}
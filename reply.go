@@ -0,0 +1,191 @@
+package dns
+
+import (
+	"context"
+	"errors"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ErrNotSOA is returned by negative response helpers when the provided resource is not an SOA record
+var ErrNotSOA = errors.New("dns: negative responses require an SOA resource")
+
+// NoData responds to a query for a name that exists, but has no records of the requested type.
+// The response has a NOERROR rcode, an empty answer section, and the zone's SOA in the authority
+// section so that resolvers can cache the negative answer (RFC 2308)
+func NoData(wr ResponseWriter, req *Request, soa dnsmessage.Resource) error {
+	return negative(wr, req, dnsmessage.RCodeSuccess, soa)
+}
+
+// NXDomain responds to a query for a name that does not exist. The response has a NXDOMAIN rcode,
+// an empty answer section, and the zone's SOA in the authority section so that resolvers can cache
+// the negative answer (RFC 2308)
+func NXDomain(wr ResponseWriter, req *Request, soa dnsmessage.Resource) error {
+	return negative(wr, req, dnsmessage.RCodeNameError, soa)
+}
+
+func negative(wr ResponseWriter, req *Request, rcode dnsmessage.RCode, soa dnsmessage.Resource) error {
+	soa, err := negativeSOA(soa)
+	if err != nil {
+		return err
+	}
+
+	return WriteAnswer(wr, req, &Answer{
+		Header:      dnsmessage.Header{Authoritative: true, RCode: rcode},
+		Authorities: []dnsmessage.Resource{soa},
+	})
+}
+
+// negativeSOA prepares an SOA record for the authority section of a negative response. The negative
+// caching TTL is the lesser of the SOA record's TTL and its MINIMUM field
+func negativeSOA(soa dnsmessage.Resource) (dnsmessage.Resource, error) {
+	body, is := soa.Body.(*dnsmessage.SOAResource)
+	if !is {
+		return soa, ErrNotSOA
+	}
+
+	soa.Header.TTL = min(soa.Header.TTL, body.MinTTL)
+	return soa, nil
+}
+
+// NoQuestion responds to a message without a question, such as an EDNS0 probe or keepalive, with
+// NOERROR. If the message contains an OPT record, the response includes an OPT record that reflects
+// the client's EDNS version and DO bit, without any options
+func NoQuestion(wr ResponseWriter, req *Request) error {
+	return noQuestion(wr, req)
+}
+
+// noQuestion responds to a message without a question, adding options to the response's OPT record
+func noQuestion(wr ResponseWriter, req *Request, options ...dnsmessage.Option) error {
+	opt, found, err := req.OPT()
+	if err != nil {
+		return err
+	}
+
+	res := wr.Builder(req.ResponseHeader(dnsmessage.RCodeSuccess))
+
+	if found {
+		// Keep the version and DO bit. Clear the extended RCODE and reserved flags
+		opt.Header.TTL &= 0x00ff8000
+
+		err = res.StartAdditionals()
+		if err == nil {
+			err = res.OPTResource(opt.Header, dnsmessage.OPTResource{Options: options})
+		}
+
+		if err != nil {
+			releaseBuilder(wr, &res)
+			return err
+		}
+	}
+
+	wr.SendBuilder(&res)
+	return nil
+}
+
+// ServerFailure responds to a request with SERVFAIL, echoing the request's question section
+func ServerFailure(wr ResponseWriter, req *Request) error {
+	return WriteError(wr, req, dnsmessage.RCodeServerFailure)
+}
+
+// Refused responds to a request with REFUSED, echoing the request's question section. Middlewares
+// that reject queries should generally use Refuse, which applies the configured Refusal policy
+func Refused(wr ResponseWriter, req *Request) error {
+	return WriteError(wr, req, dnsmessage.RCodeRefused)
+}
+
+// WriteError responds to a request with an rcode, echoing the request's question section. The
+// response is built by the ResponseWriter, so that it is framed for the request's transport
+func WriteError(wr ResponseWriter, req *Request, rcode dnsmessage.RCode) error {
+	header := req.ResponseHeader(rcode)
+	if rcode <= 0xf {
+		return writeEmpty(wr, req, header, nil)
+	}
+
+	// Extended RCODEs are split between the header and an OPT record
+	edns, found := req.ResponseEDNS(0)
+	if !found {
+		return ErrExtendedRCode
+	}
+
+	header.RCode, edns.ExtendedRCode = SplitRCode(rcode)
+	return writeEmpty(wr, req, header, edns)
+}
+
+// writeEmpty responds with a header and the request's question section, and an OPT record if edns
+// is not nil
+func writeEmpty(wr ResponseWriter, req *Request, header dnsmessage.Header, edns *EDNS0) error {
+	res := wr.Builder(header)
+
+	err := buildEmpty(&res, req, edns)
+	if err != nil {
+		releaseBuilder(wr, &res)
+		return err
+	}
+
+	wr.SendBuilder(&res)
+	return nil
+}
+
+// buildEmpty appends the request's question section, and an OPT record if edns is not nil, to a
+// response Builder
+func buildEmpty(res *dnsmessage.Builder, req *Request, edns *EDNS0) error {
+	questions, err := req.Questions()
+	if err == nil && len(questions) > 0 {
+		err = res.StartQuestions()
+		if err != nil {
+			return err
+		}
+
+		for _, question := range questions {
+			err = res.Question(question)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if edns != nil {
+		err = res.StartAdditionals()
+		if err != nil {
+			return err
+		}
+
+		return edns.AppendOPT(res)
+	}
+
+	return nil
+}
+
+type recursionKeyType struct{}
+
+var recursionKey recursionKeyType
+
+// ContextWithRecursion sets whether responses built by the package's helpers for requests handled
+// with a Context advertise recursion with the RA bit
+func ContextWithRecursion(ctx context.Context, available bool) context.Context {
+	return context.WithValue(ctx, recursionKey, available)
+}
+
+// RecursionFromContext checks if responses for requests handled with a Context advertise recursion
+func RecursionFromContext(ctx context.Context) bool {
+	available, _ := ctx.Value(recursionKey).(bool)
+	return available
+}
+
+// ResponseHeader derives the header of a response to the request with an RCODE. The ID, opcode, RD
+// and CD bits are copied from the request, and QR is set. RA is set by the recursion policy in the
+// request's Context (see ContextWithRecursion and Server.RecursionAvailable). AA and TC are left for
+// the handler to set, AD is not set, as only a server that validated the response's data may set
+// it (RFC 4035, section 3.1.6), and the reserved Z bit is always clear
+func (req *Request) ResponseHeader(rcode dnsmessage.RCode) dnsmessage.Header {
+	return dnsmessage.Header{
+		ID:                 req.ID,
+		Response:           true,
+		OpCode:             req.OpCode,
+		RecursionDesired:   req.RecursionDesired,
+		RecursionAvailable: RecursionFromContext(req.Context()),
+		CheckingDisabled:   req.CheckingDisabled,
+		RCode:              rcode,
+	}
+}
@@ -0,0 +1,121 @@
+package dns_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestNegativeSOA(t *testing.T) {
+	req, err := dns.ParseRequest(context.Background(), GenerateQuery(42, testQuestion))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Negative responses require an SOA record
+	wr := dns.NewMessageWriter(nil)
+	assert.ErrorIs(t, dns.NoData(wr, req, dnsmessage.Resource{Header: testSOA.Header, Body: &dnsmessage.AResource{}}), dns.ErrNotSOA)
+	assert.Empty(t, wr.Bytes())
+
+	// The SOA record's TTL is kept when it is less than the MINIMUM field
+	soa := testSOA
+	soa.Header.TTL = 60
+
+	res := Exchange(t, dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+		assert.NoError(t, dns.NXDomain(wr, req, soa))
+	}), GenerateQuery(42, testQuestion))
+
+	assert.Equal(t, []dnsmessage.Question{testQuestion}, res.Questions)
+
+	if assert.Len(t, res.Authorities, 1) {
+		assert.Equal(t, uint32(60), res.Authorities[0].Header.TTL)
+		assert.Equal(t, testSOA.Body, res.Authorities[0].Body)
+	}
+
+	// The caller's SOA record is not modified
+	assert.Equal(t, uint32(60), soa.Header.TTL)
+	assert.Equal(t, uint32(3600), testSOA.Header.TTL)
+}
+
+func TestRequestQuestions(t *testing.T) {
+	req, err := dns.ParseRequest(context.Background(), GenerateQuery(42, testQuestion))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Questions does not depend on the position of the embedded Parser
+	questions, err := req.Questions()
+	assert.NoError(t, err)
+	assert.Equal(t, []dnsmessage.Question{testQuestion}, questions)
+
+	_, err = req.AllQuestions()
+	assert.NoError(t, err)
+
+	questions, err = req.Questions()
+	assert.NoError(t, err)
+	assert.Equal(t, []dnsmessage.Question{testQuestion}, questions)
+}
+
+func TestNoQuestion(t *testing.T) {
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 42})
+	builder.StartAdditionals()
+
+	var header dnsmessage.ResourceHeader
+	header.SetEDNS0(1232, dnsmessage.RCodeSuccess, true)
+
+	// Set an extended RCODE and a reserved flag, which are not echoed
+	header.TTL |= 0x01000001
+
+	builder.OPTResource(header, dnsmessage.OPTResource{Options: []dnsmessage.Option{{Code: 10, Data: make([]byte, 8)}}})
+
+	probe, err := builder.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := dns.ParseRequest(context.Background(), probe)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opt, found, err := req.OPT()
+	if assert.NoError(t, err) && assert.True(t, found) {
+		assert.Equal(t, header.TTL, opt.Header.TTL)
+	}
+
+	res := Exchange(t, dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+		assert.NoError(t, dns.NoQuestion(wr, req))
+	}), probe)
+
+	assert.Equal(t, uint16(42), res.ID)
+	assert.True(t, res.Response)
+	assert.Equal(t, dnsmessage.RCodeSuccess, res.RCode)
+	assert.Empty(t, res.Questions)
+
+	if assert.Len(t, res.Additionals, 1) {
+		assert.Equal(t, dnsmessage.TypeOPT, res.Additionals[0].Header.Type)
+		assert.True(t, res.Additionals[0].Header.DNSSECAllowed())
+		assert.Equal(t, dnsmessage.RCodeSuccess, res.Additionals[0].Header.ExtendedRCode(dnsmessage.RCodeSuccess))
+		assert.Zero(t, res.Additionals[0].Header.TTL&0x7fff)
+		assert.Empty(t, res.Additionals[0].Body.(*dnsmessage.OPTResource).Options)
+	}
+
+	// Messages without an OPT record are answered without one
+	req, err = dns.ParseRequest(context.Background(), GenerateQuery(42))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, found, err = req.OPT()
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	res = Exchange(t, dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+		assert.NoError(t, dns.NoQuestion(wr, req))
+	}), GenerateQuery(42))
+
+	assert.Empty(t, res.Additionals)
+}
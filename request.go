@@ -2,12 +2,19 @@ package dns
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"net"
+	"strings"
 
 	"golang.org/x/net/dns/dnsmessage"
 )
 
-// Request stores a parsed dnsmessage.Header and a dnsmessage.Parser to read the rest of the request
+// Request stores a parsed dnsmessage.Header and a dnsmessage.Parser to read the rest of the request.
+//
+// Messages are not required to contain a question. EDNS0 probes and keepalives may arrive with
+// QDCOUNT=0 and only an OPT record, in which case AllQuestions and Questions return an empty
+// slice without an error. Handlers should check for this case rather than assuming a question exists
 type Request struct {
 	dnsmessage.Header
 	dnsmessage.Parser
@@ -16,17 +23,220 @@ type Request struct {
 	RemoteAddr net.Addr
 
 	ctx context.Context
+	msg []byte
+
+	// transport names the protocol that the request was received on
+	transport string
+
+	// parser reads the question section of messages in a non-standard encoding
+	parser Parser
+
+	// payload is the UDP payload size that a response advertises, from ResponseEDNS
+	payload uint16
+
+	// qclass overrides the class of the first question when it is set by a ClassANYPolicy
+	qclass dnsmessage.Class
+}
+
+// Transport names
+const (
+	TransportUDP  = "udp"
+	TransportTCP  = "tcp"
+	TransportTLS  = "tls"
+	TransportQUIC = "quic"
+	TransportUnix = "unix"
+)
+
+// packetTransport names the transport of a net.PacketConn
+func packetTransport(conn net.PacketConn) string {
+	if strings.HasPrefix(conn.LocalAddr().Network(), "unix") {
+		return TransportUnix
+	}
+
+	return TransportUDP
+}
+
+// streamTransport names the transport of a net.Conn
+func streamTransport(conn net.Conn) string {
+	if _, is := conn.(*tls.Conn); is {
+		return TransportTLS
+	}
+
+	if strings.HasPrefix(conn.LocalAddr().Network(), "unix") {
+		return TransportUnix
+	}
+
+	return TransportTCP
+}
+
+// ParseRequest creates a Request from a wire-format message and parses its header. It allows
+// integrations and tests to call a Handler with messages that were not received by a Server
+func ParseRequest(ctx context.Context, msg []byte) (*Request, error) {
+	req := Request{ctx: ctx, msg: msg}
+
+	var err error
+
+	req.Header, err = req.Start(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &req, nil
 }
 
 func (req *Request) String() string {
 	return req.Header.GoString()
 }
 
-// Context returns the context for the request
+// Context returns the context for the request. Requests that were created without a context return
+// context.Background
 func (req *Request) Context() context.Context {
+	if req.ctx == nil {
+		return context.Background()
+	}
+
 	return req.ctx
 }
 
+// Message returns the raw wire-format message that the Request was parsed from. The
+// underlying buffer is reused after the Handler returns, and must be copied if it is retained
+func (req *Request) Message() []byte {
+	return req.msg
+}
+
+// Questions parses the question section of the request's message. It is independent of the
+// embedded Parser's position, and may be called before or after the Parser is used. Messages
+// received by a Server with a custom Parser are parsed with it
+func (req *Request) Questions() ([]dnsmessage.Question, error) {
+	if req.parser != nil {
+		return req.parser.ParseQuestions(req.msg)
+	}
+
+	var parser dnsmessage.Parser
+
+	_, err := parser.Start(req.msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return parser.AllQuestions()
+}
+
+// OPT scans the additional section of the request's message for an EDNS0 OPT pseudo-record. The
+// boolean result is false if the message does not contain an OPT record
+func (req *Request) OPT() (dnsmessage.Resource, bool, error) {
+	return req.findOPT(false)
+}
+
+// findOPT scans the additional section for an OPT record. When unique is set, the rest of the
+// section is scanned for another OPT record, which is an error
+func (req *Request) findOPT(unique bool) (dnsmessage.Resource, bool, error) {
+	var parser dnsmessage.Parser
+	var opt dnsmessage.Resource
+	var found bool
+
+	_, err := parser.Start(req.msg)
+	if err != nil {
+		return dnsmessage.Resource{}, false, err
+	}
+
+	err = skipToAdditionals(&parser)
+	if err != nil {
+		return dnsmessage.Resource{}, false, err
+	}
+
+	for {
+		header, err := parser.AdditionalHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			return opt, found, nil
+		}
+
+		if err != nil {
+			return dnsmessage.Resource{}, false, err
+		}
+
+		if header.Type != dnsmessage.TypeOPT {
+			err = parser.SkipAdditional()
+			if err != nil {
+				return dnsmessage.Resource{}, false, err
+			}
+
+			continue
+		}
+
+		if found {
+			return dnsmessage.Resource{}, false, ErrMultipleOPT
+		}
+
+		body, err := parser.OPTResource()
+		if err != nil {
+			return dnsmessage.Resource{}, false, err
+		}
+
+		opt, found = dnsmessage.Resource{Header: header, Body: &body}, true
+		if !unique {
+			return opt, found, nil
+		}
+	}
+}
+
+func skipToAdditionals(parser *dnsmessage.Parser) error {
+	err := parser.SkipAllQuestions()
+	if err != nil {
+		return err
+	}
+
+	err = parser.SkipAllAnswers()
+	if err != nil {
+		return err
+	}
+
+	return parser.SkipAllAuthorities()
+}
+
+// Transport returns the name of the protocol that the request was received on: one of TransportUDP,
+// TransportTCP, TransportTLS, TransportQUIC, TransportUnix, or an empty string if the request was not
+// received by a Server
+func (req *Request) Transport() string {
+	return req.transport
+}
+
+// Reserved header bits
+const headerBitZ = 1 << 6
+
+// IsResponse reports whether the message has the QR bit set. A Server drops such messages unless
+// its AcceptResponses option is set
+func (req *Request) IsResponse() bool {
+	return req.Header.Response
+}
+
+// RequestsAD reports whether the client set the AD bit, indicating that it understands the AD bit in
+// responses even if it did not set the DO bit (RFC 6840, section 5.7)
+func (req *Request) RequestsAD() bool {
+	return req.AuthenticData
+}
+
+// DisablesChecking reports whether the client set the CD bit, to disable DNSSEC validation of the
+// response by the server (RFC 4035, section 3.2.2). CD is echoed in responses built by the
+// package's helpers
+func (req *Request) DisablesChecking() bool {
+	return req.CheckingDisabled
+}
+
+// Reserved reports whether the client set the reserved Z bit, which must be zero (RFC 1035). The bit
+// is ignored when parsing the request, and is never set in responses built with a dnsmessage.Builder
+func (req *Request) Reserved() bool {
+	return len(req.msg) >= 4 && req.msg[3]&headerBitZ != 0
+}
+
+// ClearReserved zeroes the reserved Z bit in the header of a wire-format message, so that messages
+// relayed from another server do not carry it to clients
+func ClearReserved(msg []byte) {
+	if len(msg) >= 4 {
+		msg[3] &^= headerBitZ
+	}
+}
+
 // WithContext clones the REquest and sets its context value
 func (req *Request) WithContext(ctx context.Context) *Request {
 	clone := *req
@@ -0,0 +1,154 @@
+package dns_test
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestReservedBits(t *testing.T) {
+	query := GenerateQuery(42, testQuestion)
+
+	// Set the Z, AD and CD bits
+	query[3] |= 0x40 | 0x20 | 0x10
+
+	// An upstream response that carries the Z bit
+	relayed := append([]byte(nil), query...)
+	relayed[2] |= 0x80
+
+	req, err := dns.ParseRequest(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, req.Reserved())
+	assert.True(t, req.RequestsAD())
+	assert.True(t, req.DisablesChecking())
+
+	// The embedded Header's fields remain accessible
+	assert.True(t, req.AuthenticData)
+	assert.True(t, req.CheckingDisabled)
+
+	for name, handler := range map[string]dns.HandlerFunc{
+		"ServerFailure": func(wr dns.ResponseWriter, req *dns.Request) { dns.ServerFailure(wr, req) },
+		"NoQuestion":    func(wr dns.ResponseWriter, req *dns.Request) { dns.NoQuestion(wr, req) },
+		"NXDomain":      func(wr dns.ResponseWriter, req *dns.Request) { dns.NXDomain(wr, req, testSOA) },
+		"Forward": func(wr dns.ResponseWriter, req *dns.Request) {
+			(&dns.ForwardHandler{Upstreams: []dns.Upstream{StaticUpstream(relayed)}}).ServeDNS(wr, req)
+		},
+	} {
+		wr := dns.NewMessageWriter(nil)
+		handler.ServeDNS(wr, req)
+
+		res := wr.Bytes()
+		if !assert.GreaterOrEqual(t, len(res), 12, name) {
+			continue
+		}
+
+		assert.Zero(t, res[3]&0x40, "%s: Z bit is set", name)
+		assert.NotZero(t, res[2]&0x80, "%s: QR bit is not set", name)
+
+		var parsed dnsmessage.Message
+		if name != "Forward" && assert.NoError(t, parsed.Unpack(res), name) {
+			assert.False(t, parsed.AuthenticData, name)
+			assert.True(t, parsed.CheckingDisabled, name)
+		}
+	}
+}
+
+func TestResponseHeader(t *testing.T) {
+	query := GenerateQuery(42, testQuestion)
+	query[2] |= 0x01 | 0x04        // RD, AA
+	query[3] |= 0x40 | 0x20 | 0x10 // Z, AD, CD
+
+	req, err := dns.ParseRequest(dns.ContextWithRecursion(context.Background(), true), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, dnsmessage.Header{
+		ID:                 42,
+		Response:           true,
+		RecursionDesired:   true,
+		RecursionAvailable: true,
+		CheckingDisabled:   true,
+		RCode:              dnsmessage.RCodeNameError,
+	}, req.ResponseHeader(dnsmessage.RCodeNameError))
+}
+
+func TestRequestTransport(t *testing.T) {
+	req, err := dns.ParseRequest(context.Background(), GenerateQuery(42, testQuestion))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Requests that were not received by a Server do not have a transport
+	assert.Empty(t, req.Transport())
+
+	transports := make(chan string, 1)
+	server := dns.Server{Handler: dns.HandlerFunc(func(_ dns.ResponseWriter, req *dns.Request) {
+		transports <- req.Transport()
+	})}
+
+	defer server.Shutdown(context.Background())
+
+	dir := t.TempDir()
+
+	for network, expected := range map[string]string{
+		"udp":      dns.TransportUDP,
+		"tcp":      dns.TransportTCP,
+		"unix":     dns.TransportUnix,
+		"unixgram": dns.TransportUnix,
+	} {
+		addr := "127.0.0.1:0"
+		if strings.HasPrefix(network, "unix") {
+			addr = filepath.Join(dir, network+".sock")
+		}
+
+		query := GenerateQuery(42, testQuestion)
+
+		switch network {
+		case "udp", "unixgram":
+			conn, err := net.ListenPacket(network, addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			addr = conn.LocalAddr().String()
+			go server.Serve(conn)
+		default:
+			listener, err := net.Listen(network, addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			addr = listener.Addr().String()
+			query = GenerateFrame(42, testQuestion)
+			go server.ServeStream(listener)
+		}
+
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = conn.Write(query)
+		assert.NoError(t, err, network)
+
+		select {
+		case transport := <-transports:
+			assert.Equal(t, expected, transport, network)
+		case <-time.After(time.Second):
+			t.Error("query was not handled over", network)
+		}
+
+		conn.Close()
+	}
+}
@@ -1,8 +1,12 @@
 package dns
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"net"
+	"slices"
+	"sync"
 
 	"golang.org/x/net/dns/dnsmessage"
 )
@@ -13,23 +17,67 @@ var (
 	DecodeLength = binary.BigEndian.Uint16
 )
 
-// ResponseWriter sends a DNS response frame to the client
+// ResponseWriter sends a DNS response frame to the client.
+//
+// Builders returned by the package's writers take their buffers from a pool for the transport, and
+// SendBuilder returns them, so that a server does not allocate a response buffer for each request.
+//
+// Send and SendMessage do not retain or free the slices that they are called with. The caller owns
+// the slice, and may reuse it or return it to the buffer pool once the call returns. Use
+// SendAndFree to send a message from GetBuffer and release it. SendBuilder finishes a Builder from
+// ResponseWriter.Builder, and returns its buffer to the pool, so the builder must not be used again
 type ResponseWriter interface {
 	// Builder creates a dnsmessage.Builder optimized for the underlying transport
 	Builder(dnsmessage.Header) dnsmessage.Builder
 
 	// Send a message directly to the underlying transport
 	Send([]byte)
+	// SendMessage sends a complete wire-format message to the client, adding any
+	// framing required by the transport
+	SendMessage([]byte)
 	// SendBuilder finalizes a builder and sends the result, with any post-processing
 	// required for the transport, to the client. It is assumed that the builder was
 	// prepared by ResponseWriter.Builder
 	SendBuilder(*dnsmessage.Builder)
 }
 
+// SendAndFree sends a complete message and returns its buffer to the pool. The message must not be
+// used after SendAndFree is called
+func SendAndFree(wr ResponseWriter, msg []byte) {
+	defer FreeBuffer(msg)
+	wr.SendMessage(msg)
+}
+
 // PacketWriter implements ResponseWriter for net.PacketConn
 type PacketWriter struct {
 	net.PacketConn
 	Addr net.Addr
+
+	// MaxSize is the largest response that will be sent. Larger responses are truncated. A zero
+	// value uses the payload size advertised by Request, or MinUDPSize if Request is nil
+	MaxSize int
+	// Request is the query that responses are written for
+	Request *Request
+
+	// OnTruncate is called when a response is truncated to fit within the size limit, and its TC bit
+	// is set. It is not called when only additional records are dropped
+	OnTruncate func(size, limit int)
+
+	// MaxAmplification caps the size of a response to a multiple of the size of its query, to limit
+	// the server's usefulness in reflection attacks. Larger responses are truncated, so that
+	// legitimate clients retry over TCP, or dropped if DropAmplified is set. A zero value disables the cap
+	MaxAmplification int
+	DropAmplified    bool
+
+	// OnAmplified is called when a response exceeds the amplification cap
+	OnAmplified func(size, limit int)
+
+	// Compression enables name compression in the Builders that the writer creates
+	Compression bool
+
+	// Allocator provides the buffers of the Builders that the writer creates. A nil Allocator uses
+	// the package's builder pools
+	Allocator Allocator
 }
 
 var _ ResponseWriter = &PacketWriter{}
@@ -37,18 +85,23 @@ var _ ResponseWriter = &PacketWriter{}
 // Builder initializes a new dnsmessage.Builder for a UDP DNS transaction
 func (wr *PacketWriter) Builder(header dnsmessage.Header) dnsmessage.Builder {
 	// Start building at the beginning of the buffer
-	return dnsmessage.NewBuilder(GetBuffer(4096, 0), header)
+	builder := allocBuilder(wr.Allocator, &packetBuilders, 0, header)
+	if wr.Compression {
+		builder.EnableCompression()
+	}
+
+	return builder
 }
 
-// SendBuilder is a helper that finalizes a dnsmessage.Builder and calls Send with the resulting datagram
+// SendBuilder is a helper that finalizes a dnsmessage.Builder and calls SendMessage with the resulting datagram
 func (wr *PacketWriter) SendBuilder(builder *dnsmessage.Builder) {
 	msg, err := builder.Finish()
 	if err != nil {
 		panic(err)
 	}
 
-	wr.Send(msg)
-	FreeBuffer(msg)
+	wr.SendMessage(msg)
+	freeBuilder(wr.Allocator, &packetBuilders, msg)
 }
 
 // Send a message to the peer that the request was received from
@@ -59,9 +112,71 @@ func (wr *PacketWriter) Send(msg []byte) {
 	}
 }
 
+// SendMessage sends a complete message to the peer. Datagrams require no additional framing, but
+// messages that exceed the writer's size limit are truncated at a resource record boundary
+func (wr *PacketWriter) SendMessage(msg []byte) {
+	limit := wr.Limit()
+
+	if amplified := wr.AmplificationLimit(); amplified > 0 && len(msg) > amplified {
+		if wr.OnAmplified != nil {
+			wr.OnAmplified(len(msg), amplified)
+		}
+
+		if wr.DropAmplified {
+			return
+		}
+
+		limit = min(limit, amplified)
+	}
+
+	truncated, dropped, err := Truncate(msg, limit)
+	if err != nil {
+		// Messages that can not be parsed are sent as they are
+		wr.Send(msg)
+		return
+	}
+
+	// Responses that only lost additional records are not truncated (RFC 2181, section 9)
+	if dropped && truncated[2]&headerBitTC != 0 && wr.OnTruncate != nil {
+		wr.OnTruncate(len(msg), limit)
+	}
+
+	wr.Send(truncated)
+}
+
+// Limit returns the size limit for responses sent by the writer
+func (wr *PacketWriter) Limit() int {
+	if wr.MaxSize > 0 {
+		return wr.MaxSize
+	}
+
+	if wr.Request != nil {
+		return wr.Request.UDPSize()
+	}
+
+	return MinUDPSize
+}
+
+// AmplificationLimit returns the largest response permitted by MaxAmplification, or zero if the
+// cap is disabled or the query is unknown
+func (wr *PacketWriter) AmplificationLimit() int {
+	if wr.MaxAmplification <= 0 || wr.Request == nil {
+		return 0
+	}
+
+	return wr.MaxAmplification * len(wr.Request.Message())
+}
+
 // StreamWriter implements ResponseWriter for net.Conn
 type StreamWriter struct {
 	net.Conn
+
+	// Compression enables name compression in the Builders that the writer creates
+	Compression bool
+
+	// Allocator provides the buffers of the Builders and frames that the writer creates. A nil
+	// Allocator uses the package's pools
+	Allocator Allocator
 }
 
 var _ ResponseWriter = &StreamWriter{}
@@ -69,7 +184,12 @@ var _ ResponseWriter = &StreamWriter{}
 // Builder creates a new builder with a 2 byte length header
 func (wr *StreamWriter) Builder(header dnsmessage.Header) dnsmessage.Builder {
 	// Start building after the first 2 bytes of the slice
-	return dnsmessage.NewBuilder(GetBuffer(4096, 2), header)
+	builder := allocBuilder(wr.Allocator, &streamBuilders, 2, header)
+	if wr.Compression {
+		builder.EnableCompression()
+	}
+
+	return builder
 }
 
 // SendBuilder finalizes a Builder and writes its length header before sending
@@ -85,7 +205,7 @@ func (wr *StreamWriter) SendBuilder(builder *dnsmessage.Builder) {
 	EncodeLength(msg, uint16(len(msg)-2))
 
 	wr.Send(msg)
-	FreeBuffer(msg)
+	freeBuilder(wr.Allocator, &streamBuilders, msg)
 }
 
 // Send a message directly to the connection stream. The caller is responsible
@@ -96,3 +216,144 @@ func (wr *StreamWriter) Send(frame []byte) {
 		panic(err)
 	}
 }
+
+// SendMessage prepends a length header to a complete message and writes the
+// resulting frame to the connection stream
+func (wr *StreamWriter) SendMessage(msg []byte) {
+	alloc := allocator(wr.Allocator)
+
+	frame := alloc.Get(len(msg)+2, len(msg)+2)
+	defer alloc.Put(frame)
+
+	EncodeLength(frame, uint16(len(msg)))
+	copy(frame[2:], msg)
+
+	wr.Send(frame)
+}
+
+// BufferWriter implements ResponseWriter by appending messages to an in-memory buffer instead of
+// writing them to a connection. It allows integrations like DNS-over-HTTPS, proxies, and tests to
+// drive a Handler and capture its wire-format output. Messages are appended without framing
+type BufferWriter struct {
+	buf []byte
+}
+
+var _ ResponseWriter = &BufferWriter{}
+
+// NewMessageWriter creates a BufferWriter that appends messages to buf
+func NewMessageWriter(buf []byte) *BufferWriter {
+	return &BufferWriter{buf: buf[:0]}
+}
+
+// Builder creates a new dnsmessage.Builder without any framing prefix
+func (wr *BufferWriter) Builder(header dnsmessage.Header) dnsmessage.Builder {
+	return packetBuilders.Builder(0, header)
+}
+
+// SendBuilder finalizes a Builder and appends the resulting message to the buffer
+func (wr *BufferWriter) SendBuilder(builder *dnsmessage.Builder) {
+	msg, err := builder.Finish()
+	if err != nil {
+		panic(err)
+	}
+
+	wr.Send(msg)
+	packetBuilders.Free(msg)
+}
+
+// Send appends a message to the buffer
+func (wr *BufferWriter) Send(msg []byte) {
+	wr.buf = append(wr.buf, msg...)
+}
+
+// SendMessage appends a complete message to the buffer
+func (wr *BufferWriter) SendMessage(msg []byte) {
+	wr.Send(msg)
+}
+
+// Bytes returns the messages that have been written to the buffer
+func (wr *BufferWriter) Bytes() []byte {
+	return wr.buf
+}
+
+// Reset discards the contents of the buffer
+func (wr *BufferWriter) Reset() {
+	wr.buf = wr.buf[:0]
+}
+
+// ErrNoResponse is returned by RecordingWriter.Response when the Handler did not send a message
+var ErrNoResponse = errors.New("dns: no response was sent")
+
+// RecordingWriter implements ResponseWriter by recording each message that is sent as a separate
+// copy, for tests that assert on a Handler's responses without a connection. Its Builder behaves
+// like PacketWriter.Builder, but responses are not truncated. It is safe for concurrent use
+type RecordingWriter struct {
+	messages [][]byte
+	sync.Mutex
+}
+
+var _ ResponseWriter = &RecordingWriter{}
+
+// Builder creates a new dnsmessage.Builder without any framing prefix
+func (wr *RecordingWriter) Builder(header dnsmessage.Header) dnsmessage.Builder {
+	return packetBuilders.Builder(0, header)
+}
+
+// SendBuilder finalizes a Builder and records the resulting message
+func (wr *RecordingWriter) SendBuilder(builder *dnsmessage.Builder) {
+	msg, err := builder.Finish()
+	if err != nil {
+		panic(err)
+	}
+
+	wr.Send(msg)
+	packetBuilders.Free(msg)
+}
+
+// Send records a copy of a message
+func (wr *RecordingWriter) Send(msg []byte) {
+	wr.Lock()
+	defer wr.Unlock()
+
+	wr.messages = append(wr.messages, bytes.Clone(msg))
+}
+
+// SendMessage records a copy of a complete message
+func (wr *RecordingWriter) SendMessage(msg []byte) {
+	wr.Send(msg)
+}
+
+// Messages returns the recorded messages, in the order that they were sent
+func (wr *RecordingWriter) Messages() [][]byte {
+	wr.Lock()
+	defer wr.Unlock()
+
+	return slices.Clone(wr.messages)
+}
+
+// Response parses the last recorded message. It returns ErrNoResponse if no message has been sent
+func (wr *RecordingWriter) Response() (*dnsmessage.Message, error) {
+	wr.Lock()
+	defer wr.Unlock()
+
+	if len(wr.messages) == 0 {
+		return nil, ErrNoResponse
+	}
+
+	var res dnsmessage.Message
+
+	err := res.Unpack(wr.messages[len(wr.messages)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+// Reset discards the recorded messages
+func (wr *RecordingWriter) Reset() {
+	wr.Lock()
+	defer wr.Unlock()
+
+	wr.messages = nil
+}
@@ -0,0 +1,424 @@
+package dns_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// CapturePacketConn records the datagrams written to it
+type CapturePacketConn struct {
+	net.PacketConn
+	sent [][]byte
+}
+
+func (cc *CapturePacketConn) WriteTo(buf []byte, _ net.Addr) (int, error) {
+	cc.sent = append(cc.sent, append([]byte(nil), buf...))
+	return len(buf), nil
+}
+
+func TestAmplification(t *testing.T) {
+	req, err := dns.ParseRequest(context.Background(), GenerateQuery(42, testQuestion))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var answers []dnsmessage.Resource
+	for i := range 16 {
+		answers = append(answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: testQuestion.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, byte(i)}},
+		})
+	}
+
+	var conn CapturePacketConn
+	var amplified int
+
+	wr := dns.PacketWriter{PacketConn: &conn, Request: req, MaxAmplification: 2, OnAmplified: func(int, int) { amplified++ }}
+	assert.NoError(t, dns.WriteAnswer(&wr, req, &dns.Answer{Answers: answers}))
+
+	// The response is truncated to twice the query's size
+	if assert.Len(t, conn.sent, 1) {
+		assert.LessOrEqual(t, len(conn.sent[0]), 2*len(req.Message()))
+
+		var res dnsmessage.Message
+		if assert.NoError(t, res.Unpack(conn.sent[0])) {
+			assert.True(t, res.Truncated)
+			assert.Less(t, len(res.Answers), len(answers))
+		}
+	}
+
+	// Amplified responses are dropped
+	wr.DropAmplified = true
+	assert.NoError(t, dns.WriteAnswer(&wr, req, &dns.Answer{Answers: answers}))
+	assert.Len(t, conn.sent, 1)
+	assert.Equal(t, 2, amplified)
+
+	// Small responses are not affected
+	assert.NoError(t, dns.WriteAnswer(&wr, req, &dns.Answer{Answers: answers[:1]}))
+	assert.Len(t, conn.sent, 2)
+	assert.Equal(t, 2, amplified)
+}
+
+func TestSendOwnership(t *testing.T) {
+	msg := dns.GetBuffer(4096, 0)
+	msg = append(msg, GenerateQuery(42, testQuestion)...)
+
+	expected := append([]byte(nil), msg...)
+
+	var conn CapturePacketConn
+	writers := []dns.ResponseWriter{dns.NewMessageWriter(nil), &dns.PacketWriter{PacketConn: &conn}}
+
+	for _, wr := range writers {
+		wr.SendMessage(msg)
+	}
+
+	// The caller still owns the message after sending it
+	assert.Equal(t, expected, msg)
+
+	dns.SendAndFree(writers[0], msg)
+
+	// Reuse of freed buffers must not affect messages that have been sent
+	for range 8 {
+		buf := dns.GetBuffer(4096, 4096)
+		clear(buf)
+		dns.FreeBuffer(buf)
+	}
+
+	assert.Equal(t, append(append([]byte(nil), expected...), expected...), writers[0].(*dns.BufferWriter).Bytes())
+	if assert.Len(t, conn.sent, 1) {
+		assert.Equal(t, expected, conn.sent[0])
+	}
+}
+
+func TestCompressedNSFitsInUDP(t *testing.T) {
+	question := dnsmessage.Question{Name: dnsmessage.MustNewName("com."), Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET}
+
+	req, err := dns.ParseRequest(context.Background(), GenerateQuery(42, question))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var answer dns.Answer
+	for i := range 13 {
+		name := dnsmessage.MustNewName(fmt.Sprintf("%c.gtld-servers.net.", 'a'+i))
+
+		answer.Answers = append(answer.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET, TTL: 172800},
+			Body:   &dnsmessage.NSResource{NS: name},
+		})
+
+		answer.Additionals = append(answer.Additionals, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 172800},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, byte(i)}},
+		})
+	}
+
+	// The response is larger than a minimal UDP payload without compression
+	uncompressed := dnsmessage.Message{Header: dnsmessage.Header{Response: true}, Questions: []dnsmessage.Question{question}, Answers: answer.Answers, Additionals: answer.Additionals}
+
+	build := func(compression bool) []byte {
+		builder := dnsmessage.NewBuilder(nil, uncompressed.Header)
+		if compression {
+			builder.EnableCompression()
+		}
+
+		builder.StartQuestions()
+		builder.Question(question)
+		builder.StartAnswers()
+		dns.AppendResources(&builder, answer.Answers...)
+		builder.StartAdditionals()
+		dns.AppendResources(&builder, answer.Additionals...)
+
+		msg, err := builder.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return msg
+	}
+
+	assert.False(t, dns.FitsInUDP(build(false), dns.MinUDPSize))
+	assert.True(t, dns.FitsInUDP(build(true), dns.MinUDPSize))
+
+	// The response is compressed by writers with the Compression setting, and fits without truncation
+	var conn CapturePacketConn
+
+	wr := dns.PacketWriter{PacketConn: &conn, Request: req, Compression: true}
+	assert.NoError(t, dns.WriteAnswer(&wr, req, &answer))
+
+	// Writers without the setting build the response without compression
+	plain := dns.NewMessageWriter(nil)
+	assert.NoError(t, dns.WriteAnswer(plain, req, &answer))
+	assert.Greater(t, len(plain.Bytes()), dns.MinUDPSize)
+
+	if assert.Len(t, conn.sent, 1) {
+		assert.LessOrEqual(t, len(conn.sent[0]), dns.MinUDPSize)
+
+		var res dnsmessage.Message
+		if assert.NoError(t, res.Unpack(conn.sent[0])) {
+			assert.False(t, res.Truncated)
+			assert.Len(t, res.Answers, 13)
+			assert.Len(t, res.Additionals, 13)
+		}
+	}
+}
+
+func TestPacketWriterTruncate(t *testing.T) {
+	var answers []dnsmessage.Resource
+	for i := range 32 {
+		answers = append(answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: testQuestion.Name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   &dnsmessage.TXTResource{TXT: []string{fmt.Sprintf("%064d", i)}},
+		})
+	}
+
+	extra := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: testQuestion.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+		Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+	}
+
+	send := func(query []byte, maxSize int, answer *dns.Answer) (res dnsmessage.Message, size int) {
+		req, err := dns.ParseRequest(context.Background(), query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var conn CapturePacketConn
+		wr := dns.PacketWriter{PacketConn: &conn, Request: req, MaxSize: maxSize}
+		assert.NoError(t, dns.WriteAnswer(&wr, req, answer))
+
+		if assert.Len(t, conn.sent, 1) {
+			// Records are dropped whole, so the datagram always parses
+			assert.NoError(t, res.Unpack(conn.sent[0]))
+			size = len(conn.sent[0])
+		}
+
+		return
+	}
+
+	// Queries without an OPT record receive at most MinUDPSize
+	res, size := send(GenerateQuery(1, testQuestion), 0, &dns.Answer{Answers: answers})
+	assert.LessOrEqual(t, size, dns.MinUDPSize)
+	assert.True(t, res.Truncated)
+	assert.NotEmpty(t, res.Answers)
+	assert.Less(t, len(res.Answers), len(answers))
+	assert.Equal(t, []dnsmessage.Question{testQuestion}, res.Questions)
+
+	// The payload size in the query's OPT record raises the limit
+	larger, size := send(GenerateEDNSQuery(2, 1232), 0, &dns.Answer{Answers: answers})
+	assert.LessOrEqual(t, size, 1232)
+	assert.True(t, larger.Truncated)
+	assert.Greater(t, len(larger.Answers), len(res.Answers))
+
+	// MaxSize overrides the negotiated size
+	_, size = send(GenerateEDNSQuery(3, 1232), 700, &dns.Answer{Answers: answers})
+	assert.LessOrEqual(t, size, 700)
+
+	// Responses that fit are sent whole
+	res, _ = send(GenerateQuery(4, testQuestion), 0, &dns.Answer{Answers: answers[:2]})
+	assert.False(t, res.Truncated)
+	assert.Len(t, res.Answers, 2)
+
+	// Dropping only additional records does not set TC
+	res, _ = send(GenerateQuery(5, testQuestion), 0, &dns.Answer{Answers: answers[:5], Additionals: []dnsmessage.Resource{extra, extra, extra, extra, extra, extra, extra, extra, extra, extra}})
+	assert.False(t, res.Truncated)
+	assert.Len(t, res.Answers, 5)
+	assert.Less(t, len(res.Additionals), 10)
+}
+
+func TestBufferWriter(t *testing.T) {
+	req, err := dns.ParseRequest(context.Background(), GenerateQuery(42, testQuestion))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The writer appends to the storage of the buffer that it is created with
+	buf := make([]byte, 16, 1024)
+	wr := dns.NewMessageWriter(buf)
+	assert.Empty(t, wr.Bytes())
+
+	// Responses from Builders are captured without framing
+	assert.NoError(t, dns.WriteAnswer(wr, req, &dns.Answer{}))
+
+	first := append([]byte(nil), wr.Bytes()...)
+	assert.Same(t, &buf[0], &wr.Bytes()[0])
+
+	var res dnsmessage.Message
+	if assert.NoError(t, res.Unpack(first)) {
+		assert.Equal(t, uint16(42), res.ID)
+		assert.Equal(t, []dnsmessage.Question{testQuestion}, res.Questions)
+	}
+
+	// Further messages are appended to the buffer
+	wr.SendMessage(first)
+	assert.Equal(t, append(append([]byte(nil), first...), first...), wr.Bytes())
+
+	wr.Reset()
+	assert.Empty(t, wr.Bytes())
+
+	dns.ServerFailure(wr, req)
+	if assert.NoError(t, res.Unpack(wr.Bytes())) {
+		assert.Equal(t, dnsmessage.RCodeServerFailure, res.RCode)
+	}
+}
+
+func TestRecordingWriter(t *testing.T) {
+	req, err := dns.ParseRequest(context.Background(), GenerateQuery(42, testQuestion))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wr dns.RecordingWriter
+
+	_, err = wr.Response()
+	assert.ErrorIs(t, err, dns.ErrNoResponse)
+
+	dns.ServerFailure(&wr, req)
+	assert.NoError(t, dns.WriteAnswer(&wr, req, &dns.Answer{Answers: []dnsmessage.Resource{{
+		Header: dnsmessage.ResourceHeader{Name: testQuestion.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+		Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+	}}}))
+
+	// Each message is recorded separately, and the last is parsed
+	messages := wr.Messages()
+	if assert.Len(t, messages, 2) {
+		assert.Equal(t, uint16(42), dns.MessageID(messages[0]))
+	}
+
+	res, err := wr.Response()
+	if assert.NoError(t, err) {
+		assert.Equal(t, dnsmessage.RCodeSuccess, res.RCode)
+		assert.Len(t, res.Answers, 1)
+	}
+
+	wr.Reset()
+	assert.Empty(t, wr.Messages())
+}
+
+// CaptureConn records the bytes written to it
+type CaptureConn struct {
+	net.Conn
+	sent []byte
+}
+
+func (cc *CaptureConn) Write(buf []byte) (int, error) {
+	cc.sent = append(cc.sent, buf...)
+	return len(buf), nil
+}
+
+func TestWriterCompression(t *testing.T) {
+	req, err := dns.ParseRequest(context.Background(), GenerateQuery(42, testQuestion))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Build a response with records whose names share a suffix, without the package's helpers
+	send := func(wr dns.ResponseWriter) {
+		builder := wr.Builder(req.ResponseHeader(dnsmessage.RCodeSuccess))
+		builder.StartAnswers()
+
+		for i := range 10 {
+			builder.AResource(
+				dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(fmt.Sprintf("host-%d.service.example.com.", i)), Class: dnsmessage.ClassINET, TTL: 60},
+				dnsmessage.AResource{A: [4]byte{192, 0, 2, byte(i)}},
+			)
+		}
+
+		wr.SendBuilder(&builder)
+	}
+
+	size := func(compression bool) (packet, stream int) {
+		var conn CapturePacketConn
+		send(&dns.PacketWriter{PacketConn: &conn, Request: req, MaxSize: 4096, Compression: compression})
+
+		var sconn CaptureConn
+		send(&dns.StreamWriter{Conn: &sconn, Compression: compression})
+
+		if assert.Len(t, conn.sent, 1) {
+			packet = len(conn.sent[0])
+
+			var res dnsmessage.Message
+			assert.NoError(t, res.Unpack(conn.sent[0]))
+			assert.Len(t, res.Answers, 10)
+		}
+
+		return packet, len(sconn.sent) - 2
+	}
+
+	// Compression is disabled by default
+	packet, stream := size(false)
+	compressed, scompressed := size(true)
+
+	assert.Equal(t, packet, stream)
+	assert.Equal(t, compressed, scompressed)
+	assert.Less(t, compressed, packet*2/3)
+}
+
+func TestServerCompressionWrapped(t *testing.T) {
+	handler := dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+		builder := wr.Builder(req.ResponseHeader(dnsmessage.RCodeSuccess))
+		builder.StartAnswers()
+
+		for i := range 10 {
+			builder.AResource(
+				dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(fmt.Sprintf("host-%d.service.example.com.", i)), Class: dnsmessage.ClassINET, TTL: 60},
+				dnsmessage.AResource{A: [4]byte{192, 0, 2, byte(i)}},
+			)
+		}
+
+		wr.SendBuilder(&builder)
+	})
+
+	// Writers that wrap the transport's writer, such as for Metrics, build responses with its
+	// compression and Allocator settings
+	size := func(server *dns.Server) int {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go server.Serve(conn)
+		defer server.Shutdown(context.Background())
+
+		client, err := net.Dial("udp", conn.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer client.Close()
+		client.SetDeadline(time.Now().Add(time.Second))
+		client.Write(GenerateQuery(1, testQuestion))
+
+		buf := make([]byte, 4096)
+		size, err := client.Read(buf)
+		assert.NoError(t, err)
+
+		return size
+	}
+
+	var unwrapped, alloc CountingAllocator
+	var metrics MetricsRecorder
+
+	packet := size(&dns.Server{Metrics: &MetricsRecorder{}, Handler: handler})
+	plain := size(&dns.Server{Compression: true, Allocator: &unwrapped, Handler: handler})
+	compressed := size(&dns.Server{Compression: true, Allocator: &alloc, Metrics: &metrics, Handler: handler})
+
+	assert.Less(t, compressed, packet*2/3)
+	assert.Equal(t, plain, compressed)
+
+	// The response builder's buffer is taken from the Allocator, as it is without the wrapper
+	assert.Equal(t, unwrapped.Gets.Load(), alloc.Gets.Load())
+	assert.Equal(t, alloc.Gets.Load(), alloc.Puts.Load())
+
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	assert.Equal(t, []dnsmessage.RCode{dnsmessage.RCodeSuccess}, metrics.rcodes)
+}
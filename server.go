@@ -1,16 +1,21 @@
 package dns
 
 import (
+	"cmp"
 	"context"
+	"crypto/tls"
 	"errors"
 	"io"
 	"net"
-	"runtime/debug"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jmanero/go-logging"
 	"go.uber.org/multierr"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 // Handler receives DNS messages and builds responses
@@ -26,25 +31,98 @@ func (fn HandlerFunc) ServeDNS(wr ResponseWriter, req *Request) {
 	fn(wr, req)
 }
 
+// ErrServerClosed is returned by Serve methods that are called after the Server has been shut down
+var ErrServerClosed = errors.New("dns: Server closed")
+
 type closers struct {
 	entries []io.Closer
+	// streams stops reading from stream connections, which are added and removed as they open and close
+	streams map[io.Closer]struct{}
+	closed  bool
 	sync.Mutex
 }
 
-func (cls *closers) AddCloser(closer io.Closer) {
+// AddCloser registers a closer to be closed by CloseAll. It returns false, and does not register
+// the closer, if CloseAll has already been called
+func (cls *closers) AddCloser(closer io.Closer) bool {
 	cls.Lock()
 	defer cls.Unlock()
+
+	if cls.closed {
+		return false
+	}
+
 	cls.entries = append(cls.entries, closer)
+	return true
 }
 
+// CloseAll closes the registered closers, and stops reading from stream connections
 func (cls *closers) CloseAll() (err error) {
 	cls.Lock()
 	defer cls.Unlock()
 
+	cls.closed = true
 	for _, closer := range cls.entries {
 		err = multierr.Append(err, closer.Close())
 	}
 
+	for stream := range cls.streams {
+		err = multierr.Append(err, stream.Close())
+	}
+
+	return
+}
+
+// addStream registers a stream connection's closer. If join is not nil, it is added to in the same
+// step, so that a drain can not begin to wait for it before the connection is registered. It returns
+// false if CloseAll has already been called
+func (cls *closers) addStream(stream io.Closer, join *sync.WaitGroup) bool {
+	cls.Lock()
+	defer cls.Unlock()
+
+	if cls.closed {
+		return false
+	}
+
+	if join != nil {
+		join.Add(1)
+	}
+
+	if cls.streams == nil {
+		cls.streams = map[io.Closer]struct{}{}
+	}
+
+	cls.streams[stream] = struct{}{}
+	return true
+}
+
+func (cls *closers) removeStream(stream io.Closer) {
+	cls.Lock()
+	defer cls.Unlock()
+
+	delete(cls.streams, stream)
+}
+
+// Addrs returns the local addresses of the listeners and packet connections that are being served.
+// It allows callers that bind to an ephemeral port to discover the port that was chosen. No addresses
+// are returned after the Server is shut down
+func (server *Server) Addrs() (addrs []net.Addr) {
+	server.closers.Lock()
+	defer server.closers.Unlock()
+
+	if server.closers.closed {
+		return nil
+	}
+
+	for _, closer := range server.entries {
+		switch closer := closer.(type) {
+		case net.Listener:
+			addrs = append(addrs, closer.Addr())
+		case net.PacketConn:
+			addrs = append(addrs, closer.LocalAddr())
+		}
+	}
+
 	return
 }
 
@@ -60,83 +138,639 @@ func (ca *canceler) Context() context.Context {
 	return ca.base
 }
 
+// ConnState represents the state of a stream connection, for the Server.ConnState hook
+type ConnState int
+
+// Stream connection states
+const (
+	// StateNew is a connection that has been accepted, and has not received any data
+	StateNew ConnState = iota
+	// StateActive is a connection that is receiving or handling a message
+	StateActive
+	// StateIdle is a connection that has handled all of the messages that it received, and is
+	// waiting for another message
+	StateIdle
+	// StateClosed is a connection that has been closed. It is the final state
+	StateClosed
+)
+
+var connStateNames = [...]string{"new", "active", "idle", "closed"}
+
+func (state ConnState) String() string {
+	if int(state) < len(connStateNames) {
+		return connStateNames[state]
+	}
+
+	return "unknown"
+}
+
 // Server receives DNS messages from clients and calls a Handler to generate responses
 type Server struct {
 	Handler
 
-	// BaseContext is called when new Serve/ServeStream routines are created
+	// BaseContext is called when new Serve/ServeStream/ServeTLS/ServeConn routines are created
 	BaseContext func(context.Context, net.Addr) context.Context
 	// ConnContext is called when a new connection is accepted from a Listener
 	ConnContext func(context.Context, net.Conn) context.Context
 
+	// CorrelateFallback matches TCP queries to the truncated UDP responses that they retry, by client
+	// IP address and question, to measure the rate at which clients fall back to TCP. Retries are
+	// counted in Stats.Fallbacks and passed to OnFallback with the delay since the truncated response
+	CorrelateFallback bool
+	// FallbackWindow bounds the delay of a correlated retry. A zero value uses DefaultFallbackWindow
+	FallbackWindow time.Duration
+	OnFallback     func(req *Request, delay time.Duration)
+
+	// ConnState is called when a stream connection changes state. Connections begin in StateNew,
+	// alternate between StateActive and StateIdle as messages are received and handled, and end in
+	// StateClosed. A connection that is closed before it receives a message skips StateActive
+	ConnState func(net.Conn, ConnState)
+
+	// OnTruncate is called when a UDP response is truncated, with its TC bit set, because it exceeds
+	// the client's payload size
+	OnTruncate func(req *Request, size, limit int)
+
+	// MaxAmplification caps the size of UDP responses to a multiple of the size of their query.
+	// Larger responses are truncated, or dropped if DropAmplified is set. See PacketWriter
+	MaxAmplification int
+	DropAmplified    bool
+
+	// Compression enables name compression in the Builders of the PacketWriters and StreamWriters
+	// that the Server creates. Helpers such as WriteAnswer and Truncate compress their messages
+	// regardless
+	Compression bool
+
+	// TCPNoDelay sets TCP_NODELAY on stream connections, so that small response frames are sent
+	// without waiting for an ACK. Go enables TCP_NODELAY on new TCP connections by default, but
+	// custom listeners may disable it. TLS connections are unwrapped to set the option on the
+	// underlying TCP connection
+	TCPNoDelay bool
+
+	// StreamWriteBuffer coalesces the responses written to a stream connection in a buffer of this
+	// size. Buffered responses are flushed when the buffer fills, or after StreamFlushDelay. A zero
+	// value writes each response to the connection immediately
+	StreamWriteBuffer int
+	// StreamFlushDelay bounds how long a buffered response is held. A zero value uses DefaultFlushDelay
+	StreamFlushDelay time.Duration
+
+	// ReadTimeout bounds the time to receive the rest of a frame once a stream connection has sent
+	// its first byte, so that a client can not hold a connection by trickling a frame one byte at a
+	// time. IdleTimeout bounds the time that a stream connection may wait between frames.
+	// Connections that exceed either are closed after their in-flight queries are answered. Zero
+	// values do not limit reads
+	ReadTimeout time.Duration
+	IdleTimeout time.Duration
+
+	// MaxFrameSize bounds the length of the frames that stream connections may send. A connection
+	// that declares a longer frame, or an empty one, is closed once the frames before it have been
+	// dispatched, rather than holding a buffer for the frame. A zero value uses MaxStreamMessageSize
+	MaxFrameSize int
+
+	// ProxyProtocol reads a PROXY protocol (version 1 or 2) header from the start of each stream
+	// connection, and uses the client address that it carries as the connection's RemoteAddr, for
+	// connections that are accepted behind a TCP load balancer. DNS-over-TLS connections carry the
+	// header before the TLS handshake. Connections without a valid header are closed
+	ProxyProtocol bool
+
+	// HandlerTimeout sets a deadline on the Context of each request, so that a Handler's upstream
+	// queries and other blocking calls give up before the client does. The Context is canceled when
+	// the Handler returns. Neither the deadline nor the cancellation affect the connection that the
+	// request was received on. A zero value does not set a deadline, but the Context is still canceled
+	HandlerTimeout time.Duration
+
+	// TLSHandshakeTimeout bounds the TLS handshake of connections accepted by ServeTLS. A zero value
+	// uses DefaultTLSHandshakeTimeout
+	TLSHandshakeTimeout time.Duration
+
+	// MaxConcurrentPerConn handles up to this many pipelined queries from a stream connection
+	// concurrently (RFC 7766, section 6.2.1.1), so that a client's slow queries do not delay its
+	// others. Reading from a connection pauses while it is at its limit, so that one connection can
+	// not monopolize the server's handlers. A zero value handles each connection's queries serially
+	MaxConcurrentPerConn int
+
+	// MaxConcurrent bounds the number of UDP queries that are handled concurrently across all of the
+	// Server's packet connections. Datagrams that arrive at the limit are handled according to
+	// OverflowPolicy, and those that are dropped are counted in Stats.Overflows. A zero value does
+	// not limit UDP handlers. Stream connections are limited by MaxConcurrentPerConn
+	MaxConcurrent  int
+	OverflowPolicy OverflowPolicy
+	// OverflowWait bounds how long OverflowBlock waits for a handler. A zero value uses DefaultOverflowWait
+	OverflowWait time.Duration
+
+	// DedupRetries drops UDP queries that are identical to a query from the same client that is
+	// still being handled, rather than dispatching a second handler for a client's retransmission.
+	// Queries are identified by client address, ID, and question
+	DedupRetries bool
+	// DedupWindow bounds how long a query is considered in-flight. A zero value uses DefaultDedupWindow
+	DedupWindow time.Duration
+
+	// CacheEDNS caches the EDNS0 parameters of the last query received on each stream connection,
+	// so that Request.ClientEDNS does not parse the OPT record of each query when a client's
+	// parameters do not change
+	CacheEDNS bool
+
+	// RecursionAvailable sets the RA bit in responses built by the package's helpers, for servers
+	// that provide recursion or forward queries to recursive resolvers
+	RecursionAvailable bool
+
+	// TraceOption is the code of an EDNS0 local option that carries a client's trace ID. When a query
+	// carries the option, the trace ID is added to the request's logger, and the option is copied
+	// into the OPT record of each response. A zero value disables tracing
+	TraceOption uint16
+
+	// Explain records the decisions that middlewares and Handlers make for each request in an
+	// Explanation, which is logged when the Handler returns. See Explain
+	Explain bool
+
+	// ExplainOption is the code of an EDNS0 local option that enables explain mode for a query. The
+	// explanation is logged, and returned to the client in a CHAOS TXT record in the additional
+	// section of each response. A zero value disables the option
+	ExplainOption uint16
+
+	// ExplainACL restricts the clients that may request an explanation with ExplainOption, as the
+	// steps may include internal addresses and upstream error messages. The option is ignored in
+	// queries from other clients. A nil ACL allows only clients with a loopback address
+	ExplainACL *ACL
+
+	// DoHRespectEDNSSize truncates DNS-over-HTTPS responses to the UDP payload size that the client
+	// advertises in its OPT record, for consistency with UDP. HTTP carries messages of any size, so
+	// DoH responses are not truncated by default. See ServeHTTP
+	DoHRespectEDNSSize bool
+
+	// AcceptResponses passes messages with the QR bit set to the Handler. Such messages are usually
+	// reflection attack traffic or misdirected responses, and are dropped by default
+	AcceptResponses bool
+
+	// Parser reads the header and questions of received messages in place of the standard wire
+	// format parser. A nil Parser parses messages with the request's embedded dnsmessage.Parser
+	Parser Parser
+
+	// MaxResponseSize caps the size of the responses that a Handler sends, on any transport. A larger
+	// response is not sent, and the client receives SERVFAIL instead, so that a bug that builds a
+	// pathologically large response is contained. A zero value does not limit responses
+	MaxResponseSize int
+
+	// MaxNameDepth responds with FORMERR to queries whose question name has more labels than this,
+	// before the Handler is called. Deep names are cheap to send, and costly to process in tries or
+	// canonical ordering. A zero value does not limit the depth of names
+	MaxNameDepth int
+
+	// SingleQuestionOnly responds with FORMERR to messages that do not have exactly one question,
+	// before the Handler is called, so that Handlers do not need to check for multiple questions.
+	// Note that this also rejects messages without a question, such as COOKIE probes
+	SingleQuestionOnly bool
+
+	// AwaitReady answers queries with NotReady until SetReady is called, so that queries that arrive
+	// while listeners are starting, or before the Handler's data is loaded, are not answered
+	// incorrectly. NotReady is a Handler for queries that arrive before SetReady. A nil NotReady
+	// responds with SERVFAIL
+	AwaitReady bool
+	NotReady   Handler
+
+	// OnDrain is called when the server begins to drain, from BeginDrain or Shutdown
+	OnDrain func()
+
+	// DefaultRefusal is the policy that built-in middlewares apply when they reject a query
+	DefaultRefusal Refusal
+
+	// Tap is called with each query that is received, and each response that is sent with
+	// ResponseWriter.SendMessage or SendBuilder. See Server.Dnstap
+	Tap func(TapEvent)
+
+	// Metrics receives the outcome of each message that the Server handles. See Metrics
+	Metrics Metrics
+
+	// LogLevels overrides the level that server events are logged at, by event name. Events are
+	// "handler.panic" (error), "handler.parse" (error), "handler.oversized" (warn), "handler.explain"
+	// (debug), "handler.overflow" (debug), "tls.handshake" (warn), "connection.timeout" (debug),
+	// "connection.frame" (warn), "connection.proxy" (warn), "connection" (warn) and "shutdown.close"
+	// (error). Map an event to LogDisabled to suppress it
+	LogLevels map[string]zapcore.Level
+
+	// Allocator provides the buffers that messages are read into, and that responses are built in. A
+	// nil Allocator uses DefaultAllocator for read buffers, and the package's builder pools for responses
+	Allocator Allocator
+
+	// Stats counts server events
+	Stats Stats
+	gauges
+
 	sync.WaitGroup
 	closers
 	canceler
+
+	inflight  inflight
+	fallbacks truncations
+	conns     connections
+	latency   latency
+	names     sync.Map
+
+	slots     chan struct{}
+	slotsOnce sync.Once
+
+	ready    atomic.Bool
+	drain    sync.Once
+	draining atomic.Bool
+	drained  chan struct{}
+}
+
+// streamTracker tracks the state of a stream connection whose queries may be handled concurrently
+// with reading further queries. A connection is idle once all of the frames that it received have
+// been dispatched and their handlers have returned
+type streamTracker struct {
+	server *Server
+	conn   net.Conn
+
+	state    ConnState
+	inflight int
+	caughtUp bool
+	stopped  bool
+	sync.Mutex
+}
+
+// Close stops reading frames from the connection when the server drains. A blocked read is
+// interrupted, and the frames that were already received are answered before the connection is
+// closed. The connection's socket is closed by Shutdown if its deadline passes first
+func (st *streamTracker) Close() error {
+	st.Lock()
+	defer st.Unlock()
+
+	st.stopped = true
+	return st.conn.SetReadDeadline(time.Unix(1, 0))
+}
+
+// stopping reports whether Close has been called
+func (st *streamTracker) stopping() bool {
+	st.Lock()
+	defer st.Unlock()
+
+	return st.stopped
+}
+
+// setReadDeadline applies ReadTimeout or IdleTimeout to the following reads from the connection,
+// depending on whether part of a frame has been received. The ReadTimeout deadline must be set once,
+// when the first part of a frame is received. The deadline set by Close is kept
+func (st *streamTracker) setReadDeadline(partial bool) {
+	server := st.server
+	if server.ReadTimeout == 0 && server.IdleTimeout == 0 {
+		return
+	}
+
+	st.Lock()
+	defer st.Unlock()
+
+	if st.stopped {
+		return
+	}
+
+	timeout := server.IdleTimeout
+	if partial {
+		timeout = server.ReadTimeout
+	}
+
+	if timeout == 0 {
+		st.conn.SetReadDeadline(time.Time{})
+		return
+	}
+
+	st.conn.SetReadDeadline(time.Now().Add(timeout))
+}
+
+// received marks the connection active when data is read
+func (st *streamTracker) received() {
+	st.Lock()
+	defer st.Unlock()
+
+	st.caughtUp = false
+	if st.state != StateActive {
+		st.state = StateActive
+		st.server.setState(st.conn, StateActive)
+	}
+}
+
+// dispatched records whether all received frames have been dispatched. It returns true if the
+// connection became idle while the server is draining, and should be closed
+func (st *streamTracker) dispatched(caughtUp bool) bool {
+	st.Lock()
+	defer st.Unlock()
+
+	st.caughtUp = caughtUp
+	return st.idle()
+}
+
+func (st *streamTracker) begin() {
+	st.Lock()
+	defer st.Unlock()
+
+	st.inflight++
+}
+
+// done records that a handler returned, and closes the connection if it became idle while the
+// server is draining. Closing the connection interrupts the read loop
+func (st *streamTracker) done() {
+	st.Lock()
+	defer st.Unlock()
+
+	st.inflight--
+	if st.idle() {
+		st.conn.Close()
+	}
+}
+
+// idle transitions an active connection to StateIdle if it has no work. The tracker must be locked
+func (st *streamTracker) idle() bool {
+	if st.state != StateActive || !st.caughtUp || st.inflight > 0 {
+		return false
+	}
+
+	st.state = StateIdle
+	st.server.setState(st.conn, StateIdle)
+
+	return st.server.draining.Load()
+}
+
+// connections tracks the state of live stream connections
+type connections struct {
+	states map[net.Conn]ConnState
+	sync.Mutex
+}
+
+func (cs *connections) set(conn net.Conn, state ConnState) {
+	cs.Lock()
+	defer cs.Unlock()
+
+	if state == StateClosed {
+		delete(cs.states, conn)
+		return
+	}
+
+	if cs.states == nil {
+		cs.states = map[net.Conn]ConnState{}
+	}
+
+	cs.states[conn] = state
+}
+
+// closeConnections closes all stream connections
+func (server *Server) closeConnections() {
+	server.conns.Lock()
+	defer server.conns.Unlock()
+
+	for conn := range server.conns.states {
+		conn.Close()
+	}
+}
+
+// CloseIdleConnections closes stream connections that are idle, waiting for another query after
+// handling all of the queries that they received. Active connections are not affected
+func (server *Server) CloseIdleConnections() {
+	server.conns.Lock()
+	defer server.conns.Unlock()
+
+	for conn, state := range server.conns.states {
+		if state == StateIdle {
+			conn.Close()
+		}
+	}
+}
+
+// truncated records a truncated response
+func (server *Server) truncated(req *Request, size, limit int) {
+	server.Stats.Truncated.Add(1)
+	server.recordTruncation(req)
+
+	if server.OnTruncate != nil {
+		server.OnTruncate(req, size, limit)
+	}
+}
+
+// LogDisabled suppresses an event in Server.LogLevels
+const LogDisabled = zapcore.InvalidLevel
+
+// log writes a server event at its configured level, or at a default level
+func (server *Server) log(logger *zap.Logger, level zapcore.Level, event string, fields ...zap.Field) {
+	if configured, has := server.LogLevels[event]; has {
+		level = configured
+	}
+
+	if level == LogDisabled {
+		return
+	}
+
+	logger.Log(level, event, fields...)
+}
+
+// baseContext derives the root Context of Serve, ServeStream and ServeConn routines from the Server's
+// policies and BaseContext hook
+func (server *Server) baseContext(ctx context.Context, addr net.Addr) context.Context {
+	ctx = ContextWithRefusal(ctx, server.DefaultRefusal)
+	ctx = ContextWithListener(ctx, server.listenerName(addr))
+	ctx = ContextWithRecursion(ctx, server.RecursionAvailable)
+
+	if server.BaseContext != nil {
+		ctx = server.BaseContext(ctx, addr)
+	}
+
+	return ctx
 }
 
 // Handle is called when a message is received from a connection. It parses the message's header, then calls the Server's Handler
 func (server *Server) Handle(ctx context.Context, buf []byte, wr ResponseWriter, req *Request) {
-	defer func() {
-		if value := recover(); value != nil {
-			logging.Error(ctx, "handler.panic", zap.Any("panic", value), zap.String("stack", string(debug.Stack())))
+	defer server.logPanic(ctx, req.Transport())
+
+	wr, end, accepted := server.begin(ctx, buf, wr, req)
+	if !accepted {
+		return
+	}
+
+	defer end()
+	server.ServeDNS(wr, req)
+}
+
+// begin accepts a message, and prepares its request to be passed to the Handler: it derives the
+// request's deadline, and starts measuring the Handler. It returns the ResponseWriter for the Handler
+// and a function that ends the request, which must be called when the Handler returns. The boolean
+// result is false if the message has been handled or dropped
+func (server *Server) begin(ctx context.Context, buf []byte, wr ResponseWriter, req *Request) (ResponseWriter, func(), bool) {
+	wr, accepted := server.accept(ctx, buf, wr, req)
+	if !accepted {
+		return nil, nil, false
+	}
+
+	cancel := server.deadline(req)
+	wr = server.measure(wr)
+	start := time.Now()
+
+	server.gauges.handlers.Add(1)
+
+	return wr, func() {
+		server.gauges.handlers.Add(-1)
+		server.measured(wr, req, start)
+		server.explained(req)
+		server.latency.record(time.Since(start))
+		cancel()
+	}, true
+}
+
+// deadline derives a request's Context with the Server's HandlerTimeout. The returned function
+// cancels the Context, and must be called when the request's Handler returns
+func (server *Server) deadline(req *Request) context.CancelFunc {
+	var cancel context.CancelFunc
+	if server.HandlerTimeout > 0 {
+		req.ctx, cancel = context.WithTimeout(req.ctx, server.HandlerTimeout)
+	} else {
+		req.ctx, cancel = context.WithCancel(req.ctx)
+	}
+
+	return cancel
+}
+
+// logPanic recovers and logs a panic from a Handler, and reports it to the Server's Metrics. It must
+// be deferred
+func (server *Server) logPanic(ctx context.Context, transport string) {
+	if value := recover(); value != nil {
+		if server.Metrics != nil {
+			server.Metrics.Error(transport, ErrHandlerPanic)
 		}
-	}()
 
+		server.log(logging.FromContext(ctx), zapcore.ErrorLevel, "handler.panic", panicFields(value)...)
+	}
+}
+
+// accept parses a message's header and applies the Server's policies before it is passed to the
+// Handler. It returns the ResponseWriter for the Handler, and false if the message has been handled
+// or dropped
+func (server *Server) accept(ctx context.Context, buf []byte, wr ResponseWriter, req *Request) (ResponseWriter, bool) {
 	var err error
 
+	// Requests that were created without a Context use the connection's
+	if req.ctx == nil {
+		req.ctx = ctx
+	}
+
 	// Parse the message's header
-	req.Header, err = req.Start(buf)
+	req.msg = buf
+	if server.Parser != nil {
+		req.parser = server.Parser
+		req.Header, err = server.Parser.ParseHeader(buf)
+	} else {
+		req.Header, err = req.Start(buf)
+	}
+
 	if err != nil {
-		logging.Error(ctx, "handler.parse", zap.Error(err))
-		return
+		server.log(logging.FromContext(ctx), zapcore.ErrorLevel, "handler.parse", zap.Error(err))
+		if server.Metrics != nil {
+			server.Metrics.Error(req.Transport(), err)
+		}
+
+		return nil, false
 	}
 
-	server.ServeDNS(wr, req)
+	if req.Response && !server.AcceptResponses {
+		// Replying to a response could start a loop between two servers, or reflect an attack
+		server.Stats.DroppedResponses.Add(1)
+		return nil, false
+	}
+
+	server.received(req)
+	server.correlateFallback(req)
+	wr = server.limitSize(server.explain(server.trace(server.tap(wr, req), req), req), req)
+	if server.tooDeep(wr, req) || server.notSingle(wr, req) || server.warmingUp(wr, req) {
+		return nil, false
+	}
+
+	return wr, true
 }
 
 // Serve handles DNS messages from a PacketConn
 func (server *Server) Serve(conn net.PacketConn) error {
+	if !server.AddCloser(conn) {
+		conn.Close()
+		return ErrServerClosed
+	}
+
 	server.Add(1)
-	server.AddCloser(conn)
 
 	defer server.Done()
 	defer conn.Close()
 
-	ctx := server.Context()
-	if server.BaseContext != nil {
-		ctx = server.BaseContext(ctx, conn.LocalAddr())
-	}
+	ctx := server.baseContext(server.Context(), conn.LocalAddr())
+
+	transport := packetTransport(conn)
+	alloc := allocator(server.Allocator)
 
 	for {
 		// Get a 4k buffer to read the next datagram
-		buf := GetBuffer(4096, 4096)
+		buf := alloc.Get(4096, 4096)
 
 		size, from, err := conn.ReadFrom(buf)
 		if err != nil {
+			alloc.Put(buf)
 			return err
 		}
 
+		var key string
+		var token uint64
+		if server.DedupRetries {
+			var tracked, fresh bool
+
+			key, tracked = dedupKey(from, buf[:size])
+			if tracked {
+				token, fresh = server.inflight.begin(key, cmp.Or(server.DedupWindow, DefaultDedupWindow))
+			}
+
+			if tracked && !fresh {
+				server.Stats.Duplicates.Add(1)
+				alloc.Put(buf)
+				continue
+			}
+		}
+
+		if !server.acquire(from) {
+			if key != "" {
+				server.inflight.end(key, token)
+			}
+
+			alloc.Put(buf)
+			continue
+		}
+
 		server.Go(func() {
-			defer FreeBuffer(buf)
-			server.Handle(ctx, buf[:size],
-				&PacketWriter{PacketConn: conn, Addr: from},
-				&Request{ctx: ctx, LocalAddr: conn.LocalAddr(), RemoteAddr: from})
+			defer server.release()
+			defer alloc.Put(buf)
+			if key != "" {
+				defer server.inflight.end(key, token)
+			}
+
+			req := &Request{ctx: ctx, LocalAddr: conn.LocalAddr(), RemoteAddr: from, transport: transport}
+			server.Handle(ctx, buf[:size], &PacketWriter{
+				PacketConn:       conn,
+				Addr:             from,
+				Request:          req,
+				OnTruncate:       func(size, limit int) { server.truncated(req, size, limit) },
+				MaxAmplification: server.MaxAmplification,
+				DropAmplified:    server.DropAmplified,
+				OnAmplified:      func(int, int) { server.Stats.Amplified.Add(1) },
+				Compression:      server.Compression,
+				Allocator:        server.Allocator,
+			}, req)
 		})
 	}
 }
 
 // ServeStream handles DNS messages from a Listener
 func (server *Server) ServeStream(listener net.Listener) error {
+	if !server.AddCloser(listener) {
+		listener.Close()
+		return ErrServerClosed
+	}
+
 	server.Add(1)
-	server.AddCloser(listener)
 
 	defer server.Done()
 	defer listener.Close()
 
-	ctx := server.Context()
-	if server.BaseContext != nil {
-		ctx = server.BaseContext(ctx, listener.Addr())
-	}
+	ctx := server.baseContext(server.Context(), listener.Addr())
 
 	for {
 		conn, err := listener.Accept()
@@ -148,36 +782,221 @@ func (server *Server) ServeStream(listener net.Listener) error {
 	}
 }
 
+// ServeContext handles DNS messages from a PacketConn until a Context is done, then closes the
+// PacketConn and returns ErrServerClosed. In-flight handlers are not interrupted, and may be joined
+// with Shutdown.
+//
+// ServeContext composes with an errgroup.Group created with errgroup.WithContext, so that all of
+// the group's connections are closed when one of them fails or the group's parent is canceled:
+//
+//	group, ctx := errgroup.WithContext(ctx)
+//	group.Go(func() error { return server.ServeContext(ctx, conn) })
+//	group.Go(func() error { return server.ServeStreamContext(ctx, listener) })
+func (server *Server) ServeContext(ctx context.Context, conn net.PacketConn) error {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	err := server.Serve(conn)
+	if ctx.Err() != nil {
+		return ErrServerClosed
+	}
+
+	return err
+}
+
+// ServeStreamContext accepts connections from a Listener until a Context is done, then closes the
+// Listener and returns ErrServerClosed. Accepted connections are not closed, and may be joined with Shutdown
+func (server *Server) ServeStreamContext(ctx context.Context, listener net.Listener) error {
+	stop := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stop()
+
+	err := server.ServeStream(listener)
+	if ctx.Err() != nil {
+		return ErrServerClosed
+	}
+
+	return err
+}
+
+// ServeConn handles DNS messages from a stream connection that was accepted by the caller, such as
+// from a custom listener, a connection pool, or a multiplexed stream. Messages are framed with a
+// two-octet length prefix in network byte order (RFC 1035, section 4.2.2), in both directions.
+// ServeConn returns when the connection is closed or fails, or the Context is done. The connection
+// is closed before ServeConn returns.
+//
+// Connections served with ServeConn are tracked by the Server like those accepted by ServeStream:
+// they are drained and joined by Shutdown, and their handlers' Contexts are canceled when the Server
+// shuts down. ServeConn returns ErrServerClosed without serving the connection if the Server has
+// been closed or has begun to drain
+func (server *Server) ServeConn(ctx context.Context, conn net.Conn) error {
+	// Handler Contexts are canceled when the Server shuts down, and the connection is closed when
+	// the caller's Context is done
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stop := context.AfterFunc(server.Context(), cancel)
+	defer stop()
+
+	closing := context.AfterFunc(ctx, func() { conn.Close() })
+	defer closing()
+
+	if !server.handleStream(server.baseContext(ctx, conn.LocalAddr()), conn, streamOptions{join: true}) {
+		return ErrServerClosed
+	}
+
+	return nil
+}
+
 // HandleStream reconstructs frames from a net.Conn stream and passes them to the
-// message handler. Packets are processed serially
+// message handler. Packets are processed serially, unless MaxConcurrentPerConn is set.
+// HandleStream is a step of ServeStream and ServeConn, and is not joined by Shutdown
+// when it is called directly. Use ServeConn to serve a connection accepted by the caller
 func (server *Server) HandleStream(ctx context.Context, conn net.Conn) {
+	server.handleStream(ctx, conn, streamOptions{})
+}
+
+// streamOptions describe how handleStream serves a connection
+type streamOptions struct {
+	// join registers the connection to be joined by Shutdown
+	join bool
+	// proxied is set when the connection's PROXY protocol header has already been read, as ServeTLS
+	// reads it before the TLS handshake
+	proxied bool
+}
+
+// handleStream serves a stream connection. It returns false if the connection was not served
+// because the Server has been closed
+func (server *Server) handleStream(ctx context.Context, conn net.Conn, opts streamOptions) bool {
+	if !opts.proxied {
+		var err error
+
+		conn, err = server.proxy(ctx, conn)
+		if err != nil {
+			return true
+		}
+	}
+
+	tracker := &streamTracker{server: server, conn: conn, state: StateNew}
+
+	var wg *sync.WaitGroup
+	if opts.join {
+		wg = &server.WaitGroup
+	}
+
+	// Reading stops when the server drains
+	if !server.addStream(tracker, wg) {
+		conn.Close()
+		return false
+	}
+
+	if opts.join {
+		defer server.Done()
+	}
+
+	server.readStream(ctx, conn, tracker)
+	return true
+}
+
+// readStream reassembles frames from a registered stream connection and dispatches them to the
+// Handler, until the connection is closed, fails, or the Server drains
+func (server *Server) readStream(ctx context.Context, conn net.Conn, tracker *streamTracker) {
+	defer server.removeStream(tracker)
+	server.setState(conn, StateNew)
+
+	server.gauges.conns.Add(1)
+	defer server.gauges.conns.Add(-1)
+
+	// Close hooks are called after the connection is closed and its handlers have returned
+	hooks := &closeHooks{}
+	ctx = context.WithValue(ctx, closeHooksKey, hooks)
+
+	defer server.setState(conn, StateClosed)
+	defer func() { hooks.run(ctx, server, streamTransport(conn)) }()
 	defer conn.Close()
 
+	if server.TCPNoDelay {
+		setNoDelay(conn)
+	}
+
+	if server.CacheEDNS {
+		ctx = withEDNSCache(ctx)
+	}
+
 	if server.ConnContext != nil {
 		ctx = server.ConnContext(ctx, conn)
 	}
 
 	logger := logging.FromContext(ctx)
+	transport := streamTransport(conn)
+
+	// Responses are written to the connection through an optional write buffer
+	var out net.Conn = conn
+	if server.StreamWriteBuffer > 0 {
+		buffered := newBufferedConn(conn, server.StreamWriteBuffer, cmp.Or(server.StreamFlushDelay, DefaultFlushDelay))
+		defer buffered.Flush()
+
+		out = buffered
+	}
+
+	// Pipelined queries are handled concurrently, up to the per-connection limit. Reading stops
+	// while the connection is at its limit
+	var slots chan struct{}
+	var pending sync.WaitGroup
+
+	if server.MaxConcurrentPerConn > 0 {
+		slots = make(chan struct{}, server.MaxConcurrentPerConn)
+		defer pending.Wait()
+	}
+
+	// Frames that are read together are passed to a BatchHandler together when queries are handled serially
+	var batch streamBatch
+	_, batching := server.Handler.(BatchHandler)
+	batching = batching && slots == nil
+
+	// Get a 4k buffer for reassembling frames. It is replaced with a larger buffer from the pool
+	// when a frame does not fit
+	alloc := allocator(server.Allocator)
 
-	// Get a 4k buffer for reassembling frames
-	buf := GetBuffer(4096, 4096)
-	defer FreeBuffer(buf)
+	buf := alloc.Get(4096, 4096)
+	defer func() { alloc.Put(buf) }()
 
 	// Write position, read position in buffer
 	var wpos, rpos int
 
+	// Set when the connection declares a frame that is not reassembled
+	var invalid bool
+	maxFrame := cmp.Or(server.MaxFrameSize, MaxStreamMessageSize)
+
+	// Set when the ReadTimeout deadline of the partial frame at the front of the buffer is set. It is
+	// not extended by later reads of the same frame
+	var reading bool
+
 	for {
+		switch {
+		case wpos == 0:
+			tracker.setReadDeadline(false)
+		case !reading:
+			tracker.setReadDeadline(true)
+			reading = true
+		}
+
 		nread, err := conn.Read(buf[wpos:])
 		wpos += nread
 
+		if nread > 0 {
+			tracker.received()
+		}
+
 		// Read frames out of the buffer while there's at least one frame header (2 bytes)
-		// and DNS message header (12 bytes)
-		for wpos-rpos >= 14 {
+		for wpos-rpos >= 2 {
 			// Read the frame header
 			size := int(DecodeLength(buf[rpos:]))
+			if size == 0 || size > maxFrame {
+				server.log(logger, zapcore.WarnLevel, "connection.frame", zap.Int("size", size), zap.Int("limit", maxFrame))
 
-			// Make sure that the buffer has enough capacity to hold the whole frame
-			buf = GrowBuffer(buf, size, size)
+				invalid = true
+				break
+			}
 
 			// Check if the whole frame has been read into the buffer
 			if size > wpos-(rpos+2) {
@@ -188,49 +1007,177 @@ func (server *Server) HandleStream(ctx context.Context, conn net.Conn) {
 			// Step past the frame header
 			rpos += 2
 
+			wr := &StreamWriter{Conn: out, Compression: server.Compression, Allocator: server.Allocator}
+			req := &Request{ctx: ctx, LocalAddr: conn.LocalAddr(), RemoteAddr: conn.RemoteAddr(), transport: transport}
+
 			// Send the message to the handler
-			server.Handle(ctx, buf[rpos:rpos+size],
-				&StreamWriter{Conn: conn},
-				&Request{ctx: ctx, LocalAddr: conn.RemoteAddr(), RemoteAddr: conn.RemoteAddr()})
+			if batching {
+				tracker.begin()
+				batch.add(buf[rpos:rpos+size], wr, req)
+			} else if slots == nil {
+				tracker.begin()
+				server.Handle(ctx, buf[rpos:rpos+size], wr, req)
+				tracker.done()
+			} else {
+				// Copy the frame, as the reassembly buffer is reused while the handler runs
+				frame := append(alloc.Get(size, 0), buf[rpos:rpos+size]...)
+
+				slots <- struct{}{}
+				tracker.begin()
+
+				pending.Go(func() {
+					defer func() {
+						alloc.Put(frame)
+						<-slots
+						tracker.done()
+					}()
+
+					server.Handle(ctx, frame, wr, req)
+				})
+			}
 
 			// Step passed the processed message and check for another frame
 			rpos += size
 		}
 
-		if errors.Is(err, io.EOF) {
+		if len(batch.bufs) > 0 {
+			server.HandleBatch(ctx, batch.bufs, batch.wrs, batch.reqs)
+			for range batch.bufs {
+				tracker.done()
+			}
+
+			batch.reset()
+		}
+
+		if invalid {
+			// The frames before the invalid frame have been dispatched. The connection is closed once
+			// their handlers return
+			return
+		}
+
+		if tracker.dispatched(rpos == wpos) {
+			// Close idle connections once the server begins to drain
+			return
+		}
+
+		if tracker.stopping() {
+			// The server is draining. The frames that were received have been dispatched, and the
+			// connection is closed once their handlers return
+			return
+		}
+
+		if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
 			// Connection is closed
 			return
 		}
 
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			server.log(logger, zapcore.DebugLevel, "connection.timeout", zap.Bool("partial", wpos > rpos))
+			return
+		}
+
 		if err != nil {
-			logger.Warn("connection", zap.Error(err))
+			server.log(logger, zapcore.WarnLevel, "connection", zap.Error(err))
 			return
 		}
 
 		// Shift a trailing frame fragment to the front of the buffer and continue
 		// reading. In the wild, this happens very rarely as most TCP DNS clients
 		// only use a connection for a single request/response transaction
+		if rpos > 0 {
+			// A new frame has begun
+			reading = false
+		}
+
 		wpos = copy(buf, buf[rpos:wpos])
 		rpos = 0
 
+		// Make sure that the buffer has enough capacity to hold the whole trailing frame
+		size := len(buf)
+		if wpos >= 2 {
+			size = max(size, int(DecodeLength(buf))+2)
+		}
+
+		if size > cap(buf) {
+			grown := alloc.Get(size, size)
+			copy(grown, buf[:wpos])
+
+			alloc.Put(buf)
+			buf = grown
+		}
+
 		buf = buf[:cap(buf)]
 	}
 }
 
-// Shutdown gracefully stops accepting requests and attempts to
-func (server *Server) Shutdown(ctx context.Context) (err error) {
-	// Close connections to stop accepting new requests and join Serve/ServeStream routines
-	if cerr := server.CloseAll(); cerr != nil {
-		logging.Error(ctx, "shutdown.close", zap.Error(cerr))
+func (server *Server) setState(conn net.Conn, state ConnState) {
+	server.conns.set(conn, state)
+
+	if server.ConnState != nil {
+		server.ConnState(conn, state)
 	}
+}
 
-	// Wait for in-flight handlers to complete, or context to be canceled
-	wait := make(chan struct{})
-	go func() { server.Wait(); close(wait) }()
+// setNoDelay enables TCP_NODELAY on a TCP connection, or on the TCP connection underlying a TLS connection
+func setNoDelay(conn net.Conn) {
+	if tlsConn, is := conn.(*tls.Conn); is {
+		conn = tlsConn.NetConn()
+	}
+
+	if tcpConn, is := conn.(*net.TCPConn); is {
+		tcpConn.SetNoDelay(true)
+	}
+}
+
+// BeginDrain starts the first phase of a two-phase shutdown: listeners and packet connections are
+// closed to stop accepting new connections and queries, stream connections stop reading frames and
+// are closed once the frames that they received have been answered, and OnDrain is called. In-flight
+// queries continue to be handled. The returned channel is closed once
+// all Serve routines and handlers have returned. Orchestrators can deregister the server from service
+// discovery during the drain, then call Shutdown with a deadline to force the remaining work to stop.
+// BeginDrain may be called more than once
+func (server *Server) BeginDrain() <-chan struct{} {
+	return server.beginDrain(logging.FromContext(server.Context()))
+}
+
+func (server *Server) beginDrain(logger *zap.Logger) <-chan struct{} {
+	server.drain.Do(func() {
+		server.draining.Store(true)
+		server.drained = make(chan struct{})
+
+		// Close connections to stop accepting new requests and join Serve/ServeStream routines
+		if cerr := server.CloseAll(); cerr != nil {
+			server.log(logger, zapcore.ErrorLevel, "shutdown.close", zap.Error(cerr))
+		}
+
+		server.CloseIdleConnections()
 
+		if server.OnDrain != nil {
+			server.OnDrain()
+		}
+
+		go func() { server.Wait(); close(server.drained) }()
+	})
+
+	return server.drained
+}
+
+// Draining reports whether BeginDrain or Shutdown has been called
+func (server *Server) Draining() bool {
+	return server.draining.Load()
+}
+
+// Shutdown gracefully stops accepting requests and waits for in-flight requests to complete. If the
+// Context is done first, the remaining stream connections are closed. Handler contexts are canceled
+// before Shutdown returns
+func (server *Server) Shutdown(ctx context.Context) (err error) {
+	drained := server.beginDrain(logging.FromContext(ctx))
+
+	// Wait for in-flight handlers to complete, or context to be canceled
 	select {
 	case <-ctx.Done():
-	case <-wait:
+		server.closeConnections()
+	case <-drained:
 	}
 
 	if server.cancel != nil {
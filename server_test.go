@@ -3,17 +3,22 @@ package dns_test
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/jmanero/go-dns"
 	"github.com/jmanero/go-logging"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 	"golang.org/x/net/dns/dnsmessage"
 )
 
@@ -129,7 +134,7 @@ func TestDatagram(t *testing.T) {
 	tester.AddDatagram(&net.UDPAddr{IP: net.IP{1, 2, 3, 4}, Port: 5367}, GenerateQuery(42))
 	queries = append(queries, 42)
 
-	tester.AddDatagram(&net.UDPAddr{IP: net.IP{1, 2, 3, 4}, Port: 5367}, GenerateFrame(1234,
+	tester.AddDatagram(&net.UDPAddr{IP: net.IP{1, 2, 3, 4}, Port: 5367}, GenerateQuery(1234,
 		dnsmessage.Question{Name: dnsmessage.MustNewName("foo.bar.baz."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
 		dnsmessage.Question{Name: dnsmessage.MustNewName("foo.bar.baz."), Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET},
 		dnsmessage.Question{Name: dnsmessage.MustNewName("foo.bar.baz."), Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassCHAOS},
@@ -139,23 +144,32 @@ func TestDatagram(t *testing.T) {
 
 	queries = append(queries, 1234)
 
-	tester.AddDatagram(&net.UDPAddr{IP: net.IP{1, 2, 3, 4}, Port: 5367}, GenerateFrame(5678, dnsmessage.Question{Name: dnsmessage.MustNewName("foo.bar.baz."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}))
+	tester.AddDatagram(&net.UDPAddr{IP: net.IP{1, 2, 3, 4}, Port: 5367}, GenerateQuery(5678, dnsmessage.Question{Name: dnsmessage.MustNewName("foo.bar.baz."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}))
 	queries = append(queries, 5678)
 
+	// Datagrams are handled concurrently, and may be handled in any order
+	var mu sync.Mutex
+	var handled []uint16
+
 	server := dns.Server{
 		Handler: dns.HandlerFunc(func(_ dns.ResponseWriter, req *dns.Request) {
 			qs, err := req.AllQuestions()
 			assert.NoError(t, err)
 
 			fmt.Println(req.ID, req.OpCode, req.RCode, len(qs))
-			assert.Equal(t, queries[0], req.ID)
 
-			queries = queries[1:]
+			mu.Lock()
+			handled = append(handled, req.ID)
+			mu.Unlock()
 		}),
 		ConnContext: func(context.Context, net.Conn) context.Context { return ctx },
 	}
 
 	server.Serve(&tester)
+
+	// Wait for in-flight handlers to return
+	server.Wait()
+	assert.ElementsMatch(t, queries, handled)
 }
 
 func TestStream(t *testing.T) {
@@ -207,3 +221,964 @@ func TestStream(t *testing.T) {
 
 	server.HandleStream(ctx, &tester)
 }
+
+func FuzzStream(f *testing.F) {
+	f.Add(GenerateFrame(42), uint8(0))
+	f.Add(append(GenerateFrame(42), GenerateFrame(1234)...), uint8(3))
+	f.Add(append(GenerateFrame(42), GenerateFrame(5678, dnsmessage.Question{Name: dnsmessage.MustNewName("foo.bar.baz."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})...), uint8(7))
+	f.Add([]byte{0xff, 0xff, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}, uint8(1))
+	f.Add([]byte{0x0f, 0xfe, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}, uint8(2))
+	f.Add([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, uint8(5))
+	f.Add([]byte{0, 12, 0}, uint8(0))
+
+	f.Fuzz(func(t *testing.T, data []byte, chunk uint8) {
+		var tester StreamTester
+
+		// Split the input into chunks of a fuzzed size. A zero size delivers the input in one chunk
+		size := int(chunk)
+		if size == 0 {
+			size = max(len(data), 1)
+		}
+
+		for buf := data; len(buf) > 0; {
+			n := min(size, len(buf))
+			tester.chunks, buf = append(tester.chunks, buf[:n]), buf[n:]
+		}
+
+		var handled int
+
+		server := dns.Server{
+			Handler: dns.HandlerFunc(func(_ dns.ResponseWriter, req *dns.Request) {
+				msg := req.Message()
+
+				assert.LessOrEqual(t, len(msg), 65535)
+				handled += len(msg) + 2
+			}),
+		}
+
+		done := make(chan struct{})
+		go func() { server.HandleStream(server.Context(), &tester); close(done) }()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("HandleStream did not return")
+		}
+
+		// Handled frames can not account for more bytes than were written to the stream
+		assert.LessOrEqual(t, handled, len(data))
+	})
+}
+
+func TestServeContext(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var server dns.Server
+	ctx, cancel := context.WithCancel(context.Background())
+
+	errs := make(chan error, 2)
+	go func() { errs <- server.ServeContext(ctx, conn) }()
+	go func() { errs <- server.ServeStreamContext(ctx, listener) }()
+
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	assert.ErrorIs(t, <-errs, dns.ErrServerClosed)
+	assert.ErrorIs(t, <-errs, dns.ErrServerClosed)
+
+	server.Wait()
+}
+
+func TestConnState(t *testing.T) {
+	var tester StreamTester
+	var states []dns.ConnState
+
+	frame := GenerateFrame(42)
+	tester.chunks = append(tester.chunks, frame[:4], frame[4:], frame)
+
+	server := dns.Server{
+		Handler:   dns.HandlerFunc(func(dns.ResponseWriter, *dns.Request) {}),
+		ConnState: func(_ net.Conn, state dns.ConnState) { states = append(states, state) },
+	}
+
+	server.HandleStream(server.Context(), &tester)
+
+	assert.Equal(t, []dns.ConnState{dns.StateNew, dns.StateActive, dns.StateIdle, dns.StateActive, dns.StateIdle, dns.StateClosed}, states)
+}
+
+func TestLogLevels(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	ctx := logging.WithLogger(context.Background(), zap.New(core))
+
+	server := dns.Server{
+		Handler:   dns.HandlerFunc(func(dns.ResponseWriter, *dns.Request) { panic("oops") }),
+		LogLevels: map[string]zapcore.Level{"handler.parse": zapcore.DebugLevel, "handler.panic": dns.LogDisabled},
+	}
+
+	// A message that is shorter than a header fails to parse
+	server.Handle(ctx, []byte{1, 2, 3}, dns.NewMessageWriter(nil), &dns.Request{})
+	server.Handle(ctx, GenerateQuery(42), dns.NewMessageWriter(nil), &dns.Request{})
+
+	if assert.Equal(t, 1, logs.Len()) {
+		entry := logs.All()[0]
+
+		assert.Equal(t, "handler.parse", entry.Message)
+		assert.Equal(t, zapcore.DebugLevel, entry.Level)
+	}
+}
+
+func TestStreamFlushDelay(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := dns.Server{
+		Handler:           dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) { dns.ServerFailure(wr, req) }),
+		StreamWriteBuffer: 16384,
+		StreamFlushDelay:  5 * time.Millisecond,
+	}
+
+	go server.ServeStream(listener)
+	defer server.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	// A lone response is flushed by the timer while the connection remains open
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	_, err = conn.Write(GenerateFrame(42, testQuestion))
+	assert.NoError(t, err)
+
+	res, err := dns.ReadFrame(conn)
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint16(42), dns.MessageID(res))
+	}
+}
+
+func TestCloseIdleConnections(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release := make(chan struct{})
+	idle := make(chan struct{}, 1)
+
+	server := dns.Server{
+		Handler: dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+			if req.ID == 2 {
+				<-release
+			}
+
+			dns.ServerFailure(wr, req)
+		}),
+		ConnState: func(_ net.Conn, state dns.ConnState) {
+			if state == dns.StateIdle {
+				idle <- struct{}{}
+			}
+		},
+	}
+
+	go server.ServeStream(listener)
+	defer server.Shutdown(context.Background())
+
+	dial := func(id uint16) net.Conn {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn.SetDeadline(time.Now().Add(time.Second))
+		conn.Write(GenerateFrame(id, testQuestion))
+
+		return conn
+	}
+
+	// The first connection handles its query and becomes idle
+	first := dial(1)
+	defer first.Close()
+
+	_, err = dns.ReadFrame(first)
+	assert.NoError(t, err)
+	<-idle
+
+	// The second connection is active while its handler blocks
+	second := dial(2)
+	defer second.Close()
+
+	time.Sleep(50 * time.Millisecond)
+	server.CloseIdleConnections()
+	close(release)
+
+	_, err = dns.ReadFrame(first)
+	assert.ErrorIs(t, err, io.EOF)
+
+	res, err := dns.ReadFrame(second)
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint16(2), dns.MessageID(res))
+	}
+}
+
+func TestAddrs(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := dns.Server{Handler: dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) { dns.ServerFailure(wr, req) })}
+	go server.Serve(conn)
+
+	var addrs []net.Addr
+	for start := time.Now(); len(addrs) == 0 && time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		addrs = server.Addrs()
+	}
+
+	if assert.Len(t, addrs, 1) {
+		assert.Equal(t, conn.LocalAddr().String(), addrs[0].String())
+		assert.NotEqual(t, 0, addrs[0].(*net.UDPAddr).Port)
+
+		// Queries to the reported address reach the server
+		res, err := (&dns.Client{Timeout: time.Second}).Exchange(context.Background(), GenerateQuery(42, testQuestion), addrs[0].String())
+		if assert.NoError(t, err) {
+			assert.Equal(t, uint16(42), dns.MessageID(res))
+		}
+	}
+
+	server.Shutdown(context.Background())
+	assert.Empty(t, server.Addrs())
+}
+
+func TestCorrelateFallback(t *testing.T) {
+	var answers []dnsmessage.Resource
+	for i := range 64 {
+		answers = append(answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: testQuestion.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, byte(i)}},
+		})
+	}
+
+	delays := make(chan time.Duration, 1)
+
+	server := dns.Server{
+		Handler:           dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) { dns.WriteAnswer(wr, req, &dns.Answer{Answers: answers}) }),
+		CorrelateFallback: true,
+		OnFallback:        func(_ *dns.Request, delay time.Duration) { delays <- delay },
+	}
+
+	// Listen for TCP on the same port, as clients retry on the address that truncated the response
+	conn, listener := ListenPair(t)
+
+	go server.Serve(conn)
+	go server.ServeStream(listener)
+	defer server.Shutdown(context.Background())
+
+	res, err := (&dns.Client{Timeout: time.Second}).Exchange(context.Background(), GenerateQuery(42, testQuestion), conn.LocalAddr().String())
+	if assert.NoError(t, err) {
+		var msg dnsmessage.Message
+		assert.NoError(t, msg.Unpack(res))
+		assert.Len(t, msg.Answers, len(answers))
+	}
+
+	assert.Less(t, <-delays, time.Second)
+	assert.Equal(t, uint64(1), server.Stats.Truncated.Load())
+	assert.Equal(t, uint64(1), server.Stats.Fallbacks.Load())
+}
+
+func TestBeginDrain(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release := make(chan struct{})
+	idle := make(chan struct{}, 1)
+	drains := 0
+
+	server := dns.Server{
+		Handler: dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+			if req.ID == 2 {
+				<-release
+			}
+
+			dns.ServerFailure(wr, req)
+		}),
+		ConnState: func(_ net.Conn, state dns.ConnState) {
+			if state == dns.StateIdle {
+				select {
+				case idle <- struct{}{}:
+				default:
+				}
+			}
+		},
+		OnDrain: func() { drains++ },
+	}
+
+	go server.ServeStream(listener)
+
+	dial := func(id uint16) net.Conn {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn.SetDeadline(time.Now().Add(time.Second))
+		conn.Write(GenerateFrame(id, testQuestion))
+
+		return conn
+	}
+
+	first := dial(1)
+	defer first.Close()
+
+	_, err = dns.ReadFrame(first)
+	assert.NoError(t, err)
+	<-idle
+
+	second := dial(2)
+	defer second.Close()
+
+	// A connection that has sent part of a frame, and one that has not sent anything
+	stalled, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer stalled.Close()
+	stalled.SetDeadline(time.Now().Add(time.Second))
+	stalled.Write(GenerateFrame(3, testQuestion)[:5])
+
+	silent, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer silent.Close()
+	silent.SetDeadline(time.Now().Add(time.Second))
+
+	time.Sleep(50 * time.Millisecond)
+
+	drained := server.BeginDrain()
+	assert.Equal(t, drained, server.BeginDrain())
+	assert.Equal(t, 1, drains)
+	assert.True(t, server.Draining())
+
+	// The listener is closed, and the idle connection is closed
+	_, err = net.Dial("tcp", listener.Addr().String())
+	assert.Error(t, err)
+
+	_, err = dns.ReadFrame(first)
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Connections stop reading frames, and are closed without waiting for the rest of a frame
+	_, err = dns.ReadFrame(stalled)
+	assert.ErrorIs(t, err, io.EOF)
+
+	_, err = dns.ReadFrame(silent)
+	assert.ErrorIs(t, err, io.EOF)
+
+	select {
+	case <-drained:
+		t.Fatal("drained with an active handler")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The active connection completes its query, then is closed when it becomes idle
+	close(release)
+
+	res, err := dns.ReadFrame(second)
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint16(2), dns.MessageID(res))
+	}
+
+	_, err = dns.ReadFrame(second)
+	assert.ErrorIs(t, err, io.EOF)
+
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("server did not drain")
+	}
+
+	assert.NoError(t, server.Shutdown(context.Background()))
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var server dns.Server
+	go server.ServeStream(listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	// A partial frame keeps the connection active
+	conn.Write(GenerateFrame(1, testQuestion)[:4])
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	server.Shutdown(ctx)
+
+	_, err = dns.ReadFrame(conn)
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestAwaitReady(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := dns.Server{
+		AwaitReady: true,
+		Handler: dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+			dns.Refused(wr, req)
+		}),
+	}
+
+	go server.Serve(conn)
+	defer server.Shutdown(context.Background())
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(time.Second))
+
+	rcode := func(id uint16) dnsmessage.RCode {
+		client.Write(GenerateQuery(id, testQuestion))
+
+		var res dnsmessage.Message
+		buf := make([]byte, 512)
+
+		size, err := client.Read(buf)
+		if assert.NoError(t, err) {
+			assert.NoError(t, res.Unpack(buf[:size]))
+		}
+
+		return res.RCode
+	}
+
+	// Queries are answered with SERVFAIL until the server is ready
+	assert.False(t, server.Ready())
+	assert.Equal(t, dnsmessage.RCodeServerFailure, rcode(1))
+
+	server.SetReady()
+	assert.True(t, server.Ready())
+	assert.Equal(t, dnsmessage.RCodeRefused, rcode(2))
+	assert.Equal(t, uint64(1), server.Stats.NotReady.Load())
+
+	// Draining servers are not ready
+	server.BeginDrain()
+	assert.False(t, server.Ready())
+}
+
+func TestLatency(t *testing.T) {
+	var tester StreamTester
+	for id := range uint16(100) {
+		tester.chunks = append(tester.chunks, GenerateFrame(id, testQuestion))
+	}
+
+	server := dns.Server{
+		Handler: dns.HandlerFunc(func(_ dns.ResponseWriter, req *dns.Request) {
+			if req.ID >= 95 {
+				time.Sleep(20 * time.Millisecond)
+			}
+		}),
+	}
+
+	assert.Equal(t, dns.LatencyStats{}, server.Latency())
+	server.HandleStream(server.Context(), &tester)
+
+	stats := server.Latency()
+	assert.Equal(t, uint64(100), stats.Count)
+	assert.Less(t, stats.P50, 5*time.Millisecond)
+	assert.Less(t, stats.P90, 5*time.Millisecond)
+
+	// Percentiles are accurate to within a histogram bucket
+	assert.GreaterOrEqual(t, stats.P99, 20*time.Millisecond)
+	assert.Less(t, stats.P99, 30*time.Millisecond)
+}
+
+func TestDropResponses(t *testing.T) {
+	response := GenerateFrame(1, testQuestion)
+	response[4] |= 0x80
+
+	var handled []bool
+
+	server := dns.Server{
+		Handler: dns.HandlerFunc(func(_ dns.ResponseWriter, req *dns.Request) {
+			handled = append(handled, req.IsResponse())
+		}),
+	}
+
+	tester := StreamTester{chunks: [][]byte{response, GenerateFrame(2, testQuestion)}}
+	server.HandleStream(server.Context(), &tester)
+
+	assert.Equal(t, []bool{false}, handled)
+	assert.Equal(t, uint64(1), server.Stats.DroppedResponses.Load())
+
+	// Responses are passed to the Handler when they are accepted
+	server.AcceptResponses = true
+	handled = nil
+
+	tester = StreamTester{chunks: [][]byte{response}}
+	server.HandleStream(server.Context(), &tester)
+
+	assert.Equal(t, []bool{true}, handled)
+}
+
+func TestMaxConcurrentPerConn(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release := make(chan struct{})
+
+	var active atomic.Int32
+	var peak int32
+	var mu sync.Mutex
+
+	server := dns.Server{
+		MaxConcurrentPerConn: 2,
+		Handler: dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+			if req.ID < 100 {
+				// Queries from the first connection block until they are released
+				count := active.Add(1)
+				defer active.Add(-1)
+
+				mu.Lock()
+				peak = max(peak, count)
+				mu.Unlock()
+
+				<-release
+			}
+
+			dns.ServerFailure(wr, req)
+		}),
+	}
+
+	go server.ServeStream(listener)
+	defer server.Shutdown(context.Background())
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		return conn
+	}
+
+	// The first connection pipelines more queries than its limit
+	busy := dial()
+	defer busy.Close()
+
+	for id := range uint16(10) {
+		busy.Write(GenerateFrame(id, testQuestion))
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(2), active.Load())
+
+	// Another connection is answered while the first is at its limit
+	other := dial()
+	defer other.Close()
+
+	other.Write(GenerateFrame(100, testQuestion))
+
+	res, err := dns.ReadFrame(other)
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint16(100), dns.MessageID(res))
+	}
+
+	close(release)
+
+	seen := map[uint16]bool{}
+	for range 10 {
+		res, err := dns.ReadFrame(busy)
+		if !assert.NoError(t, err) {
+			break
+		}
+
+		seen[dns.MessageID(res)] = true
+	}
+
+	assert.Len(t, seen, 10)
+	mu.Lock()
+	defer mu.Unlock()
+
+	assert.Equal(t, int32(2), peak)
+}
+
+func TestServeConn(t *testing.T) {
+	server := dns.Server{
+		DefaultRefusal: dns.Refusal{RCode: dns.RCodeNotAuth},
+		Handler: dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+			dns.Refuse(wr, req)
+		}),
+	}
+
+	client, conn := net.Pipe()
+	defer client.Close()
+
+	served := make(chan error)
+	go func() { served <- server.ServeConn(context.Background(), conn) }()
+
+	// Responses are framed with a length prefix, and the server's policies apply
+	client.SetDeadline(time.Now().Add(time.Second))
+	client.Write(GenerateFrame(1, testQuestion))
+
+	var head [2]byte
+	if _, err := io.ReadFull(client, head[:]); assert.NoError(t, err) {
+		buf := make([]byte, binary.BigEndian.Uint16(head[:]))
+
+		_, err = io.ReadFull(client, buf)
+		if assert.NoError(t, err) {
+			var res dnsmessage.Message
+			assert.NoError(t, res.Unpack(buf))
+			assert.Equal(t, dns.RCodeNotAuth, res.RCode)
+		}
+	}
+
+	// Shutdown closes the idle connection and joins ServeConn
+	assert.NoError(t, server.Shutdown(context.Background()))
+	assert.NoError(t, <-served)
+
+	// Connections are not served once the server has shut down
+	client, conn = net.Pipe()
+	defer client.Close()
+
+	assert.ErrorIs(t, server.ServeConn(context.Background(), conn), dns.ErrServerClosed)
+}
+
+func TestServeConnShutdown(t *testing.T) {
+	var server dns.Server
+	var served, refused atomic.Int32
+
+	// Initialize the Server's Context before it is shared with ServeConn routines
+	server.Context()
+
+	// Connections that are served while the server begins to drain are either joined by Shutdown,
+	// or refused
+	var group sync.WaitGroup
+	for range 32 {
+		client, conn := net.Pipe()
+		client.Close()
+
+		group.Go(func() {
+			if errors.Is(server.ServeConn(context.Background(), conn), dns.ErrServerClosed) {
+				refused.Add(1)
+			} else {
+				served.Add(1)
+			}
+		})
+	}
+
+	assert.NoError(t, server.Shutdown(context.Background()))
+	group.Wait()
+
+	assert.Equal(t, int32(32), served.Load()+refused.Load())
+}
+
+func TestOnClose(t *testing.T) {
+	var closed []uint16
+
+	core, logs := observer.New(zapcore.DebugLevel)
+	ctx := logging.WithLogger(context.Background(), zap.New(core))
+
+	server := dns.Server{
+		Handler: dns.HandlerFunc(func(_ dns.ResponseWriter, req *dns.Request) {
+			assert.True(t, dns.OnClose(req.Context(), func() { closed = append(closed, req.ID) }))
+			assert.Empty(t, closed)
+
+			if req.ID == 2 {
+				assert.True(t, dns.OnClose(req.Context(), func() { panic("oops") }))
+			}
+		}),
+	}
+
+	tester := StreamTester{chunks: [][]byte{GenerateFrame(1, testQuestion), GenerateFrame(2, testQuestion)}}
+	server.HandleStream(ctx, &tester)
+
+	// Hooks are called in reverse order once the connection is closed. Panics are logged, and do not
+	// stop the remaining hooks
+	assert.Equal(t, []uint16{2, 1}, closed)
+	assert.Equal(t, 1, logs.FilterMessage("handler.panic").Len())
+
+	// Requests that were not received on a stream connection can not register hooks
+	assert.False(t, dns.OnClose(context.Background(), func() {}))
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+
+	server := dns.Server{
+		MaxConcurrent:  1,
+		OverflowPolicy: dns.OverflowDrop,
+		Handler: dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+			started <- struct{}{}
+			if req.ID == 1 {
+				<-release
+			}
+
+			dns.ServerFailure(wr, req)
+		}),
+	}
+
+	go server.Serve(conn)
+	defer server.Shutdown(context.Background())
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+
+	client.Write(GenerateQuery(1, testQuestion))
+	<-started
+
+	// Queries that arrive at the limit are dropped
+	client.Write(GenerateQuery(2, testQuestion))
+	client.Write(GenerateQuery(3, testQuestion))
+
+	assert.Eventually(t, func() bool { return server.Stats.Overflows.Load() == 2 }, time.Second, time.Millisecond)
+	close(release)
+
+	buf := make([]byte, 512)
+	size, err := client.Read(buf)
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint16(1), dns.MessageID(buf[:size]))
+	}
+
+	// Queries are handled again once a slot is free
+	client.Write(GenerateQuery(4, testQuestion))
+
+	size, err = client.Read(buf)
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint16(4), dns.MessageID(buf[:size]))
+	}
+
+	assert.Len(t, started, 1)
+}
+
+func TestStreamTimeouts(t *testing.T) {
+	handler := dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) { dns.ServerFailure(wr, req) })
+
+	dial := func(server *dns.Server) net.Conn {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go server.ServeStream(listener)
+		t.Cleanup(func() { server.Shutdown(context.Background()) })
+
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+		return conn
+	}
+
+	// Idle connections are kept open without an IdleTimeout
+	server := &dns.Server{ReadTimeout: 50 * time.Millisecond, Handler: handler}
+	idle := dial(server)
+
+	time.Sleep(100 * time.Millisecond)
+	idle.Write(GenerateFrame(1, testQuestion))
+
+	res, err := dns.ReadFrame(idle)
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint16(1), dns.MessageID(res))
+	}
+
+	// Connections that stall in the middle of a frame are closed
+	idle.Write(GenerateFrame(2, testQuestion)[:5])
+
+	_, err = idle.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Connections that trickle a frame are closed ReadTimeout after its first byte
+	trickle := dial(server)
+	frame := GenerateFrame(4, testQuestion)
+
+	start := time.Now()
+	for _, octet := range frame {
+		if _, err = trickle.Write([]byte{octet}); err != nil {
+			break
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	_, err = trickle.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Less(t, time.Since(start), time.Duration(len(frame))*20*time.Millisecond)
+
+	// Connections are closed after IdleTimeout between frames
+	reaped := dial(&dns.Server{IdleTimeout: 50 * time.Millisecond, Handler: handler})
+	reaped.Write(GenerateFrame(3, testQuestion))
+
+	res, err = dns.ReadFrame(reaped)
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint16(3), dns.MessageID(res))
+	}
+
+	_, err = reaped.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	var handled context.Context
+	var err error
+
+	server := dns.Server{
+		HandlerTimeout: 20 * time.Millisecond,
+		Handler: dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+			handled = req.Context()
+
+			// Upstream queries from the Handler give up at the deadline
+			upstream, silent := net.Pipe()
+			defer silent.Close()
+
+			client := dns.Client{Timeout: time.Second}
+			_, err = client.ExchangeConn(req.Context(), upstream, GenerateQuery(1, testQuestion))
+
+			dns.ServerFailure(wr, req)
+		}),
+	}
+
+	ctx, cancel := context.WithCancel(server.Context())
+	defer cancel()
+
+	var conn CapturePacketConn
+
+	start := time.Now()
+	req := &dns.Request{}
+	server.Handle(ctx, GenerateQuery(1, testQuestion), &dns.PacketWriter{PacketConn: &conn, Request: req}, req)
+
+	assert.Less(t, time.Since(start), time.Second)
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	assert.Len(t, conn.sent, 1)
+
+	// The request's Context is canceled when the Handler returns, but the connection's is not
+	if assert.NotNil(t, handled) {
+		assert.Error(t, handled.Err())
+	}
+
+	assert.NoError(t, ctx.Err())
+}
+
+func TestMaxFrameSize(t *testing.T) {
+	server := &dns.Server{MaxFrameSize: 512, Handler: dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) { dns.ServerFailure(wr, req) })}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go server.ServeStream(listener)
+	defer server.Shutdown(context.Background())
+
+	for _, prefix := range [][]byte{{0xff, 0xff}, {0x02, 0x01}, {0x00, 0x00}} {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn.SetDeadline(time.Now().Add(time.Second))
+
+		// The frames before a hostile length prefix are answered, then the connection is closed
+		// without waiting for the rest of the frame
+		conn.Write(append(GenerateFrame(1, testQuestion), prefix...))
+
+		res, err := dns.ReadFrame(conn)
+		if assert.NoError(t, err) {
+			assert.Equal(t, uint16(1), dns.MessageID(res))
+		}
+
+		_, err = conn.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.EOF, "prefix %x", prefix)
+
+		conn.Close()
+	}
+}
+
+func TestActiveGauges(t *testing.T) {
+	handling := make(chan struct{})
+	release := make(chan struct{})
+
+	server := &dns.Server{Handler: dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+		handling <- struct{}{}
+		<-release
+
+		dns.ServerFailure(wr, req)
+	})}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go server.ServeStream(listener)
+	defer server.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetDeadline(time.Now().Add(time.Second))
+	conn.Write(GenerateFrame(1, testQuestion))
+
+	<-handling
+	assert.Equal(t, int64(1), server.ActiveConns())
+	assert.Equal(t, int64(1), server.ActiveHandlers())
+
+	close(release)
+
+	_, err = dns.ReadFrame(conn)
+	assert.NoError(t, err)
+	conn.Close()
+
+	assert.Eventually(t, func() bool { return server.ActiveConns() == 0 && server.ActiveHandlers() == 0 }, time.Second, 10*time.Millisecond)
+}
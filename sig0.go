@@ -0,0 +1,346 @@
+package dns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// SIG(0) constants
+const (
+	TypeSIG dnsmessage.Type = 24
+
+	AlgorithmECDSAP256SHA256 uint8 = 13
+)
+
+// SIG(0) verification errors
+var (
+	ErrNoSignature        = errors.New("dns: message does not contain a SIG(0) record")
+	ErrBadSignature       = errors.New("dns: SIG(0) signature is invalid")
+	ErrSignatureExpired   = errors.New("dns: SIG(0) signature is outside of its validity period")
+	ErrUnknownKey         = errors.New("dns: SIG(0) signer and key tag do not match a trusted key")
+	ErrMalformedSignature = errors.New("dns: SIG(0) record is malformed")
+)
+
+// SIG0Key is a public key that SIG(0) request signatures are verified against. Only
+// ECDSAP256SHA256 keys are currently supported
+type SIG0Key struct {
+	// Name is the owner name of the key's KEY record, and must match the SIG(0) signer's name
+	Name dnsmessage.Name
+	// Flags are the KEY record's flags, which are included in the key tag
+	Flags     uint16
+	PublicKey *ecdsa.PublicKey
+}
+
+// Tag computes the key tag of the key's KEY record (RFC 4034, Appendix B)
+func (key *SIG0Key) Tag() uint16 {
+	pub, err := key.PublicKey.ECDH()
+	if err != nil {
+		return 0
+	}
+
+	// Flags, protocol (always 3), algorithm, and the uncompressed point without its 0x04 prefix
+	rdata := binary.BigEndian.AppendUint16(nil, key.Flags)
+	rdata = append(rdata, 3, AlgorithmECDSAP256SHA256)
+	rdata = append(rdata, pub.Bytes()[1:]...)
+
+	var ac uint32
+	for i, b := range rdata {
+		if i&1 == 0 {
+			ac += uint32(b) << 8
+		} else {
+			ac += uint32(b)
+		}
+	}
+
+	ac += ac >> 16 & 0xffff
+	return uint16(ac)
+}
+
+// SIG0 implements MessageAuthenticator with public-key transaction signatures (RFC 2931). Requests are
+// verified against a set of trusted client keys, and responses are signed with the server's private key
+type SIG0 struct {
+	// Key identifies the server's signing key in responses. Its PublicKey must match PrivateKey
+	Key        SIG0Key
+	PrivateKey *ecdsa.PrivateKey
+
+	// Trusted holds the public keys that requests may be signed with
+	Trusted []SIG0Key
+
+	// Fudge is the allowed clock skew when checking a signature's validity period
+	Fudge time.Duration
+	// Validity is the lifetime of response signatures. A zero value uses five minutes
+	Validity time.Duration
+
+	// Now returns the current time. A nil value uses time.Now
+	Now func() time.Time
+}
+
+var _ MessageAuthenticator = &SIG0{}
+var _ ResponseSigner = &SIG0{}
+
+// sig0Record holds the fields of a parsed SIG(0) record
+type sig0Record struct {
+	algorithm  uint8
+	expiration uint32
+	inception  uint32
+	tag        uint16
+	signer     string
+	signature  []byte
+
+	// rdata holds the wire-format RDATA without the signature
+	rdata []byte
+}
+
+// Verify checks the SIG(0) record at the end of a request's additional section. Key tags may collide,
+// so the signature is checked against every trusted key with the signer's name and key tag
+func (auth *SIG0) Verify(msg []byte, _ *Request) error {
+	unsigned, sig, err := splitSIG0(msg)
+	if err != nil {
+		return err
+	}
+
+	if sig.algorithm != AlgorithmECDSAP256SHA256 {
+		return ErrUnknownKey
+	}
+
+	now := uint32(auth.now().Unix())
+	fudge := uint32(auth.Fudge / time.Second)
+
+	// Compare times with serial number arithmetic (RFC 1982)
+	if int32(now+fudge-sig.inception) < 0 || int32(sig.expiration+fudge-now) < 0 {
+		return ErrSignatureExpired
+	}
+
+	digest := sha256.New()
+	digest.Write(sig.rdata)
+	digest.Write(unsigned)
+
+	hash := digest.Sum(nil)
+	matched := false
+
+	for _, key := range auth.Trusted {
+		if key.Tag() != sig.tag || !strings.EqualFold(key.Name.String(), sig.signer) {
+			continue
+		}
+
+		if verifyP256(key.PublicKey, hash, sig.signature) {
+			return nil
+		}
+
+		matched = true
+	}
+
+	if matched {
+		return ErrBadSignature
+	}
+
+	return ErrUnknownKey
+}
+
+// Sign appends a SIG(0) record covering a message to its additional section
+func (auth *SIG0) Sign(msg []byte) ([]byte, error) {
+	return auth.sign(msg, nil)
+}
+
+// SignResponse appends a SIG(0) record covering both a response and the request that it answers
+func (auth *SIG0) SignResponse(msg []byte, req *Request) ([]byte, error) {
+	return auth.sign(msg, req.Message())
+}
+
+func (auth *SIG0) sign(msg, request []byte) ([]byte, error) {
+	if len(msg) < 12 {
+		return nil, ErrShortMessage
+	}
+
+	validity := auth.Validity
+	if validity == 0 {
+		validity = 5 * time.Minute
+	}
+
+	now := auth.now()
+
+	rdata := make([]byte, 18, 18+len(auth.Key.Name.Data)+2)
+	// Type covered, labels and original TTL are always zero for SIG(0)
+	rdata[2] = AlgorithmECDSAP256SHA256
+	binary.BigEndian.PutUint32(rdata[8:], uint32(now.Add(validity).Unix()))
+	binary.BigEndian.PutUint32(rdata[12:], uint32(now.Add(-auth.Fudge).Unix()))
+	binary.BigEndian.PutUint16(rdata[16:], auth.Key.Tag())
+	rdata = appendName(rdata, auth.Key.Name)
+
+	digest := sha256.New()
+	digest.Write(rdata)
+	digest.Write(request)
+	digest.Write(msg)
+
+	r, s, err := ecdsa.Sign(rand.Reader, auth.PrivateKey, digest.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	rdata = append(rdata, r.FillBytes(make([]byte, 32))...)
+	rdata = append(rdata, s.FillBytes(make([]byte, 32))...)
+
+	// Owner name is the root, class is ANY and TTL is zero
+	signed := make([]byte, 0, len(msg)+11+len(rdata))
+	signed = append(signed, msg...)
+	signed = append(signed, 0)
+	signed = binary.BigEndian.AppendUint16(signed, uint16(TypeSIG))
+	signed = binary.BigEndian.AppendUint16(signed, uint16(dnsmessage.ClassANY))
+	signed = binary.BigEndian.AppendUint32(signed, 0)
+	signed = binary.BigEndian.AppendUint16(signed, uint16(len(rdata)))
+	signed = append(signed, rdata...)
+
+	// Increment ARCOUNT
+	binary.BigEndian.PutUint16(signed[10:], binary.BigEndian.Uint16(signed[10:])+1)
+
+	return signed, nil
+}
+
+func (auth *SIG0) now() time.Time {
+	if auth.Now != nil {
+		return auth.Now()
+	}
+
+	return time.Now()
+}
+
+// splitSIG0 locates a SIG(0) record at the end of a message's additional section, and returns
+// the message as it was before the record was appended, along with the parsed record
+func splitSIG0(msg []byte) ([]byte, sig0Record, error) {
+	var parser dnsmessage.Parser
+	var sig sig0Record
+
+	_, err := parser.Start(msg)
+	if err != nil {
+		return nil, sig, err
+	}
+
+	err = skipToAdditionals(&parser)
+	if err != nil {
+		return nil, sig, err
+	}
+
+	var last dnsmessage.ResourceHeader
+	var found bool
+
+	for {
+		header, err := parser.AdditionalHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		}
+
+		if err != nil {
+			return nil, sig, err
+		}
+
+		last, found = header, true
+
+		err = parser.SkipAdditional()
+		if err != nil {
+			return nil, sig, err
+		}
+	}
+
+	if !found || last.Type != TypeSIG {
+		return nil, sig, ErrNoSignature
+	}
+
+	// The record's owner is the root name, which is never compressed
+	start := len(msg) - 11 - int(last.Length)
+	if start < 12 || msg[start] != 0 || last.Name.String() != "." {
+		return nil, sig, ErrMalformedSignature
+	}
+
+	rdata := msg[start+11:]
+	if len(rdata) < 19 {
+		return nil, sig, ErrMalformedSignature
+	}
+
+	sig.algorithm = rdata[2]
+	sig.expiration = binary.BigEndian.Uint32(rdata[8:])
+	sig.inception = binary.BigEndian.Uint32(rdata[12:])
+	sig.tag = binary.BigEndian.Uint16(rdata[16:])
+
+	signer, end, err := readName(rdata, 18)
+	if err != nil {
+		return nil, sig, err
+	}
+
+	sig.signer = signer
+	sig.rdata = rdata[:end]
+	sig.signature = rdata[end:]
+
+	// Restore the message's original ARCOUNT
+	unsigned := append([]byte(nil), msg[:start]...)
+	binary.BigEndian.PutUint16(unsigned[10:], binary.BigEndian.Uint16(unsigned[10:])-1)
+
+	return unsigned, sig, nil
+}
+
+// appendName appends the uncompressed, lower-cased wire format of a name
+func appendName(buf []byte, name dnsmessage.Name) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(strings.ToLower(name.String()), "."), ".") {
+		if label == "" {
+			continue
+		}
+
+		buf = append(buf, byte(len(label)))
+		buf = append(buf, label...)
+	}
+
+	return append(buf, 0)
+}
+
+// readName reads an uncompressed wire-format name from a buffer, and returns it in presentation
+// format with the offset of the byte following it
+func readName(buf []byte, off int) (string, int, error) {
+	var name strings.Builder
+
+	for {
+		if off >= len(buf) {
+			return "", 0, ErrMalformedSignature
+		}
+
+		size := int(buf[off])
+		off++
+
+		if size == 0 {
+			break
+		}
+
+		// Compression pointers are not permitted in the signer's name
+		if size > 63 || off+size > len(buf) {
+			return "", 0, ErrMalformedSignature
+		}
+
+		name.Write(buf[off : off+size])
+		name.WriteByte('.')
+		off += size
+	}
+
+	if name.Len() == 0 {
+		return ".", off, nil
+	}
+
+	return name.String(), off, nil
+}
+
+func verifyP256(key *ecdsa.PublicKey, hash, signature []byte) bool {
+	if key == nil || key.Curve != elliptic.P256() || len(signature) != 64 {
+		return false
+	}
+
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+
+	return ecdsa.Verify(key, hash, r, s)
+}
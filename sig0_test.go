@@ -0,0 +1,191 @@
+package dns_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// A query for example.org. AAAA signed by client.example. with ECDSAP256SHA256, valid from
+// 2025-10-09T08:48:20Z to 2025-10-09T08:58:20Z. It was generated with github.com/miekg/dns v1.1.72,
+// which computes the key's tag as 13843
+const sig0IndependentVector = "2f5100000001000000000001076578616d706c65036f726700001c000100001800ff00000000006200000d000000000068e7792c68e776d4361306636c69656e74076578616d706c65007f3f1cd07a00548a6c280ebcc3ae3cbfe42307b97a1e705d088b5d11cc34d29e7d43d0940743bf5244856fa2ea105cc39e06f7406aedb82a5d9c0f2f25240b5a"
+
+// sig0CollidingKey is a P-256 private key whose KEY record for client.example. has the same tag as
+// sig0Key's
+const sig0CollidingKey = "b0862921ef81a6c2bd05b71bb481d332aa3b70852dba48dd0405d2b0880fde43"
+
+// A query for example.com. A signed by client.example. with ECDSAP256SHA256 at 2025-10-09T08:53:20Z
+const sig0Vector = "109200000001000000000001076578616d706c6503636f6d000001000100001800ff00000000006200000d000000000068e7792c68e77800361306636c69656e74076578616d706c650024a197d21cc7565d3084b23cd2b026bcc245fe4d86c238459689b2a88014ee0a63c7e6955bebfd5105d14fa7dafe51c518ea594a7b0eac1fb11eca2d282768ec"
+
+func sig0Key(t *testing.T) *ecdsa.PrivateKey {
+	return parseP256Key(t, "c9806898a0334916c860748880a541f093b579a9b1f32934d86c363c39800357")
+}
+
+func parseP256Key(t *testing.T, scalar string) *ecdsa.PrivateKey {
+	d, _ := hex.DecodeString(scalar)
+
+	key, err := ecdsa.ParseRawPrivateKey(elliptic.P256(), d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func TestSIG0Vector(t *testing.T) {
+	key := sig0Key(t)
+	client := dns.SIG0Key{Name: dnsmessage.MustNewName("client.example."), Flags: 512, PublicKey: &key.PublicKey}
+
+	assert.Equal(t, uint16(13843), client.Tag())
+
+	auth := dns.SIG0{
+		Trusted: []dns.SIG0Key{client},
+		Fudge:   time.Minute,
+		Now:     func() time.Time { return time.Unix(1760000000, 0) },
+	}
+
+	msg, _ := hex.DecodeString(sig0Vector)
+	assert.NoError(t, auth.Verify(msg, nil))
+
+	// Modify the question's type
+	tampered := append([]byte(nil), msg...)
+	tampered[28] = byte(dnsmessage.TypeAAAA)
+	assert.ErrorIs(t, auth.Verify(tampered, nil), dns.ErrBadSignature)
+
+	// Unsigned messages and untrusted keys are rejected
+	assert.ErrorIs(t, auth.Verify(GenerateQuery(42), nil), dns.ErrNoSignature)
+	assert.ErrorIs(t, (&dns.SIG0{Now: auth.Now}).Verify(msg, nil), dns.ErrUnknownKey)
+
+	// Verify after the signature has expired
+	auth.Now = func() time.Time { return time.Unix(1760000000, 0).Add(time.Hour) }
+	assert.ErrorIs(t, auth.Verify(msg, nil), dns.ErrSignatureExpired)
+}
+
+func TestSIG0RoundTrip(t *testing.T) {
+	key := sig0Key(t)
+	server := dns.SIG0Key{Name: dnsmessage.MustNewName("ns1.example."), Flags: 512, PublicKey: &key.PublicKey}
+
+	signer := dns.SIG0{Key: server, PrivateKey: key}
+	verifier := dns.SIG0{Trusted: []dns.SIG0Key{server}}
+
+	msg, err := signer.Sign(GenerateQuery(42, dnsmessage.Question{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET}))
+	assert.NoError(t, err)
+	assert.NoError(t, verifier.Verify(msg, nil))
+
+	var parser dnsmessage.Parser
+
+	_, err = parser.Start(msg)
+	assert.NoError(t, err)
+	assert.NoError(t, parser.SkipAllQuestions())
+	assert.NoError(t, parser.SkipAllAnswers())
+	assert.NoError(t, parser.SkipAllAuthorities())
+
+	additionals, err := parser.AllAdditionals()
+	assert.NoError(t, err)
+
+	if assert.Len(t, additionals, 1) {
+		assert.Equal(t, dns.TypeSIG, additionals[0].Header.Type)
+		assert.Equal(t, dnsmessage.ClassANY, additionals[0].Header.Class)
+	}
+}
+
+func TestSIG0KeyTagCollision(t *testing.T) {
+	key := sig0Key(t)
+	colliding := parseP256Key(t, sig0CollidingKey)
+
+	name := dnsmessage.MustNewName("client.example.")
+	client := dns.SIG0Key{Name: name, Flags: 512, PublicKey: &key.PublicKey}
+	other := dns.SIG0Key{Name: name, Flags: 512, PublicKey: &colliding.PublicKey}
+
+	if !assert.Equal(t, client.Tag(), other.Tag()) {
+		t.FailNow()
+	}
+
+	now := func() time.Time { return time.Unix(1760000000, 0) }
+	msg, _ := hex.DecodeString(sig0IndependentVector)
+
+	// The signature is checked against every key with the signer's name and tag, in any order
+	for _, trusted := range [][]dns.SIG0Key{{client}, {other, client}, {client, other}} {
+		auth := dns.SIG0{Trusted: trusted, Now: now}
+		assert.NoError(t, auth.Verify(msg, nil))
+	}
+
+	// A signature that no matching key verifies is rejected
+	auth := dns.SIG0{Trusted: []dns.SIG0Key{other}, Now: now}
+	assert.ErrorIs(t, auth.Verify(msg, nil), dns.ErrBadSignature)
+}
+
+// verifySIG0Response checks the SIG(0) record at the end of a response against the request that it
+// answers (RFC 2931, section 3.1)
+func verifySIG0Response(pub *ecdsa.PublicKey, request, response []byte) bool {
+	// The record has a root owner name and fixed fields, followed by RDATA that ends in a 64 octet
+	// ECDSAP256SHA256 signature
+	signer := []byte("\x03ns1\x07example\x00")
+	rdata := response[len(response)-(18+len(signer)+64):]
+	unsigned := append([]byte(nil), response[:len(response)-len(rdata)-11]...)
+	binary.BigEndian.PutUint16(unsigned[10:], binary.BigEndian.Uint16(unsigned[10:])-1)
+
+	digest := sha256.New()
+	digest.Write(rdata[:18+len(signer)])
+	digest.Write(request)
+	digest.Write(unsigned)
+
+	signature := rdata[18+len(signer):]
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+
+	return ecdsa.Verify(pub, digest.Sum(nil), r, s)
+}
+
+func TestSIG0SignResponse(t *testing.T) {
+	key := sig0Key(t)
+	server := dns.SIG0{Key: dns.SIG0Key{Name: dnsmessage.MustNewName("ns1.example."), Flags: 512, PublicKey: &key.PublicKey}, PrivateKey: key}
+	client := dns.SIG0{Key: dns.SIG0Key{Name: dnsmessage.MustNewName("client.example."), Flags: 512, PublicKey: &key.PublicKey}, PrivateKey: key}
+
+	query, err := client.Sign(GenerateQuery(42, testQuestion))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := dns.ParseRequest(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unsigned := dns.NewMessageWriter(nil)
+	assert.NoError(t, dns.WriteAnswer(unsigned, req, &dns.Answer{}))
+
+	// Responses are signed through a SigningWriter with the request, including its signature
+	buf := dns.NewMessageWriter(nil)
+	wr := &dns.SigningWriter{ResponseWriter: buf, Authenticator: &server, Request: req}
+	wr.SendMessage(unsigned.Bytes())
+
+	res := buf.Bytes()
+	assert.Equal(t, len(unsigned.Bytes())+11+18+len("\x03ns1\x07example\x00")+64, len(res))
+	assert.True(t, verifySIG0Response(&key.PublicKey, query, res))
+
+	// The signature does not verify for another request, or without the request
+	other := append([]byte(nil), query...)
+	other[1]++
+	assert.False(t, verifySIG0Response(&key.PublicKey, other, res))
+
+	verifier := dns.SIG0{Trusted: []dns.SIG0Key{server.Key}}
+	assert.ErrorIs(t, verifier.Verify(res, nil), dns.ErrBadSignature)
+
+	// Sign covers the response alone
+	signed, err := server.Sign(unsigned.Bytes())
+	if assert.NoError(t, err) {
+		assert.NoError(t, verifier.Verify(signed, nil))
+	}
+}
@@ -0,0 +1,43 @@
+package dns
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// QuestionCount returns the QDCOUNT of a wire-format message's header, or zero if the message is
+// shorter than a header
+func QuestionCount(msg []byte) int {
+	if len(msg) < 12 {
+		return 0
+	}
+
+	return int(binary.BigEndian.Uint16(msg[4:]))
+}
+
+// notSingle responds with FORMERR to a message that does not have exactly one question, when the
+// Server's SingleQuestionOnly flag is set
+func (server *Server) notSingle(wr ResponseWriter, req *Request) bool {
+	if !server.SingleQuestionOnly {
+		return false
+	}
+
+	count := QuestionCount(req.msg)
+	if req.parser != nil {
+		// Messages in a non-standard encoding are counted by their parsed questions
+		questions, err := req.Questions()
+		if err != nil {
+			return false
+		}
+
+		count = len(questions)
+	}
+
+	if count == 1 {
+		return false
+	}
+
+	WriteError(wr, req, dnsmessage.RCodeFormatError)
+	return true
+}
@@ -0,0 +1,43 @@
+package dns_test
+
+import (
+	"testing"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestSingleQuestionOnly(t *testing.T) {
+	var handled int
+
+	server := dns.Server{
+		SingleQuestionOnly: true,
+		Handler: dns.HandlerFunc(func(dns.ResponseWriter, *dns.Request) {
+			handled++
+		}),
+	}
+
+	second := testQuestion
+	second.Type = dnsmessage.TypeAAAA
+
+	var conn CapturePacketConn
+	for _, msg := range [][]byte{GenerateQuery(1, testQuestion, second), GenerateQuery(2), GenerateQuery(3, testQuestion)} {
+		req := &dns.Request{}
+		server.Handle(server.Context(), msg, &dns.PacketWriter{PacketConn: &conn, Request: req}, req)
+	}
+
+	assert.Equal(t, 2, dns.QuestionCount(GenerateQuery(1, testQuestion, second)))
+	assert.Zero(t, dns.QuestionCount(nil))
+
+	assert.Equal(t, 1, handled)
+
+	if assert.Len(t, conn.sent, 2) {
+		for _, sent := range conn.sent {
+			var res dnsmessage.Message
+			if assert.NoError(t, res.Unpack(sent)) {
+				assert.Equal(t, dnsmessage.RCodeFormatError, res.RCode)
+			}
+		}
+	}
+}
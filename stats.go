@@ -0,0 +1,123 @@
+package dns
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// Stats holds counters for Server events. Counters are updated atomically, and may be read at any time
+type Stats struct {
+	// Truncated counts UDP responses that were truncated to fit the client's payload size, and sent
+	// with the TC bit set
+	Truncated atomic.Uint64
+	// Duplicates counts UDP retransmissions that were dropped while the original query was in-flight
+	Duplicates atomic.Uint64
+	// Amplified counts UDP responses that exceeded the server's amplification cap
+	Amplified atomic.Uint64
+	// Fallbacks counts TCP queries that retried a truncated UDP response (see Server.CorrelateFallback)
+	Fallbacks atomic.Uint64
+	// NotReady counts queries that were received before the server was ready (see Server.AwaitReady)
+	NotReady atomic.Uint64
+	// DroppedResponses counts messages with the QR bit set that were dropped (see Server.AcceptResponses)
+	DroppedResponses atomic.Uint64
+	// DeepNames counts queries that were rejected for exceeding the server's name depth (see Server.MaxNameDepth)
+	DeepNames atomic.Uint64
+	// Oversized counts responses that were replaced with SERVFAIL for exceeding the server's size
+	// limit (see Server.MaxResponseSize)
+	Oversized atomic.Uint64
+	// Overflows counts UDP queries that were dropped at the server's concurrency limit (see Server.MaxConcurrent)
+	Overflows atomic.Uint64
+}
+
+// Counters is a snapshot of a Server's Stats
+type Counters struct {
+	Truncated        uint64
+	Duplicates       uint64
+	Amplified        uint64
+	Fallbacks        uint64
+	NotReady         uint64
+	DroppedResponses uint64
+	DeepNames        uint64
+	Oversized        uint64
+	Overflows        uint64
+}
+
+// Load reads the current value of each counter
+func (stats *Stats) Load() Counters {
+	return Counters{
+		Truncated:        stats.Truncated.Load(),
+		Duplicates:       stats.Duplicates.Load(),
+		Amplified:        stats.Amplified.Load(),
+		Fallbacks:        stats.Fallbacks.Load(),
+		NotReady:         stats.NotReady.Load(),
+		DroppedResponses: stats.DroppedResponses.Load(),
+		DeepNames:        stats.DeepNames.Load(),
+		Oversized:        stats.Oversized.Load(),
+		Overflows:        stats.Overflows.Load(),
+	}
+}
+
+// Add sums two snapshots
+func (counters Counters) Add(other Counters) Counters {
+	return Counters{
+		Truncated:        counters.Truncated + other.Truncated,
+		Duplicates:       counters.Duplicates + other.Duplicates,
+		Amplified:        counters.Amplified + other.Amplified,
+		Fallbacks:        counters.Fallbacks + other.Fallbacks,
+		NotReady:         counters.NotReady + other.NotReady,
+		DroppedResponses: counters.DroppedResponses + other.DroppedResponses,
+		DeepNames:        counters.DeepNames + other.DeepNames,
+		Oversized:        counters.Oversized + other.Oversized,
+		Overflows:        counters.Overflows + other.Overflows,
+	}
+}
+
+// gauges track the Server's current load. Unlike Stats, they rise and fall
+type gauges struct {
+	conns    atomic.Int64
+	handlers atomic.Int64
+}
+
+// ActiveConns returns the number of open stream connections
+func (server *Server) ActiveConns() int64 {
+	return server.gauges.conns.Load()
+}
+
+// ActiveHandlers returns the number of requests that are being handled, on all transports
+func (server *Server) ActiveHandlers() int64 {
+	return server.gauges.handlers.Load()
+}
+
+// ForwardStats counts failed exchanges between a ForwardHandler and its upstreams
+type ForwardStats struct {
+	Timeouts    atomic.Uint64
+	Unreachable atomic.Uint64
+	Malformed   atomic.Uint64
+	// ServerFailures counts SERVFAIL responses that were retried
+	ServerFailures atomic.Uint64
+	// Other counts failures that were not classified, including canceled requests
+	Other atomic.Uint64
+}
+
+func (stats *ForwardStats) count(err error) {
+	switch {
+	case errors.Is(err, ErrUpstreamTimeout):
+		stats.Timeouts.Add(1)
+	case errors.Is(err, ErrUpstreamUnreachable):
+		stats.Unreachable.Add(1)
+	case errors.Is(err, ErrUpstreamMalformed):
+		stats.Malformed.Add(1)
+	case errors.Is(err, ErrUpstreamFailure):
+		stats.ServerFailures.Add(1)
+	default:
+		stats.Other.Add(1)
+	}
+}
+
+// CacheStats counts cache lookups by their outcome
+type CacheStats struct {
+	Hits   atomic.Uint64
+	Misses atomic.Uint64
+	// Stale counts expired responses that were served
+	Stale atomic.Uint64
+}
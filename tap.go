@@ -0,0 +1,80 @@
+package dns
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// TapKind identifies the direction of a tapped message
+type TapKind int
+
+// Tapped message kinds
+const (
+	TapQuery TapKind = iota + 1
+	TapResponse
+)
+
+// TapEvent describes a message that was received or sent by a Server
+type TapEvent struct {
+	Kind      TapKind
+	Transport string
+
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+
+	// QueryTime is the time that the query was received. ResponseTime is set for responses
+	QueryTime    time.Time
+	ResponseTime time.Time
+
+	// Message is the wire-format message. It is only valid during the call to the tap function
+	Message []byte
+}
+
+// tap calls the Server's Tap function with a query, and wraps the ResponseWriter to tap its responses
+func (server *Server) tap(wr ResponseWriter, req *Request) ResponseWriter {
+	if server.Tap == nil {
+		return wr
+	}
+
+	event := TapEvent{
+		Kind:       TapQuery,
+		Transport:  req.Transport(),
+		LocalAddr:  req.LocalAddr,
+		RemoteAddr: req.RemoteAddr,
+		QueryTime:  time.Now(),
+		Message:    req.Message(),
+	}
+
+	server.Tap(event)
+
+	event.Kind = TapResponse
+	event.Message = nil
+
+	return &tapWriter{wrappedWriter: wrappedWriter{wr}, tap: server.Tap, event: event}
+}
+
+// tapWriter passes responses to a tap function before sending them
+type tapWriter struct {
+	wrappedWriter
+
+	tap   func(TapEvent)
+	event TapEvent
+}
+
+// SendBuilder finalizes a Builder, and taps and sends the resulting message
+func (wr *tapWriter) SendBuilder(builder *dnsmessage.Builder) {
+	wr.sendBuilder(wr.SendMessage, builder)
+}
+
+// SendMessage taps and sends a complete message. Messages sent directly with Send are not tapped,
+// as they may include transport framing
+func (wr *tapWriter) SendMessage(msg []byte) {
+	event := wr.event
+	event.ResponseTime = time.Now()
+	event.Message = msg
+
+	wr.tap(event)
+	wr.ResponseWriter.SendMessage(msg)
+}
@@ -0,0 +1,79 @@
+package dns
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/jmanero/go-logging"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// DefaultTLSHandshakeTimeout bounds the TLS handshake of a DNS-over-TLS connection when
+// Server.TLSHandshakeTimeout is zero
+const DefaultTLSHandshakeTimeout = 10 * time.Second
+
+// ErrNoTLSConfig is returned by ListenAndServeTLS when its ListenOptions do not have a TLS configuration
+var ErrNoTLSConfig = errors.New("dns: listener does not have a TLS configuration")
+
+// ServeTLS accepts DNS-over-TLS (RFC 7858) connections from a Listener. Each connection's TLS
+// handshake is completed before its messages are handled as they are by ServeStream, with the same
+// length-prefixed framing inside the encrypted stream. Connections whose handshake fails or does not
+// complete within TLSHandshakeTimeout are closed, and the failure is logged as "tls.handshake"
+func (server *Server) ServeTLS(listener net.Listener, config *tls.Config) error {
+	if !server.AddCloser(listener) {
+		listener.Close()
+		return ErrServerClosed
+	}
+
+	server.Add(1)
+
+	defer server.Done()
+	defer listener.Close()
+
+	ctx := server.baseContext(server.Context(), listener.Addr())
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		server.Go(func() {
+			conn, err := server.proxy(ctx, conn)
+			if err != nil {
+				return
+			}
+
+			tlsConn, err := server.handshake(ctx, conn, config)
+			if err != nil {
+				return
+			}
+
+			server.handleStream(ctx, tlsConn, streamOptions{proxied: true})
+		})
+	}
+}
+
+// handshake completes the TLS handshake of an accepted connection. The handshake is aborted when
+// the Server shuts down
+func (server *Server) handshake(ctx context.Context, conn net.Conn, config *tls.Config) (*tls.Conn, error) {
+	tlsConn := tls.Server(conn, config)
+
+	hctx, cancel := context.WithTimeout(ctx, cmp.Or(server.TLSHandshakeTimeout, DefaultTLSHandshakeTimeout))
+	defer cancel()
+
+	err := tlsConn.HandshakeContext(hctx)
+	if err != nil {
+		server.log(logging.FromContext(ctx), zapcore.WarnLevel, "tls.handshake", zap.Stringer("remote", conn.RemoteAddr()), zap.Error(err))
+		tlsConn.Close()
+
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
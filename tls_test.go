@@ -0,0 +1,129 @@
+package dns_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// SelfSigned creates a TLS certificate for 127.0.0.1, and a pool that trusts it
+func SelfSigned(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dns.test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestServeTLS(t *testing.T) {
+	cert, pool := SelfSigned(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transports := make(chan string, 1)
+	server := dns.Server{
+		TLSHandshakeTimeout: 50 * time.Millisecond,
+		Handler: dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+			transports <- req.Transport()
+			dns.ServerFailure(wr, req)
+		}),
+	}
+
+	go server.ServeTLS(listener, &tls.Config{Certificates: []tls.Certificate{cert}})
+	defer server.Shutdown(context.Background())
+
+	client := dns.Client{Timeout: time.Second, TLSConfig: &tls.Config{RootCAs: pool}}
+
+	res, err := client.ExchangeTLS(context.Background(), GenerateQuery(42, testQuestion), listener.Addr().String())
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint16(42), dns.MessageID(res))
+		assert.Equal(t, dns.TransportTLS, <-transports)
+	}
+
+	// Connections that do not complete their handshake are closed
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestServeTLSProxyProtocol(t *testing.T) {
+	cert, pool := SelfSigned(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clients := make(chan net.Addr, 1)
+	server := dns.Server{ProxyProtocol: true, Handler: dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+		clients <- req.RemoteAddr
+		dns.ServerFailure(wr, req)
+	})}
+
+	go server.ServeTLS(listener, &tls.Config{Certificates: []tls.Certificate{cert}})
+	defer server.Shutdown(context.Background())
+
+	// The PROXY protocol header precedes the TLS handshake, and is not read again from the TLS stream
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 40000 853\r\n"))
+
+	tlsConn := tls.Client(conn, &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"})
+	tlsConn.Write(GenerateFrame(1, testQuestion))
+
+	_, err = dns.ReadFrame(tlsConn)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "192.0.2.1:40000", (<-clients).String())
+	}
+}
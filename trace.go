@@ -0,0 +1,136 @@
+package dns
+
+import (
+	"context"
+	"encoding/hex"
+
+	"github.com/jmanero/go-logging"
+	"go.uber.org/zap"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Local and experimental EDNS0 option codes (RFC 6891) are assigned by each site. The range is
+// suitable for Server.TraceOption
+const (
+	OptionLocalMin uint16 = 65001
+	OptionLocalMax uint16 = 65534
+)
+
+type traceOptionKeyType struct{}
+
+var traceOptionKey traceOptionKeyType
+
+// ContextWithTraceOption sets the EDNS0 option code that carries trace IDs for requests handled
+// with a Context
+func ContextWithTraceOption(ctx context.Context, code uint16) context.Context {
+	return context.WithValue(ctx, traceOptionKey, code)
+}
+
+// TraceOptionFromContext returns the EDNS0 option code that carries trace IDs, or zero if tracing
+// is not enabled
+func TraceOptionFromContext(ctx context.Context) uint16 {
+	code, _ := ctx.Value(traceOptionKey).(uint16)
+	return code
+}
+
+// TraceID returns the data of the request's trace option, when the Server's TraceOption is set
+// and the request's OPT record carries the option
+func (req *Request) TraceID() ([]byte, bool) {
+	code := TraceOptionFromContext(req.Context())
+	if code == 0 {
+		return nil, false
+	}
+
+	edns, found, err := req.ClientEDNS()
+	if err != nil || !found {
+		return nil, false
+	}
+
+	return edns.Option(code)
+}
+
+// trace adds a request's trace ID to the logger in its Context, and wraps the ResponseWriter to
+// echo the trace option in its responses
+func (server *Server) trace(wr ResponseWriter, req *Request) ResponseWriter {
+	if server.TraceOption == 0 {
+		return wr
+	}
+
+	req.ctx = ContextWithTraceOption(req.ctx, server.TraceOption)
+
+	id, found := req.TraceID()
+	if !found {
+		return wr
+	}
+
+	req.ctx, _ = logging.With(req.ctx, zap.String("trace", hex.EncodeToString(id)))
+
+	opt, _, _ := req.OPT()
+	return &traceWriter{wrappedWriter: wrappedWriter{wr}, opt: opt.Header, option: dnsmessage.Option{Code: server.TraceOption, Data: id}}
+}
+
+// traceWriter copies a trace option into the OPT record of each response
+type traceWriter struct {
+	wrappedWriter
+
+	opt    dnsmessage.ResourceHeader
+	option dnsmessage.Option
+}
+
+// SendBuilder finalizes a Builder, and sends the resulting message with the trace option
+func (wr *traceWriter) SendBuilder(builder *dnsmessage.Builder) {
+	wr.sendBuilder(wr.SendMessage, builder)
+}
+
+// SendMessage adds the trace option to a message's OPT record, or adds an OPT record that reflects
+// the client's EDNS version and DO bit, and sends the message. Messages sent directly with Send
+// are not modified, as they may include transport framing. Messages that cannot be parsed are sent
+// without the trace option
+func (wr *traceWriter) SendMessage(msg []byte) {
+	traced, err := appendOption(msg, wr.opt, wr.option)
+	if err != nil {
+		wr.ResponseWriter.SendMessage(msg)
+		return
+	}
+
+	wr.ResponseWriter.SendMessage(traced)
+}
+
+// appendOption adds an option to a message's OPT record, unless the record already has an option
+// with the same code. An OPT record is added to a message without one, using the given header
+func appendOption(msg []byte, header dnsmessage.ResourceHeader, option dnsmessage.Option) ([]byte, error) {
+	var res dnsmessage.Message
+
+	err := res.Unpack(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, resource := range res.Additionals {
+		body, is := resource.Body.(*dnsmessage.OPTResource)
+		if !is {
+			continue
+		}
+
+		for _, existing := range body.Options {
+			if existing.Code == option.Code {
+				return msg, nil
+			}
+		}
+
+		body.Options = append(body.Options, option)
+		return res.Pack()
+	}
+
+	// Keep the version and DO bit. Clear the extended RCODE and reserved flags
+	header.Name = dnsmessage.MustNewName(".")
+	header.Type = dnsmessage.TypeOPT
+	header.TTL &= 0x00ff8000
+
+	res.Additionals = append(res.Additionals, dnsmessage.Resource{
+		Header: header,
+		Body:   &dnsmessage.OPTResource{Options: []dnsmessage.Option{option}},
+	})
+
+	return res.Pack()
+}
@@ -0,0 +1,84 @@
+package dns_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestTraceOption(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trace := dnsmessage.Option{Code: dns.OptionLocalMin, Data: []byte("0af7651916cd43dd")}
+	traces := make(chan []byte, 3)
+
+	server := dns.Server{
+		TraceOption: dns.OptionLocalMin,
+		Handler: dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+			id, _ := req.TraceID()
+			traces <- id
+
+			if req.ID == 3 {
+				// A header that claims a question that it does not have
+				wr.SendMessage([]byte{0, 3, 0x80, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				return
+			}
+
+			dns.ServerFailure(wr, req)
+		}),
+	}
+
+	go server.Serve(conn)
+	defer server.CloseAll()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(time.Second))
+
+	read := func(query []byte) []byte {
+		client.Write(query)
+
+		buf := make([]byte, 4096)
+		size, err := client.Read(buf)
+		assert.NoError(t, err)
+
+		return buf[:size]
+	}
+
+	exchange := func(query []byte) (res dnsmessage.Message) {
+		assert.NoError(t, res.Unpack(read(query)))
+		return
+	}
+
+	// The trace option is copied into an OPT record in the response
+	res := exchange(GenerateEDNSQuery(1, 1232, trace))
+	assert.Equal(t, dnsmessage.RCodeServerFailure, res.RCode)
+
+	if assert.Len(t, res.Additionals, 1) {
+		opt := res.Additionals[0]
+		assert.Equal(t, dnsmessage.TypeOPT, opt.Header.Type)
+		assert.Equal(t, []dnsmessage.Option{trace}, opt.Body.(*dnsmessage.OPTResource).Options)
+	}
+
+	// Responses to queries without the option are not modified
+	res = exchange(GenerateEDNSQuery(2, 1232))
+	assert.Empty(t, res.Additionals)
+
+	// Messages that cannot be parsed are sent without the option
+	assert.Equal(t, []byte{0, 3, 0x80, 0, 0, 1, 0, 0, 0, 0, 0, 0}, read(GenerateEDNSQuery(3, 1232, trace)))
+
+	assert.Equal(t, trace.Data, <-traces)
+	assert.Nil(t, <-traces)
+	assert.Equal(t, trace.Data, <-traces)
+}
@@ -0,0 +1,144 @@
+package dns
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// MinUDPSize is the largest UDP message that every client must accept (RFC 1035)
+const MinUDPSize = 512
+
+// DefaultUDPSize is the EDNS0 payload size that the Client advertises, which avoids IP fragmentation
+// on most paths (DNS Flag Day 2020)
+const DefaultUDPSize = 1232
+
+// headerBitTC is the TC flag in the third octet of a message header
+const headerBitTC = 1 << 1
+
+// Truncate shortens a message to fit within a size limit by dropping whole resource records from
+// the end of the message. The question section and any OPT record are always retained. The TC bit
+// is set if any answer or authority records are dropped. Dropping only additional records does not
+// set TC (RFC 2181, section 9). The returned boolean reports whether any records were dropped
+func Truncate(msg []byte, limit int) ([]byte, bool, error) {
+	if len(msg) <= limit {
+		return msg, false, nil
+	}
+
+	var full dnsmessage.Message
+
+	err := full.Unpack(msg)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Set aside the OPT record, which must be included in truncated responses (RFC 6891)
+	var opt []dnsmessage.Resource
+	var additionals []dnsmessage.Resource
+
+	for _, resource := range full.Additionals {
+		if resource.Header.Type == dnsmessage.TypeOPT {
+			opt = append(opt, resource)
+		} else {
+			additionals = append(additionals, resource)
+		}
+	}
+
+	sections := len(full.Answers) + len(full.Authorities)
+	records := len(full.Answers) + len(full.Authorities) + len(additionals)
+
+	// Pack a prefix of the message's records, with compression
+	pack := func(count int) ([]byte, error) {
+		header := full.Header
+		header.Truncated = full.Truncated || count < sections
+
+		builder := dnsmessage.NewBuilder(nil, header)
+		builder.EnableCompression()
+
+		err := builder.StartQuestions()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, question := range full.Questions {
+			err = builder.Question(question)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		answers := full.Answers[:min(count, len(full.Answers))]
+		count -= len(answers)
+
+		authorities := full.Authorities[:min(count, len(full.Authorities))]
+		count -= len(authorities)
+
+		extra := append(additionals[:min(count, len(additionals)):min(count, len(additionals))], opt...)
+
+		for _, part := range []struct {
+			start   func() error
+			records []dnsmessage.Resource
+		}{
+			{builder.StartAnswers, answers},
+			{builder.StartAuthorities, authorities},
+			{builder.StartAdditionals, extra},
+		} {
+			err = part.start()
+			if err != nil {
+				return nil, err
+			}
+
+			err = AppendResources(&builder, part.records...)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return builder.Finish()
+	}
+
+	// Binary search for the largest number of records that fit within the limit. Re-packing may
+	// compress names in the original message, so all of its records may fit
+	low, high := 0, records
+	for low < high {
+		mid := (low + high + 1) / 2
+
+		candidate, err := pack(mid)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if FitsInUDP(candidate, limit) {
+			low = mid
+		} else {
+			high = mid - 1
+		}
+	}
+
+	truncated, err := pack(low)
+	return truncated, low < records, err
+}
+
+// FitsInUDP reports whether a finished message fits within a UDP size limit. Build a candidate
+// message with compression, measure it, and build it again with fewer records if it does not fit. The
+// message must not have a transport framing prefix
+func FitsInUDP(msg []byte, limit int) bool {
+	return len(msg) <= limit
+}
+
+// UDPSize returns the largest UDP response that the client will accept, from the payload size
+// advertised in the request's OPT record, or the size advertised by the response if ResponseEDNS
+// negotiated a smaller one. MinUDPSize is returned if the request does not have an OPT record, or
+// if it advertises a smaller size
+func (req *Request) UDPSize() int {
+	opt, found, err := req.OPT()
+	if err != nil || !found {
+		return MinUDPSize
+	}
+
+	// The OPT record's class field holds the requestor's UDP payload size
+	size := int(opt.Header.Class)
+	if req.payload > 0 {
+		size = min(size, int(req.payload))
+	}
+
+	return max(MinUDPSize, size)
+}
@@ -0,0 +1,107 @@
+package dns_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// GenerateResponse builds a compressed response to testQuestion with a number of answer and
+// additional records
+func GenerateResponse(t *testing.T, answers, additionals int) []byte {
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 42, Response: true})
+	builder.EnableCompression()
+	builder.StartQuestions()
+	builder.Question(testQuestion)
+
+	header := dnsmessage.ResourceHeader{Name: testQuestion.Name, Class: dnsmessage.ClassINET, TTL: 300}
+
+	builder.StartAnswers()
+	for i := range answers {
+		builder.AResource(header, dnsmessage.AResource{A: [4]byte{192, 0, 2, byte(i)}})
+	}
+
+	builder.StartAdditionals()
+	for i := range additionals {
+		builder.AAAAResource(header, dnsmessage.AAAAResource{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: byte(i)}})
+	}
+
+	msg, err := builder.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return msg
+}
+
+func TestTruncate(t *testing.T) {
+	msg := GenerateResponse(t, 4, 4)
+
+	// Messages within the limit are not modified
+	res, dropped, err := dns.Truncate(msg, len(msg))
+	assert.NoError(t, err)
+	assert.False(t, dropped)
+	assert.Equal(t, msg, res)
+
+	// Dropping additional records does not set TC
+	res, dropped, err = dns.Truncate(msg, len(msg)-1)
+	assert.NoError(t, err)
+	assert.True(t, dropped)
+
+	var parsed dnsmessage.Message
+	if assert.NoError(t, parsed.Unpack(res)) {
+		assert.False(t, parsed.Truncated)
+		assert.Len(t, parsed.Answers, 4)
+		assert.Len(t, parsed.Additionals, 3)
+	}
+
+	// Dropping answers sets TC
+	res, dropped, err = dns.Truncate(msg, 12+len(msg)/4)
+	assert.NoError(t, err)
+	assert.True(t, dropped)
+
+	if assert.NoError(t, parsed.Unpack(res)) {
+		assert.True(t, parsed.Truncated)
+		assert.Less(t, len(parsed.Answers), 4)
+		assert.Empty(t, parsed.Additionals)
+		assert.Equal(t, []dnsmessage.Question{testQuestion}, parsed.Questions)
+	}
+}
+
+func TestPacketWriterOnTruncate(t *testing.T) {
+	req, err := dns.ParseRequest(context.Background(), GenerateQuery(42, testQuestion))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var conn CapturePacketConn
+	var truncated int
+
+	wr := dns.PacketWriter{PacketConn: &conn, Request: req, OnTruncate: func(int, int) { truncated++ }}
+
+	// Responses that only lose additional records are not counted
+	msg := GenerateResponse(t, 4, 30)
+	wr.MaxSize = len(msg) - 1
+
+	wr.SendMessage(msg)
+	assert.Zero(t, truncated)
+
+	// Responses with the TC bit set are counted
+	wr.MaxSize = dns.MinUDPSize
+
+	wr.SendMessage(GenerateResponse(t, 40, 0))
+	assert.Equal(t, 1, truncated)
+
+	// Messages that can not be parsed are sent unchanged
+	garbage := append(GenerateResponse(t, 40, 0)[:dns.MinUDPSize+1], 0xff)
+
+	wr.SendMessage(garbage)
+	assert.Equal(t, 1, truncated)
+
+	if assert.Len(t, conn.sent, 3) {
+		assert.Equal(t, garbage, conn.sent[2])
+	}
+}
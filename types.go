@@ -0,0 +1,143 @@
+package dns
+
+import (
+	"maps"
+	"sync"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// TypeCounter counts queries by their question type. It is safe for concurrent use
+type TypeCounter struct {
+	counts map[dnsmessage.Type]uint64
+	sync.Mutex
+}
+
+// Add increments the count for a type
+func (counter *TypeCounter) Add(qtype dnsmessage.Type) {
+	counter.Lock()
+	defer counter.Unlock()
+
+	if counter.counts == nil {
+		counter.counts = map[dnsmessage.Type]uint64{}
+	}
+
+	counter.counts[qtype]++
+}
+
+// Counts returns a copy of the counts by type
+func (counter *TypeCounter) Counts() map[dnsmessage.Type]uint64 {
+	counter.Lock()
+	defer counter.Unlock()
+
+	return maps.Clone(counter.counts)
+}
+
+// TypeRestriction limits the question types that are passed to a Handler. Queries for other types
+// are answered with NOTIMP before they are dispatched, which is useful to lock down the surface of
+// an authoritative server that is queried for obsolete types
+type TypeRestriction struct {
+	allowed map[dnsmessage.Type]bool
+
+	// Rejected counts rejected queries by type
+	Rejected TypeCounter
+}
+
+// NewTypeRestriction creates a TypeRestriction that passes queries for a set of types
+func NewTypeRestriction(allowed ...dnsmessage.Type) *TypeRestriction {
+	restriction := &TypeRestriction{allowed: map[dnsmessage.Type]bool{}}
+	for _, qtype := range allowed {
+		restriction.allowed[qtype] = true
+	}
+
+	return restriction
+}
+
+// Middleware wraps a Handler with the restriction. Messages without a question are passed to the Handler
+func (restriction *TypeRestriction) Middleware(next Handler) Handler {
+	return HandlerFunc(func(wr ResponseWriter, req *Request) {
+		questions, err := req.Questions()
+		if err != nil || len(questions) == 0 || restriction.allowed[questions[0].Type] {
+			next.ServeDNS(wr, req)
+			return
+		}
+
+		restriction.Rejected.Add(questions[0].Type)
+		WriteError(wr, req, dnsmessage.RCodeNotImplemented)
+	})
+}
+
+// RestrictTypes creates a Middleware that answers queries for types other than the allowed types
+// with NOTIMP. Use NewTypeRestriction to count the rejected queries
+func RestrictTypes(allowed ...dnsmessage.Type) Middleware {
+	return NewTypeRestriction(allowed...).Middleware
+}
+
+// TypeMux dispatches queries to Handlers by the type of their question. Messages without a question
+// are answered with NoQuestion, and messages with more than one question with FORMERR, as their
+// dispatch would be ambiguous. A TypeMux is safe for concurrent use
+type TypeMux struct {
+	// Default serves queries for types that do not have a Handler. A nil Default rejects them
+	// according to the request's Refusal policy
+	Default Handler
+
+	handlers map[dnsmessage.Type]Handler
+	sync.RWMutex
+}
+
+var _ Handler = &TypeMux{}
+
+// Handle registers the Handler for a question type, replacing any existing Handler
+func (mux *TypeMux) Handle(qtype dnsmessage.Type, handler Handler) {
+	mux.Lock()
+	defer mux.Unlock()
+
+	if mux.handlers == nil {
+		mux.handlers = map[dnsmessage.Type]Handler{}
+	}
+
+	mux.handlers[qtype] = handler
+}
+
+// HandleFunc registers a handler function for a question type
+func (mux *TypeMux) HandleFunc(qtype dnsmessage.Type, handler func(ResponseWriter, *Request)) {
+	mux.Handle(qtype, HandlerFunc(handler))
+}
+
+// Handler returns the Handler for a question type, or nil if the type does not have a Handler
+func (mux *TypeMux) Handler(qtype dnsmessage.Type) Handler {
+	mux.RLock()
+	defer mux.RUnlock()
+
+	return mux.handlers[qtype]
+}
+
+// ServeDNS dispatches a request to the Handler for its question's type
+func (mux *TypeMux) ServeDNS(wr ResponseWriter, req *Request) {
+	questions, err := req.Questions()
+
+	switch {
+	case err != nil, len(questions) > 1:
+		WriteError(wr, req, dnsmessage.RCodeFormatError)
+		return
+
+	case len(questions) == 0:
+		NoQuestion(wr, req)
+		return
+	}
+
+	if handler := mux.Handler(questions[0].Type); handler != nil {
+		req.Explain("mux: type %s", questions[0].Type)
+		handler.ServeDNS(wr, req)
+		return
+	}
+
+	if mux.Default != nil {
+		req.Explain("mux: default")
+		mux.Default.ServeDNS(wr, req)
+		return
+	}
+
+	req.Explain("mux: no route")
+	Refuse(wr, req)
+}
@@ -0,0 +1,57 @@
+package dns_test
+
+import (
+	"testing"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestRestrictTypes(t *testing.T) {
+	restriction := dns.NewTypeRestriction(dnsmessage.TypeA, dnsmessage.TypeAAAA)
+	handler := restriction.Middleware(dns.HandlerFunc(func(wr dns.ResponseWriter, req *dns.Request) {
+		dns.WriteAnswer(wr, req, &dns.Answer{})
+	}))
+
+	query := func(qtype dnsmessage.Type) dnsmessage.RCode {
+		return Exchange(t, handler, GenerateQuery(42, dnsmessage.Question{Name: testQuestion.Name, Type: qtype, Class: dnsmessage.ClassINET})).RCode
+	}
+
+	assert.Equal(t, dnsmessage.RCodeSuccess, query(dnsmessage.TypeA))
+	assert.Equal(t, dnsmessage.RCodeSuccess, query(dnsmessage.TypeAAAA))
+	assert.Equal(t, dnsmessage.RCodeNotImplemented, query(dnsmessage.TypeWKS))
+	assert.Equal(t, dnsmessage.RCodeNotImplemented, query(dnsmessage.TypeWKS))
+	assert.Equal(t, dnsmessage.RCodeNotImplemented, query(dnsmessage.Type(99)))
+
+	assert.Equal(t, map[dnsmessage.Type]uint64{dnsmessage.TypeWKS: 2, 99: 1}, restriction.Rejected.Counts())
+}
+
+func TestTypeMux(t *testing.T) {
+	answer := func(rcode dnsmessage.RCode) dns.HandlerFunc {
+		return func(wr dns.ResponseWriter, req *dns.Request) {
+			dns.WriteAnswer(wr, req, &dns.Answer{Header: dnsmessage.Header{RCode: rcode}})
+		}
+	}
+
+	var mux dns.TypeMux
+	mux.Handle(dnsmessage.TypeTXT, answer(dnsmessage.RCodeSuccess))
+	mux.HandleFunc(dnsmessage.TypeSRV, answer(dnsmessage.RCodeNameError))
+
+	query := func(qtype dnsmessage.Type) dnsmessage.RCode {
+		return Exchange(t, &mux, GenerateQuery(42, dnsmessage.Question{Name: testQuestion.Name, Type: qtype, Class: dnsmessage.ClassINET})).RCode
+	}
+
+	assert.Equal(t, dnsmessage.RCodeSuccess, query(dnsmessage.TypeTXT))
+	assert.Equal(t, dnsmessage.RCodeNameError, query(dnsmessage.TypeSRV))
+
+	// Unregistered types are refused, or passed to the default Handler
+	assert.Equal(t, dnsmessage.RCodeRefused, query(dnsmessage.TypeA))
+
+	mux.Default = answer(dnsmessage.RCodeNotImplemented)
+	assert.Equal(t, dnsmessage.RCodeNotImplemented, query(dnsmessage.TypeA))
+
+	// Messages without a question are answered without dispatch, and multiple questions are rejected
+	assert.Equal(t, dnsmessage.RCodeSuccess, Exchange(t, &mux, GenerateQuery(42)).RCode)
+	assert.Equal(t, dnsmessage.RCodeFormatError, Exchange(t, &mux, GenerateQuery(42, testQuestion, testQuestion)).RCode)
+}
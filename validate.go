@@ -0,0 +1,93 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ErrInvalidResponse is wrapped by the errors that ValidateResponse returns
+var ErrInvalidResponse = errors.New("dns: invalid response")
+
+// ValidateResponse checks a wire-format response against its query. The response must be parseable
+// with section counts that match its records, set QR, and match the query's ID and opcode. Its
+// question section must echo the query's exactly, including case, unless it is a FORMERR or NOTIMP
+// response without questions. At most one OPT record may be present, and the header RCODE must be
+// assigned unless an OPT record extends it.
+//
+// ValidateResponse is intended for tests of Handlers, to catch malformed responses
+func ValidateResponse(query, response []byte) error {
+	var qmsg, rmsg dnsmessage.Message
+
+	err := qmsg.Unpack(query)
+	if err != nil {
+		return fmt.Errorf("%w: query: %w", ErrInvalidResponse, err)
+	}
+
+	// Unpack parses every section, and fails if a section has fewer records than its count
+	err = rmsg.Unpack(response)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidResponse, err)
+	}
+
+	switch {
+	case !rmsg.Response:
+		return fmt.Errorf("%w: QR bit is not set", ErrInvalidResponse)
+	case rmsg.ID != qmsg.ID:
+		return fmt.Errorf("%w: ID %d does not match query ID %d", ErrInvalidResponse, rmsg.ID, qmsg.ID)
+	case rmsg.OpCode != qmsg.OpCode:
+		return fmt.Errorf("%w: opcode %d does not match query opcode %d", ErrInvalidResponse, rmsg.OpCode, qmsg.OpCode)
+	}
+
+	err = validateQuestions(qmsg, rmsg)
+	if err != nil {
+		return err
+	}
+
+	var opts int
+	for _, section := range [][]dnsmessage.Resource{rmsg.Answers, rmsg.Authorities} {
+		for _, resource := range section {
+			if resource.Header.Type == dnsmessage.TypeOPT {
+				return fmt.Errorf("%w: OPT record outside of the additional section", ErrInvalidResponse)
+			}
+		}
+	}
+
+	for _, resource := range rmsg.Additionals {
+		if resource.Header.Type == dnsmessage.TypeOPT {
+			opts++
+		}
+	}
+
+	if opts > 1 {
+		return fmt.Errorf("%w: %d OPT records", ErrInvalidResponse, opts)
+	}
+
+	// RCODEs above NOTZONE are unassigned in the header, and are only valid when extended by an OPT record
+	if rmsg.RCode > 10 && opts == 0 {
+		return fmt.Errorf("%w: unassigned RCODE %d", ErrInvalidResponse, rmsg.RCode)
+	}
+
+	return nil
+}
+
+func validateQuestions(qmsg, rmsg dnsmessage.Message) error {
+	if len(rmsg.Questions) == 0 && (rmsg.RCode == dnsmessage.RCodeFormatError || rmsg.RCode == dnsmessage.RCodeNotImplemented) {
+		return nil
+	}
+
+	if len(rmsg.Questions) != len(qmsg.Questions) {
+		return fmt.Errorf("%w: %d questions do not echo the query's %d questions", ErrInvalidResponse, len(rmsg.Questions), len(qmsg.Questions))
+	}
+
+	for i, question := range qmsg.Questions {
+		echo := rmsg.Questions[i]
+
+		if echo.Name.String() != question.Name.String() || echo.Type != question.Type || echo.Class != question.Class {
+			return fmt.Errorf("%w: question %s does not echo the query's question %s", ErrInvalidResponse, echo.GoString(), question.GoString())
+		}
+	}
+
+	return nil
+}
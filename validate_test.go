@@ -0,0 +1,51 @@
+package dns_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestValidateResponse(t *testing.T) {
+	query := GenerateQuery(42, testQuestion)
+
+	req, err := dns.ParseRequest(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wr := dns.NewMessageWriter(nil)
+	dns.NXDomain(wr, req, testSOA)
+
+	response := wr.Bytes()
+	assert.NoError(t, dns.ValidateResponse(query, response))
+
+	invalid := func(tamper func(res []byte)) error {
+		res := bytes.Clone(response)
+		tamper(res)
+
+		return dns.ValidateResponse(query, res)
+	}
+
+	assert.ErrorIs(t, invalid(func(res []byte) { res[1]++ }), dns.ErrInvalidResponse)
+	assert.ErrorIs(t, invalid(func(res []byte) { res[2] &^= 0x80 }), dns.ErrInvalidResponse)
+	assert.ErrorIs(t, invalid(func(res []byte) { res[3] |= 0x0f }), dns.ErrInvalidResponse)
+
+	// A section count that does not match its records
+	assert.ErrorIs(t, invalid(func(res []byte) { res[11]++ }), dns.ErrInvalidResponse)
+
+	// The question's case must be echoed exactly
+	assert.ErrorIs(t, invalid(func(res []byte) { res[13] = 'W' }), dns.ErrInvalidResponse)
+
+	// FORMERR responses may omit the question
+	res := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 42, Response: true, RCode: dnsmessage.RCodeFormatError})
+
+	formerr, err := res.Finish()
+	if assert.NoError(t, err) {
+		assert.NoError(t, dns.ValidateResponse(query, formerr))
+	}
+}
@@ -0,0 +1,63 @@
+package dns
+
+import "golang.org/x/net/dns/dnsmessage"
+
+// builderSettings is implemented by writers whose Builders use name compression or an Allocator,
+// so that writers that wrap them can create Builders with the same settings
+type builderSettings interface {
+	builderSettings() (alloc Allocator, compression bool)
+}
+
+func (wr *PacketWriter) builderSettings() (Allocator, bool) {
+	return wr.Allocator, wr.Compression
+}
+
+func (wr *StreamWriter) builderSettings() (Allocator, bool) {
+	return wr.Allocator, wr.Compression
+}
+
+func (wr *QUICWriter) builderSettings() (Allocator, bool) {
+	return wr.Allocator, wr.Compression
+}
+
+// wrappedWriter is embedded by writers that inspect or modify complete messages before passing them
+// to an underlying ResponseWriter. Its Builders have no transport framing, so that their messages can
+// be passed to the wrapping writer's SendMessage, and use the underlying writer's compression and
+// Allocator settings. Wrapping writers must implement SendBuilder with sendBuilder
+type wrappedWriter struct {
+	ResponseWriter
+}
+
+func (wr wrappedWriter) builderSettings() (Allocator, bool) {
+	if settings, is := wr.ResponseWriter.(builderSettings); is {
+		return settings.builderSettings()
+	}
+
+	return nil, false
+}
+
+// Builder creates a dnsmessage.Builder without any transport framing
+func (wr wrappedWriter) Builder(header dnsmessage.Header) dnsmessage.Builder {
+	alloc, compression := wr.builderSettings()
+
+	builder := allocBuilder(alloc, &packetBuilders, 0, header)
+	if compression {
+		builder.EnableCompression()
+	}
+
+	return builder
+}
+
+// sendBuilder finalizes a Builder from wrappedWriter.Builder, passes the resulting message to the
+// wrapping writer's SendMessage, and releases the Builder's buffer
+func (wr wrappedWriter) sendBuilder(send func([]byte), builder *dnsmessage.Builder) {
+	msg, err := builder.Finish()
+	if err != nil {
+		panic(err)
+	}
+
+	send(msg)
+
+	alloc, _ := wr.builderSettings()
+	freeBuilder(alloc, &packetBuilders, msg)
+}
@@ -0,0 +1,359 @@
+package dns
+
+import (
+	"cmp"
+	"errors"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Zone errors
+var (
+	ErrOutOfZone = errors.New("dns: record is not within the zone")
+	ErrTTLRange  = errors.New("dns: record TTL exceeds MaxRecordTTL")
+)
+
+// MaxRecordTTL is the largest valid TTL. Resolvers treat TTLs with the most significant bit set as
+// zero (RFC 2181, section 8)
+const MaxRecordTTL = 1<<31 - 1
+
+// Zone stores the SOA record and RRsets of an authoritative zone. Its methods are safe for
+// concurrent use, so that a zone can be updated while it is being served.
+//
+// The zone's apex NS RRset is derived from its nameservers when no NS records are added at its
+// origin. Nameservers are set with SetNameservers, and default to the SOA record's primary server.
+//
+// Records that are added without a TTL are given the zone's default TTL, so that records are not
+// served with a zero TTL by accident. The default TTL is set with SetDefaultTTL, and defaults to
+// the SOA record's TTL
+type Zone struct {
+	// OnTTLRange is called with the owner name and TTL of each record, SOA record, or default TTL that
+	// is set above MaxRecordTTL, so that it may log a warning. Resolvers treat such TTLs as zero (RFC
+	// 2181, section 8)
+	OnTTLRange func(name dnsmessage.Name, ttl uint32)
+
+	// StrictTTL rejects TTLs above MaxRecordTTL with ErrTTLRange. Otherwise, they are accepted
+	StrictTTL bool
+
+	origin      dnsmessage.Name
+	soa         dnsmessage.Resource
+	nameservers []dnsmessage.Name
+	defaultTTL  uint32
+
+	// RRsets by canonical owner name and type
+	records map[string]map[dnsmessage.Type][]dnsmessage.Resource
+	// descendants counts the owner names below each name in the zone, so that empty non-terminals
+	// are found without scanning the zone's names
+	descendants map[string]int
+
+	sync.RWMutex
+}
+
+// NewZone creates a Zone from its SOA record. The zone's origin is the SOA record's owner name
+func NewZone(soa dnsmessage.Resource) (*Zone, error) {
+	if _, is := soa.Body.(*dnsmessage.SOAResource); !is {
+		return nil, ErrNotSOA
+	}
+
+	soa.Header.Type = dnsmessage.TypeSOA
+
+	return &Zone{
+		origin:      soa.Header.Name,
+		soa:         soa,
+		records:     map[string]map[dnsmessage.Type][]dnsmessage.Resource{},
+		descendants: map[string]int{},
+	}, nil
+}
+
+// Origin returns the zone's apex name
+func (zone *Zone) Origin() dnsmessage.Name {
+	return zone.origin
+}
+
+// SOA returns a copy of the zone's SOA record
+func (zone *Zone) SOA() dnsmessage.Resource {
+	zone.RLock()
+	defer zone.RUnlock()
+
+	soa := *zone.soa.Body.(*dnsmessage.SOAResource)
+	return dnsmessage.Resource{Header: zone.soa.Header, Body: &soa}
+}
+
+// Serial returns the zone's current serial number
+func (zone *Zone) Serial() uint32 {
+	zone.RLock()
+	defer zone.RUnlock()
+
+	return zone.soa.Body.(*dnsmessage.SOAResource).Serial
+}
+
+// Bump increments the zone's serial number with serial number arithmetic (RFC 1982), and returns
+// the new serial. Call Bump after a set of changes so that secondaries detect the update
+func (zone *Zone) Bump() uint32 {
+	zone.Lock()
+	defer zone.Unlock()
+
+	// Replace the SOA body rather than modifying it, as copies returned by SOA may still be in use
+	soa := *zone.soa.Body.(*dnsmessage.SOAResource)
+	soa.Serial++
+
+	zone.soa.Body = &soa
+	return soa.Serial
+}
+
+// SetSOA replaces the zone's SOA record. The owner name must match the zone's origin. The record's
+// TTL and MINIMUM field are checked like the TTLs of records that are added
+func (zone *Zone) SetSOA(soa dnsmessage.Resource) error {
+	body, is := soa.Body.(*dnsmessage.SOAResource)
+	if !is {
+		return ErrNotSOA
+	}
+
+	if CanonicalName(soa.Header.Name) != CanonicalName(zone.origin) {
+		return ErrOutOfZone
+	}
+
+	for _, ttl := range []uint32{soa.Header.TTL, body.MinTTL} {
+		if err := zone.checkTTL(soa.Header.Name, ttl); err != nil {
+			return err
+		}
+	}
+
+	soa.Header.Type = dnsmessage.TypeSOA
+
+	zone.Lock()
+	defer zone.Unlock()
+
+	zone.soa = soa
+	return nil
+}
+
+// SetNameservers sets the targets of the zone's derived apex NS RRset
+func (zone *Zone) SetNameservers(names ...dnsmessage.Name) {
+	zone.Lock()
+	defer zone.Unlock()
+
+	zone.nameservers = slices.Clone(names)
+}
+
+// SetDefaultTTL sets the TTL of records that are added without one. Records that were already
+// added are not changed
+func (zone *Zone) SetDefaultTTL(ttl uint32) error {
+	if err := zone.checkTTL(zone.origin, ttl); err != nil {
+		return err
+	}
+
+	zone.Lock()
+	defer zone.Unlock()
+
+	zone.defaultTTL = ttl
+	return nil
+}
+
+// DefaultTTL returns the TTL of records that are added without one
+func (zone *Zone) DefaultTTL() uint32 {
+	zone.RLock()
+	defer zone.RUnlock()
+
+	return cmp.Or(zone.defaultTTL, zone.soa.Header.TTL)
+}
+
+// NS returns a copy of the zone's apex NS RRset
+func (zone *Zone) NS() []dnsmessage.Resource {
+	zone.RLock()
+	defer zone.RUnlock()
+
+	return zone.apexNS()
+}
+
+// apexNS returns the NS records added at the zone's origin, or derives them from the nameservers
+// and SOA record. The zone must be locked
+func (zone *Zone) apexNS() []dnsmessage.Resource {
+	if records := zone.records[CanonicalName(zone.origin)][dnsmessage.TypeNS]; len(records) > 0 {
+		return slices.Clone(records)
+	}
+
+	names := zone.nameservers
+	if len(names) == 0 {
+		names = []dnsmessage.Name{zone.soa.Body.(*dnsmessage.SOAResource).NS}
+	}
+
+	header := dnsmessage.ResourceHeader{Name: zone.origin, Type: dnsmessage.TypeNS, Class: zone.soa.Header.Class, TTL: zone.soa.Header.TTL}
+
+	records := make([]dnsmessage.Resource, 0, len(names))
+	for _, name := range names {
+		records = append(records, dnsmessage.Resource{Header: header, Body: &dnsmessage.NSResource{NS: name}})
+	}
+
+	return records
+}
+
+// Contains checks if a name is equal to or below the zone's origin
+func (zone *Zone) Contains(name dnsmessage.Name) bool {
+	return IsSubdomain(name, zone.origin)
+}
+
+// Add appends records to their RRsets. Records without a TTL are given the zone's default TTL. SOA
+// records are rejected, and must be replaced with SetSOA. Records with TTLs above MaxRecordTTL are
+// reported to OnTTLRange, and rejected if StrictTTL is set
+func (zone *Zone) Add(records ...dnsmessage.Resource) error {
+	for _, record := range records {
+		if record.Header.Type == dnsmessage.TypeSOA {
+			return ErrNotSOA
+		}
+
+		if !zone.Contains(record.Header.Name) {
+			return ErrOutOfZone
+		}
+
+		if err := zone.checkTTL(record.Header.Name, record.Header.TTL); err != nil {
+			return err
+		}
+	}
+
+	zone.Lock()
+	defer zone.Unlock()
+
+	ttl := cmp.Or(zone.defaultTTL, zone.soa.Header.TTL)
+
+	for _, record := range records {
+		if record.Header.TTL == 0 {
+			record.Header.TTL = ttl
+		}
+
+		key := CanonicalName(record.Header.Name)
+
+		rrsets, has := zone.records[key]
+		if !has {
+			rrsets = map[dnsmessage.Type][]dnsmessage.Resource{}
+			zone.records[key] = rrsets
+			zone.count(key, 1)
+		}
+
+		rrsets[record.Header.Type] = append(rrsets[record.Header.Type], record)
+	}
+
+	return nil
+}
+
+// checkTTL reports a TTL above MaxRecordTTL to OnTTLRange, and rejects it if StrictTTL is set
+func (zone *Zone) checkTTL(name dnsmessage.Name, ttl uint32) error {
+	if ttl <= MaxRecordTTL {
+		return nil
+	}
+
+	if zone.OnTTLRange != nil {
+		zone.OnTTLRange(name, ttl)
+	}
+
+	if zone.StrictTTL {
+		return ErrTTLRange
+	}
+
+	return nil
+}
+
+// Remove deletes the RRset for an owner name and type
+func (zone *Zone) Remove(name dnsmessage.Name, qtype dnsmessage.Type) {
+	zone.Lock()
+	defer zone.Unlock()
+
+	key := CanonicalName(name)
+
+	rrsets, has := zone.records[key]
+	if !has {
+		return
+	}
+
+	delete(rrsets, qtype)
+	if len(rrsets) == 0 {
+		delete(zone.records, key)
+		zone.count(key, -1)
+	}
+}
+
+// count adjusts the descendant counts of the ancestors of an owner name, up to the zone's origin
+func (zone *Zone) count(key string, delta int) {
+	origin := CanonicalName(zone.origin)
+
+	for key != origin {
+		_, parent, found := strings.Cut(key, ".")
+		if !found || parent == "" {
+			return
+		}
+
+		key = parent
+
+		zone.descendants[key] += delta
+		if zone.descendants[key] <= 0 {
+			delete(zone.descendants, key)
+		}
+	}
+}
+
+// Lookup returns a copy of the RRset for an owner name and type. The boolean result reports
+// whether the name exists in the zone, either with records of any type, or as an empty non-terminal
+// that has no records but is an ancestor of a name with records. Queries for empty non-terminals
+// must be answered with NODATA rather than NXDOMAIN (RFC 8020)
+func (zone *Zone) Lookup(name dnsmessage.Name, qtype dnsmessage.Type) ([]dnsmessage.Resource, bool) {
+	key := CanonicalName(name)
+
+	zone.RLock()
+	defer zone.RUnlock()
+
+	if key == CanonicalName(zone.origin) {
+		switch qtype {
+		case dnsmessage.TypeSOA:
+			return []dnsmessage.Resource{zone.soa}, true
+		case dnsmessage.TypeNS:
+			return zone.apexNS(), true
+		}
+	}
+
+	rrsets, exists := zone.records[key]
+	if key == CanonicalName(zone.origin) || zone.descendants[key] > 0 {
+		exists = true
+	}
+
+	return slices.Clone(rrsets[qtype]), exists
+}
+
+// Records returns a copy of all of the zone's records, beginning with its SOA and apex NS RRset
+func (zone *Zone) Records() []dnsmessage.Resource {
+	zone.RLock()
+	defer zone.RUnlock()
+
+	records := append([]dnsmessage.Resource{zone.soa}, zone.apexNS()...)
+	for key, rrsets := range zone.records {
+		if key == CanonicalName(zone.origin) {
+			rrsets = maps.Clone(rrsets)
+			delete(rrsets, dnsmessage.TypeNS)
+		}
+
+		for _, rrset := range rrsets {
+			records = append(records, rrset...)
+		}
+	}
+
+	return records
+}
+
+// CanonicalName returns the lower-cased presentation format of a name, for use as a lookup key
+func CanonicalName(name dnsmessage.Name) string {
+	return strings.ToLower(name.String())
+}
+
+// IsSubdomain checks if a name is equal to or below a parent name, comparing whole labels without regard to case
+func IsSubdomain(name, parent dnsmessage.Name) bool {
+	child, base := CanonicalName(name), CanonicalName(parent)
+
+	if base == "." || child == base {
+		return true
+	}
+
+	return strings.HasSuffix(child, "."+base)
+}
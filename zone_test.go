@@ -0,0 +1,285 @@
+package dns_test
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmanero/go-dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestZone(t *testing.T) {
+	zone, err := dns.NewZone(dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Class: dnsmessage.ClassINET, TTL: 3600},
+		Body: &dnsmessage.SOAResource{
+			NS: dnsmessage.MustNewName("ns1.example.com."), MBox: dnsmessage.MustNewName("hostmaster.example.com."),
+			Serial: 0xffffffff, Refresh: 3600, Retry: 600, Expire: 86400, MinTTL: 300,
+		},
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, zone.Add(dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("www.Example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+		Body:   &dnsmessage.AResource{A: [4]byte{10, 0, 1, 1}},
+	}))
+
+	assert.ErrorIs(t, zone.Add(dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("www.example.org."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+		Body:   &dnsmessage.AResource{},
+	}), dns.ErrOutOfZone)
+
+	records, exists := zone.Lookup(dnsmessage.MustNewName("WWW.example.com."), dnsmessage.TypeA)
+	assert.True(t, exists)
+	assert.Len(t, records, 1)
+
+	records, exists = zone.Lookup(dnsmessage.MustNewName("www.example.com."), dnsmessage.TypeAAAA)
+	assert.True(t, exists)
+	assert.Empty(t, records)
+
+	_, exists = zone.Lookup(dnsmessage.MustNewName("mail.example.com."), dnsmessage.TypeA)
+	assert.False(t, exists)
+
+	// Serials wrap around with serial number arithmetic
+	soa := zone.SOA()
+	assert.Equal(t, uint32(0), zone.Bump())
+	assert.Equal(t, uint32(0xffffffff), soa.Body.(*dnsmessage.SOAResource).Serial)
+
+	var wg sync.WaitGroup
+	for range 100 {
+		wg.Go(func() { zone.Bump(); zone.Lookup(zone.Origin(), dnsmessage.TypeSOA) })
+	}
+
+	wg.Wait()
+	assert.Equal(t, uint32(100), zone.Serial())
+}
+
+func TestEmptyNonTerminal(t *testing.T) {
+	zone, err := dns.NewZone(testSOA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deep := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("x.a.b.example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+		Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+	}
+
+	assert.NoError(t, zone.Add(deep))
+
+	handler := &dns.ZoneHandler{Zone: zone}
+	query := func(name string) dnsmessage.Message {
+		return Exchange(t, handler, GenerateQuery(42, dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}))
+	}
+
+	// Ancestors of x.a.b.example.com. exist without records
+	for _, name := range []string{"a.b.example.com.", "b.example.com."} {
+		res := query(name)
+
+		assert.Equal(t, dnsmessage.RCodeSuccess, res.RCode, name)
+		assert.True(t, res.Authoritative, name)
+		assert.Empty(t, res.Answers, name)
+
+		if assert.Len(t, res.Authorities, 1, name) {
+			assert.Equal(t, dnsmessage.TypeSOA, res.Authorities[0].Header.Type)
+			assert.Equal(t, uint32(300), res.Authorities[0].Header.TTL)
+		}
+	}
+
+	res := query("y.a.b.example.com.")
+	assert.Equal(t, dnsmessage.RCodeNameError, res.RCode)
+
+	res = query("x.a.b.example.com.")
+	assert.Equal(t, dnsmessage.RCodeSuccess, res.RCode)
+	assert.Len(t, res.Answers, 1)
+
+	// Removing the only descendant removes its empty non-terminals
+	zone.Remove(deep.Header.Name, dnsmessage.TypeA)
+
+	res = query("a.b.example.com.")
+	assert.Equal(t, dnsmessage.RCodeNameError, res.RCode)
+
+	res = query("www.example.org.")
+	assert.Equal(t, dnsmessage.RCodeRefused, res.RCode)
+}
+
+func TestApexNS(t *testing.T) {
+	zone, err := dns.NewZone(testSOA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ns1 := dnsmessage.MustNewName("ns1.example.com.")
+	ns2 := dnsmessage.MustNewName("ns.example.net.")
+
+	assert.NoError(t, zone.Add(dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: ns1, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 3600},
+		Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 53}},
+	}))
+
+	handler := &dns.ZoneHandler{Zone: zone}
+	apex := dnsmessage.Question{Name: zone.Origin(), Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET}
+
+	// The apex NS RRset defaults to the SOA record's primary server, with glue
+	res := Exchange(t, handler, GenerateQuery(1, apex))
+	assert.True(t, res.Authoritative)
+
+	if assert.Len(t, res.Answers, 1) {
+		assert.Equal(t, ns1, res.Answers[0].Body.(*dnsmessage.NSResource).NS)
+		assert.Equal(t, testSOA.Header.TTL, res.Answers[0].Header.TTL)
+	}
+
+	if assert.Len(t, res.Additionals, 1) {
+		assert.Equal(t, ns1, res.Additionals[0].Header.Name)
+	}
+
+	// Out-of-zone nameservers do not have glue
+	zone.SetNameservers(ns1, ns2)
+
+	res = Exchange(t, handler, GenerateQuery(2, apex))
+	assert.Len(t, res.Answers, 2)
+	assert.Len(t, res.Additionals, 1)
+
+	apex.Type = dnsmessage.TypeSOA
+
+	res = Exchange(t, handler, GenerateQuery(3, apex))
+	if assert.Len(t, res.Answers, 1) {
+		assert.Equal(t, dnsmessage.TypeSOA, res.Answers[0].Header.Type)
+	}
+
+	// NS records added at the origin replace the derived RRset
+	assert.NoError(t, zone.Add(dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: zone.Origin(), Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET, TTL: 60},
+		Body:   &dnsmessage.NSResource{NS: ns2},
+	}))
+
+	records := zone.NS()
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, uint32(60), records[0].Header.TTL)
+	}
+
+	assert.Len(t, zone.Records(), 3)
+}
+
+func TestGlueLimit(t *testing.T) {
+	zone, err := dns.NewZone(testSOA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var nameservers []dnsmessage.Name
+	for i := range byte(3) {
+		name := dnsmessage.MustNewName(fmt.Sprintf("ns%d.example.com.", i))
+		nameservers = append(nameservers, name)
+
+		assert.NoError(t, zone.Add(dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 3600},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, i}},
+		}, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET, TTL: 3600},
+			Body:   &dnsmessage.AAAAResource{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: i}},
+		}))
+	}
+
+	// Glue is not served for names outside of the zone, even if the zone has records for them
+	zone.SetNameservers(append(nameservers, dnsmessage.MustNewName("ns.example.net."))...)
+
+	handler := &dns.ZoneHandler{Zone: zone, MaxGlue: 4}
+	query := GenerateQuery(42, dnsmessage.Question{Name: zone.Origin(), Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET})
+
+	// Glue is not limited on stream transports
+	res := Exchange(t, handler, query)
+	assert.False(t, res.Truncated)
+	assert.Len(t, res.Answers, 4)
+	assert.Len(t, res.Additionals, 6)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := dns.Server{Handler: handler}
+	go server.Serve(conn)
+	defer server.CloseAll()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(time.Second))
+	client.Write(query)
+
+	buf := make([]byte, 4096)
+
+	size, err := client.Read(buf)
+	if assert.NoError(t, err) && assert.NoError(t, res.Unpack(buf[:size])) {
+		// UDP responses that omit glue set TC
+		assert.True(t, res.Truncated)
+		assert.Len(t, res.Answers, 4)
+		assert.Len(t, res.Additionals, 4)
+	}
+}
+
+func TestDefaultTTL(t *testing.T) {
+	zone, err := dns.NewZone(testSOA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := func(name string) dnsmessage.Resource {
+		return dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+			Body:   &dnsmessage.AResource{A: [4]byte{10, 0, 1, 1}},
+		}
+	}
+
+	// Records without a TTL default to the SOA record's TTL
+	assert.Equal(t, uint32(3600), zone.DefaultTTL())
+	assert.NoError(t, zone.Add(record("a.example.com.")))
+
+	assert.NoError(t, zone.SetDefaultTTL(300))
+	assert.NoError(t, zone.Add(record("b.example.com.")))
+
+	explicit := record("c.example.com.")
+	explicit.Header.TTL = 60
+	assert.NoError(t, zone.Add(explicit))
+
+	for name, ttl := range map[string]uint32{"a.example.com.": 3600, "b.example.com.": 300, "c.example.com.": 60} {
+		records, _ := zone.Lookup(dnsmessage.MustNewName(name), dnsmessage.TypeA)
+		if assert.Len(t, records, 1) {
+			assert.Equal(t, ttl, records[0].Header.TTL, name)
+		}
+	}
+
+	// TTLs with the most significant bit set are reported, and accepted
+	var reported []string
+	zone.OnTTLRange = func(name dnsmessage.Name, _ uint32) { reported = append(reported, name.String()) }
+
+	large := record("d.example.com.")
+	large.Header.TTL = dns.MaxRecordTTL + 1
+	assert.NoError(t, zone.Add(large))
+
+	soa := zone.SOA()
+	soa.Header.TTL = dns.MaxRecordTTL + 1
+	assert.NoError(t, zone.SetSOA(soa))
+	assert.Equal(t, []string{"d.example.com.", "example.com."}, reported)
+
+	// They are rejected when StrictTTL is set
+	zone.StrictTTL = true
+	large.Header.Name = dnsmessage.MustNewName("e.example.com.")
+
+	assert.ErrorIs(t, zone.Add(large), dns.ErrTTLRange)
+	assert.ErrorIs(t, zone.SetDefaultTTL(dns.MaxRecordTTL+1), dns.ErrTTLRange)
+
+	soa.Header.TTL = 3600
+	soa.Body.(*dnsmessage.SOAResource).MinTTL = dns.MaxRecordTTL + 1
+	assert.ErrorIs(t, zone.SetSOA(soa), dns.ErrTTLRange)
+
+	_, found := zone.Lookup(large.Header.Name, dnsmessage.TypeA)
+	assert.False(t, found)
+}
@@ -0,0 +1,175 @@
+package dns
+
+import (
+	"cmp"
+
+	"github.com/jmanero/go-logging"
+	"go.uber.org/zap"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ZoneHandler answers queries authoritatively from a Zone. CNAME chains within the zone are
+// followed, names that exist without records of the requested type (including empty
+// non-terminals) are answered with NODATA, and names that do not exist with NXDOMAIN. Queries for
+// names outside of the zone are refused. The apex SOA and NS RRsets are answered from the Zone's
+// metadata, and NS answers include the addresses of nameservers within the zone as glue
+type ZoneHandler struct {
+	Zone *Zone
+
+	// MaxGlue bounds the glue records in UDP responses. Responses that omit glue set TC, so that
+	// clients retry over TCP, where glue is not limited. A zero value uses DefaultMaxGlue
+	MaxGlue int
+
+	// Denial adds NSEC or NSEC3 records that prove the non-existence of names and types to negative
+	// responses for clients that set the DO bit. The SortedZone should index the Zone's records
+	Denial *SortedZone
+
+	// Transfers answers AXFR queries for the zone's origin with the whole zone, streamed over stream
+	// transports in as many messages as it needs. AXFR queries over UDP, and all AXFR queries when
+	// Transfers is false, are refused. Use an ACL to restrict transfers to secondary servers
+	Transfers bool
+}
+
+// DefaultMaxGlue bounds the glue records in UDP responses of a ZoneHandler with a zero MaxGlue
+const DefaultMaxGlue = 16
+
+var _ Handler = &ZoneHandler{}
+
+// ServeDNS answers the request's first question
+func (handler *ZoneHandler) ServeDNS(wr ResponseWriter, req *Request) {
+	questions, err := req.Questions()
+	if err != nil {
+		WriteError(wr, req, dnsmessage.RCodeFormatError)
+		return
+	}
+
+	if len(questions) == 0 {
+		NoQuestion(wr, req)
+		return
+	}
+
+	question := questions[0]
+	zone := handler.Zone
+
+	if !zone.Contains(question.Name) {
+		Refuse(wr, req)
+		return
+	}
+
+	if question.Type == dnsmessage.TypeAXFR {
+		handler.transfer(wr, req, question)
+		return
+	}
+
+	answers, rcode := FollowCNAME(zone, question.Name, question.Type)
+	if rcode == dnsmessage.RCodeServerFailure {
+		ServerFailure(wr, req)
+		return
+	}
+
+	answer := Answer{
+		Header:  dnsmessage.Header{Authoritative: true, RCode: rcode},
+		Answers: answers,
+	}
+
+	if rcode == dnsmessage.RCodeNameError || handler.nodata(question, answers) {
+		soa, _ := negativeSOA(zone.SOA())
+		answer.Authorities = []dnsmessage.Resource{soa}
+
+		if handler.Denial != nil {
+			handler.Denial.Deny(req, &answer, lastName(question.Name, answers))
+		}
+	}
+
+	limit := 0
+	if req.Transport() == TransportUDP {
+		limit = cmp.Or(handler.MaxGlue, DefaultMaxGlue)
+	}
+
+	answer.Additionals, answer.Header.Truncated = Glue(zone, zone.Origin(), answers, limit)
+	WriteAnswer(wr, req, &answer)
+}
+
+// transfer answers an AXFR query with the zone's records
+func (handler *ZoneHandler) transfer(wr ResponseWriter, req *Request, question dnsmessage.Question) {
+	zone := handler.Zone
+	if !handler.Transfers || req.Transport() == TransportUDP || CanonicalName(question.Name) != CanonicalName(zone.Origin()) {
+		Refuse(wr, req)
+		return
+	}
+
+	axfr, err := NewAXFRWriter(wr, req, zone.SOA())
+	if err != nil {
+		ServerFailure(wr, req)
+		return
+	}
+
+	err = axfr.WriteZone(zone)
+	if err == nil {
+		err = axfr.Close()
+	}
+
+	// Messages may have been sent already, so the transfer is abandoned rather than answered with
+	// SERVFAIL. The secondary detects the missing SOA record that ends the transfer
+	if err != nil {
+		logging.FromContext(req.Context()).Warn("zone.transfer", zap.Stringer("zone", zone.Origin()), zap.Error(err))
+	}
+}
+
+// nodata checks if an answer ends without records of the requested type within the zone
+func (handler *ZoneHandler) nodata(question dnsmessage.Question, answers []dnsmessage.Resource) bool {
+	if len(answers) == 0 {
+		return true
+	}
+
+	last := answers[len(answers)-1]
+	if last.Header.Type == question.Type {
+		return false
+	}
+
+	// A chain that leaves the zone is resolved by the client
+	cname, is := last.Body.(*dnsmessage.CNAMEResource)
+	return is && handler.Zone.Contains(cname.CNAME)
+}
+
+// lastName returns the name that a CNAME chain ends at
+func lastName(name dnsmessage.Name, answers []dnsmessage.Resource) dnsmessage.Name {
+	if len(answers) > 0 {
+		if cname, is := answers[len(answers)-1].Body.(*dnsmessage.CNAMEResource); is {
+			return cname.CNAME
+		}
+	}
+
+	return name
+}
+
+// Glue returns the address records of the targets of NS records, for the additional section of a
+// referral or NS answer. Only targets within the bailiwick are resolved from the store, as a server
+// can not vouch for the addresses of names in other zones, and serving them would let one zone
+// poison caches with addresses for another. At most limit records are returned, in whole RRsets,
+// and dropped reports whether any glue was omitted. A limit of zero does not bound the glue
+func Glue(store RecordStore, bailiwick dnsmessage.Name, records []dnsmessage.Resource, limit int) (glue []dnsmessage.Resource, dropped bool) {
+	seen := map[string]bool{}
+
+	for _, record := range records {
+		ns, is := record.Body.(*dnsmessage.NSResource)
+		if !is || !IsSubdomain(ns.NS, bailiwick) || seen[CanonicalName(ns.NS)] {
+			continue
+		}
+
+		seen[CanonicalName(ns.NS)] = true
+
+		for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+			rrset, _ := store.Lookup(ns.NS, qtype)
+
+			if limit > 0 && len(glue)+len(rrset) > limit {
+				dropped = true
+				continue
+			}
+
+			glue = append(glue, rrset...)
+		}
+	}
+
+	return
+}